@@ -80,7 +80,18 @@ func upost(u *user, url string, contentType string, body io.Reader, errMsgPrefix
 		req.Header.Add("Authorization", "Bearer "+u.token)
 		resp, err = u.client.Do(req)
 	} else {
-		resp, err = u.client.Post(url, contentType, body)
+		req, err := http.NewRequest("POST", url, body)
+		if err != nil {
+			log.Fatalf("upost: user %d - %s - NewRequest failed - %s", u.id, errMsgPrefix, err.Error())
+		}
+		req.Header.Add("Content-type", contentType)
+		// double-submit the CSRF cookie, if the server has sent us one
+		for _, ck := range u.jar.Cookies(req.URL) {
+			if ck.Name == "csrf_token" {
+				req.Header.Add("X-CSRF-Token", ck.Value)
+			}
+		}
+		resp, err = u.client.Do(req)
 	}
 
 	if scenario.ShowWait {
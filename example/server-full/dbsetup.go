@@ -116,14 +116,6 @@ func gldbSetup() {
 	}
 }
 
-func gldbDump() {
-	iter := gldb.NewIterator(nil, nil)
-	for iter.Next() {
-		log.Printf("%x: %x\n", iter.Key(), iter.Value())
-	}
-	iter.Release()
-}
-
 // mysql - must have mysql installed and running and set up as follows.
 // (these names are all configurable in config.toml)
 //
@@ -18,14 +18,21 @@ import (
 	. "github.com/gkong/go-qweb/example/api"
 	"github.com/gkong/go-qweb/qctx"
 	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/qsmetrics"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// the client copies the CSRF cookie into the X-CSRF-Token request header.
+var csrfConfig = qctx.CSRFConfig{CookieName: "csrf_token", CookiePath: "/"}
+
 func main() {
 	doConfig()
 	defer dbClose()
 
+	sessMetrics := qsmetrics.New()
+	qsStore.Observer = sessMetrics
+
 	// middleware stacks
 	root := qctx.MwStack(qctx.MwRecovery(os.Stderr, true, false))
 	if Config.Logging {
@@ -34,6 +41,10 @@ func main() {
 	// content type is text/plain by default and is overridden by qctx.WriteJSON
 	plain := root.Append(qctx.MwHeader("Content-Type", "text/plain; charset=utf-8"))
 	sess := plain.Append(qctx.MwRequireSess(qsStore))
+	if qsStore.AuthType == qsess.CookieAuth {
+		// tokens are not sent automatically by browsers, so only cookies need CSRF protection.
+		sess = sess.Append(qctx.MwCSRF(csrfConfig))
+	}
 
 	r := httprouter.New()
 
@@ -54,6 +65,7 @@ func main() {
 	r.POST("/addpwdb", plain.HRHandle(addpwdbHandler))
 	r.POST("/exit", plain.HRHandle(exitHandler))
 	r.GET("/debug", root.HRHandle(debugHandler))
+	r.Handler("GET", "/metrics", sessMetrics)
 	r.GET("/profcpu", profCPUHandler)
 	r.GET("/profmem", profMemHandler)
 
@@ -86,14 +98,15 @@ func loginHandler(c *qctx.Ctx) {
 		return
 	}
 
-	c.Sess = qsStore.NewSession(userID)
+	// binds the session to the client, if qsStore.Fingerprint is set
+	c.Sess = qsStore.NewClientSession(userID, c.R)
 
 	sd := c.Sess.Data.(*mySessData)
 	sd.userid = userID
 	sd.username = lReq.Username
 	sd.note = "(nothing)"
 
-	if err := c.Sess.Save(c.W); err != nil {
+	if err := c.Sess.SaveCtx(c.R.Context(), c.W); err != nil {
 		c.Error(err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -102,19 +115,20 @@ func loginHandler(c *qctx.Ctx) {
 	case qsess.TokenAuth:
 		token, ttl, err := c.Sess.Token()
 		if err != nil {
-			c.Sess.Delete(c.W)
+			c.Sess.DeleteCtx(c.R.Context(), c.W)
 			c.Error("token creation failed", http.StatusInternalServerError)
 			return
 		}
 		c.WriteJSON(&TokenResponse{Token: token, TimeToLiveSecs: ttl})
 	case qsess.CookieAuth:
 		// Save has already put cookie into response header. Now just send TTL.
+		csrfConfig.SetCookie(c)
 		c.WriteJSON(&TTLResponse{TimeToLiveSecs: c.Sess.MaxAgeSecs})
 	}
 }
 
 func logoutHandler(c *qctx.Ctx) {
-	if err := c.Sess.Delete(c.W); err != nil {
+	if err := c.Sess.DeleteCtx(c.R.Context(), c.W); err != nil {
 		c.Error(err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -137,16 +151,22 @@ func updateHandler(c *qctx.Ctx) {
 		return
 	}
 
-	c.Sess.Data.(*mySessData).note = uReq.Note
-	if err := c.Sess.Save(c.W); err != nil {
+	// Update re-reads the session and retries if a concurrent request
+	// saved it in the meantime, so neither request's changes are lost.
+	sess, err := qsStore.Update(c.W, c.R, func(s *qsess.Session) error {
+		s.Data.(*mySessData).note = uReq.Note
+		return nil
+	})
+	if err != nil {
 		c.Error(err.Error(), http.StatusInternalServerError)
 		return
 	}
+	c.Sess = sess
 }
 
 // Reset session expiration time.
 func refreshHandler(c *qctx.Ctx) {
-	if err := c.Sess.Save(c.W); err != nil {
+	if err := c.Sess.RefreshCtx(c.R.Context(), c.W); err != nil {
 		c.Error(err.Error(), http.StatusInternalServerError)
 		return
 	}
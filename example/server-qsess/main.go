@@ -136,7 +136,7 @@ func fetchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if ttl < (sess.MaxAgeSecs - sess.MinRefreshSecs) {
-		sess.Save(w) // refresh
+		sess.Refresh(w)
 	}
 
 	sd := sess.Data.(*MySessData)
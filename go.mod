@@ -1,25 +1,36 @@
 module github.com/gkong/go-qweb
 
-go 1.15
+go 1.18
 
 require (
 	github.com/BurntSushi/toml v0.3.1
-	github.com/bitly/go-hostpool v0.0.0-20171023180738-a3a6125de932 // indirect
-	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
-	github.com/fatih/camelcase v1.0.0 // indirect
-	github.com/fatih/structs v1.0.0 // indirect
 	github.com/glycerine/zebrapack v4.1.0+incompatible
 	github.com/go-sql-driver/mysql v1.4.0
 	github.com/gocql/gocql v0.0.0-20180913072538-864d5908455a
 	github.com/jackc/pgx/v5 v5.6.0
 	github.com/julienschmidt/httprouter v0.0.0-20180715161854-348b672cd90d
 	github.com/koding/multiconfig v0.0.0-20171124222453-69c27309b2d7
-	github.com/onsi/gomega v1.4.2 // indirect
-	github.com/philhofer/fwd v1.0.0 // indirect
 	github.com/pquerna/ffjson v0.0.0-20180717144149-af8b230fcd20
 	github.com/syndtr/goleveldb v0.0.0-20180815032940-ae2bd5eed72d
 	github.com/tinylib/msgp v1.0.2
 	golang.org/x/crypto v0.17.0
+)
+
+require (
+	github.com/bitly/go-hostpool v0.0.0-20171023180738-a3a6125de932 // indirect
+	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
+	github.com/fatih/camelcase v1.0.0 // indirect
+	github.com/fatih/structs v1.0.0 // indirect
+	github.com/golang/snappy v0.0.0-20170215233205-553a64147049 // indirect
+	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/puddle/v2 v2.2.1 // indirect
+	github.com/onsi/gomega v1.4.2 // indirect
+	github.com/philhofer/fwd v1.0.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/appengine v1.1.0 // indirect
+	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -6,6 +6,10 @@
 package qctx
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"net/http"
 
 	"github.com/gkong/go-qweb/qsess"
@@ -42,7 +46,8 @@ func (s MakerStack) HRHandle(f func(*Ctx)) httprouter.Handle {
 }
 
 // MwRequireSess is middleware which checks for a valid qsess session.
-// If it finds one, it calls downstream, otherwise, it returns an error.
+// If it finds one, it calls downstream, otherwise, it returns an error
+// (503 if the session back-end failed, 401 otherwise).
 // It also refreshes session expiration time, if needed.
 func MwRequireSess(st *qsess.Store) MwMaker {
 	return func(next CtxHandler) CtxHandler {
@@ -50,6 +55,10 @@ func MwRequireSess(st *qsess.Store) MwMaker {
 			var ttl int
 			var err error
 			c.Sess, ttl, err = st.GetSession(c.W, c.R)
+			if errors.Is(err, qsess.ErrBackend) {
+				c.Error("session store unavailable", http.StatusServiceUnavailable)
+				return
+			}
 			if err != nil {
 				c.Error("not logged in", http.StatusUnauthorized)
 				return
@@ -58,9 +67,121 @@ func MwRequireSess(st *qsess.Store) MwMaker {
 				// do this before calling downstream, because we return
 				// cookies to the client in http headers, which we can't
 				// do later, if ResponseWriter.WriteHeader has been called.
-				c.Sess.Save(c.W)
+				c.Sess.RefreshCtx(c.R.Context(), c.W)
+			}
+			next.CtxServeHTTP(c)
+		})
+	}
+}
+
+// CSRFConfig configures MwCSRF. The zero value is usable.
+type CSRFConfig struct {
+	// HeaderName and FormField are where MwCSRF looks for the token on
+	// unsafe requests. They default to "X-CSRF-Token" and "csrf_token".
+	HeaderName string
+	FormField  string
+
+	// If CookieName is set, MwCSRF also sends the token to the client in a
+	// cookie readable by javascript, so single-page apps can copy it into
+	// the request header ("double-submit cookie").
+	CookieName   string
+	CookiePath   string
+	CookieSecure bool
+}
+
+const (
+	DefaultCSRFHeaderName = "X-CSRF-Token"
+	DefaultCSRFFormField  = "csrf_token"
+)
+
+// MwCSRF is middleware which protects against cross-site request forgery.
+// Requests with safe methods (GET, HEAD, OPTIONS, TRACE) are passed through.
+// Other requests must carry a token, in a header or form field, or they are
+// rejected with 403.
+//
+// If there is a session (MwCSRF follows MwRequireSess in the stack), the
+// token must be one issued by c.Sess.CSRFToken(). Otherwise, if
+// cfg.CookieName is set, the token must match the CSRF cookie, and if it
+// is not set, all unsafe requests are rejected.
+func MwCSRF(cfg CSRFConfig) MwMaker {
+	if cfg.HeaderName == "" {
+		cfg.HeaderName = DefaultCSRFHeaderName
+	}
+	if cfg.FormField == "" {
+		cfg.FormField = DefaultCSRFFormField
+	}
+	return func(next CtxHandler) CtxHandler {
+		return CtxHandlerFunc(func(c *Ctx) {
+			var cookie string
+			if cfg.CookieName != "" {
+				if ck, err := c.R.Cookie(cfg.CookieName); err == nil {
+					cookie = ck.Value
+				}
+			}
+
+			switch c.R.Method {
+			case "GET", "HEAD", "OPTIONS", "TRACE":
+				// set the cookie before calling downstream, for the same
+				// reason as in MwRequireSess.
+				if cfg.CookieName != "" && !csrfCookieOK(c, cookie) {
+					cfg.SetCookie(c)
+				}
+				next.CtxServeHTTP(c)
+				return
+			}
+
+			token := c.R.Header.Get(cfg.HeaderName)
+			if token == "" {
+				token = c.R.PostFormValue(cfg.FormField)
+			}
+
+			var ok bool
+			if c.Sess != nil {
+				ok = c.Sess.CheckCSRFToken(token)
+			} else if cfg.CookieName != "" {
+				ok = token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cookie)) == 1
+			}
+			if !ok {
+				c.Error("missing or invalid CSRF token", http.StatusForbidden)
+				return
 			}
 			next.CtxServeHTTP(c)
 		})
 	}
 }
+
+// csrfCookieOK reports whether an existing CSRF cookie can be kept.
+func csrfCookieOK(c *Ctx, cookie string) bool {
+	if c.Sess != nil {
+		return c.Sess.CheckCSRFToken(cookie)
+	}
+	return cookie != ""
+}
+
+// SetCookie sends a fresh CSRF cookie to the client. MwCSRF does this on
+// safe requests, as needed. Handlers which create or regenerate a session
+// (for example, login) can call it after saving the session, so the client
+// can make unsafe requests immediately.
+func (cfg CSRFConfig) SetCookie(c *Ctx) {
+	var token string
+	if c.Sess != nil {
+		token = c.Sess.CSRFToken()
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return
+		}
+		token = base64.RawURLEncoding.EncodeToString(b)
+	}
+	if token == "" {
+		return
+	}
+	http.SetCookie(c.W, &http.Cookie{
+		Name:     cfg.CookieName,
+		Value:    token,
+		Path:     cfg.CookiePath,
+		Secure:   cfg.CookieSecure,
+		HttpOnly: false, // must be readable by javascript
+		SameSite: http.SameSiteStrictMode,
+	})
+}
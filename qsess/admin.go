@@ -0,0 +1,38 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+// DecodeToken decrypts a token or cookie value, without reading the
+// back-end, and returns the session id (and, if the Store sends user ids to
+// clients, the user id) it refers to. It is for administration tools, such
+// as qsadmin, which work with back-ends directly.
+func (st *Store) DecodeToken(token string) (sessID []byte, userID []byte, err error) {
+	s := st.newSess()
+	if err := s.decode(token); err != nil {
+		return nil, nil, qsErr{"DecodeToken - ", withSentinel(ErrInvalidToken, err)}
+	}
+	return s.sessID, s.userID, nil
+}
+
+// Inspect returns information about a session read directly from a back-end
+// (for example, with Iterable), and its marshaled session data, without the
+// metadata which qsess stores with it. It is for administration tools.
+func (st *Store) Inspect(e SessEntry) (SessInfo, []byte, error) {
+	meta, data, err := unwrapMeta(e.Data)
+	if err != nil {
+		return SessInfo{}, nil, qsErr{"Inspect - bad metadata", withSentinel(ErrBackend, err)}
+	}
+	handle, err := st.encodeRef(e.SessID, e.UserID, handleAD)
+	if err != nil {
+		return SessInfo{}, nil, qsErr{"Inspect - handle encode failed", err}
+	}
+	return SessInfo{
+		Handle:         handle,
+		Created:        unixOrZero(meta.created),
+		LastSaved:      unixOrZero(meta.saved),
+		TimeToLiveSecs: e.TimeToLiveSecs,
+		ClientIP:       meta.clientIP,
+		UserAgent:      meta.userAgent,
+	}, data, nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"bytes"
+	"context"
+)
+
+// sealMagic begins session records sealed by EncryptAtRest, distinguishing
+// them from plaintext records (which begin with metaMagic, or are from
+// before metadata existed).
+var sealMagic = []byte("\xffqse")
+
+// sealAD is the start of the encryption additional data for sealed records,
+// which is followed by the session id, so records can't be moved from one
+// session to another.
+var sealAD = []byte("qsess-data\x00")
+
+// EncryptAtRest makes the Store encrypt session data before giving it to its
+// back-end, and decrypt it after reading it, so the database holds no
+// readable session data. It uses the Store's keys (and Purpose), and binds
+// each record to its session id, so records can't be swapped between
+// sessions. Call it after configuring the Store's keys, before using it.
+//
+// Since back-ends assign ids when sessions are first saved, and records are
+// bound to their ids, saving a new session costs two back-end writes, rather
+// than one: an empty placeholder record, to get the id, then the encrypted
+// record. (If the second write fails, the placeholder is deleted.)
+//
+// Records are encrypted with the primary key whenever they're saved. A
+// record read which was encrypted with an old key is marked (in its
+// metadata, as passed to the Store), so that it is saved in full, rather
+// than having just its expiration time extended (see SessToucher). So,
+// once the longest session lifetime has passed since a new primary key was
+// deployed, the old key can be retired.
+//
+// Records written before encryption was enabled are rejected (as
+// ErrNotFound, like records sealed with retired keys), unless
+// acceptPlaintext is true, in which case they are read as they are, and
+// encrypted when next saved (or refreshed). Leave acceptPlaintext false once
+// they have all been saved or expired, since, while it is true, anyone who
+// can write to the database can forge session data.
+//
+// EncryptAtRest wraps the Store's back-end (see SetBackEnd). To encrypt
+// during a migration, enable it in the old and new Stores before passing
+// their back-ends to NewMigratingBackEnd. It fails with ErrNotSupported for
+// Stores made by NewCookieStore, whose session data is only kept in clients,
+// already encrypted, and for Stores with user-supplied Encrypt and Decrypt
+// functions, since those only handle cookies and tokens.
+func (st *Store) EncryptAtRest(acceptPlaintext bool) error {
+	if st.Encrypt != nil || st.Decrypt != nil {
+		return errUserCrypto
+	}
+	for be := st.backEnd; be != nil; {
+		if _, ok := be.(stableIDer); ok {
+			return qsErr{"EncryptAtRest - cookie stores keep session data only in clients", ErrNotSupported}
+		}
+		w, ok := be.(SessBackEndWrapper)
+		if !ok {
+			break
+		}
+		be = w.Unwrap()
+	}
+	st.backEnd = &sealedBackEnd{be: st.backEnd, st: st, acceptPlaintext: acceptPlaintext}
+	return nil
+}
+
+// sealedBackEnd encrypts session data on its way to another back-end. It
+// implements the optional interfaces (except SessMover, since moved data
+// would be bound to the wrong id), failing with ErrNotSupported when the
+// back-end it wraps doesn't. ListByUserIDCtx and IterateCtx skip records
+// which can't be decrypted (such as placeholders of saves in progress).
+type sealedBackEnd struct {
+	be              SessBackEndCtx
+	st              *Store
+	acceptPlaintext bool
+}
+
+func (s *sealedBackEnd) Unwrap() SessBackEndCtx {
+	return s.be
+}
+
+func (s *sealedBackEnd) ad(sessID []byte) []byte {
+	return s.st.purposeAD(append(append([]byte(nil), sealAD...), sessID...))
+}
+
+// errUserCrypto is returned if a Store has user-supplied Encrypt or Decrypt
+// functions, which EncryptAtRest can't use.
+var errUserCrypto = qsErr{"EncryptAtRest - can't be used with user-supplied Encrypt and Decrypt", ErrNotSupported}
+
+func (s *sealedBackEnd) seal(sessID []byte, data []byte) ([]byte, error) {
+	if s.st.Encrypt != nil || s.st.Decrypt != nil {
+		return nil, errUserCrypto
+	}
+	sealed, err := s.st.seal(data, s.ad(sessID))
+	if err != nil {
+		return nil, qsErr{"EncryptAtRest - seal - ", err}
+	}
+	return append(append([]byte(nil), sealMagic...), sealed...), nil
+}
+
+func (s *sealedBackEnd) open(sessID []byte, data []byte) ([]byte, error) {
+	opened, _, err := s.openKey(sessID, data)
+	return opened, err
+}
+
+// openSession is open, for records returned to the Store as sessions, which
+// marks those which were not sealed with the primary key (plaintext records
+// included), so the Store re-seals them, rather than touching them.
+func (s *sealedBackEnd) openSession(sessID []byte, data []byte) ([]byte, error) {
+	opened, primary, err := s.openKey(sessID, data)
+	if err != nil || primary {
+		return opened, err
+	}
+	return withMetaField(opened, metaTagReseal, nil), nil
+}
+
+// openKey is open, which also reports whether the record was sealed with
+// the primary key (plaintext records count as not).
+func (s *sealedBackEnd) openKey(sessID []byte, data []byte) (opened []byte, primary bool, err error) {
+	if !bytes.HasPrefix(data, sealMagic) {
+		if s.acceptPlaintext {
+			return data, false, nil
+		}
+		// an unreadable record, not a back-end failure, so the client is
+		// sent to log in again, rather than told the store is down.
+		return nil, false, qsErr{"EncryptAtRest - record is not encrypted", ErrNotFound}
+	}
+	if s.st.Encrypt != nil || s.st.Decrypt != nil {
+		return nil, false, errUserCrypto
+	}
+	opened, primary, err = s.st.open(data[len(sealMagic):], s.ad(sessID))
+	if err != nil {
+		// such as a record sealed with a retired key
+		return nil, false, qsErr{"EncryptAtRest - open - ", withSentinel(ErrNotFound, err)}
+	}
+	return opened, primary, nil
+}
+
+// placeholder saves an empty record for a new session, to get its id, so
+// its data can be bound to it.
+func (s *sealedBackEnd) placeholder(ctx context.Context, sessID *[]byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	if *sessID != nil {
+		return nil
+	}
+	return s.be.SaveCtx(ctx, sessID, []byte{}, userID, maxAgeSecs, minRefreshSecs)
+}
+
+// dropPlaceholder deletes the placeholder of a new session whose save
+// failed, and clears its id, so the session is still new.
+func (s *sealedBackEnd) dropPlaceholder(ctx context.Context, sessID *[]byte, userID []byte) {
+	s.be.DeleteCtx(ctx, *sessID, userID)
+	*sessID = nil
+}
+
+func (s *sealedBackEnd) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	isNew := *sessID == nil
+	if err := s.placeholder(ctx, sessID, userID, maxAgeSecs, minRefreshSecs); err != nil {
+		return err
+	}
+	sealed, err := s.seal(*sessID, data)
+	if err == nil {
+		err = s.be.SaveCtx(ctx, sessID, sealed, userID, maxAgeSecs, minRefreshSecs)
+	}
+	if err != nil && isNew {
+		s.dropPlaceholder(ctx, sessID, userID)
+	}
+	return err
+}
+
+func (s *sealedBackEnd) GetCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	data, userID, ttl, maxAge, minRefresh, err := s.be.GetCtx(ctx, sessID, uID)
+	if err != nil {
+		// pass on any record returned with ErrExpired, for lifecycle events
+		return data, userID, 0, 0, 0, err
+	}
+	if data, err = s.openSession(sessID, data); err != nil {
+		return nil, nil, 0, 0, 0, err
+	}
+	return data, userID, ttl, maxAge, minRefresh, nil
+}
+
+func (s *sealedBackEnd) DeleteCtx(ctx context.Context, sessID []byte, uID []byte) error {
+	return s.be.DeleteCtx(ctx, sessID, uID)
+}
+
+func (s *sealedBackEnd) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
+	return s.be.DeleteByUserIDCtx(ctx, userID)
+}
+
+func (s *sealedBackEnd) ConsumeCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	cb, ok := consumer(s.be)
+	if !ok {
+		return nil, nil, 0, 0, 0, ErrNotSupported
+	}
+	data, userID, ttl, maxAge, minRefresh, err := cb.ConsumeCtx(ctx, sessID, uID)
+	if err != nil {
+		return data, userID, 0, 0, 0, err
+	}
+	if data, err = s.openSession(sessID, data); err != nil {
+		return nil, nil, 0, 0, 0, err
+	}
+	return data, userID, ttl, maxAge, minRefresh, nil
+}
+
+func (s *sealedBackEnd) GetVersionCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, int64, error) {
+	vb, ok := versioner(s.be)
+	if !ok {
+		return nil, nil, 0, 0, 0, 0, ErrNotSupported
+	}
+	data, userID, ttl, maxAge, minRefresh, version, err := vb.GetVersionCtx(ctx, sessID, uID)
+	if err != nil {
+		// pass on any record returned with ErrExpired, for lifecycle events
+		return data, userID, 0, 0, 0, 0, err
+	}
+	if data, err = s.openSession(sessID, data); err != nil {
+		return nil, nil, 0, 0, 0, 0, err
+	}
+	return data, userID, ttl, maxAge, minRefresh, version, nil
+}
+
+func (s *sealedBackEnd) SaveVersionCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int, version *int64) error {
+	vb, ok := versioner(s.be)
+	if !ok {
+		return ErrNotSupported
+	}
+	isNew := *sessID == nil
+	if isNew {
+		if err := s.placeholder(ctx, sessID, userID, maxAgeSecs, minRefreshSecs); err != nil {
+			return err
+		}
+		// the placeholder isn't a version anyone has read
+		*version = -1
+	}
+	sealed, err := s.seal(*sessID, data)
+	if err == nil {
+		err = vb.SaveVersionCtx(ctx, sessID, sealed, userID, maxAgeSecs, minRefreshSecs, version)
+	}
+	if err != nil && isNew {
+		s.dropPlaceholder(ctx, sessID, userID)
+	}
+	return err
+}
+
+// TouchCtx is only called by the Store for records sealed with the primary
+// key, since openSession marks the others to be saved in full.
+func (s *sealedBackEnd) TouchCtx(ctx context.Context, sessID []byte, uID []byte, maxAgeSecs int) error {
+	tb, ok := toucher(s.be)
+	if !ok {
+		return ErrNotSupported
+	}
+	return tb.TouchCtx(ctx, sessID, uID, maxAgeSecs)
+}
+
+func (s *sealedBackEnd) ListByUserIDCtx(ctx context.Context, userID []byte) ([]SessEntry, error) {
+	lb, ok := lister(s.be)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	entries, err := lb.ListByUserIDCtx(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	opened := entries[:0]
+	for _, e := range entries {
+		if e.Data, err = s.open(e.SessID, e.Data); err == nil {
+			opened = append(opened, e)
+		}
+	}
+	return opened, nil
+}
+
+func (s *sealedBackEnd) IterateCtx(ctx context.Context, fn func(e SessEntry) error) error {
+	it, ok := s.be.(Iterable)
+	if !ok {
+		return ErrNotSupported
+	}
+	return it.IterateCtx(ctx, func(e SessEntry) error {
+		var err error
+		if e.Data, err = s.open(e.SessID, e.Data); err != nil {
+			return nil
+		}
+		return fn(e)
+	})
+}
+
+func (s *sealedBackEnd) ImportCtx(ctx context.Context, e SessEntry) error {
+	im, ok := s.be.(SessImporter)
+	if !ok {
+		return ErrNotSupported
+	}
+	var err error
+	if e.Data, err = s.seal(e.SessID, e.Data); err != nil {
+		return err
+	}
+	return im.ImportCtx(ctx, e)
+}
@@ -0,0 +1,248 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// tests that do NOT see package internals
+
+package qsess_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/qstest"
+)
+
+func makeEncryptedTestStore(t *testing.T) *qsess.Store {
+	st := makeTestStore(t, false)
+	if err := st.EncryptAtRest(false); err != nil {
+		t.Fatal("EncryptAtRest failed - " + err.Error())
+	}
+	return st
+}
+
+func TestEncryptedSanity(t *testing.T) {
+	qstest.SanityTest(t, makeEncryptedTestStore(t))
+}
+
+func TestEncryptedDeleteByUserId(t *testing.T) {
+	qstest.DeleteByUserIDTest(t, makeEncryptedTestStore(t), true)
+}
+
+func TestEncryptedListByUserId(t *testing.T) {
+	qstest.ListByUserIDTest(t, makeEncryptedTestStore(t))
+}
+
+func TestEncryptedRegenerate(t *testing.T) {
+	qstest.RegenerateTest(t, makeEncryptedTestStore(t))
+}
+
+func TestEncryptedConflict(t *testing.T) {
+	qstest.ConflictTest(t, makeEncryptedTestStore(t))
+}
+
+func TestEncryptedRefresh(t *testing.T) {
+	qstest.RefreshTest(t, makeEncryptedTestStore(t))
+}
+
+func TestEncryptedCookieStore(t *testing.T) {
+	st, err := qsess.NewCookieStore(nil, false, []byte("key-for-encryption--------------"))
+	if err != nil {
+		t.Fatal("NewCookieStore failed - " + err.Error())
+	}
+	if err := st.EncryptAtRest(false); !errors.Is(err, qsess.ErrNotSupported) {
+		t.Fatalf("EncryptAtRest of a cookie store - expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestEncryptedConsume(t *testing.T) {
+	qstest.ConsumeTest(t, makeEncryptedTestStore(t))
+}
+
+func TestEncryptedUserCrypto(t *testing.T) {
+	st := makeTestStore(t, false)
+	st.Encrypt = func(data []byte) ([]byte, error) { return data, nil }
+	st.Decrypt = func(data []byte) ([]byte, error) { return data, nil }
+	if err := st.EncryptAtRest(false); !errors.Is(err, qsess.ErrNotSupported) {
+		t.Fatalf("EncryptAtRest with user-supplied Encrypt and Decrypt - expected ErrNotSupported, got %v", err)
+	}
+
+	// set after EncryptAtRest
+	st = makeEncryptedTestStore(t)
+	st.Encrypt = func(data []byte) ([]byte, error) { return data, nil }
+	if err := st.NewSession([]byte("userid-crypto")).Save(httptest.NewRecorder()); !errors.Is(err, qsess.ErrNotSupported) {
+		t.Fatalf("Save with user-supplied Encrypt set after EncryptAtRest - expected ErrNotSupported, got %v", err)
+	}
+}
+
+// TestEncryptedKeyRotation checks that refreshing a session re-encrypts its
+// record under the primary key, so the old key can be retired.
+func TestEncryptedKeyRotation(t *testing.T) {
+	oldKey := []byte("old-key-for-encryption----------")
+	newKey := []byte("new-key-for-encryption----------")
+
+	var raw qsess.SessBackEndCtx
+	store := func(keys ...[]byte) *qsess.Store {
+		st, err := qsess.NewMapStore(keys...)
+		if err != nil {
+			t.Fatal("NewMapStore failed - " + err.Error())
+		}
+		if raw == nil {
+			raw = st.BackEndCtx()
+		}
+		st.SetBackEnd(raw)
+		if err := st.EncryptAtRest(false); err != nil {
+			t.Fatal("EncryptAtRest failed - " + err.Error())
+		}
+		st.AuthType = qsess.TokenAuth
+		return st
+	}
+
+	sess := store(oldKey).NewSession([]byte("userid-rotate"))
+	sess.Data.(*qsess.VarMap).Vars["k"] = "v"
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	token, _, _ := sess.Token()
+
+	sess, _, err := store(newKey, oldKey).GetTokenSession(token)
+	if err != nil {
+		t.Fatal("GetTokenSession after rotation failed - " + err.Error())
+	}
+	if err := sess.Refresh(httptest.NewRecorder()); err != nil {
+		t.Fatal("Refresh failed - " + err.Error())
+	}
+	token, _, _ = sess.Token()
+
+	sess, _, err = store(newKey).GetTokenSession(token)
+	if err != nil {
+		t.Fatal("GetTokenSession after retiring the old key failed - " + err.Error())
+	}
+	if sess.Data.(*qsess.VarMap).Vars["k"] != "v" {
+		t.Fatal("retrieved session data does not match saved session data")
+	}
+}
+
+// countingBackEnd counts reads and writes, and can touch sessions.
+type countingBackEnd struct {
+	qsess.SessBackEndCtx
+	qsess.SessToucher
+	gets, saves, touches *int
+}
+
+func (c countingBackEnd) GetCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	*c.gets++
+	return c.SessBackEndCtx.GetCtx(ctx, sessID, uID)
+}
+
+func (c countingBackEnd) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	*c.saves++
+	return c.SessBackEndCtx.SaveCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs)
+}
+
+func (c countingBackEnd) TouchCtx(ctx context.Context, sessID []byte, uID []byte, maxAgeSecs int) error {
+	*c.touches++
+	return c.SessToucher.TouchCtx(ctx, sessID, uID, maxAgeSecs)
+}
+
+// TestEncryptedTouch checks that refreshing a session sealed with the
+// primary key just touches it, without reading it again, and that one
+// sealed with an old key is saved in full.
+func TestEncryptedTouch(t *testing.T) {
+	oldKey := []byte("old-key-for-encryption----------")
+	newKey := []byte("new-key-for-encryption----------")
+	var gets, saves, touches int
+	var raw qsess.SessBackEndCtx
+	store := func(keys ...[]byte) *qsess.Store {
+		st, err := qsess.NewMapStore(keys...)
+		if err != nil {
+			t.Fatal("NewMapStore failed - " + err.Error())
+		}
+		if raw == nil {
+			raw = st.BackEndCtx()
+		}
+		st.SetBackEnd(countingBackEnd{raw, raw.(qsess.SessToucher), &gets, &saves, &touches})
+		if err := st.EncryptAtRest(false); err != nil {
+			t.Fatal("EncryptAtRest failed - " + err.Error())
+		}
+		st.AuthType = qsess.TokenAuth
+		return st
+	}
+	refresh := func(st *qsess.Store, token string) {
+		gets, saves, touches = 0, 0, 0
+		sess, _, err := st.GetTokenSession(token)
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+		if err := sess.Refresh(httptest.NewRecorder()); err != nil {
+			t.Fatal("Refresh failed - " + err.Error())
+		}
+	}
+
+	st := store(oldKey)
+	sess := st.NewSession([]byte("userid-touch"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	token, _, _ := sess.Token()
+
+	refresh(st, token)
+	if gets != 1 || saves != 0 || touches != 1 {
+		t.Fatalf("Refresh of a current record - expected 1 get, 0 saves, 1 touch, got %d, %d, %d", gets, saves, touches)
+	}
+	refresh(store(newKey, oldKey), token)
+	if gets != 1 || saves != 1 || touches != 0 {
+		t.Fatalf("Refresh of an old-key record - expected 1 get, 1 save, 0 touches, got %d, %d, %d", gets, saves, touches)
+	}
+}
+
+// failingSaveBackEnd fails every save of a non-empty record, while fail is
+// true.
+type failingSaveBackEnd struct {
+	qsess.SessBackEndCtx
+	fail *bool
+}
+
+func (f failingSaveBackEnd) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	if *f.fail && len(data) > 0 {
+		return errors.New("disk full")
+	}
+	return f.SessBackEndCtx.SaveCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs)
+}
+
+// TestEncryptedPlaceholder checks that a new session's placeholder record is
+// deleted if its encrypted record can't be saved.
+func TestEncryptedPlaceholder(t *testing.T) {
+	under := makeTestStore(t, false)
+	st := makeTestStore(t, false)
+	fail := true
+	st.SetBackEnd(failingSaveBackEnd{under.BackEndCtx(), &fail})
+	if err := st.EncryptAtRest(false); err != nil {
+		t.Fatal("EncryptAtRest failed - " + err.Error())
+	}
+
+	userID := []byte("userid-placeholder")
+	sess := st.NewSession(userID)
+	if err := sess.Save(httptest.NewRecorder()); err == nil {
+		t.Fatal("Save succeeded although the back-end failed")
+	}
+	infos, err := under.ListByUserID(userID)
+	if err != nil {
+		t.Fatal("ListByUserID failed - " + err.Error())
+	}
+	if len(infos) != 0 {
+		t.Fatalf("expected the placeholder to be deleted, found %d records", len(infos))
+	}
+
+	// a retry must make a new session, rather than save to the deleted
+	// placeholder's id.
+	fail = false
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save after the back-end recovered failed - " + err.Error())
+	}
+	if infos, _ := under.ListByUserID(userID); len(infos) != 1 {
+		t.Fatalf("expected 1 record after a successful Save, found %d", len(infos))
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Invalidation identifies cached sessions which are no longer valid: the
+// session SessID, if not nil, and, if UserID is not nil and SessID is nil,
+// all of that user's sessions.
+type Invalidation struct {
+	SessID []byte
+	UserID []byte
+}
+
+// InvalidationFeed distributes invalidations among the servers sharing a
+// back-end, so a session which is saved or deleted on one server is evicted
+// from the CachingBackEnds of the others. It is typically built on a
+// publish/subscribe mechanism, such as PostgreSQL's LISTEN/NOTIFY.
+type InvalidationFeed interface {
+	// Publish sends an invalidation to all subscribers (including, if
+	// convenient, the publisher). It should not block for long, and it may
+	// drop invalidations if it must, since cache entries expire anyway.
+	Publish(inv Invalidation)
+	// Subscribe returns a channel of invalidations published by all servers.
+	// It is called once, by NewCachingBackEnd.
+	Subscribe() <-chan Invalidation
+}
+
+// CachingBackEnd wraps a back-end with an in-memory cache of recently read
+// sessions, so requests which only read their sessions don't have to wait
+// for a database.
+//
+// Saves and deletes go straight to the wrapped back-end, and evict the
+// sessions they change. Sessions changed by other servers stay in the cache
+// for up to its TTL, unless those servers share an InvalidationFeed, so the
+// TTL should be short (a few seconds), and session revocation is delayed by
+// up to that long if there is no feed.
+type CachingBackEnd struct {
+	hits, misses uint64 // accessed atomically, so first, for alignment
+
+	be   SessBackEndCtx
+	size int
+	ttl  time.Duration
+	feed InvalidationFeed
+
+	mu    sync.Mutex
+	lru   *list.List // of *cacheEntry, most recently used first
+	items map[string]*list.Element
+	gen   uint64 // incremented by every invalidation
+}
+
+type cacheEntry struct {
+	sessID     string
+	data       []byte
+	userID     []byte
+	expires    int64 // back-end expiration time, in unix seconds
+	maxAge     int
+	minRefresh int
+	version    int64
+	validUntil time.Time
+}
+
+// NewCachingBackEnd returns a CachingBackEnd which caches up to size sessions
+// read from be, each for at most ttl. If feed is not nil, invalidations are
+// published to it, and invalidations received from it are applied, until
+// the feed's channel is closed.
+//
+// To cache a Store's sessions, wrap its back-end before using it:
+//
+//	st.SetBackEnd(qsess.NewCachingBackEnd(st.BackEndCtx(), 10000, 5*time.Second, nil))
+func NewCachingBackEnd(be SessBackEndCtx, size int, ttl time.Duration, feed InvalidationFeed) *CachingBackEnd {
+	c := &CachingBackEnd{
+		be:    be,
+		size:  size,
+		ttl:   ttl,
+		feed:  feed,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+	if feed != nil {
+		go func(ch <-chan Invalidation) {
+			for inv := range ch {
+				c.Invalidate(inv)
+			}
+		}(feed.Subscribe())
+	}
+	return c
+}
+
+// Unwrap returns the wrapped back-end.
+func (c *CachingBackEnd) Unwrap() SessBackEndCtx {
+	return c.be
+}
+
+// Stats returns the number of Gets satisfied by the cache, and the number
+// passed on to the wrapped back-end.
+func (c *CachingBackEnd) Stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// Invalidate evicts the sessions identified by inv from the cache, without
+// publishing to the feed.
+func (c *CachingBackEnd) Invalidate(inv Invalidation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if inv.SessID != nil {
+		if e, ok := c.items[string(inv.SessID)]; ok {
+			c.remove(e)
+		}
+		return
+	}
+	if inv.UserID != nil {
+		for e := c.lru.Front(); e != nil; {
+			next := e.Next()
+			if string(e.Value.(*cacheEntry).userID) == string(inv.UserID) {
+				c.remove(e)
+			}
+			e = next
+		}
+	}
+}
+
+// invalidate evicts sessions locally and publishes to the feed.
+func (c *CachingBackEnd) invalidate(inv Invalidation) {
+	c.Invalidate(inv)
+	if c.feed != nil {
+		c.feed.Publish(inv)
+	}
+}
+
+// remove must be called with c.mu held.
+func (c *CachingBackEnd) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.items, e.Value.(*cacheEntry).sessID)
+}
+
+// lookup returns a copy of a session's cache entry, if it is present and
+// still valid.
+func (c *CachingBackEnd) lookup(sessID []byte) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[string(sessID)]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	ce := e.Value.(*cacheEntry)
+	if !time.Now().Before(ce.validUntil) {
+		c.remove(e)
+		return cacheEntry{}, false
+	}
+	c.lru.MoveToFront(e)
+	return *ce, true
+}
+
+// insert adds a session to the cache, unless there has been an invalidation
+// since gen was read (in which case the session might be stale).
+func (c *CachingBackEnd) insert(gen uint64, ce *cacheEntry) {
+	validUntil := time.Now().Add(c.ttl)
+	if exp := time.Unix(ce.expires, 0); exp.Before(validUntil) {
+		validUntil = exp
+	}
+	ce.validUntil = validUntil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || c.size <= 0 {
+		return
+	}
+	if e, ok := c.items[ce.sessID]; ok {
+		c.remove(e)
+	}
+	c.items[ce.sessID] = c.lru.PushFront(ce)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *CachingBackEnd) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+func (c *CachingBackEnd) GetCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	data, userID, ttl, maxAge, minRefresh, _, err := c.get(ctx, sessID, uID)
+	return data, userID, ttl, maxAge, minRefresh, err
+}
+
+// GetVersionCtx fails with ErrNotSupported if the wrapped back-end doesn't
+// implement SessVersioner.
+func (c *CachingBackEnd) GetVersionCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, int64, error) {
+	if _, ok := versioner(c.be); !ok {
+		return nil, nil, 0, 0, 0, 0, ErrNotSupported
+	}
+	return c.get(ctx, sessID, uID)
+}
+
+func (c *CachingBackEnd) get(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, 0, 0, 0, 0, err
+	}
+	if ce, ok := c.lookup(sessID); ok {
+		atomic.AddUint64(&c.hits, 1)
+		ttl := int(ce.expires - time.Now().Unix())
+		if ttl < 1 {
+			ttl = 1 // validUntil is no later than expires, so it can only be rounding
+		}
+		return append([]byte(nil), ce.data...), append([]byte(nil), ce.userID...), ttl, ce.maxAge, ce.minRefresh, ce.version, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	gen := c.generation()
+	var data, userID []byte
+	var ttl, maxAge, minRefresh int
+	var version int64
+	var err error
+	vb, isVersioner := versioner(c.be)
+	if isVersioner {
+		data, userID, ttl, maxAge, minRefresh, version, err = vb.GetVersionCtx(ctx, sessID, uID)
+	} else {
+		data, userID, ttl, maxAge, minRefresh, err = c.be.GetCtx(ctx, sessID, uID)
+	}
+	if err != nil {
+		return data, userID, ttl, maxAge, minRefresh, version, err
+	}
+
+	c.insert(gen, &cacheEntry{
+		sessID:     string(sessID),
+		data:       append([]byte(nil), data...),
+		userID:     append([]byte(nil), userID...),
+		expires:    time.Now().Unix() + int64(ttl),
+		maxAge:     maxAge,
+		minRefresh: minRefresh,
+		version:    version,
+	})
+	return data, userID, ttl, maxAge, minRefresh, version, nil
+}
+
+func (c *CachingBackEnd) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	old := *sessID
+	err := c.be.SaveCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs)
+	c.invalidateSave(old, *sessID)
+	return err
+}
+
+// SaveVersionCtx fails with ErrNotSupported if the wrapped back-end doesn't
+// implement SessVersioner.
+func (c *CachingBackEnd) SaveVersionCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int, version *int64) error {
+	vb, ok := versioner(c.be)
+	if !ok {
+		return ErrNotSupported
+	}
+	old := *sessID
+	err := vb.SaveVersionCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs, version)
+	c.invalidateSave(old, *sessID)
+	return err
+}
+
+// invalidateSave evicts a saved session, even if the save failed, since
+// the back-end might have written it anyway.
+func (c *CachingBackEnd) invalidateSave(oldID []byte, newID []byte) {
+	if oldID != nil {
+		c.invalidate(Invalidation{SessID: oldID})
+	}
+	if newID != nil && string(newID) != string(oldID) {
+		c.invalidate(Invalidation{SessID: newID})
+	}
+}
+
+// TouchCtx fails with ErrNotSupported if the wrapped back-end doesn't
+// implement SessToucher.
+func (c *CachingBackEnd) TouchCtx(ctx context.Context, sessID []byte, uID []byte, maxAgeSecs int) error {
+	tb, ok := toucher(c.be)
+	if !ok {
+		return ErrNotSupported
+	}
+	err := tb.TouchCtx(ctx, sessID, uID, maxAgeSecs)
+	c.invalidate(Invalidation{SessID: sessID})
+	return err
+}
+
+func (c *CachingBackEnd) DeleteCtx(ctx context.Context, sessID []byte, uID []byte) error {
+	err := c.be.DeleteCtx(ctx, sessID, uID)
+	c.invalidate(Invalidation{SessID: sessID})
+	return err
+}
+
+func (c *CachingBackEnd) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
+	err := c.be.DeleteByUserIDCtx(ctx, userID)
+	c.invalidate(Invalidation{UserID: userID})
+	return err
+}
+
+// ConsumeCtx fails with ErrNotSupported if the wrapped back-end doesn't
+// implement SessConsumer.
+func (c *CachingBackEnd) ConsumeCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	cb, ok := consumer(c.be)
+	if !ok {
+		return nil, nil, 0, 0, 0, ErrNotSupported
+	}
+	data, userID, ttl, maxAge, minRefresh, err := cb.ConsumeCtx(ctx, sessID, uID)
+	c.invalidate(Invalidation{SessID: sessID})
+	return data, userID, ttl, maxAge, minRefresh, err
+}
+
+// MoveCtx fails with ErrNotSupported if the wrapped back-end doesn't
+// implement SessMover.
+func (c *CachingBackEnd) MoveCtx(ctx context.Context, sessID []byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) ([]byte, error) {
+	mb, ok := mover(c.be)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	newID, err := mb.MoveCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs)
+	if newID != nil {
+		c.invalidate(Invalidation{SessID: sessID})
+	}
+	return newID, err
+}
+
+// ListByUserIDCtx is not cached. It fails with ErrNotSupported if the
+// wrapped back-end doesn't implement SessLister.
+func (c *CachingBackEnd) ListByUserIDCtx(ctx context.Context, userID []byte) ([]SessEntry, error) {
+	lb, ok := lister(c.be)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return lb.ListByUserIDCtx(ctx, userID)
+}
@@ -0,0 +1,218 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// tests that do NOT see package internals
+
+package qsess_test
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/qstest"
+)
+
+func makeCachedTestStore(t *testing.T) *qsess.Store {
+	st := makeTestStore(t, false)
+	st.SetBackEnd(qsess.NewCachingBackEnd(st.BackEndCtx(), 100, time.Minute, nil))
+	return st
+}
+
+func TestCacheSanity(t *testing.T) {
+	qstest.SanityTest(t, makeCachedTestStore(t))
+}
+
+func TestCacheDeleteByUserId(t *testing.T) {
+	qstest.DeleteByUserIDTest(t, makeCachedTestStore(t), true)
+}
+
+func TestCacheExpiration(t *testing.T) {
+	qstest.ExpirationTest(t, makeCachedTestStore(t))
+}
+
+func TestCacheListByUserId(t *testing.T) {
+	qstest.ListByUserIDTest(t, makeCachedTestStore(t))
+}
+
+func TestCacheRegenerate(t *testing.T) {
+	qstest.RegenerateTest(t, makeCachedTestStore(t))
+}
+
+func TestCacheConflict(t *testing.T) {
+	qstest.ConflictTest(t, makeCachedTestStore(t))
+}
+
+func TestCacheRefresh(t *testing.T) {
+	qstest.RefreshTest(t, makeCachedTestStore(t))
+}
+
+func TestCacheConsume(t *testing.T) {
+	qstest.ConsumeTest(t, makeCachedTestStore(t))
+}
+
+func TestCacheFlash(t *testing.T) {
+	qstest.FlashTest(t, makeCachedTestStore(t))
+}
+
+// testFeed is an in-process InvalidationFeed.
+type testFeed struct {
+	sync.Mutex
+	subs []chan qsess.Invalidation
+}
+
+func (f *testFeed) Publish(inv qsess.Invalidation) {
+	f.Lock()
+	defer f.Unlock()
+	for _, ch := range f.subs {
+		ch <- inv
+	}
+}
+
+func (f *testFeed) Subscribe() <-chan qsess.Invalidation {
+	f.Lock()
+	defer f.Unlock()
+	ch := make(chan qsess.Invalidation, 100)
+	f.subs = append(f.subs, ch)
+	return ch
+}
+
+// makeCachedPair returns two token Stores, standing in for two servers,
+// which have separate caches of the same back-end.
+func makeCachedPair(t *testing.T, feed qsess.InvalidationFeed) (*qsess.Store, *qsess.Store) {
+	st1 := makeTestStore(t, false)
+	be := st1.BackEndCtx()
+	st2, err := qsess.NewStoreCtx(be, false,
+		[]byte("key-to-detect-tampering---------"),
+		[]byte("key-for-encryption--------------"),
+	)
+	if err != nil {
+		t.Fatal("NewStoreCtx failed - " + err.Error())
+	}
+	for _, st := range []*qsess.Store{st1, st2} {
+		st.AuthType = qsess.TokenAuth
+		st.SetBackEnd(qsess.NewCachingBackEnd(be, 100, time.Minute, feed))
+	}
+	return st1, st2
+}
+
+func saveToken(t *testing.T, st *qsess.Store, userID string) string {
+	sess := st.NewSession([]byte(userID))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	token, _, err := sess.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+	return token
+}
+
+// TestCacheHits checks that repeated Gets are satisfied by the cache, and
+// that Save evicts the session.
+func TestCacheHits(t *testing.T) {
+	st := makeCachedTestStore(t)
+	st.AuthType = qsess.TokenAuth
+	cache := st.BackEndCtx().(*qsess.CachingBackEnd)
+
+	token := saveToken(t, st, "userid-hits")
+	for i := 0; i < 3; i++ {
+		if _, _, err := st.GetTokenSession(token); err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+	}
+	// Token's Get is the only miss
+	if hits, misses := cache.Stats(); hits != 3 || misses != 1 {
+		t.Fatalf("expected 3 hits and 1 miss, got %d and %d", hits, misses)
+	}
+
+	sess, _, _ := st.GetTokenSession(token)
+	sess.Data.(*qsess.VarMap).Vars["k"] = "v"
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	sess, _, err := st.GetTokenSession(token)
+	if err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	if sess.Data.(*qsess.VarMap).Vars["k"] != "v" {
+		t.Fatal("cache returned stale session data after Save")
+	}
+}
+
+// TestCacheSize checks that the least recently used session is evicted.
+func TestCacheSize(t *testing.T) {
+	st := makeTestStore(t, false)
+	st.AuthType = qsess.TokenAuth
+	cache := qsess.NewCachingBackEnd(st.BackEndCtx(), 2, time.Minute, nil)
+	st.SetBackEnd(cache)
+
+	tokens := []string{saveToken(t, st, "u1"), saveToken(t, st, "u2"), saveToken(t, st, "u3")}
+	for _, i := range []int{0, 1, 0, 2, 0, 1} {
+		if _, _, err := st.GetTokenSession(tokens[i]); err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+	}
+	// Token misses 3 times, leaving 1 and 2 cached, then Gets miss 0
+	// (evicting 1), miss 1 (evicting 2), hit 0, miss 2 (evicting 1),
+	// hit 0 and miss 1.
+	if hits, misses := cache.Stats(); hits != 2 || misses != 7 {
+		t.Fatalf("expected 2 hits and 7 misses, got %d and %d", hits, misses)
+	}
+}
+
+// TestCacheFeed checks that deletions on one server evict sessions from
+// another server's cache, only if they share an InvalidationFeed.
+func TestCacheFeed(t *testing.T) {
+	for _, feed := range []*testFeed{nil, {}} {
+		var st1, st2 *qsess.Store
+		if feed == nil {
+			st1, st2 = makeCachedPair(t, nil)
+		} else {
+			st1, st2 = makeCachedPair(t, feed)
+		}
+
+		t1 := saveToken(t, st1, "userid-feed-1")
+		t2 := saveToken(t, st1, "userid-feed-2")
+		for _, tok := range []string{t1, t2} {
+			if _, _, err := st2.GetTokenSession(tok); err != nil {
+				t.Fatal("GetTokenSession failed - " + err.Error())
+			}
+		}
+
+		sess, _, err := st1.GetTokenSession(t1)
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+		if err := sess.Delete(httptest.NewRecorder()); err != nil {
+			t.Fatal("Delete failed - " + err.Error())
+		}
+		sess, _, err = st1.GetTokenSession(t2)
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+		if err := sess.DeleteByUserID(httptest.NewRecorder()); err != nil {
+			t.Fatal("DeleteByUserID failed - " + err.Error())
+		}
+
+		for _, tok := range []string{t1, t2} {
+			_, _, err := st2.GetTokenSession(tok)
+			if feed == nil {
+				if err != nil {
+					t.Fatal("without a feed, the other cache should still have the session")
+				}
+				continue
+			}
+			// invalidations are applied asynchronously
+			for deadline := time.Now().Add(time.Second); err == nil && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+				_, _, err = st2.GetTokenSession(tok)
+			}
+			if err == nil {
+				t.Fatal("deleted session was not evicted from the other cache")
+			}
+		}
+	}
+}
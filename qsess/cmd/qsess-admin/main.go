@@ -0,0 +1,15 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// Command qsess-admin inspects and manages sessions in any qsess back-end:
+// it lists and counts sessions, decodes tokens, shows session data, revokes
+// sessions and runs the pruner. See package
+// github.com/gkong/go-qweb/qsess/qsadmin for details, and for how to show
+// custom session data types.
+package main
+
+import "github.com/gkong/go-qweb/qsess/qsadmin"
+
+func main() {
+	qsadmin.Main()
+}
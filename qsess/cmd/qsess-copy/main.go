@@ -0,0 +1,101 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// Command qsess-copy copies all live sessions from one qsess back-end to
+// another, keeping their ids, user ids, data and remaining time-to-live, so
+// existing cookies and tokens work with the new back-end. It is meant for
+// migrations and disaster recovery.
+//
+//	qsess-copy -from goleveldb:/var/lib/sess -to 'postgresql:postgres://user@db/app?table=session'
+//
+// The source back-end must implement qsess.Iterable, and the destination
+// qsess.SessImporter. Session ids are back-end-defined, so the destination
+// must accept the source's ids: mysql and postgresql ids are interchangeable,
+// but goleveldb and cassandra ids are not, so the copy stops at the first
+// session the destination rejects. (To move sessions between back-ends whose
+// ids differ, see qsess.MigratingBackEnd.) See package
+// github.com/gkong/go-qweb/qsess/internal/backends for the syntax of
+// back-end descriptions.
+//
+// Sessions which are saved to the source while qsess-copy is running may or
+// may not be copied, so stop writing to it first.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/internal/backends"
+)
+
+func main() {
+	from := flag.String("from", "", "back-end to copy sessions from")
+	to := flag.String("to", "", "back-end to copy sessions to")
+	dryRun := flag.Bool("dry-run", false, "count sessions, but don't copy them")
+	flag.Parse()
+	if *from == "" || (*to == "" && !*dryRun) || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	n, err := run(context.Background(), *from, *to, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "qsess-copy: "+err.Error())
+		os.Exit(1)
+	}
+	if *dryRun {
+		fmt.Printf("%d sessions to copy\n", n)
+	} else {
+		fmt.Printf("copied %d sessions\n", n)
+	}
+}
+
+func run(ctx context.Context, fromSpec string, toSpec string, dryRun bool) (int, error) {
+	fromSt, closeFrom, err := backends.Open(fromSpec)
+	if err != nil {
+		return 0, err
+	}
+	defer closeFrom()
+	src, ok := fromSt.BackEndCtx().(qsess.Iterable)
+	if !ok {
+		return 0, fmt.Errorf("%s back-ends can't be iterated", typeOf(fromSpec))
+	}
+
+	var dst qsess.SessImporter
+	if !dryRun {
+		toSt, closeTo, err := backends.Open(toSpec)
+		if err != nil {
+			return 0, err
+		}
+		defer closeTo()
+		if dst, ok = toSt.BackEndCtx().(qsess.SessImporter); !ok {
+			return 0, fmt.Errorf("%s back-ends can't import sessions", typeOf(toSpec))
+		}
+	}
+
+	return copySessions(ctx, src, dst, typeOf(toSpec))
+}
+
+// copySessions imports every session in src into dst, and returns how many
+// there were. If dst is nil, it only counts them.
+func copySessions(ctx context.Context, src qsess.Iterable, dst qsess.SessImporter, dstType string) (int, error) {
+	n := 0
+	err := src.IterateCtx(ctx, func(e qsess.SessEntry) error {
+		if dst != nil {
+			if err := dst.ImportCtx(ctx, e); err != nil {
+				return fmt.Errorf("%s back-end can't import session %x (copied %d sessions before it) - %w", dstType, e.SessID, n, err)
+			}
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func typeOf(spec string) string {
+	return strings.ToLower(strings.SplitN(spec, ":", 2)[0])
+}
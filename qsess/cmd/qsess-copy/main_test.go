@@ -0,0 +1,73 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/internal/backends"
+)
+
+var testKey = []byte("key-for-encryption--------------")
+
+// TestCopy copies sessions between two goleveldb databases, and checks that
+// their tokens work with the copy.
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	from := "goleveldb:" + filepath.Join(dir, "from") + "?prefix=ff"
+	to := "goleveldb:" + filepath.Join(dir, "to") + "?prefix=ff"
+
+	st, closeSt, err := backends.Open(from, testKey)
+	if err != nil {
+		t.Fatal("Open failed - " + err.Error())
+	}
+	st.AuthType = qsess.TokenAuth
+	var tokens []string
+	for _, uid := range []string{"copy-1", "copy-2", "copy-3"} {
+		sess := st.NewSession([]byte(uid))
+		sess.Data.(*qsess.VarMap).Vars["uid"] = uid
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		token, _, err := sess.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+		tokens = append(tokens, token)
+	}
+	closeSt()
+
+	if n, err := run(context.Background(), from, "", true); err != nil || n != 3 {
+		t.Fatalf("dry run - expected 3 sessions, got %d, %v", n, err)
+	}
+	if n, err := run(context.Background(), from, to, false); err != nil || n != 3 {
+		t.Fatalf("expected to copy 3 sessions, got %d, %v", n, err)
+	}
+	// session ids made with prefix ff can't be imported with another prefix.
+	other := "goleveldb:" + filepath.Join(dir, "other") + "?prefix=ee"
+	if _, err := run(context.Background(), from, other, false); err == nil || !strings.Contains(err.Error(), "can't import session") {
+		t.Fatalf("copy to a back-end which rejects the source's ids - expected an import error, got %v", err)
+	}
+
+	st, closeSt, err = backends.Open(to, testKey)
+	if err != nil {
+		t.Fatal("Open failed - " + err.Error())
+	}
+	defer closeSt()
+	st.AuthType = qsess.TokenAuth
+	for i, uid := range []string{"copy-1", "copy-2", "copy-3"} {
+		sess, _, err := st.GetTokenSession(tokens[i])
+		if err != nil {
+			t.Fatal("GetTokenSession of copied session failed - " + err.Error())
+		}
+		if string(sess.UserID()) != uid || sess.Data.(*qsess.VarMap).Vars["uid"] != uid {
+			t.Fatal("copied session has the wrong user id or data")
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// Package codec provides serializers for session data, which are much faster
+// than gob (used by qsess.VarMap and qsess.GobCodec): JSON, for any type,
+// Msgp, for types with code generated by tinylib/msgp or zebrapack, and
+// Flate, which compresses the output of another codec, when it is large.
+//
+// They are qsess.Codecs, for use with qsess.Typed:
+//
+//	typed := qsess.NewTyped[MyData](st, codec.JSON[MyData]{})
+//
+// or, with NewSessData, as a Store's session data type:
+//
+//	st.NewSessData = codec.NewSessData[MyData](codec.JSON[MyData]{})
+//	...
+//	d := &sess.Data.(*codec.Data[MyData]).Value
+//
+// Changing a Store's codec makes existing sessions' data unreadable, so
+// GetSession fails for them.
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/gkong/go-qweb/qsess"
+)
+
+// Data is a qsess.SessData which holds a value of type T, serialized by a
+// Codec. See NewSessData.
+type Data[T any] struct {
+	Value T
+	codec qsess.Codec[T]
+}
+
+// NewSessData returns a constructor for Data[T], serialized by c, for use
+// as Store.NewSessData.
+func NewSessData[T any](c qsess.Codec[T]) func() qsess.SessData {
+	return func() qsess.SessData {
+		return &Data[T]{codec: c}
+	}
+}
+
+func (d *Data[T]) Marshal() ([]byte, error) {
+	return d.codec.Marshal(&d.Value)
+}
+
+func (d *Data[T]) Unmarshal(b []byte) error {
+	var zero T
+	d.Value = zero
+	return d.codec.Unmarshal(b, &d.Value)
+}
+
+// JSON is a Codec which uses encoding/json.
+type JSON[T any] struct{}
+
+func (JSON[T]) Marshal(v *T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON[T]) Unmarshal(data []byte, v *T) error {
+	return json.Unmarshal(data, v)
+}
+
+// MsgpPtr is satisfied by pointers to types with MarshalMsg and UnmarshalMsg
+// methods generated by tinylib/msgp (with -io=false) or zebrapack.
+type MsgpPtr[T any] interface {
+	*T
+	MarshalMsg(b []byte) ([]byte, error)
+	UnmarshalMsg(b []byte) ([]byte, error)
+}
+
+// Msgp is a Codec for types with generated MessagePack serializers. Give it
+// both the type and its pointer type: Msgp[MyData, *MyData]{}.
+type Msgp[T any, PT MsgpPtr[T]] struct{}
+
+func (Msgp[T, PT]) Marshal(v *T) ([]byte, error) {
+	return PT(v).MarshalMsg(nil)
+}
+
+func (Msgp[T, PT]) Unmarshal(data []byte, v *T) error {
+	_, err := PT(v).UnmarshalMsg(data)
+	return err
+}
+
+// Flate record formats, in the first byte of the data.
+const (
+	flatePlain = 1
+	flateFlate = 2
+)
+
+// Flate is a Codec which compresses the output of another Codec, if it is
+// at least a threshold size, and compression makes it smaller.
+type Flate[T any] struct {
+	codec     qsess.Codec[T]
+	threshold int
+}
+
+// NewFlate returns a Flate, which compresses the output of c, if it is at
+// least threshold bytes.
+func NewFlate[T any](c qsess.Codec[T], threshold int) Flate[T] {
+	return Flate[T]{c, threshold}
+}
+
+func (f Flate[T]) Marshal(v *T) ([]byte, error) {
+	data, err := f.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= f.threshold {
+		var b bytes.Buffer
+		b.WriteByte(flateFlate)
+		zw, _ := flate.NewWriter(&b, flate.BestSpeed) // only fails for bad levels
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, errors.New("codec.Flate Marshal - compression failed - " + err.Error())
+		}
+		if b.Len() < 1+len(data) {
+			return b.Bytes(), nil
+		}
+	}
+	return append([]byte{flatePlain}, data...), nil
+}
+
+func (f Flate[T]) Unmarshal(data []byte, v *T) error {
+	if len(data) == 0 {
+		return errors.New("codec.Flate Unmarshal - no data")
+	}
+	payload := data[1:]
+	switch data[0] {
+	case flatePlain:
+	case flateFlate:
+		var err error
+		if payload, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload))); err != nil {
+			return errors.New("codec.Flate Unmarshal - decompression failed - " + err.Error())
+		}
+	default:
+		return errors.New("codec.Flate Unmarshal - unknown record format")
+	}
+	return f.codec.Unmarshal(payload, v)
+}
@@ -0,0 +1,153 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// to re-generate generated_msgp_test.go:
+//    install github.com/tinylib/msgp
+//    run "go generate"
+
+//go:generate msgp -file=codec_test.go -o=generated_msgp_test.go -io=false -tests=false
+
+package codec_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/codec"
+)
+
+// MsgpData is an example session data type, with generated serializers.
+type MsgpData struct {
+	Userid   MsgpUUID
+	Username string
+	Note     string
+}
+
+type MsgpUUID [16]byte
+
+var example = MsgpData{
+	Userid:   MsgpUUID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5},
+	Username: "JohnDoe",
+	Note:     "This is an example string of 43 characters.",
+}
+
+var codecs = []struct {
+	name  string
+	codec qsess.Codec[MsgpData]
+}{
+	{"Gob", qsess.GobCodec[MsgpData]{}},
+	{"JSON", codec.JSON[MsgpData]{}},
+	{"Msgp", codec.Msgp[MsgpData, *MsgpData]{}},
+	{"FlateJSON", codec.NewFlate[MsgpData](codec.JSON[MsgpData]{}, 0)},
+	{"FlateJSONBelowThreshold", codec.NewFlate[MsgpData](codec.JSON[MsgpData]{}, 1000)},
+}
+
+func TestRoundTrip(t *testing.T) {
+	big := example
+	big.Note = strings.Repeat(example.Note, 100)
+	for _, c := range codecs {
+		for _, v := range []MsgpData{example, big} {
+			data, err := c.codec.Marshal(&v)
+			if err != nil {
+				t.Fatalf("%s Marshal failed - %s", c.name, err)
+			}
+			var got MsgpData
+			if err := c.codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("%s Unmarshal failed - %s", c.name, err)
+			}
+			if got != v {
+				t.Fatalf("%s round trip failed, got %+v", c.name, got)
+			}
+		}
+	}
+}
+
+func TestFlate(t *testing.T) {
+	f := codec.NewFlate[MsgpData](codec.JSON[MsgpData]{}, 200)
+	plain, _ := codec.JSON[MsgpData]{}.Marshal(&example)
+	small, _ := f.Marshal(&example)
+	if !bytes.Equal(small[1:], plain) {
+		t.Fatal("data below the threshold should not be compressed")
+	}
+
+	big := example
+	big.Note = strings.Repeat(example.Note, 100)
+	plain, _ = codec.JSON[MsgpData]{}.Marshal(&big)
+	compressed, _ := f.Marshal(&big)
+	if len(compressed) >= len(plain) {
+		t.Fatalf("data above the threshold should be compressed, got %d bytes from %d", len(compressed), len(plain))
+	}
+
+	var got MsgpData
+	if err := f.Unmarshal([]byte{99, 1, 2}, &got); err == nil {
+		t.Fatal("Unmarshal of an unknown format should fail")
+	}
+}
+
+func TestSessData(t *testing.T) {
+	st, err := qsess.NewMapStore([]byte("key-for-encryption--------------"))
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	st.AuthType = qsess.TokenAuth
+	st.NewSessData = codec.NewSessData[MsgpData](codec.Msgp[MsgpData, *MsgpData]{})
+
+	sess := st.NewSession([]byte("codec-user"))
+	sess.Data.(*codec.Data[MsgpData]).Value = example
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	token, _, err := sess.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+	sess, _, err = st.GetTokenSession(token)
+	if err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	if sess.Data.(*codec.Data[MsgpData]).Value != example {
+		t.Fatal("session data was not preserved")
+	}
+}
+
+func benchmark(b *testing.B, c qsess.Codec[MsgpData], v MsgpData) {
+	for i := 0; i < b.N; i++ {
+		data, err := c.Marshal(&v)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var got MsgpData
+		if err := c.Unmarshal(data, &got); err != nil {
+			b.Fatal(err)
+		}
+	}
+	data, _ := c.Marshal(&v)
+	b.ReportMetric(float64(len(data)), "bytes")
+}
+
+func BenchmarkGob(b *testing.B) {
+	benchmark(b, qsess.GobCodec[MsgpData]{}, example)
+}
+
+func BenchmarkJSON(b *testing.B) {
+	benchmark(b, codec.JSON[MsgpData]{}, example)
+}
+
+func BenchmarkMsgp(b *testing.B) {
+	benchmark(b, codec.Msgp[MsgpData, *MsgpData]{}, example)
+}
+
+// BenchmarkFlateSmall measures the overhead of Flate below its threshold.
+func BenchmarkFlateSmall(b *testing.B) {
+	benchmark(b, codec.NewFlate[MsgpData](codec.Msgp[MsgpData, *MsgpData]{}, 1024), example)
+}
+
+// BenchmarkFlateLarge measures compression of 4K of data.
+func BenchmarkFlateLarge(b *testing.B) {
+	big := example
+	big.Note = strings.Repeat(example.Note, 100)
+	benchmark(b, codec.NewFlate[MsgpData](codec.Msgp[MsgpData, *MsgpData]{}, 1024), big)
+}
@@ -0,0 +1,60 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ConsumeTokenSession is like GetTokenSession, but deletes the session as it
+// reads it, in one atomic back-end operation, so a token can only be used
+// once, even by concurrent requests. It is for single-use tokens, such as
+// those in email verification and password reset links. The returned
+// session no longer exists in the back-end, so don't Save it.
+//
+// It fails with ErrNotSupported if the Store's back-end doesn't implement
+// SessConsumer (all the database back-ends in this module do; the back-end
+// made by NewCookieStore doesn't). Like GetTokenSession, it also returns the
+// session's time-to-live, in seconds.
+func (st *Store) ConsumeTokenSession(token string) (*Session, int, error) {
+	return st.ConsumeTokenSessionCtx(context.Background(), token)
+}
+
+// ConsumeTokenSessionCtx is like ConsumeTokenSession, with a context for
+// back-end calls.
+func (st *Store) ConsumeTokenSessionCtx(ctx context.Context, token string) (*Session, int, error) {
+	cb, ok := consumer(st.backEnd)
+	if !ok {
+		return nil, 0, qsErr{"ConsumeTokenSession - back-end can't consume sessions", ErrNotSupported}
+	}
+
+	s := st.newSess()
+	start := time.Now()
+	err := s.decode(token)
+	st.observe(OpDecode, start, len(token), err)
+	if err != nil {
+		return nil, 0, qsErr{"ConsumeTokenSession - decode - ", withSentinel(ErrInvalidToken, err)}
+	}
+
+	start = time.Now()
+	dbData, userid, ttl, maxage, minrefresh, err := cb.ConsumeCtx(ctx, s.sessID, s.userID)
+	if err != nil {
+		err = backEndErr(err)
+		st.observe(OpConsume, start, 0, err)
+		if errors.Is(err, ErrExpired) {
+			st.observeEvent(OpExpire)
+			st.ReportExpired(s.sessID, userid, dbData)
+		}
+		return nil, 0, qsErr{"ConsumeTokenSession - no record in db", err}
+	}
+	st.observe(OpConsume, start, len(dbData), nil)
+
+	if ttl, err = s.load(ctx, dbData, userid, ttl, maxage, minrefresh, false); err != nil {
+		return nil, 0, qsErr{"ConsumeTokenSession - ", err}
+	}
+	st.lifecycle(LifecycleDeleted, s.userID, s.meta)
+	return s, ttl, nil
+}
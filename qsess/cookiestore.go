@@ -0,0 +1,225 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// "stateless" back-end for qsess, which keeps sessions in clients.
+//
+// A session's id is its whole record (marshaled data and all), which Store
+// encrypts into the cookie or token, as it does any session id. So Save
+// makes a new id every time, Get just unmarshals and checks expiration,
+// and Delete does nothing, except with the help of an EpochStore.
+
+package qsess
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// EpochStore records, for each user, a time before which that user's
+// sessions are invalid. It allows sessions kept in clients (see
+// NewCookieStore) to be revoked, so it must be shared by all servers which
+// accept those sessions. Implementations must be safe for concurrent use.
+type EpochStore interface {
+	// NotBefore returns the zero time if userID has no epoch.
+	NotBefore(ctx context.Context, userID []byte) (time.Time, error)
+	SetNotBefore(ctx context.Context, userID []byte, t time.Time) error
+}
+
+type mapEpochStore struct {
+	sync.RWMutex
+	epochs map[string]time.Time
+}
+
+// NewMapEpochStore returns an EpochStore which keeps epochs in memory, with
+// no persistence, for use by a single server.
+func NewMapEpochStore() EpochStore {
+	return &mapEpochStore{epochs: make(map[string]time.Time)}
+}
+
+func (m *mapEpochStore) NotBefore(ctx context.Context, userID []byte) (time.Time, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.epochs[string(userID)], nil
+}
+
+func (m *mapEpochStore) SetNotBefore(ctx context.Context, userID []byte, t time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	m.epochs[string(userID)] = t
+	return nil
+}
+
+// cookie session record layout:
+//
+//	format      1 byte: cookieRecPlain or cookieRecFlate
+//	stable id   cookieIDSize bytes, random, kept across Saves
+//	payload     possibly compressed:
+//	    uvarint issued time, in unix nanoseconds (compared with epochs)
+//	    uvarint expiration time, in unix seconds
+//	    varint  maxAgeSecs
+//	    varint  minRefreshSecs
+//	    uvarint user id length, then user id
+//	    data (the rest)
+const (
+	cookieRecPlain = 1
+	cookieRecFlate = 2
+	cookieIDSize   = 16
+)
+
+// cookieStore holds per-store information and implements SessBackEndCtx.
+type cookieStore struct {
+	epochs   EpochStore
+	compress bool
+}
+
+// NewCookieStore creates a session store which keeps sessions entirely in
+// clients: session data is marshaled and encrypted into the cookie or token
+// itself. No database is needed, but cookies and tokens are larger, and
+// Store splits cookies which are too large for a single cookie (up to a
+// limit of about 70K). All the servers which accept a session must have
+// the same keys.
+//
+// Sessions can't be changed or deleted on the server. Save and Regenerate
+// send the client a new cookie or token, but old ones stay valid (with the
+// old data) until they expire, and Session.Delete only removes the session
+// from the client. To revoke sessions, supply an EpochStore, which
+// Store.DeleteByUserID uses to invalidate all of a user's sessions issued
+// before the call. If epochs is nil, DeleteByUserID returns ErrNotSupported.
+//
+// If compress is true, session data is compressed before encryption. Only
+// do this if session data never contains both secrets and values which
+// might be chosen by an attacker, since compression can leak information
+// through the sizes of cookies (as in the CRIME attack).
+//
+// cipherkeys are one or more 32-byte encryption keys, to be used with
+// AES-GCM. For encryption, only the first key is used; for decryption,
+// the key is identified by the cookie or token (allowing key rotation).
+//
+// Additional configuration options can be set by manipulating fields in the
+// returned qsess.Store.
+func NewCookieStore(epochs EpochStore, compress bool, cipherkeys ...[]byte) (*Store, error) {
+	st, err := NewStoreCtx(&cookieStore{epochs, compress}, false, cipherkeys...)
+	if err != nil {
+		return nil, qsErr{"NewCookieStore - NewStore - ", err}
+	}
+	return st, nil
+}
+
+func (c *cookieStore) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rec := make([]byte, 1+cookieIDSize, 1+cookieIDSize+4*binary.MaxVarintLen64+len(userID)+len(data))
+	rec[0] = cookieRecPlain
+	if len(*sessID) >= 1+cookieIDSize {
+		copy(rec[1:], (*sessID)[1:1+cookieIDSize])
+	} else if _, err := rand.Read(rec[1 : 1+cookieIDSize]); err != nil {
+		return qsErr{"cookieStore Save - could not create id", err}
+	}
+
+	payload := appendUvarint(nil, uint64(now.UnixNano()))
+	payload = appendUvarint(payload, uint64(now.Unix()+int64(maxAgeSecs)))
+	payload = appendVarint(payload, int64(maxAgeSecs))
+	payload = appendVarint(payload, int64(minRefreshSecs))
+	payload = appendUvarint(payload, uint64(len(userID)))
+	payload = append(payload, userID...)
+	payload = append(payload, data...)
+
+	if c.compress {
+		var b bytes.Buffer
+		zw, _ := flate.NewWriter(&b, flate.BestSpeed) // only fails for bad levels
+		zw.Write(payload)
+		if err := zw.Close(); err != nil {
+			return qsErr{"cookieStore Save - compression failed", err}
+		}
+		if b.Len() < len(payload) {
+			rec[0] = cookieRecFlate
+			payload = b.Bytes()
+		}
+	}
+
+	*sessID = append(rec, payload...)
+	return nil
+}
+
+func (c *cookieStore) GetCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, 0, 0, 0, err
+	}
+	bad := func(msg string) ([]byte, []byte, int, int, int, error) {
+		return nil, nil, 0, 0, 0, qsErr{"cookieStore Get - " + msg, ErrInvalidToken}
+	}
+
+	if len(sessID) < 1+cookieIDSize {
+		return bad("record too small")
+	}
+	payload := sessID[1+cookieIDSize:]
+	switch sessID[0] {
+	case cookieRecPlain:
+	case cookieRecFlate:
+		var err error
+		if payload, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload))); err != nil {
+			return bad("decompression failed")
+		}
+	default:
+		return bad("unknown record format")
+	}
+
+	r := bytes.NewReader(payload)
+	issued, err1 := binary.ReadUvarint(r)
+	expires, err2 := binary.ReadUvarint(r)
+	maxAge, err3 := binary.ReadVarint(r)
+	minRefresh, err4 := binary.ReadVarint(r)
+	uidLen, err5 := binary.ReadUvarint(r)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || uidLen > uint64(r.Len()) {
+		return bad("malformed record")
+	}
+	rest := payload[len(payload)-r.Len():]
+	userID, data := rest[:uidLen], rest[uidLen:]
+
+	ttl := int64(expires) - time.Now().Unix()
+	if ttl <= 0 {
+		return data, userID, 0, 0, 0, qsErr{"cookieStore Get - session has expired", ErrExpired}
+	}
+
+	if c.epochs != nil {
+		notBefore, err := c.epochs.NotBefore(ctx, userID)
+		if err != nil {
+			return nil, nil, 0, 0, 0, qsErr{"cookieStore Get - NotBefore failed", withSentinel(ErrBackend, err)}
+		}
+		if !notBefore.IsZero() && int64(issued) < notBefore.UnixNano() {
+			return nil, nil, 0, 0, 0, qsErr{"cookieStore Get - session has been revoked", ErrNotFound}
+		}
+	}
+
+	return data, userID, int(ttl), int(maxAge), int(minRefresh), nil
+}
+
+// DeleteCtx does nothing, since the session is kept by the client.
+func (c *cookieStore) DeleteCtx(ctx context.Context, sessID []byte, uID []byte) error {
+	return nil
+}
+
+func (c *cookieStore) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
+	if c.epochs == nil {
+		return ErrNotSupported
+	}
+	return c.epochs.SetNotBefore(ctx, userID, time.Now())
+}
+
+// stableID returns the part of a session id which stays the same across
+// Saves (see stableIDer).
+func (c *cookieStore) stableID(sessID []byte) []byte {
+	if len(sessID) < 1+cookieIDSize {
+		return sessID
+	}
+	return sessID[1 : 1+cookieIDSize]
+}
@@ -0,0 +1,169 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// tests that do NOT see package internals
+
+package qsess_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/qstest"
+)
+
+func makeCookieTestStore(t *testing.T, compress bool) *qsess.Store {
+	st, err := qsess.NewCookieStore(qsess.NewMapEpochStore(), compress,
+		[]byte("key-for-encryption--------------"),
+	)
+	if err != nil {
+		t.Fatal("makeCookieTestStore - NewCookieStore failed - " + err.Error())
+	}
+	return st
+}
+
+func TestCookieSanity(t *testing.T) {
+	qstest.SanityTest(t, makeCookieTestStore(t, false))
+	qstest.SanityTest(t, makeCookieTestStore(t, true))
+}
+
+func TestCookieNoSessData(t *testing.T) {
+	qstest.NoSessDataTest(t, makeCookieTestStore(t, false))
+}
+
+func TestCookieDeleteByUserId(t *testing.T) {
+	qstest.DeleteByUserIDTest(t, makeCookieTestStore(t, false), false)
+}
+
+func TestCookieCSRF(t *testing.T) {
+	qstest.CSRFTest(t, makeCookieTestStore(t, false))
+}
+
+func TestCookieJWT(t *testing.T) {
+	qstest.JWTTest(t, makeCookieTestStore(t, false))
+}
+
+func TestCookieExpiration(t *testing.T) {
+	qstest.ExpirationTest(t, makeCookieTestStore(t, false))
+}
+
+// TestCookieChunks checks that session data too large for one cookie is
+// split across several, and that chunks are deleted when no longer needed.
+func TestCookieChunks(t *testing.T) {
+	st := makeCookieTestStore(t, false)
+	big := strings.Repeat("0123456789", 1000)
+
+	sess := st.NewSession([]byte("userid-chunks"))
+	sess.Data.(*qsess.VarMap).Vars["big"] = big
+	w := httptest.NewRecorder()
+	if err := sess.Save(w); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) < 3 {
+		t.Fatalf("expected data to be split across at least 3 cookies, got %d", len(cookies))
+	}
+
+	r, _ := http.NewRequest("GET", "http://foo.com", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	sess, _, err := st.GetSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal("GetSession failed - " + err.Error())
+	}
+	if sess.Data.(*qsess.VarMap).Vars["big"] != big {
+		t.Fatal("retrieved session data does not match saved session data")
+	}
+
+	// shrink the session; it should fit in one cookie, and the others
+	// should be deleted.
+	delete(sess.Data.(*qsess.VarMap).Vars, "big")
+	w = httptest.NewRecorder()
+	if err := sess.Save(w); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	resp := w.Result().Cookies()
+	if len(resp) != len(cookies) {
+		t.Fatalf("expected %d Set-Cookie headers, got %d", len(cookies), len(resp))
+	}
+	for _, c := range resp[1:] {
+		if c.MaxAge >= 0 {
+			t.Errorf("left-over chunk %s was not deleted", c.Name)
+		}
+	}
+
+	// a missing chunk makes the cookie invalid
+	r, _ = http.NewRequest("GET", "http://foo.com", nil)
+	for _, c := range cookies[:len(cookies)-1] {
+		r.AddCookie(c)
+	}
+	if _, _, err := st.GetSession(httptest.NewRecorder(), r); err == nil {
+		t.Fatal("GetSession succeeded with a missing chunk")
+	}
+}
+
+// TestCookieRevoke checks that DeleteByUserID revokes sessions issued
+// before it, but not after, and only for the given user.
+func TestCookieRevoke(t *testing.T) {
+	st := makeCookieTestStore(t, false)
+	st.AuthType = qsess.TokenAuth
+
+	token := func(userID string) string {
+		sess := st.NewSession([]byte(userID))
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		tok, _, err := sess.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+		return tok
+	}
+	alice, bob := token("alice"), token("bob")
+
+	sess, _, err := st.GetTokenSession(alice)
+	if err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	if err := sess.DeleteByUserID(httptest.NewRecorder()); err != nil {
+		t.Fatal("DeleteByUserID failed - " + err.Error())
+	}
+	if _, _, err := st.GetTokenSession(alice); !errors.Is(err, qsess.ErrNotFound) {
+		t.Errorf("revoked session - expected ErrNotFound, got %v", err)
+	}
+	if _, _, err := st.GetTokenSession(bob); err != nil {
+		t.Errorf("other user's session was revoked - %v", err)
+	}
+	if _, _, err := st.GetTokenSession(token("alice")); err != nil {
+		t.Errorf("session issued after revocation was rejected - %v", err)
+	}
+
+	noEpochs, err := qsess.NewCookieStore(nil, false, []byte("key-for-encryption--------------"))
+	if err != nil {
+		t.Fatal("NewCookieStore failed - " + err.Error())
+	}
+	if err := noEpochs.NewSession([]byte("alice")).DeleteByUserID(httptest.NewRecorder()); !errors.Is(err, qsess.ErrNotSupported) {
+		t.Errorf("DeleteByUserID without EpochStore - expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestCookieConsume(t *testing.T) {
+	st := makeCookieTestStore(t, false)
+	s := st.NewSession([]byte("user"))
+	if err := s.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	tok, _, err := s.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+	// sessions kept in clients can't be deleted, so can't be consumed.
+	if _, _, err := st.ConsumeTokenSession(tok); !errors.Is(err, qsess.ErrNotSupported) {
+		t.Fatalf("ConsumeTokenSession - expected ErrNotSupported, got %v", err)
+	}
+}
@@ -4,15 +4,72 @@
 package qsess
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"io"
+
+	"golang.org/x/crypto/hkdf"
 )
 
+var deriveKeyLabel = []byte("qsess-store-key\x00")
+
+// DeriveKeys derives Store keys from one or more master secrets, using
+// HKDF-SHA256, for passing to a Store constructor. Each purpose yields
+// different keys, so several Stores can share master secrets (for example,
+// one for login sessions and one for email verification tokens), without
+// accepting each other's cookies and tokens. Set each Store's Purpose to
+// the same purpose string, so they are also bound to it.
+//
+// As with keys passed directly, the first master secret is primary, and
+// the others allow rotation.
+func DeriveKeys(purpose string, masterSecrets ...[]byte) [][]byte {
+	keys := make([][]byte, len(masterSecrets))
+	info := append(append([]byte{}, deriveKeyLabel...), purpose...)
+	for i, secret := range masterSecrets {
+		keys[i] = make([]byte, 32)
+		// can't fail: 32 bytes is far below HKDF-SHA256's output limit.
+		io.ReadFull(hkdf.New(sha256.New, secret, nil, info), keys[i])
+	}
+	return keys
+}
+
+// purposeAD prefixes additional data with the Store's purpose, if any.
+func (st *Store) purposeAD(ad []byte) []byte {
+	if st.Purpose == "" {
+		return ad
+	}
+	// length-prefixed, so purpose and ad can't run into each other.
+	p := append([]byte("qsess-purpose"), 0)
+	p = appendUvarint(p, uint64(len(st.Purpose)))
+	p = append(p, st.Purpose...)
+	return append(p, ad...)
+}
+
+var keyIDLabel = []byte("qsess-key-id")
+
+// keyID derives a key's id from the key itself, so ids don't depend on the
+// order of keys given to NewStore, and stay the same as keys are added and
+// retired. Ids are only one byte, so two keys may share one.
+func keyID(key []byte) byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(keyIDLabel)
+	return mac.Sum(nil)[0]
+}
+
 func (st *Store) makeCiphers(cipherkeys ...[]byte) error {
 	for i, key := range cipherkeys {
+		st.keyIDs[i] = keyID(key)
+
+		// a separate key for CSRF secrets, so they reveal nothing about key.
+		mac := hmac.New(sha256.New, key)
+		mac.Write(csrfKeyLabel)
+		st.csrfKeys[i] = mac.Sum(nil)
+
 		blk, err := aes.NewCipher(key)
 		if err != nil {
 			return qsErr{"makeCiphers - NewCipher", err}
@@ -26,55 +83,102 @@ func (st *Store) makeCiphers(cipherkeys ...[]byte) error {
 	return nil
 }
 
-// encrypt, then base64-encode
-func (st *Store) encrypt(data []byte) ([]byte, error) {
-	var encrypted []byte
-	var err error
+// encrypt, then base64-encode. The result starts with the id of the
+// primary key (ciphers[0]), so decrypt can go straight to it.
+//
+// ad is additional data, which must be presented again to decrypt, so that
+// data encrypted for one purpose cannot be used for another. User-supplied
+// Encrypt functions don't support additional data, so it is prepended to
+// the plaintext instead.
+func (st *Store) encrypt(data []byte, ad []byte) ([]byte, error) {
+	encrypted, err := st.seal(data, ad)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, base64.URLEncoding.EncodedLen(len(encrypted)))
+	base64.URLEncoding.Encode(encoded, encrypted)
+	return encoded, nil
+}
 
+// seal is encrypt, without base64 encoding.
+func (st *Store) seal(data []byte, ad []byte) (encrypted []byte, err error) {
 	if st.Encrypt == nil {
 		nonce := make([]byte, st.ciphers[0].NonceSize())
 		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 			return nil, qsErr{"encrypt - could not create nonce", err}
 		}
-		encrypted = st.ciphers[0].Seal(nonce, nonce, data, nil)
+		encrypted = append([]byte{st.keyIDs[0]}, nonce...)
+		encrypted = st.ciphers[0].Seal(encrypted, nonce, data, ad)
 	} else {
+		if len(ad) > 0 {
+			data = append(append([]byte{}, ad...), data...)
+		}
 		encrypted, err = st.Encrypt(data)
 		if err != nil {
 			return nil, qsErr{"encrypt - user-supplied Encrypt failed", err}
 		}
 	}
-
-	encoded := make([]byte, base64.URLEncoding.EncodedLen(len(encrypted)))
-	base64.URLEncoding.Encode(encoded, encrypted)
-	return encoded, nil
+	return encrypted, nil
 }
 
-// base64-decode, then decrypt
-func (st *Store) decrypt(data []byte) ([]byte, error) {
+// base64-decode, then decrypt. primary is false if data was encrypted with
+// a key other than the primary key, so it should be re-encrypted.
+//
+// Data made before key ids were introduced has no id byte, so, if
+// Store.LegacyTokens is true and no key with a matching id can open it,
+// every key is tried, without the id byte.
+//
+// User-supplied Decrypt functions are given data still base64-encoded.
+func (st *Store) decrypt(data []byte, ad []byte) (decrypted []byte, primary bool, err error) {
+	if st.Decrypt != nil {
+		return st.userDecrypt(data, ad)
+	}
 	decoded := make([]byte, base64.URLEncoding.DecodedLen(len(data)))
 	decodedsize, err := base64.URLEncoding.Decode(decoded, data)
 	if err != nil {
-		return nil, qsErr{"decrypt - base64 decode failure", nil}
+		return nil, false, qsErr{"decrypt - base64 decode failure", nil}
 	}
-	decoded = decoded[:decodedsize]
+	return st.open(decoded[:decodedsize], ad)
+}
 
+// open is decrypt, without base64 decoding.
+func (st *Store) open(decoded []byte, ad []byte) (decrypted []byte, primary bool, err error) {
 	if st.Decrypt == nil {
 		nsize := st.ciphers[0].NonceSize()
-		if len(decoded) < nsize {
-			return nil, qsErr{"decrypt - data too small", nil}
+		if len(decoded) < 1+nsize {
+			return nil, false, qsErr{"decrypt - data too small", nil}
+		}
+		id, nonce, sealed := decoded[0], decoded[1:1+nsize], decoded[1+nsize:]
+		for i, c := range st.ciphers {
+			if st.keyIDs[i] != id {
+				continue
+			}
+			if decrypted, err := c.Open(nil, nonce, sealed, ad); err == nil {
+				return decrypted, i == 0, nil
+			}
 		}
-		for _, c := range st.ciphers {
-			decrypted, err := c.Open(nil, decoded[:nsize], decoded[nsize:], nil)
-			if err == nil {
-				return decrypted, nil
+		if st.LegacyTokens {
+			for _, c := range st.ciphers {
+				if decrypted, err := c.Open(nil, decoded[:nsize], decoded[nsize:], ad); err == nil {
+					return decrypted, false, nil
+				}
 			}
 		}
-		return nil, qsErr{"decrypt - could not Open", nil}
-	} else {
-		decrypted, err := st.Decrypt(data)
-		if err != nil {
-			return nil, qsErr{"decrypt - user-supplied Decrypt failed", err}
+		return nil, false, qsErr{"decrypt - could not Open", nil}
+	}
+	return st.userDecrypt(decoded, ad)
+}
+
+func (st *Store) userDecrypt(data []byte, ad []byte) (decrypted []byte, primary bool, err error) {
+	decrypted, err = st.Decrypt(data)
+	if err != nil {
+		return nil, false, qsErr{"decrypt - user-supplied Decrypt failed", err}
+	}
+	if len(ad) > 0 {
+		if !bytes.HasPrefix(decrypted, ad) {
+			return nil, false, qsErr{"decrypt - additional data mismatch", nil}
 		}
-		return decrypted, nil
+		decrypted = decrypted[len(ad):]
 	}
+	return decrypted, true, nil
 }
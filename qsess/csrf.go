@@ -0,0 +1,87 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+var csrfKeyLabel = []byte("qsess-csrf")
+
+const csrfSecretSize = sha256.Size
+
+// stableIDer is implemented by back-ends whose session ids change whenever
+// sessions are saved (cookieStore). stableID returns the part of a session
+// id which stays the same.
+type stableIDer interface {
+	stableID(sessID []byte) []byte
+}
+
+// csrfSecret derives a session's CSRF secret from its session ID, so nothing
+// extra needs to be stored, and Regenerate yields a new secret.
+func (s *Session) csrfSecret(key []byte) []byte {
+	id := s.sessID
+	for be := s.store.backEnd; be != nil; {
+		if si, ok := be.(stableIDer); ok {
+			id = si.stableID(id)
+			break
+		}
+		w, ok := be.(SessBackEndWrapper)
+		if !ok {
+			break
+		}
+		be = w.Unwrap()
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(id)
+	return mac.Sum(nil)
+}
+
+// CSRFToken returns a token which proves that a request was issued by a page
+// belonging to this session. Embed it in forms or send it in a request header,
+// and check it with CheckCSRFToken (or use qctx.MwCSRF).
+//
+// The token is masked with a fresh random pad on every call, so it can be
+// included in compressed responses without being exposed to BREACH-style
+// attacks. Returns "" if the session has not yet been saved.
+func (s *Session) CSRFToken() string {
+	if s.sessID == nil {
+		return ""
+	}
+	secret := s.csrfSecret(s.store.csrfKeys[0])
+
+	tok := make([]byte, 2*csrfSecretSize)
+	if _, err := rand.Read(tok[:csrfSecretSize]); err != nil {
+		return ""
+	}
+	for i := range secret {
+		tok[csrfSecretSize+i] = tok[i] ^ secret[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(tok)
+}
+
+// CheckCSRFToken reports whether token was issued by CSRFToken for this
+// session. Tokens made with any of the Store's cipher keys are accepted.
+func (s *Session) CheckCSRFToken(token string) bool {
+	if s.sessID == nil {
+		return false
+	}
+	tok, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(tok) != 2*csrfSecretSize {
+		return false
+	}
+	secret := make([]byte, csrfSecretSize)
+	for i := range secret {
+		secret[i] = tok[i] ^ tok[csrfSecretSize+i]
+	}
+	for _, key := range s.store.csrfKeys {
+		if hmac.Equal(secret, s.csrfSecret(key)) {
+			return true
+		}
+	}
+	return false
+}
@@ -44,9 +44,9 @@
 //		...
 //	}
 //
-// Session data is persisted in the server and accessed via Session.Data.
-// (Storing session data only in clients, with a "stateless" back-end,
-// is not supported.)
+// Session data is accessed via Session.Data and is normally persisted in the
+// server. Alternatively, NewCookieStore makes a "stateless" Store, which
+// keeps session data only in clients, encrypted into cookies or tokens.
 //
 // If the only session data you require is a user id, you can ignore
 // Session.Data entirely. Just provide the user id as a byte slice to Store.NewSession
@@ -55,15 +55,21 @@
 //
 // If you require session data beyond just a user id,
 // it is recommended that you supply a data type and serializer,
-// using Store.NewSessData. (See qstest/benchmark_test.go
-// for examples.) If you do not, the default session data type, VarMap, is a
+// using Store.NewSessData. Package codec provides fast serializers for any
+// type. (See also qstest/benchmark_test.go.)
+// If you do not, the default session data type, VarMap, is a
 // map[interface{}]interface{} with gob serialization (which is very slow,
-// compared to the alternatives in qstest/benchmark_test.go).
+// compared to the alternatives). To avoid type assertions on Session.Data,
+// use a Typed view of the Store.
+//
+// Flash messages, typically displayed on the page following a redirect,
+// can be added to a session with AddFlash and read (and cleared) with
+// Flashes. They work with any session data type.
 //
 // If AuthType is TokenAuth, session references are transmitted to/from
 // the client as tokens, rather than cookies. Tokens are opaque,
-// base64-encoded strings, but they can be wrapped in structured formats,
-// like JWT, by user code.
+// base64-encoded strings, unless Store.JWT is set, in which case they are
+// signed JSON Web Tokens.
 // To send tokens to clients, user code must either set Store.SendToken
 // and Store.DeleteToken or call Session.Token to obtain tokens and manage
 // token communication explicitly. To receive tokens from clients, GetSession,
@@ -71,24 +77,100 @@
 // "Authorization: Bearer <token>". This can be overridden by supplying a
 // GetToken callback.
 //
+// Tokens such as those in email verification and password reset links
+// should only work once, so read them with Store.ConsumeTokenSession, which
+// deletes the session as it reads it.
+//
 // By default, cookies and tokens are encrypted and authenticated, using
 // AES-GCM. This can be overridden by supplying Encrypt and Decrypt functions.
 //
+// Store constructors take one or more keys. The first (primary) key is used
+// for encryption. Cookies and tokens carry a key id, derived from the key,
+// so decryption goes straight to the right key. To rotate keys without
+// logging anyone out:
+//
+//  1. Put the new key first, and keep the old one after it. GetSession
+//     re-issues cookies and tokens arriving under the old key under the
+//     new one (see Session.StaleKey).
+//  2. Once the longest session lifetime has passed, remove the old key.
+//
+// Cookies and tokens made before key ids were introduced are accepted, and
+// re-issued the same way, while Store.LegacyTokens is set, as it is by
+// default, so upgrading logs no one out. Clear it once those sessions have
+// been re-issued or expired.
+//
+// Session data is stored in the back-end as it is, unless
+// Store.EncryptAtRest is called, which makes the Store encrypt it with the
+// same keys, bound to each session's id, so database readers can't see it,
+// and records can't be moved between sessions. Records are re-encrypted
+// under the primary key when saved, so rotation works the same way.
+//
 // Multiple Stores can be used simultaneously. For example, one Store can be
 // used to implement login sessions via cookies, while another is used to
 // generate and track sign-up email verification tokens.
+// If they share a secret, give each one its own keys, with DeriveKeys, and
+// set each one's Purpose, so neither accepts the other's cookies or tokens:
+//
+//	st, err := qsess.NewMapStore(qsess.DeriveKeys("login", secret)...)
+//	st.Purpose = "login"
 //
 // Sessions are automatically deleted if not Saved within their expiration
 // times. This package does not refresh sessions (i.e. reset their
 // expiration times), except for the implicit refresh that happens whenever
 // Save is called. User code learns the remaining time-to-live whenever it
-// calls GetSession, and it can perform a refresh simply by calling Save.
+// calls GetSession, and it can perform a refresh simply by calling Save,
+// or, if it has not modified session data, by calling Refresh.
 // (See MwRequireSess in package qctx for an example of this.)
+// Because each Save extends a session's life, a regularly-used session
+// never expires, unless Store.AbsoluteMaxAgeSecs is set.
+//
+// By default, if two requests load the same session and both Save it, the
+// last writer wins. Set Store.VersionCheck to make Save return ErrConflict
+// instead, and use Store.Update to retry on conflict.
+//
+// To prevent session fixation, call Session.Regenerate (or RegenerateAs)
+// when a user logs in or changes privilege level. To bind sessions to
+// clients, so that a stolen cookie or token doesn't work from anywhere, set
+// Store.Fingerprint, and create sessions with NewClientSession. With
+// CookieAuth, protect handlers which change state against cross-site request
+// forgery, with CSRFToken and CheckCSRFToken (or qctx.MwCSRF).
 //
 // When a user changes a password, you can revoke all active sessions for
 // the user by calling DeleteByUserID. To use this optional capability,
 // you must supply a user id each time you create a session. User ids are
 // application-defined and are not interpreted or modified by session code.
 // They are persisted to the database and available for the life of
-// the session, by calling UserID.
+// the session, by calling UserID. ListByUserID returns a user's active
+// sessions, for example, to display a list of logged-in devices, any of
+// which can be revoked with DeleteSession.
+//
+// For "keep me logged in", rather than raising MaxAgeSecs, use package
+// qsremember.
+//
+// Functions which access the back-end have variants with a Ctx suffix
+// (GetSessionCtx, SaveCtx, DeleteCtx, etc.), which take a context.Context,
+// so that request cancellation and deadlines propagate into database calls.
+// GetSession uses the request's context by default.
+//
+// Errors returned by this package and its back-ends wrap sentinel errors,
+// which can be tested with errors.Is: ErrNoCredentials (no cookie or token),
+// ErrInvalidToken (a malformed or tampered cookie or token), ErrExpired,
+// ErrNotFound and ErrBackend (a database failure). For example, a request
+// which fails with ErrBackend deserves a 503, not a 401.
+//
+// Back-ends may implement optional interfaces (SessVersioner, SessToucher,
+// SessLister, SessConsumer, Iterable, SessImporter), which the features
+// above rely on. All the database back-ends in this module implement them,
+// except that qscql doesn't implement SessToucher, so refreshing a session
+// always rewrites it.
+// A Store's back-end can be wrapped (see Store.SetBackEnd) in a
+// CachingBackEnd, to avoid a database read on every request, or replaced by
+// a MigratingBackEnd, to move sessions from one back-end to another without
+// logging users out. The qsess-copy command copies all live sessions from
+// one database to another which accepts its session ids, and the
+// qsess-admin command lists, shows and revokes sessions in any back-end.
+//
+// To monitor a Store, set Store.Observer (package qsmetrics implements it).
+// To audit logins and logouts, or to release resources when sessions end,
+// set Store.Lifecycle.
 package qsess
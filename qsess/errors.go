@@ -0,0 +1,87 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import "errors"
+
+// Sentinel errors. Errors returned by Store and Session methods, and by the
+// back-ends in this module, wrap these, so callers can test for them with
+// errors.Is, for example, to tell a client which is not logged in (HTTP 401)
+// from a database outage (HTTP 503).
+var (
+	// ErrNoCredentials means the request carried no session cookie or token.
+	ErrNoCredentials = errors.New("qsess - no session cookie or token")
+
+	// ErrInvalidToken means a cookie, token or handle could not be
+	// decrypted or decoded (it is malformed, tampered with, or was made
+	// with a key which is no longer in use).
+	ErrInvalidToken = errors.New("qsess - invalid session cookie or token")
+
+	// ErrExpired means the session has expired. Back-ends which delete
+	// expired sessions promptly may report ErrNotFound instead. Back-ends'
+	// Get functions may return the expired session's data and user id
+	// along with it, so it can be reported to Store.Lifecycle.
+	ErrExpired = errors.New("qsess - session has expired")
+
+	// ErrNotFound means the back-end has no record of the session
+	// (for example, it has been deleted).
+	ErrNotFound = errors.New("qsess - session not found")
+
+	// ErrBackend means the back-end failed (for example, the database is
+	// unreachable, or the context was canceled). The original error can be
+	// retrieved with errors.Unwrap or errors.As.
+	ErrBackend = errors.New("qsess - back-end failure")
+
+	// ErrConflict is returned by Save, when version checking is in effect
+	// and the session has been saved by someone else since it was read.
+	ErrConflict = errors.New("qsess - session was modified concurrently")
+
+	// ErrFingerprintMismatch means the client's fingerprint does not match
+	// the one recorded in the session (see Store.Fingerprint).
+	ErrFingerprintMismatch = errors.New("qsess - client fingerprint does not match session")
+
+	// ErrNotSupported is returned when an operation requires an optional
+	// back-end capability which the Store's back-end does not have.
+	ErrNotSupported = errors.New("qsess - operation not supported by back-end")
+)
+
+// sentinelErr attaches a sentinel to an error, so errors.Is matches both
+// the sentinel and anything in the error's own chain.
+type sentinelErr struct {
+	sentinel error
+	err      error
+}
+
+func withSentinel(sentinel error, err error) error {
+	if err == nil {
+		return sentinel
+	}
+	return sentinelErr{sentinel, err}
+}
+
+func (e sentinelErr) Error() string {
+	return e.err.Error()
+}
+
+func (e sentinelErr) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e sentinelErr) Unwrap() error {
+	return e.err
+}
+
+// backEndErr classifies an error returned by a back-end: errors which
+// already match a sentinel are returned as is, anything else is an ErrBackend.
+func backEndErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, sentinel := range []error{ErrNotFound, ErrExpired, ErrConflict, ErrNotSupported, ErrBackend} {
+		if errors.Is(err, sentinel) {
+			return err
+		}
+	}
+	return withSentinel(ErrBackend, err)
+}
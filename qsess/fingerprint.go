@@ -0,0 +1,138 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"crypto/sha256"
+	"net"
+	"net/http"
+)
+
+// FingerprintFunc computes a fingerprint of the client making a request, to
+// bind sessions to clients (see Store.Fingerprint). It should return the
+// same value for every request from a legitimate client, and preferably a
+// different one for requests from elsewhere. Fingerprints are hashed before
+// being stored.
+type FingerprintFunc func(r *http.Request) []byte
+
+// FingerprintUserAgent fingerprints clients by User-Agent.
+func FingerprintUserAgent(r *http.Request) []byte {
+	return []byte(r.UserAgent())
+}
+
+// FingerprintIPPrefix returns a FingerprintFunc which fingerprints clients
+// by the first v4Bits bits of IPv4 addresses, or v6Bits of IPv6 addresses,
+// for example, 24 and 64. Clients whose addresses change often (mobile
+// clients, for example) may be rejected, so prefixes should not be too long.
+// It uses http.Request.RemoteAddr, so, behind a proxy, write your own.
+func FingerprintIPPrefix(v4Bits int, v6Bits int) FingerprintFunc {
+	return func(r *http.Request) []byte {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return []byte(host)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(v4Bits, 32))
+		}
+		return ip.Mask(net.CIDRMask(v6Bits, 128))
+	}
+}
+
+// FingerprintTLSClientCert fingerprints clients by the SHA-256 hash of their
+// TLS client certificate, if any.
+func FingerprintTLSClientCert(r *http.Request) []byte {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return sum[:]
+}
+
+// CombineFingerprints returns a FingerprintFunc which combines several.
+func CombineFingerprints(fns ...FingerprintFunc) FingerprintFunc {
+	return func(r *http.Request) []byte {
+		var b []byte
+		for _, fn := range fns {
+			fp := fn(r)
+			b = appendUvarint(b, uint64(len(fp)))
+			b = append(b, fp...)
+		}
+		return b
+	}
+}
+
+// FingerprintAction is returned by Store.FingerprintMismatch, to say what
+// GetSession should do with a request whose fingerprint doesn't match its
+// session's.
+type FingerprintAction int
+
+const (
+	// FingerprintReject makes GetSession fail with ErrFingerprintMismatch.
+	FingerprintReject FingerprintAction = iota
+	// FingerprintReauth makes GetSession return the session, with
+	// ReauthRequired true.
+	FingerprintReauth
+	// FingerprintLogOnly makes GetSession return the session as usual,
+	// on the assumption that the hook has logged the mismatch.
+	FingerprintLogOnly
+)
+
+// fingerprintSize is the size of stored fingerprint hashes.
+const fingerprintSize = 16
+
+func (st *Store) fingerprint(r *http.Request) string {
+	sum := sha256.Sum256(st.Fingerprint(r))
+	return string(sum[:fingerprintSize])
+}
+
+// BindFingerprint binds the session to the client making r, by recording
+// its fingerprint, to be persisted at the next Save. NewClientSession calls
+// it; call it when a user re-authenticates, if ReauthRequired is true, or
+// logs in to a session made by NewSession. It does nothing if
+// Store.Fingerprint is not set.
+//
+// GetSession treats sessions with no recorded fingerprint (such as those
+// saved before Store.Fingerprint was set) as mismatches, so a stolen,
+// unbound session isn't bound to whoever presents it first.
+func (s *Session) BindFingerprint(r *http.Request) {
+	if s.store.Fingerprint == nil {
+		return
+	}
+	s.meta.fingerprint = s.store.fingerprint(r)
+	s.reauth = false
+}
+
+// ReauthRequired reports whether GetSession found that the client's
+// fingerprint doesn't match the session's, and Store.FingerprintMismatch
+// returned FingerprintReauth. The user should be asked to re-authenticate,
+// after which BindFingerprint should be called, and the session saved.
+func (s *Session) ReauthRequired() bool {
+	return s.reauth
+}
+
+// checkFingerprint compares the fingerprint of the client making r with
+// the one recorded in the session, and applies Store.FingerprintMismatch.
+func (s *Session) checkFingerprint(r *http.Request) error {
+	st := s.store
+	if s.meta.fingerprint != "" && s.meta.fingerprint == st.fingerprint(r) {
+		return nil
+	}
+
+	action := FingerprintReject
+	if st.FingerprintMismatch != nil {
+		action = st.FingerprintMismatch(s, r)
+	}
+	switch action {
+	case FingerprintReauth:
+		s.reauth = true
+	case FingerprintLogOnly:
+	default:
+		return qsErr{"GetSession - client fingerprint does not match session", ErrFingerprintMismatch}
+	}
+	return nil
+}
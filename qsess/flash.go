@@ -0,0 +1,55 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import "encoding/binary"
+
+// Flash is a one-time message, stored in a session until it is read,
+// typically to be displayed on the page following a redirect.
+type Flash struct {
+	Kind string // application-defined, for example, "info" or "error"
+	Msg  string
+}
+
+// AddFlash adds a flash message to the session. Like any other change to
+// a session, it is persisted by the next Save.
+//
+// Flash messages are stored with session metadata, not in Data, so they
+// work with any SessData implementation.
+func (s *Session) AddFlash(kind string, msg string) {
+	b := []byte(s.meta.flashes)
+	b = appendUvarint(b, uint64(len(kind)))
+	b = append(b, kind...)
+	b = appendUvarint(b, uint64(len(msg)))
+	b = append(b, msg...)
+	s.meta.flashes = string(b)
+}
+
+// Flashes returns the session's flash messages, in the order in which they
+// were added, and removes them from the session. Call Save afterward, or
+// they will be returned again by the next request.
+func (s *Session) Flashes() []Flash {
+	var flashes []Flash
+	b := s.meta.flashes
+	for len(b) > 0 {
+		var kind, msg string
+		kind, b = nextFlashField(b)
+		msg, b = nextFlashField(b)
+		flashes = append(flashes, Flash{kind, msg})
+	}
+	s.meta.flashes = ""
+	return flashes
+}
+
+// nextFlashField splits a length-prefixed string from the front of b.
+// Malformed input yields whatever can be salvaged, then an empty remainder.
+func nextFlashField(b string) (string, string) {
+	var buf [binary.MaxVarintLen64]byte
+	n := copy(buf[:], b)
+	size, n := binary.Uvarint(buf[:n])
+	if n <= 0 || size > uint64(len(b)-n) {
+		return "", ""
+	}
+	return b[n : n+int(size)], b[n+int(size):]
+}
@@ -0,0 +1,177 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// Package backends opens qsess back-ends described by strings, for the
+// qsess command-line tools and qsadmin.
+//
+// A back-end is described by its type, a colon, its address and, optionally,
+// a question mark and options, in URL query syntax. Options which are not
+// listed here are passed on to the database driver.
+//
+//	goleveldb:<directory>[?prefix=<hex>]
+//	postgresql:<pgx connection url>[?table=session]
+//	mysql:<go-sql-driver dsn>[?table=session&datacol=<column definition>&uidcol=<column definition>]
+//	cassandra:<host>[,<host>...]/<keyspace>[?table=session&proto=3&consistency=quorum&uidindex=true&uidtoclient=true]
+//
+// The options have the same meanings as the arguments of the back-ends'
+// constructors (see, for example, qsldb.NewGldbStore).
+package backends
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/qscql"
+	"github.com/gkong/go-qweb/qsess/qsldb"
+	"github.com/gkong/go-qweb/qsess/qsmy"
+	"github.com/gkong/go-qweb/qsess/qspgx"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/gocql/gocql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Open opens the back-end described by spec, and returns a Store using it,
+// and a function which closes it. If no cipherkeys are given, the Store has
+// a random key, which is enough for working with back-ends directly.
+func Open(spec string, cipherkeys ...[]byte) (*qsess.Store, func(), error) {
+	typ, addr, opts, err := parse(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cipherkeys) == 0 {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, nil, err
+		}
+		cipherkeys = [][]byte{key}
+	}
+
+	var st *qsess.Store
+	var closeDB func()
+	switch typ {
+	case "goleveldb":
+		prefix, err := hex.DecodeString(opts.take("prefix", ""))
+		if err != nil {
+			return nil, nil, errors.New("backends.Open - bad goleveldb prefix - " + err.Error())
+		}
+		db, err := leveldb.OpenFile(addr, nil)
+		if err != nil {
+			return nil, nil, errors.New("backends.Open - leveldb.OpenFile failed - " + err.Error())
+		}
+		closeDB = func() { db.Close() }
+		st, err = qsldb.NewGldbStore(db, prefix, nil, cipherkeys...)
+		if err != nil {
+			closeDB()
+			return nil, nil, err
+		}
+
+	case "postgresql":
+		table := opts.take("table", "session")
+		pdb, err := pgxpool.New(context.Background(), opts.join(addr))
+		if err != nil {
+			return nil, nil, errors.New("backends.Open - pgxpool.New failed - " + err.Error())
+		}
+		closeDB = pdb.Close
+		st, err = qspgx.NewPgxStore(pdb, table, nil, cipherkeys...)
+		if err != nil {
+			closeDB()
+			return nil, nil, err
+		}
+
+	case "mysql":
+		table := opts.take("table", "session")
+		dataCol := opts.take("datacol", "VARBINARY(500) NOT NULL")
+		uidCol := opts.take("uidcol", "VARBINARY(32) NULL")
+		sdb, err := sql.Open("mysql", opts.join(addr))
+		if err != nil {
+			return nil, nil, errors.New("backends.Open - sql.Open failed - " + err.Error())
+		}
+		closeDB = func() { sdb.Close() }
+		st, err = qsmy.NewMysqlStore(sdb, table, dataCol, uidCol, cipherkeys...)
+		if err != nil {
+			closeDB()
+			return nil, nil, err
+		}
+
+	case "cassandra":
+		slash := strings.LastIndex(addr, "/")
+		if slash < 0 {
+			return nil, nil, errors.New("backends.Open - cassandra address must be <hosts>/<keyspace>")
+		}
+		cluster := gocql.NewCluster(strings.Split(addr[:slash], ",")...)
+		cluster.Keyspace = addr[slash+1:]
+		if cluster.ProtoVersion, err = strconv.Atoi(opts.take("proto", "3")); err != nil {
+			return nil, nil, errors.New("backends.Open - bad cassandra proto - " + err.Error())
+		}
+		cluster.Consistency = gocql.ParseConsistency(opts.take("consistency", "quorum"))
+		table := opts.take("table", "session")
+		uidIndex := opts.take("uidindex", "") == "true"
+		uidToClient := opts.take("uidtoclient", "") == "true"
+		cdb, err := cluster.CreateSession()
+		if err != nil {
+			return nil, nil, errors.New("backends.Open - gocql CreateSession failed - " + err.Error())
+		}
+		closeDB = cdb.Close
+		st, err = qscql.NewCqlStore(cdb, table, uidIndex, uidToClient, cipherkeys...)
+		if err != nil {
+			closeDB()
+			return nil, nil, err
+		}
+
+	default:
+		return nil, nil, errors.New("backends.Open - unknown back-end type " + typ)
+	}
+
+	return st, func() {
+		if st.PruneKill != nil {
+			st.PruneKill <- 0
+		}
+		closeDB()
+	}, nil
+}
+
+type options struct {
+	url.Values
+}
+
+// take removes an option, returning its value, or def if it's missing.
+func (o options) take(name string, def string) string {
+	v, ok := o.Values[name]
+	if !ok || len(v) == 0 {
+		return def
+	}
+	delete(o.Values, name)
+	return v[0]
+}
+
+// join returns addr, with the options which haven't been taken.
+func (o options) join(addr string) string {
+	if len(o.Values) == 0 {
+		return addr
+	}
+	return addr + "?" + o.Encode()
+}
+
+func parse(spec string) (typ string, addr string, opts options, err error) {
+	colon := strings.Index(spec, ":")
+	if colon < 0 {
+		return "", "", options{}, errors.New("backends.Open - " + spec + " - expected <type>:<address>")
+	}
+	typ, addr = strings.ToLower(spec[:colon]), spec[colon+1:]
+	opts = options{url.Values{}}
+	if q := strings.LastIndex(addr, "?"); q >= 0 {
+		if opts.Values, err = url.ParseQuery(addr[q+1:]); err != nil {
+			return "", "", options{}, errors.New("backends.Open - bad options - " + err.Error())
+		}
+		addr = addr[:q]
+	}
+	return typ, addr, opts, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// JWTConfig makes a Store's tokens JSON Web Tokens (RFC 7519), so that
+// something other than qsess, for example, an API gateway, can check their
+// signatures and expiration times. Set Store.JWT to use it. It is intended
+// for TokenAuth; with CookieAuth, cookies are JWTs as well.
+//
+// Tokens carry the standard claims iat, exp and sub (the session's user id,
+// if it is valid UTF-8), plus iss and aud, if configured. The back-end
+// session reference is encrypted, as usual, in a private claim, sid.
+// Note that JWT claims are readable by anyone holding the token, so user ids
+// are exposed to clients.
+//
+// A valid signature and exp are necessary but not sufficient: GetSession
+// still looks up the session in the back-end, so deleted sessions are
+// rejected.
+type JWTConfig struct {
+	// Exactly one of HMACKey (for HS256) or EdDSAKey (for EdDSA, with
+	// Ed25519) must be set. With EdDSA, verifiers need only the public key,
+	// EdDSAKey.Public().
+	HMACKey  []byte
+	EdDSAKey ed25519.PrivateKey
+
+	// Issuer and Audience, if set, are put into tokens as the iss and aud
+	// claims, and tokens without matching claims are rejected.
+	Issuer   string
+	Audience string
+}
+
+// jwtAD is encryption additional data for sid claims, so that a sid cannot
+// be used as a plain token, and vice versa.
+var jwtAD = []byte("qsess-jwt-sid")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type jwtClaims struct {
+	Iss string `json:"iss,omitempty"`
+	Sub string `json:"sub,omitempty"`
+	Aud string `json:"aud,omitempty"`
+	Exp int64  `json:"exp"`
+	Iat int64  `json:"iat"`
+	Sid string `json:"sid"`
+}
+
+func (jc *JWTConfig) alg() (string, error) {
+	switch {
+	case len(jc.HMACKey) > 0 && jc.EdDSAKey == nil:
+		return "HS256", nil
+	case len(jc.EdDSAKey) == ed25519.PrivateKeySize && jc.HMACKey == nil:
+		return "EdDSA", nil
+	}
+	return "", qsErr{"JWT - must set exactly one of HMACKey or a valid EdDSAKey", nil}
+}
+
+func (jc *JWTConfig) sign(alg string, signingInput []byte) []byte {
+	if alg == "HS256" {
+		mac := hmac.New(sha256.New, jc.HMACKey)
+		mac.Write(signingInput)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(jc.EdDSAKey, signingInput)
+}
+
+func (jc *JWTConfig) verify(alg string, signingInput []byte, sig []byte) bool {
+	if alg == "HS256" {
+		return hmac.Equal(sig, jc.sign(alg, signingInput))
+	}
+	return ed25519.Verify(jc.EdDSAKey.Public().(ed25519.PublicKey), signingInput, sig)
+}
+
+// encodeJWT makes a JWT referring to a session, which expires in ttlSecs.
+func (st *Store) encodeJWT(sessID []byte, userID []byte, ttlSecs int) (string, error) {
+	jc := st.JWT
+	alg, err := jc.alg()
+	if err != nil {
+		return "", err
+	}
+	sid, err := st.encodeRef(sessID, userID, jwtAD)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	claims := jwtClaims{Iss: jc.Issuer, Aud: jc.Audience, Iat: now, Exp: now + int64(ttlSecs), Sid: sid}
+	if utf8.Valid(userID) {
+		claims.Sub = string(userID)
+	}
+	hdrJSON, err := json.Marshal(jwtHeader{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		return "", qsErr{"encodeJWT - marshal header", err}
+	}
+	claimsJSON, err := json.Marshal(&claims)
+	if err != nil {
+		return "", qsErr{"encodeJWT - marshal claims", err}
+	}
+
+	enc := base64.RawURLEncoding
+	var b bytes.Buffer
+	b.WriteString(enc.EncodeToString(hdrJSON))
+	b.WriteByte('.')
+	b.WriteString(enc.EncodeToString(claimsJSON))
+	sig := jc.sign(alg, b.Bytes())
+	b.WriteByte('.')
+	b.WriteString(enc.EncodeToString(sig))
+	return b.String(), nil
+}
+
+// decodeJWT is the inverse of encodeJWT.
+func (st *Store) decodeJWT(token string) (sessID []byte, userID []byte, primary bool, err error) {
+	jc := st.JWT
+	alg, err := jc.alg()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, false, qsErr{"decodeJWT - malformed token", nil}
+	}
+	enc := base64.RawURLEncoding
+	hdrJSON, err1 := enc.DecodeString(parts[0])
+	claimsJSON, err2 := enc.DecodeString(parts[1])
+	sig, err3 := enc.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, nil, false, qsErr{"decodeJWT - base64 decode failure", nil}
+	}
+
+	// only accept the configured algorithm, never one chosen by the token
+	// (in particular, never "none").
+	var hdr jwtHeader
+	if err := json.Unmarshal(hdrJSON, &hdr); err != nil || hdr.Alg != alg {
+		return nil, nil, false, qsErr{"decodeJWT - bad header or algorithm", nil}
+	}
+	if !jc.verify(alg, []byte(token[:len(parts[0])+1+len(parts[1])]), sig) {
+		return nil, nil, false, qsErr{"decodeJWT - bad signature", nil}
+	}
+
+	var claims jwtClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, nil, false, qsErr{"decodeJWT - bad claims", err}
+	}
+	if claims.Exp <= time.Now().Unix() {
+		return nil, nil, false, qsErr{"decodeJWT - token has expired", ErrExpired}
+	}
+	if claims.Iss != jc.Issuer || claims.Aud != jc.Audience {
+		return nil, nil, false, qsErr{"decodeJWT - wrong issuer or audience", nil}
+	}
+
+	return st.decodeRef(claims.Sid, jwtAD)
+}
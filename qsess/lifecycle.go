@@ -0,0 +1,85 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"bytes"
+	"time"
+)
+
+// LifecycleType identifies the kind of event reported to Store.Lifecycle.
+type LifecycleType string
+
+const (
+	LifecycleCreated LifecycleType = "created" // a new session was saved for the first time (including by Regenerate)
+	LifecycleSaved   LifecycleType = "saved"   // an existing session was saved, or its expiration time extended
+	LifecycleDeleted LifecycleType = "deleted" // a session was deleted, by Session.Delete, Store.DeleteSession or Store.ConsumeTokenSession
+	LifecycleRevoked LifecycleType = "revoked" // all of a user's sessions were deleted, by Session.DeleteByUserID
+	LifecycleExpired LifecycleType = "expired" // an expired session was found by Get, or deleted by a pruner
+)
+
+// LifecycleEvent describes a change in a session's life, as reported to
+// Store.Lifecycle. The metadata fields are zero if unknown: for example,
+// Store.DeleteSession only knows them if the session can still be read, and
+// the metadata of a LifecycleRevoked event is that of the session which
+// called DeleteByUserID, rather than of the sessions deleted.
+type LifecycleEvent struct {
+	Type      LifecycleType
+	UserID    []byte
+	Created   time.Time
+	LastSaved time.Time
+	ClientIP  string // recorded if Store.RecordClientInfo is true
+	UserAgent string
+}
+
+// lifecycle reports an event to the Store's Lifecycle callback, if any.
+func (st *Store) lifecycle(t LifecycleType, userID []byte, m sessMeta) {
+	if st.Lifecycle == nil {
+		return
+	}
+	st.Lifecycle(LifecycleEvent{
+		Type:      t,
+		UserID:    append([]byte(nil), userID...),
+		Created:   unixOrZero(m.created),
+		LastSaved: unixOrZero(m.saved),
+		ClientIP:  m.clientIP,
+		UserAgent: m.userAgent,
+	})
+}
+
+// recordMeta returns the metadata in a session record read directly from the
+// Store's back-end, unsealing it if necessary (see EncryptAtRest). It returns
+// zero metadata if the record can't be read.
+func (st *Store) recordMeta(sessID []byte, data []byte) sessMeta {
+	if bytes.HasPrefix(data, sealMagic) {
+		for be := st.backEnd; be != nil; {
+			if s, ok := be.(*sealedBackEnd); ok {
+				data, _ = s.open(sessID, data)
+				break
+			}
+			w, ok := be.(SessBackEndWrapper)
+			if !ok {
+				break
+			}
+			be = w.Unwrap()
+		}
+	}
+	m, _, err := unwrapMeta(data)
+	if err != nil {
+		return sessMeta{}
+	}
+	return m
+}
+
+// ReportExpired reports an expired session, which a back-end has deleted
+// (for example, in a pruner pass), to the Store's Lifecycle callback, if any.
+// data is the session's record, as given to the back-end's Save; it may be
+// nil if unknown. Back-ends needn't call it from Get, when they return
+// ErrExpired along with the session's user id and record.
+// It is exported only for use by back-ends.
+func (st *Store) ReportExpired(sessID []byte, userID []byte, data []byte) {
+	if st.Lifecycle != nil {
+		st.lifecycle(LifecycleExpired, userID, st.recordMeta(sessID, data))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// handleAD is encryption additional data for session handles, so that a
+// handle cannot be used as a cookie or token, and vice versa.
+var handleAD = []byte("qsess-handle")
+
+// SessInfo describes one of a user's active sessions, as returned by
+// ListByUserID, for example, to display a list of logged-in devices.
+type SessInfo struct {
+	// Handle is an opaque, encrypted reference to the session, which can be
+	// passed to DeleteSession. It cannot be used to access the session.
+	Handle string
+
+	// Created and LastSaved are zero if unknown (for sessions saved by
+	// older versions of qsess).
+	Created        time.Time
+	LastSaved      time.Time
+	TimeToLiveSecs int
+
+	// ClientIP and UserAgent are empty, unless client information was
+	// recorded (see Session.SetClient and Store.RecordClientInfo).
+	ClientIP  string
+	UserAgent string
+}
+
+// ListByUserID returns information about all active sessions for a user id.
+// It requires a back-end which implements SessLister, otherwise it returns
+// ErrNotSupported.
+func (st *Store) ListByUserID(userID []byte) ([]SessInfo, error) {
+	return st.ListByUserIDCtx(context.Background(), userID)
+}
+
+// ListByUserIDCtx is like ListByUserID, with a context for back-end calls.
+func (st *Store) ListByUserIDCtx(ctx context.Context, userID []byte) ([]SessInfo, error) {
+	lb, ok := lister(st.backEnd)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	start := time.Now()
+	entries, err := lb.ListByUserIDCtx(ctx, userID)
+	st.observe(OpList, start, 0, err)
+	if err != nil {
+		return nil, qsErr{"ListByUserID - back-end - ", backEndErr(err)}
+	}
+
+	infos := make([]SessInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.TimeToLiveSecs <= 0 {
+			continue
+		}
+		meta, _, err := unwrapMeta(e.Data)
+		if err != nil {
+			continue
+		}
+		handle, err := st.encodeRef(e.SessID, userID, handleAD)
+		if err != nil {
+			return nil, qsErr{"ListByUserID - handle encode failed", err}
+		}
+		infos = append(infos, SessInfo{
+			Handle:         handle,
+			Created:        unixOrZero(meta.created),
+			LastSaved:      unixOrZero(meta.saved),
+			TimeToLiveSecs: e.TimeToLiveSecs,
+			ClientIP:       meta.clientIP,
+			UserAgent:      meta.userAgent,
+		})
+	}
+	return infos, nil
+}
+
+// DeleteSession deletes the session referred to by a handle obtained from
+// ListByUserID (for example, to log out a single device).
+// It only deletes the database record; the session's cookie or token
+// becomes useless, but remains in the client.
+func (st *Store) DeleteSession(handle string) error {
+	return st.DeleteSessionCtx(context.Background(), handle)
+}
+
+// DeleteSessionCtx is like DeleteSession, with a context for back-end calls.
+func (st *Store) DeleteSessionCtx(ctx context.Context, handle string) error {
+	sessID, userID, _, err := st.decodeRef(handle, handleAD)
+	if err != nil {
+		return qsErr{"DeleteSession - bad handle", withSentinel(ErrInvalidToken, err)}
+	}
+	var meta sessMeta
+	if st.Lifecycle != nil {
+		// read the session first, for its user id and metadata
+		if data, uid, _, _, _, err := st.backEnd.GetCtx(ctx, sessID, userID); err == nil {
+			userID, meta = uid, st.recordMeta(sessID, data)
+		}
+	}
+	if err := st.deleteBackEnd(ctx, sessID, userID); err != nil {
+		return qsErr{"DeleteSession - back-end - ", backEndErr(err)}
+	}
+	st.lifecycle(LifecycleDeleted, userID, meta)
+	return nil
+}
+
+// MatchesHandle reports whether a handle obtained from ListByUserID refers
+// to this session, so callers can identify the current session in a list.
+// (Handles are encrypted with random nonces, so they cannot be compared
+// directly.)
+func (s *Session) MatchesHandle(handle string) bool {
+	sessID, _, _, err := s.store.decodeRef(handle, handleAD)
+	return err == nil && s.sessID != nil && bytes.Equal(sessID, s.sessID)
+}
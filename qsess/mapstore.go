@@ -9,6 +9,7 @@
 package qsess
 
 import (
+	"context"
 	"encoding/binary"
 	"sync"
 	"time"
@@ -20,9 +21,10 @@ type mapSess struct {
 	expireTime     int64
 	maxAgeSecs     int
 	minRefreshSecs int
+	version        int64
 }
 
-// type mapStore holds per-store information and implements SessBackEnd.
+// type mapStore holds per-store information and implements SessBackEndCtx.
 type mapStore struct {
 	sync.RWMutex
 
@@ -45,8 +47,8 @@ func (m *mapStore) uindexAdd(userID string, sessID uint32) {
 // with no persistence.
 //
 // cipherkeys are one or more 32-byte encryption keys, to be used with
-// AES-GCM. For encryption, only the first key is used;
-// for decryption all keys are tried (allowing key rotation).
+// AES-GCM. For encryption, only the first key is used; for decryption,
+// the key is identified by the cookie or token (allowing key rotation).
 //
 // Additional configuration options can be set by manipulating fields in the
 // returned qsess.Store.
@@ -58,7 +60,7 @@ func NewMapStore(cipherkeys ...[]byte) (*Store, error) {
 		make(map[string]map[uint32]struct{}),
 	}
 
-	st, err := NewStore(ms, false, cipherkeys...)
+	st, err := NewStoreCtx(ms, false, cipherkeys...)
 	if err != nil {
 		return nil, qsErr{"NewMapStore - NewStore - ", err}
 	}
@@ -66,30 +68,50 @@ func NewMapStore(cipherkeys ...[]byte) (*Store, error) {
 	return st, nil
 }
 
-func (m *mapStore) Get(sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, error) {
+func (m *mapStore) GetCtx(ctx context.Context, sessIDbytes []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	data, userID, ttl, maxAge, minRefresh, _, err := m.GetVersionCtx(ctx, sessIDbytes, uID)
+	return data, userID, ttl, maxAge, minRefresh, err
+}
+
+func (m *mapStore) GetVersionCtx(ctx context.Context, sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, int64, error) {
 	m.RLock()
-	defer m.RUnlock()
 
 	sessID := bytesToID(sessIDbytes)
 	s, ok := m.sess[sessID]
 	if !ok {
-		return []byte{}, []byte{}, 0, 0, 0, qsErr{"mapStore.Get - id not found", nil}
+		m.RUnlock()
+		return []byte{}, []byte{}, 0, 0, 0, 0, qsErr{"mapStore.Get - id not found", ErrNotFound}
 	}
 	ttl := s.expireTime - time.Now().Unix()
+	m.RUnlock()
+
 	if ttl <= 0 {
-		delete(m.uindex[s.userID], sessID)
-		delete(m.sess, sessID)
-		return []byte{}, []byte{}, 0, 0, 0, qsErr{"mapStore.Get - key not found", nil}
+		// deletion needs the write lock; the session may have been saved
+		// again in the meantime, so check again.
+		m.Lock()
+		if s, ok := m.sess[sessID]; ok && s.expireTime <= time.Now().Unix() {
+			delete(m.uindex[s.userID], sessID)
+			delete(m.sess, sessID)
+		}
+		m.Unlock()
+		// return the record with the error, for lifecycle events
+		return s.data, []byte(s.userID), 0, 0, 0, 0, qsErr{"mapStore.Get - session has expired", ErrExpired}
 	}
 
-	return s.data, []byte(s.userID), int(ttl), s.maxAgeSecs, s.minRefreshSecs, nil
+	return s.data, []byte(s.userID), int(ttl), s.maxAgeSecs, s.minRefreshSecs, s.version, nil
 }
 
-func (m *mapStore) Save(sessIDbytes *[]byte, data []byte, userIDbytes []byte, maxAgeSecs int, minRefreshSecs int) error {
+func (m *mapStore) SaveCtx(ctx context.Context, sessIDbytes *[]byte, data []byte, userIDbytes []byte, maxAgeSecs int, minRefreshSecs int) error {
+	version := int64(-1)
+	return m.SaveVersionCtx(ctx, sessIDbytes, data, userIDbytes, maxAgeSecs, minRefreshSecs, &version)
+}
+
+func (m *mapStore) SaveVersionCtx(ctx context.Context, sessIDbytes *[]byte, data []byte, userIDbytes []byte, maxAgeSecs int, minRefreshSecs int, version *int64) error {
 	m.Lock()
 	defer m.Unlock()
 
 	var sessID uint32
+	var oldVersion int64
 	if *sessIDbytes == nil {
 		// this is the first Save of a new session; generate a new key.
 		sessID = m.nextID
@@ -99,9 +121,14 @@ func (m *mapStore) Save(sessIDbytes *[]byte, data []byte, userIDbytes []byte, ma
 	} else {
 		sessID = bytesToID(*sessIDbytes)
 		// see if session exists; could be gone via expiration or DeleteByUserId
-		if _, ok := m.sess[sessID]; !ok {
-			return qsErr{"mapStore.Save - id not found", nil}
+		old, ok := m.sess[sessID]
+		if !ok {
+			return qsErr{"mapStore.Save - id not found", ErrNotFound}
+		}
+		if *version >= 0 && *version != old.version {
+			return ErrConflict
 		}
+		oldVersion = old.version
 	}
 	userID := string(userIDbytes)
 	m.sess[sessID] = mapSess{
@@ -110,12 +137,28 @@ func (m *mapStore) Save(sessIDbytes *[]byte, data []byte, userIDbytes []byte, ma
 		time.Now().Add(time.Duration(maxAgeSecs) * time.Second).Unix(),
 		maxAgeSecs,
 		minRefreshSecs,
+		oldVersion + 1,
 	}
 	m.uindexAdd(userID, sessID)
+	*version = oldVersion + 1
+	return nil
+}
+
+func (m *mapStore) TouchCtx(ctx context.Context, sessIDbytes []byte, uidNOTUSED []byte, maxAgeSecs int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	sessID := bytesToID(sessIDbytes)
+	s, ok := m.sess[sessID]
+	if !ok {
+		return qsErr{"mapStore.Touch - id not found", ErrNotFound}
+	}
+	s.expireTime = time.Now().Add(time.Duration(maxAgeSecs) * time.Second).Unix()
+	m.sess[sessID] = s
 	return nil
 }
 
-func (m *mapStore) Delete(sessIDbytes []byte, uidNOTUSED []byte) error {
+func (m *mapStore) DeleteCtx(ctx context.Context, sessIDbytes []byte, uidNOTUSED []byte) error {
 	m.Lock()
 	defer m.Unlock()
 
@@ -125,7 +168,28 @@ func (m *mapStore) Delete(sessIDbytes []byte, uidNOTUSED []byte) error {
 	return nil
 }
 
-func (m *mapStore) DeleteByUserID(userIDbytes []byte) error {
+// ConsumeCtx gets and deletes a session, holding the write lock throughout.
+func (m *mapStore) ConsumeCtx(ctx context.Context, sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, error) {
+	m.Lock()
+	sessID := bytesToID(sessIDbytes)
+	s, ok := m.sess[sessID]
+	if ok {
+		delete(m.uindex[s.userID], sessID)
+		delete(m.sess, sessID)
+	}
+	m.Unlock()
+
+	if !ok {
+		return []byte{}, []byte{}, 0, 0, 0, qsErr{"mapStore.Consume - id not found", ErrNotFound}
+	}
+	ttl := s.expireTime - time.Now().Unix()
+	if ttl <= 0 {
+		return s.data, []byte(s.userID), 0, 0, 0, qsErr{"mapStore.Consume - session has expired", ErrExpired}
+	}
+	return s.data, []byte(s.userID), int(ttl), s.maxAgeSecs, s.minRefreshSecs, nil
+}
+
+func (m *mapStore) DeleteByUserIDCtx(ctx context.Context, userIDbytes []byte) error {
 	m.Lock()
 	defer m.Unlock()
 
@@ -137,6 +201,89 @@ func (m *mapStore) DeleteByUserID(userIDbytes []byte) error {
 	return nil
 }
 
+func (m *mapStore) ListByUserIDCtx(ctx context.Context, userIDbytes []byte) ([]SessEntry, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	now := time.Now().Unix()
+	userID := string(userIDbytes)
+	entries := make([]SessEntry, 0, len(m.uindex[userID]))
+	for sessID := range m.uindex[userID] {
+		s, ok := m.sess[sessID]
+		if !ok || s.expireTime <= now {
+			continue
+		}
+		entries = append(entries, SessEntry{
+			SessID:         idToBytes(sessID),
+			UserID:         []byte(s.userID),
+			Data:           s.data,
+			TimeToLiveSecs: int(s.expireTime - now),
+			MaxAgeSecs:     s.maxAgeSecs,
+			MinRefreshSecs: s.minRefreshSecs,
+		})
+	}
+	return entries, nil
+}
+
+// IterateCtx copies the active sessions, then calls fn without holding the
+// lock, so fn may use the store.
+func (m *mapStore) IterateCtx(ctx context.Context, fn func(e SessEntry) error) error {
+	m.RLock()
+	now := time.Now().Unix()
+	entries := make([]SessEntry, 0, len(m.sess))
+	for sessID, s := range m.sess {
+		if s.expireTime <= now {
+			continue
+		}
+		entries = append(entries, SessEntry{
+			SessID:         idToBytes(sessID),
+			UserID:         []byte(s.userID),
+			Data:           s.data,
+			TimeToLiveSecs: int(s.expireTime - now),
+			MaxAgeSecs:     s.maxAgeSecs,
+			MinRefreshSecs: s.minRefreshSecs,
+		})
+	}
+	m.RUnlock()
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mapStore) ImportCtx(ctx context.Context, e SessEntry) error {
+	if len(e.SessID) != 4 {
+		return qsErr{"mapStore.Import - session id has the wrong size", nil}
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	sessID := bytesToID(e.SessID)
+	if old, ok := m.sess[sessID]; ok {
+		delete(m.uindex[old.userID], sessID)
+	}
+	userID := string(e.UserID)
+	m.sess[sessID] = mapSess{
+		e.Data,
+		userID,
+		time.Now().Add(time.Duration(e.TimeToLiveSecs) * time.Second).Unix(),
+		e.MaxAgeSecs,
+		e.MinRefreshSecs,
+		1,
+	}
+	m.uindexAdd(userID, sessID)
+	if sessID >= m.nextID {
+		m.nextID = sessID + 1
+	}
+	return nil
+}
+
 // serialize uint32, which we use to store a session id (database key).
 
 func idToBytes(id uint32) []byte {
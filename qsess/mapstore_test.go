@@ -45,3 +45,78 @@ func TestMapExpiration(t *testing.T) {
 	st := makeTestStore(t, false)
 	qstest.ExpirationTest(t, st)
 }
+
+func TestMapListByUserId(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.ListByUserIDTest(t, st)
+}
+
+func TestMapRegenerate(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.RegenerateTest(t, st)
+}
+
+func TestMapConflict(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.ConflictTest(t, st)
+}
+
+func TestMapAbsoluteExpiration(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.AbsoluteExpirationTest(t, st)
+}
+
+func TestMapRefresh(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.RefreshTest(t, st)
+}
+
+func TestMapSentinelErrors(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.SentinelErrorsTest(t, st)
+}
+
+func TestMapFlash(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.FlashTest(t, st)
+}
+
+func TestMapCSRF(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.CSRFTest(t, st)
+}
+
+func TestMapJWT(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.JWTTest(t, st)
+}
+
+func TestMapFingerprint(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.FingerprintTest(t, st)
+}
+
+func TestMapIterate(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.IterateTest(t, st)
+}
+
+func TestMapEncryptAtRest(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.EncryptAtRestTest(t, st)
+}
+
+func TestMapLifecycle(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.LifecycleTest(t, st, true, false)
+}
+
+func TestMapRemember(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.RememberTest(t, st)
+}
+
+func TestMapConsume(t *testing.T) {
+	st := makeTestStore(t, false)
+	qstest.ConsumeTest(t, st)
+}
@@ -0,0 +1,227 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// Session metadata is maintained by qsess on behalf of all back-ends,
+// by prepending it to the marshaled session data that is handed to
+// SessBackEnd.Save. Back-ends store it as part of the session data,
+// without interpreting it.
+//
+// Format: magic | uvarint size of fields | fields | marshaled session data
+// where each field is: tag byte | uvarint size | value
+//
+// Unknown tags are skipped, so new fields can be added without breaking
+// older records. Records written before metadata existed have no magic
+// prefix; they are treated as metadata-free session data.
+
+package qsess
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"time"
+)
+
+var metaMagic = []byte("\xffqsm")
+
+const (
+	metaTagCreated     = 1
+	metaTagSaved       = 2
+	metaTagClientIP    = 3
+	metaTagUserAgent   = 4
+	metaTagAbsMaxAge   = 5
+	metaTagMaxAge      = 6
+	metaTagFlashes     = 7
+	metaTagFingerprint = 8
+	// metaTagReseal is never persisted: EncryptAtRest adds it to records it
+	// reads which were not encrypted with the primary key (see atrest.go).
+	metaTagReseal = 9
+)
+
+// maxUserAgentLen limits the size of stored User-Agent strings, which are
+// supplied by clients.
+const maxUserAgentLen = 256
+
+type sessMeta struct {
+	created   int64 // unix seconds, zero if unknown
+	saved     int64 // unix seconds, zero if never saved
+	clientIP  string
+	userAgent string
+	// absMaxAge is Session.AbsoluteMaxAgeSecs. When it is set, back-ends
+	// may be given a reduced max age, so maxAge keeps Session.MaxAgeSecs.
+	absMaxAge int64
+	maxAge    int64
+	// flashes holds encoded flash messages (a string, not a slice,
+	// so sessMeta stays comparable; see flash.go).
+	flashes string
+	// fingerprint is a hash of the client fingerprint (see fingerprint.go).
+	fingerprint string
+	// reseal is true if the record must be saved in full, rather than
+	// touched, to re-encrypt it (see metaTagReseal). wrap ignores it.
+	reseal bool
+}
+
+// wrap prepends metadata to marshaled session data.
+func (m *sessMeta) wrap(data []byte) []byte {
+	var fields []byte
+	fields = appendMetaInt(fields, metaTagCreated, m.created)
+	fields = appendMetaInt(fields, metaTagSaved, m.saved)
+	if m.clientIP != "" {
+		fields = appendMetaField(fields, metaTagClientIP, []byte(m.clientIP))
+	}
+	if m.userAgent != "" {
+		fields = appendMetaField(fields, metaTagUserAgent, []byte(m.userAgent))
+	}
+	if m.absMaxAge > 0 {
+		fields = appendMetaInt(fields, metaTagAbsMaxAge, m.absMaxAge)
+		fields = appendMetaInt(fields, metaTagMaxAge, m.maxAge)
+	}
+	if m.flashes != "" {
+		fields = appendMetaField(fields, metaTagFlashes, []byte(m.flashes))
+	}
+	if m.fingerprint != "" {
+		fields = appendMetaField(fields, metaTagFingerprint, []byte(m.fingerprint))
+	}
+
+	b := make([]byte, 0, len(metaMagic)+binary.MaxVarintLen64+len(fields)+len(data))
+	b = append(b, metaMagic...)
+	b = appendUvarint(b, uint64(len(fields)))
+	b = append(b, fields...)
+	return append(b, data...)
+}
+
+// unwrapMeta splits data read from a back-end into metadata and
+// marshaled session data.
+func unwrapMeta(b []byte) (sessMeta, []byte, error) {
+	var m sessMeta
+
+	if !bytes.HasPrefix(b, metaMagic) {
+		return m, b, nil
+	}
+	b = b[len(metaMagic):]
+
+	size, n := binary.Uvarint(b)
+	if n <= 0 || size > uint64(len(b)-n) {
+		return m, nil, qsErr{"unwrapMeta - bad metadata size", nil}
+	}
+	fields, data := b[n:n+int(size)], b[n+int(size):]
+
+	for len(fields) > 0 {
+		tag := fields[0]
+		flen, n := binary.Uvarint(fields[1:])
+		if n <= 0 || flen > uint64(len(fields)-1-n) {
+			return m, nil, qsErr{"unwrapMeta - malformed field", nil}
+		}
+		val := fields[1+n : 1+n+int(flen)]
+		fields = fields[1+n+int(flen):]
+
+		switch tag {
+		case metaTagCreated:
+			m.created = metaInt(val)
+		case metaTagSaved:
+			m.saved = metaInt(val)
+		case metaTagClientIP:
+			m.clientIP = string(val)
+		case metaTagUserAgent:
+			m.userAgent = string(val)
+		case metaTagAbsMaxAge:
+			m.absMaxAge = metaInt(val)
+		case metaTagMaxAge:
+			m.maxAge = metaInt(val)
+		case metaTagFlashes:
+			m.flashes = string(val)
+		case metaTagFingerprint:
+			m.fingerprint = string(val)
+		case metaTagReseal:
+			m.reseal = true
+		}
+	}
+
+	return m, data, nil
+}
+
+// withMetaField returns a copy of b, data read from a back-end, with a
+// metadata field added, adding metadata to records which have none.
+// Malformed metadata is left for unwrapMeta to report.
+func withMetaField(b []byte, tag byte, val []byte) []byte {
+	fields, data := []byte(nil), b
+	if bytes.HasPrefix(b, metaMagic) {
+		rest := b[len(metaMagic):]
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || size > uint64(len(rest)-n) {
+			return b
+		}
+		fields, data = rest[n:n+int(size)], rest[n+int(size):]
+	}
+	fields = appendMetaField(append([]byte(nil), fields...), tag, val)
+
+	out := make([]byte, 0, len(metaMagic)+binary.MaxVarintLen64+len(fields)+len(data))
+	out = append(out, metaMagic...)
+	out = appendUvarint(out, uint64(len(fields)))
+	out = append(out, fields...)
+	return append(out, data...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendMetaField(b []byte, tag byte, val []byte) []byte {
+	b = append(b, tag)
+	b = appendUvarint(b, uint64(len(val)))
+	return append(b, val...)
+}
+
+func appendMetaInt(b []byte, tag byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return appendMetaField(b, tag, buf[:n])
+}
+
+func metaInt(val []byte) int64 {
+	v, n := binary.Varint(val)
+	if n <= 0 {
+		return 0
+	}
+	return v
+}
+
+func unixOrZero(secs int64) time.Time {
+	if secs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// SetClient records information about the client (IP address and
+// User-Agent) from r, to be persisted at the next Save and reported by
+// ListByUserID. If Store.RecordClientInfo is true, GetSession calls SetClient
+// automatically; for newly-created sessions, call it before Save.
+func (s *Session) SetClient(r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	s.meta.clientIP = ip
+
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLen {
+		ua = ua[:maxUserAgentLen]
+	}
+	s.meta.userAgent = ua
+}
+
+// Created returns the time at which the session was created, or the zero
+// time, if unknown (for sessions saved by older versions of qsess).
+func (s *Session) Created() time.Time {
+	return unixOrZero(s.meta.created)
+}
@@ -0,0 +1,311 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MigratingBackEnd moves sessions from one back-end to another, without
+// logging anyone out.
+//
+// Sessions are written to both back-ends, so the old one is kept up to
+// date, for as long as it might be needed. Sessions which are only in the
+// old back-end (those saved before the migration began) are read from it,
+// and copied to the new one, and their cookies or tokens re-issued, when
+// they're read (see SessMover). Deletes go to both back-ends.
+//
+// Since session ids are back-end-defined, and the two back-ends' ids may
+// look alike, sessions saved through a MigratingBackEnd have ids which are
+// marked as such, and combine their ids in both back-ends. So a migration
+// has two stages:
+//
+//  1. Use NewMigratingBackEnd(old, new), until the old back-end no longer
+//     needs to be kept up to date, and all sessions saved before it was
+//     deployed have expired.
+//  2. Use NewMigratingBackEnd(nil, new), which ignores the old back-end,
+//     and rejects unmarked ids, since they refer to the old back-end.
+//
+// Stage 2 can't end without logging users out (by changing the Store's keys
+// or Purpose, so that old cookies and tokens can't be decrypted), because
+// unmarked ids might refer to sessions in either back-end. But it costs
+// nothing more than a few bytes in each id.
+//
+// A client may present its old id again after its session has been moved
+// (concurrent requests sent before the new cookie arrived, or a token client
+// which never receives the re-issued token). The MigratingBackEnd remembers
+// where it moved each session, until the session would have expired, so it
+// is only copied once (concurrent reads of a session wait for one copy,
+// without holding up reads of other sessions). That memory is per MigratingBackEnd, so, with several
+// servers, a session may be copied once by each; the extra copies are never
+// read, and expire like any other session.
+//
+// Neither SessVersioner nor SessLister is supported, so Store.VersionCheck,
+// Store.Update and Store.ListByUserID can't be used during a migration.
+type MigratingBackEnd struct {
+	old SessBackEndCtx
+	new SessBackEndCtx
+
+	// moved maps the old back-end ids of moved sessions to their new ids,
+	// and moving maps those of sessions being copied to their copies.
+	movedMu   sync.Mutex
+	moved     map[string]movedSess
+	moving    map[string]*moveCall
+	nextPrune int
+}
+
+type movedSess struct {
+	id      []byte
+	expires int64 // unix seconds
+}
+
+// moveCall is a copy of a session in progress. Its id and err are set
+// before done is closed.
+type moveCall struct {
+	done chan struct{}
+	id   []byte
+	err  error
+}
+
+// NewMigratingBackEnd returns a MigratingBackEnd which moves sessions from
+// oldBE to newBE. If oldBE is nil, it only reads and writes newBE (see
+// MigratingBackEnd). To migrate a Store, replace its back-end with one:
+//
+//	st.SetBackEnd(qsess.NewMigratingBackEnd(oldStore.BackEndCtx(), newStore.BackEndCtx()))
+func NewMigratingBackEnd(oldBE SessBackEndCtx, newBE SessBackEndCtx) *MigratingBackEnd {
+	return &MigratingBackEnd{old: oldBE, new: newBE, moved: map[string]movedSess{}, moving: map[string]*moveCall{}}
+}
+
+// migID is the prefix of combined session ids, which are followed by a
+// uvarint length and the new back-end's id, then the old back-end's id
+// (which is empty if the session was saved in stage 2). Ids without it
+// belong to the old back-end. It is longer than the fixed-size ids of all
+// the back-ends in this repository, so none of them can be mistaken for it.
+var migID = []byte("\xffqsmig")
+
+func joinMigID(newID []byte, oldID []byte) []byte {
+	id := append([]byte(nil), migID...)
+	id = appendUvarint(id, uint64(len(newID)))
+	id = append(id, newID...)
+	return append(id, oldID...)
+}
+
+// splitMigID returns the ids of a session in the new and old back-ends.
+// If combined is false, id is an old back-end id.
+func splitMigID(id []byte) (newID []byte, oldID []byte, combined bool) {
+	if !bytes.HasPrefix(id, migID) {
+		return nil, nil, false
+	}
+	rest := id[len(migID):]
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || n > uint64(len(rest)-size) {
+		return nil, nil, false
+	}
+	rest = rest[size:]
+	return rest[:n], rest[n:], true
+}
+
+// ids returns the ids of a session in the new and old back-ends, either of
+// which may be nil, if the session isn't there (or, for the old back-end,
+// is being ignored).
+func (m *MigratingBackEnd) ids(id []byte) (newID []byte, oldID []byte) {
+	newID, oldID, combined := splitMigID(id)
+	switch {
+	case !combined:
+		oldID = id
+	case len(oldID) == 0:
+		oldID = nil
+	}
+	if m.old == nil {
+		oldID = nil
+	}
+	return newID, oldID
+}
+
+func (m *MigratingBackEnd) GetCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	newID, oldID := m.ids(sessID)
+	switch {
+	case newID != nil:
+		return m.new.GetCtx(ctx, newID, uID)
+	case oldID != nil:
+		return m.old.GetCtx(ctx, oldID, uID)
+	}
+	return nil, nil, 0, 0, 0, qsErr{"MigratingBackEnd.Get - old back-end id, after migration", ErrNotFound}
+}
+
+// MoveCtx copies a session which is only in the old back-end to the new one,
+// unless it has already done so.
+func (m *MigratingBackEnd) MoveCtx(ctx context.Context, sessID []byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) ([]byte, error) {
+	newID, oldID := m.ids(sessID)
+	if newID != nil || oldID == nil {
+		return nil, nil
+	}
+
+	key := string(oldID)
+	m.movedMu.Lock()
+	now := time.Now().Unix()
+	if ms, ok := m.moved[key]; ok && ms.expires > now {
+		ms.expires = now + int64(maxAgeSecs)
+		m.moved[key] = ms
+		m.movedMu.Unlock()
+		return ms.id, nil
+	}
+	if call, ok := m.moving[key]; ok {
+		// another read of the session is copying it; wait for its copy.
+		m.movedMu.Unlock()
+		select {
+		case <-call.done:
+			return call.id, call.err
+		case <-ctx.Done():
+			return nil, qsErr{"MigratingBackEnd.Move", ctx.Err()}
+		}
+	}
+	call := &moveCall{done: make(chan struct{})}
+	m.moving[key] = call
+	m.movedMu.Unlock()
+
+	// copy without holding movedMu, so reads of other sessions don't wait
+	// for this one's database write.
+	if err := m.new.SaveCtx(ctx, &newID, data, userID, maxAgeSecs, minRefreshSecs); err != nil {
+		call.err = qsErr{"MigratingBackEnd.Move - copy to new back-end failed", err}
+	} else {
+		call.id = joinMigID(newID, oldID)
+	}
+
+	m.movedMu.Lock()
+	delete(m.moving, key)
+	if call.err == nil {
+		m.remember(oldID, call.id, now+int64(maxAgeSecs), now)
+	}
+	m.movedMu.Unlock()
+	close(call.done)
+	return call.id, call.err
+}
+
+// remember records that the session at oldID has moved to id, first
+// forgetting expired moves, if there are many. It must be called with
+// movedMu held.
+func (m *MigratingBackEnd) remember(oldID []byte, id []byte, expires int64, now int64) {
+	if len(m.moved) >= m.nextPrune {
+		for k, ms := range m.moved {
+			if ms.expires <= now {
+				delete(m.moved, k)
+			}
+		}
+		m.nextPrune = 2*len(m.moved) + 1024
+	}
+	m.moved[string(oldID)] = movedSess{id, expires}
+}
+
+func (m *MigratingBackEnd) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	var newID, oldID []byte
+	if *sessID != nil {
+		newID, oldID = m.ids(*sessID)
+		if newID == nil && oldID == nil {
+			return qsErr{"MigratingBackEnd.Save - old back-end id, after migration", ErrNotFound}
+		}
+	}
+
+	// new first, so that a failure leaves the session where it was.
+	if err := m.new.SaveCtx(ctx, &newID, data, userID, maxAgeSecs, minRefreshSecs); err != nil {
+		return qsErr{"MigratingBackEnd.Save - new back-end - ", err}
+	}
+	if m.old == nil {
+		*sessID = joinMigID(newID, nil)
+		return nil
+	}
+	if err := m.old.SaveCtx(ctx, &oldID, data, userID, maxAgeSecs, minRefreshSecs); err != nil {
+		return qsErr{"MigratingBackEnd.Save - old back-end - ", err}
+	}
+	*sessID = joinMigID(newID, oldID)
+	return nil
+}
+
+// TouchCtx fails with ErrNotSupported unless both back-ends implement
+// SessToucher.
+func (m *MigratingBackEnd) TouchCtx(ctx context.Context, sessID []byte, uID []byte, maxAgeSecs int) error {
+	newID, oldID := m.ids(sessID)
+	if newID == nil && oldID == nil {
+		return qsErr{"MigratingBackEnd.Touch - old back-end id, after migration", ErrNotFound}
+	}
+	if newID != nil {
+		tb, ok := toucher(m.new)
+		if !ok {
+			return ErrNotSupported
+		}
+		if err := tb.TouchCtx(ctx, newID, uID, maxAgeSecs); err != nil {
+			return err
+		}
+	}
+	if oldID != nil {
+		tb, ok := toucher(m.old)
+		if !ok {
+			return ErrNotSupported
+		}
+		return tb.TouchCtx(ctx, oldID, uID, maxAgeSecs)
+	}
+	return nil
+}
+
+// DeleteCtx deletes the session from both back-ends, ignoring ErrNotFound
+// from either.
+func (m *MigratingBackEnd) DeleteCtx(ctx context.Context, sessID []byte, uID []byte) error {
+	newID, oldID := m.ids(sessID)
+	var newErr, oldErr error
+	if newID != nil {
+		newErr = m.new.DeleteCtx(ctx, newID, uID)
+	}
+	if oldID != nil {
+		oldErr = m.old.DeleteCtx(ctx, oldID, uID)
+	}
+	return m.firstErr("Delete", newErr, oldErr)
+}
+
+// ConsumeCtx consumes the session from the new back-end, and deletes it
+// from the old one, or, if it is only in the old back-end, consumes it from
+// there. It fails with ErrNotSupported if the back-end it consumes from
+// doesn't implement SessConsumer.
+func (m *MigratingBackEnd) ConsumeCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	newID, oldID := m.ids(sessID)
+	be, id := m.new, newID
+	if newID == nil {
+		if oldID == nil {
+			return nil, nil, 0, 0, 0, qsErr{"MigratingBackEnd.Consume - old back-end id, after migration", ErrNotFound}
+		}
+		be, id, oldID = m.old, oldID, nil
+	}
+	cb, ok := consumer(be)
+	if !ok {
+		return nil, nil, 0, 0, 0, ErrNotSupported
+	}
+	data, userID, ttl, maxAge, minRefresh, err := cb.ConsumeCtx(ctx, id, uID)
+	if oldID != nil {
+		m.old.DeleteCtx(ctx, oldID, uID)
+	}
+	return data, userID, ttl, maxAge, minRefresh, err
+}
+
+func (m *MigratingBackEnd) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
+	newErr := m.new.DeleteByUserIDCtx(ctx, userID)
+	var oldErr error
+	if m.old != nil {
+		oldErr = m.old.DeleteByUserIDCtx(ctx, userID)
+	}
+	return m.firstErr("DeleteByUserID", newErr, oldErr)
+}
+
+func (m *MigratingBackEnd) firstErr(op string, newErr error, oldErr error) error {
+	if newErr != nil && !errors.Is(newErr, ErrNotFound) {
+		return qsErr{"MigratingBackEnd." + op + " - new back-end - ", newErr}
+	}
+	if oldErr != nil && !errors.Is(oldErr, ErrNotFound) {
+		return qsErr{"MigratingBackEnd." + op + " - old back-end - ", oldErr}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// tests that do NOT see package internals
+
+package qsess_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/qstest"
+)
+
+// makeMigratingTestStore returns a Store which migrates sessions from one
+// map back-end to another, and the Stores of those back-ends.
+func makeMigratingTestStore(t *testing.T) (st *qsess.Store, oldSt *qsess.Store, newSt *qsess.Store) {
+	oldSt = makeTestStore(t, false)
+	newSt = makeTestStore(t, false)
+	st = makeTestStore(t, false)
+	st.SetBackEnd(qsess.NewMigratingBackEnd(oldSt.BackEndCtx(), newSt.BackEndCtx()))
+	return st, oldSt, newSt
+}
+
+func TestMigratingSanity(t *testing.T) {
+	st, _, _ := makeMigratingTestStore(t)
+	qstest.SanityTest(t, st)
+}
+
+func TestMigratingDeleteByUserId(t *testing.T) {
+	st, _, _ := makeMigratingTestStore(t)
+	qstest.DeleteByUserIDTest(t, st, true)
+}
+
+func TestMigratingExpiration(t *testing.T) {
+	st, _, _ := makeMigratingTestStore(t)
+	qstest.ExpirationTest(t, st)
+}
+
+func TestMigratingRegenerate(t *testing.T) {
+	st, _, _ := makeMigratingTestStore(t)
+	qstest.RegenerateTest(t, st)
+}
+
+func TestMigratingRefresh(t *testing.T) {
+	st, _, _ := makeMigratingTestStore(t)
+	qstest.RefreshTest(t, st)
+}
+
+func TestMigratingFlash(t *testing.T) {
+	st, _, _ := makeMigratingTestStore(t)
+	qstest.FlashTest(t, st)
+}
+
+func TestMigratingConsume(t *testing.T) {
+	st, _, _ := makeMigratingTestStore(t)
+	qstest.ConsumeTest(t, st)
+}
+
+// TestMigrate takes a session through all the stages of a migration.
+func TestMigrate(t *testing.T) {
+	st, oldSt, newSt := makeMigratingTestStore(t)
+	for _, s := range []*qsess.Store{st, oldSt, newSt} {
+		s.AuthType = qsess.TokenAuth
+	}
+
+	get := func(st *qsess.Store, token string, stale bool) (*qsess.Session, string) {
+		t.Helper()
+		sess, _, err := st.GetTokenSession(token)
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+		if sess.Data.(*qsess.VarMap).Vars["k"] != "v" {
+			t.Fatal("retrieved session data does not match saved session data")
+		}
+		if sess.StaleKey() != stale {
+			t.Fatalf("expected StaleKey %v, got %v", stale, sess.StaleKey())
+		}
+		token, _, err = sess.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+		return sess, token
+	}
+
+	// a session saved before the migration
+	sess := oldSt.NewSession([]byte("userid-migrate"))
+	sess.Data.(*qsess.VarMap).Vars["k"] = "v"
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	oldToken, _, _ := sess.Token()
+
+	// stage 1: it's copied forward, and its token re-issued.
+	_, token := get(st, oldToken, true)
+	_, token = get(st, token, false)
+	get(oldSt, oldToken, false)
+
+	// stage 2: the old back-end is ignored, and its ids rejected, even
+	// though the new back-end has a session with the same id.
+	st.SetBackEnd(qsess.NewMigratingBackEnd(nil, newSt.BackEndCtx()))
+	if _, _, err := st.GetTokenSession(oldToken); err == nil {
+		t.Fatal("an old back-end id was accepted in stage 2")
+	}
+	sess, token = get(st, token, false)
+	sess.Data.(*qsess.VarMap).Vars["k2"] = "v2"
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	sess, _ = get(st, token, false)
+	if sess.Data.(*qsess.VarMap).Vars["k2"] != "v2" {
+		t.Fatal("retrieved session data does not match saved session data")
+	}
+	get(oldSt, oldToken, false) // not written in stage 2
+
+	if err := sess.DeleteByUserID(httptest.NewRecorder()); err != nil {
+		t.Fatal("DeleteByUserID failed - " + err.Error())
+	}
+	if _, _, err := st.GetTokenSession(token); err == nil {
+		t.Fatal("GetTokenSession succeeded after DeleteByUserID")
+	}
+}
+
+// TestMigrateOnce checks that a session read repeatedly at its old id, by a
+// client which hasn't received its re-issued token, is only copied once.
+func TestMigrateOnce(t *testing.T) {
+	st, oldSt, newSt := makeMigratingTestStore(t)
+	for _, s := range []*qsess.Store{st, oldSt} {
+		s.AuthType = qsess.TokenAuth
+	}
+
+	userID := []byte("userid-migrate-once")
+	sess := oldSt.NewSession(userID)
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	oldToken, _, _ := sess.Token()
+
+	var tokens []string
+	for i := 0; i < 5; i++ {
+		sess, _, err := st.GetTokenSession(oldToken)
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+		if !sess.StaleKey() {
+			t.Fatal("session read at its old id is not stale")
+		}
+		token, _, _ := sess.Token()
+		tokens = append(tokens, token)
+	}
+	for _, token := range tokens {
+		if sess, _, err := st.GetTokenSession(token); err != nil || sess.StaleKey() {
+			t.Fatal("re-issued token does not refer to the moved session")
+		}
+	}
+	infos, err := newSt.ListByUserID(userID)
+	if err != nil {
+		t.Fatal("ListByUserID failed - " + err.Error())
+	}
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 copy of the session in the new back-end, found %d", len(infos))
+	}
+}
+
+// gatedBackEnd counts saves of a user's sessions, and holds them until gate
+// is closed, announcing each on entered.
+type gatedBackEnd struct {
+	qsess.SessBackEndCtx
+	userID  string
+	gate    chan struct{}
+	entered chan struct{}
+	mu      sync.Mutex
+	saves   int
+}
+
+func (g *gatedBackEnd) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	if string(userID) == g.userID {
+		g.mu.Lock()
+		g.saves++
+		g.mu.Unlock()
+		g.entered <- struct{}{}
+		<-g.gate
+	}
+	return g.SessBackEndCtx.SaveCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs)
+}
+
+// TestMigrateConcurrent checks that concurrent reads of a session in the old
+// back-end copy it once, and don't hold up reads of other sessions.
+func TestMigrateConcurrent(t *testing.T) {
+	oldSt := makeTestStore(t, false)
+	newSt := makeTestStore(t, false)
+	gated := &gatedBackEnd{
+		SessBackEndCtx: newSt.BackEndCtx(),
+		userID:         "userid-slow",
+		gate:           make(chan struct{}),
+		entered:        make(chan struct{}, 10),
+	}
+	st := makeTestStore(t, false)
+	st.SetBackEnd(qsess.NewMigratingBackEnd(oldSt.BackEndCtx(), gated))
+	for _, s := range []*qsess.Store{st, oldSt} {
+		s.AuthType = qsess.TokenAuth
+	}
+
+	save := func(userID string) string {
+		sess := oldSt.NewSession([]byte(userID))
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		token, _, _ := sess.Token()
+		return token
+	}
+	slowToken, fastToken := save("userid-slow"), save("userid-fast")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := st.GetTokenSession(slowToken)
+			errs <- err
+		}()
+	}
+	<-gated.entered
+
+	// the slow session's copy is held at the gate; others still move.
+	fast := make(chan error, 1)
+	go func() {
+		_, _, err := st.GetTokenSession(fastToken)
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading one session waited for another's copy")
+	}
+
+	close(gated.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+	}
+	if gated.saves != 1 {
+		t.Fatalf("expected the session to be copied once, copied %d times", gated.saves)
+	}
+}
+
+func TestMigratedSanity(t *testing.T) {
+	st := makeTestStore(t, false)
+	st.SetBackEnd(qsess.NewMigratingBackEnd(nil, st.BackEndCtx()))
+	qstest.SanityTest(t, st)
+}
+
+// TestMigratingDelete checks that deletes reach both back-ends.
+func TestMigratingDelete(t *testing.T) {
+	st, oldSt, _ := makeMigratingTestStore(t)
+	for _, s := range []*qsess.Store{st, oldSt} {
+		s.AuthType = qsess.TokenAuth
+	}
+
+	sess := oldSt.NewSession([]byte("userid-migrate-delete"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	oldToken, _, _ := sess.Token()
+
+	sess, _, err := st.GetTokenSession(oldToken)
+	if err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	token, _, _ := sess.Token()
+	if err := sess.Delete(httptest.NewRecorder()); err != nil {
+		t.Fatal("Delete failed - " + err.Error())
+	}
+	for _, tok := range []struct {
+		st    *qsess.Store
+		token string
+	}{{st, token}, {oldSt, oldToken}} {
+		if _, _, err := tok.st.GetTokenSession(tok.token); err == nil {
+			t.Fatal("GetTokenSession succeeded after Delete")
+		}
+	}
+}
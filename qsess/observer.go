@@ -0,0 +1,66 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import "time"
+
+// Op identifies the kind of operation reported to an Observer.
+type Op string
+
+const (
+	OpDecode         Op = "decode"            // decrypt and decode a cookie, token or handle
+	OpGet            Op = "get"               // back-end Get
+	OpSave           Op = "save"              // back-end Save
+	OpTouch          Op = "touch"             // back-end Touch
+	OpDelete         Op = "delete"            // back-end Delete
+	OpDeleteByUserID Op = "delete_by_user_id" // back-end DeleteByUserID
+	OpList           Op = "list"              // back-end ListByUserID
+	OpConsume        Op = "consume"           // back-end Consume (see Store.ConsumeTokenSession)
+	OpCreate         Op = "create"            // a new session was saved for the first time
+	OpExpire         Op = "expire"            // a session was found to have expired
+	OpPrune          Op = "prune"             // a back-end pruner pass (see Store.ObservePrune)
+)
+
+// Event describes an operation, as reported to an Observer.
+type Event struct {
+	Op       Op
+	Duration time.Duration // zero for OpCreate and OpExpire
+	Err      error         // nil if the operation succeeded
+	// Bytes is the size of the data read or written, if applicable:
+	// session records for OpGet and OpSave, cookies or tokens for OpDecode.
+	Bytes int
+	// Count is the number of sessions deleted, for OpPrune.
+	Count int
+}
+
+// Observer receives reports of Store and back-end operations, for metrics
+// and logging. Set Store.Observer to use one. Observe is called
+// synchronously, from the goroutine performing the operation, so it must be
+// fast and safe for concurrent use. See package qsmetrics for an
+// implementation.
+type Observer interface {
+	Observe(e Event)
+}
+
+func (st *Store) observe(op Op, start time.Time, bytes int, err error) {
+	if st.Observer != nil {
+		st.Observer.Observe(Event{Op: op, Duration: time.Since(start), Err: err, Bytes: bytes})
+	}
+}
+
+// observeEvent reports an event which has no duration.
+func (st *Store) observeEvent(op Op) {
+	if st.Observer != nil {
+		st.Observer.Observe(Event{Op: op})
+	}
+}
+
+// ObservePrune reports a back-end pruner pass, which took d and deleted
+// count expired sessions, to the Store's Observer, if any.
+// It is exported only for use by back-ends.
+func (st *Store) ObservePrune(count int, d time.Duration, err error) {
+	if st.Observer != nil {
+		st.Observer.Observe(Event{Op: OpPrune, Duration: d, Err: err, Count: count})
+	}
+}
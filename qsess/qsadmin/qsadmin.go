@@ -0,0 +1,482 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// Package qsadmin implements the qsess-admin command, which inspects and
+// manages sessions in any qsess back-end, for operations and support.
+//
+//	qsess-admin [flags] <command> [arguments]
+//
+//	count                  count active sessions
+//	list <user id>         list a user's sessions
+//	show <token>           show the session a token or cookie value refers to
+//	show-id <session id>   show a session, given its id (in hex)
+//	revoke <token>         delete the session a token or cookie value refers to
+//	revoke-id <session id> delete a session, given its id (in hex)
+//	revoke-user <user id>  delete all of a user's sessions
+//	prune                  delete expired sessions now
+//
+// The -db flag describes the back-end (see the qsess-copy command for the
+// syntax). Commands which take tokens need the Store's keys (the -keys flag
+// names a file of them, in hex, one per line, primary first) and Purpose, if
+// any. If the keys were made with qsess.DeriveKeys, give the master secrets,
+// with -derive. Back-ends which need user ids to find sessions also need
+// -user, when given session ids. If session data is encrypted (see
+// qsess.Store.EncryptAtRest), give -encrypted, with -keys. Output is
+// human-readable, or JSON, with -json.
+//
+// Session data is shown by a Decoder, chosen with -decoder. The built-in
+// decoders are varmap (the default, for qsess.VarMap), string and hex. To
+// show a custom session data type, build your own qsess-admin, which
+// registers a decoder for it:
+//
+//	func main() {
+//		qsadmin.RegisterDecoder("mydata", func(data []byte) (interface{}, error) {
+//			var d MyData
+//			err := d.Unmarshal(data)
+//			return d, err
+//		})
+//		qsadmin.Main()
+//	}
+package qsadmin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/internal/backends"
+)
+
+// Decoder converts marshaled session data into a value for display, which
+// is printed with fmt, or as JSON.
+type Decoder func(data []byte) (interface{}, error)
+
+var (
+	decodersMu sync.Mutex
+	decoders   = map[string]Decoder{
+		"varmap": decodeVarMap,
+		"string": func(data []byte) (interface{}, error) { return string(data), nil },
+		"hex":    func(data []byte) (interface{}, error) { return hex.EncodeToString(data), nil },
+	}
+)
+
+// RegisterDecoder makes a Decoder available, by name, to the -decoder flag.
+func RegisterDecoder(name string, d Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[name] = d
+}
+
+func decoder(name string) (Decoder, bool) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	d, ok := decoders[name]
+	return d, ok
+}
+
+// decodeVarMap decodes qsess.VarMap data, with keys converted to strings,
+// so it can be printed as JSON.
+func decodeVarMap(data []byte) (interface{}, error) {
+	var m qsess.VarMap
+	if err := m.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	vars := make(map[string]interface{}, len(m.Vars))
+	for k, v := range m.Vars {
+		vars[fmt.Sprint(k)] = v
+	}
+	return vars, nil
+}
+
+// Main runs qsess-admin with the command-line arguments, and exits.
+func Main() {
+	os.Exit(Run(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Run runs qsess-admin with args (which exclude the program name), and
+// returns its exit status.
+func Run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("qsess-admin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	db := fs.String("db", os.Getenv("QSESS_DB"), "back-end description (default $QSESS_DB)")
+	keysFile := fs.String("keys", "", "file of keys, in hex, one per line, primary first")
+	derive := fs.Bool("derive", false, "keys are master secrets for qsess.DeriveKeys, with -purpose")
+	purpose := fs.String("purpose", "", "the Store's Purpose")
+	user := fs.String("user", "", "user id, for back-ends which need it to find sessions by id")
+	decoderName := fs.String("decoder", "varmap", "session data decoder")
+	encrypted := fs.Bool("encrypted", false, "session data is encrypted (see Store.EncryptAtRest); requires -keys")
+	jsonOut := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: qsess-admin [flags] count | list <user id> | show <token> | show-id <session id> |")
+		fmt.Fprintln(stderr, "                           revoke <token> | revoke-id <session id> | revoke-user <user id> | prune")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok || fs.NArg() != cmd.nargs+1 || *db == "" {
+		fs.Usage()
+		return 2
+	}
+	dec, ok := decoder(*decoderName)
+	if !ok {
+		fmt.Fprintln(stderr, "qsess-admin: unknown decoder "+*decoderName)
+		return 2
+	}
+
+	var keys [][]byte
+	if *keysFile != "" {
+		var err error
+		if keys, err = readKeys(*keysFile); err != nil {
+			fmt.Fprintln(stderr, "qsess-admin: "+err.Error())
+			return 1
+		}
+		if *derive {
+			keys = qsess.DeriveKeys(*purpose, keys...)
+		}
+	}
+	st, closeStore, err := backends.Open(*db, keys...)
+	if err != nil {
+		fmt.Fprintln(stderr, "qsess-admin: "+err.Error())
+		return 1
+	}
+	defer closeStore()
+	st.Purpose = *purpose
+	if *encrypted {
+		if len(keys) == 0 {
+			fmt.Fprintln(stderr, "qsess-admin: -encrypted requires -keys")
+			return 2
+		}
+		// accept plaintext, to show sessions saved before encryption was enabled
+		if err := st.EncryptAtRest(true); err != nil {
+			fmt.Fprintln(stderr, "qsess-admin: "+err.Error())
+			return 1
+		}
+	}
+
+	a := &admin{
+		st:      st,
+		be:      st.BackEndCtx(),
+		haveKey: len(keys) > 0,
+		user:    []byte(*user),
+		decode:  dec,
+		json:    *jsonOut,
+		out:     stdout,
+	}
+	if err := cmd.run(a, ctx, fs.Args()[1:]); err != nil {
+		fmt.Fprintln(stderr, "qsess-admin: "+err.Error())
+		return 1
+	}
+	return 0
+}
+
+type admin struct {
+	st      *qsess.Store
+	be      qsess.SessBackEndCtx
+	haveKey bool
+	user    []byte
+	decode  Decoder
+	json    bool
+	out     io.Writer
+}
+
+var commands = map[string]struct {
+	nargs int
+	run   func(a *admin, ctx context.Context, args []string) error
+}{
+	"count":       {0, (*admin).count},
+	"list":        {1, (*admin).list},
+	"show":        {1, func(a *admin, ctx context.Context, args []string) error { return a.show(ctx, args, false) }},
+	"show-id":     {1, func(a *admin, ctx context.Context, args []string) error { return a.show(ctx, args, true) }},
+	"revoke":      {1, func(a *admin, ctx context.Context, args []string) error { return a.revoke(ctx, args, false) }},
+	"revoke-id":   {1, func(a *admin, ctx context.Context, args []string) error { return a.revoke(ctx, args, true) }},
+	"revoke-user": {1, (*admin).revokeUser},
+	"prune":       {0, (*admin).prune},
+}
+
+func readKeys(file string) ([][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys [][]byte
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, errors.New("bad key in " + file + " - " + err.Error())
+		}
+		keys = append(keys, key)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys in " + file)
+	}
+	return keys, nil
+}
+
+// session describes a session, for printing.
+type session struct {
+	ID         string      `json:"id"`
+	UserID     string      `json:"user_id"`
+	TTLSecs    int         `json:"ttl_secs"`
+	MaxAgeSecs int         `json:"max_age_secs"`
+	Created    string      `json:"created,omitempty"`
+	LastSaved  string      `json:"last_saved,omitempty"`
+	ClientIP   string      `json:"client_ip,omitempty"`
+	UserAgent  string      `json:"user_agent,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+	DataError  string      `json:"data_error,omitempty"`
+}
+
+func (a *admin) describe(e qsess.SessEntry, withData bool) (session, error) {
+	info, data, err := a.st.Inspect(e)
+	if err != nil {
+		return session{}, err
+	}
+	s := session{
+		ID:         hex.EncodeToString(e.SessID),
+		UserID:     string(e.UserID),
+		TTLSecs:    e.TimeToLiveSecs,
+		MaxAgeSecs: e.MaxAgeSecs,
+		Created:    formatTime(info.Created),
+		LastSaved:  formatTime(info.LastSaved),
+		ClientIP:   info.ClientIP,
+		UserAgent:  info.UserAgent,
+	}
+	if withData {
+		if s.Data, err = a.decode(data); err != nil {
+			s.Data, s.DataError = nil, err.Error()
+		}
+	}
+	return s, nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// print prints v as JSON, or calls human.
+func (a *admin) print(v interface{}, human func(w io.Writer)) error {
+	if a.json {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	human(a.out)
+	return nil
+}
+
+func (a *admin) count(ctx context.Context, args []string) error {
+	if !qsess.Supports[qsess.Iterable](a.be) {
+		return errors.New("this back-end can't count sessions")
+	}
+	n := 0
+	if err := a.be.(qsess.Iterable).IterateCtx(ctx, func(qsess.SessEntry) error { n++; return nil }); err != nil {
+		return err
+	}
+	return a.print(map[string]int{"count": n}, func(w io.Writer) {
+		fmt.Fprintf(w, "%d active sessions\n", n)
+	})
+}
+
+// list uses SessLister, if the back-end implements it, otherwise Iterable.
+func (a *admin) list(ctx context.Context, args []string) error {
+	userID := []byte(args[0])
+	var entries []qsess.SessEntry
+	if qsess.Supports[qsess.SessLister](a.be) {
+		var err error
+		if entries, err = a.be.(qsess.SessLister).ListByUserIDCtx(ctx, userID); err != nil {
+			return err
+		}
+	} else if qsess.Supports[qsess.Iterable](a.be) {
+		err := a.be.(qsess.Iterable).IterateCtx(ctx, func(e qsess.SessEntry) error {
+			if bytes.Equal(e.UserID, userID) {
+				entries = append(entries, e)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		return errors.New("this back-end can't list sessions")
+	}
+
+	sessions := []session{}
+	for _, e := range entries {
+		if e.TimeToLiveSecs <= 0 {
+			continue
+		}
+		if e.UserID == nil {
+			e.UserID = userID
+		}
+		s, err := a.describe(e, false)
+		if err != nil {
+			return err
+		}
+		sessions = append(sessions, s)
+	}
+	return a.print(sessions, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTTL\tCREATED\tLAST SAVED\tCLIENT IP\tUSER AGENT")
+		for _, s := range sessions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, time.Duration(s.TTLSecs)*time.Second,
+				s.Created, s.LastSaved, s.ClientIP, s.UserAgent)
+		}
+		tw.Flush()
+	})
+}
+
+// sessionRef returns the session id and user id referred to by a token (for
+// show and revoke) or a hex session id (for show-id and revoke-id).
+func (a *admin) sessionRef(args []string, byID bool) (sessID []byte, userID []byte, err error) {
+	if byID {
+		if sessID, err = hex.DecodeString(args[0]); err != nil {
+			return nil, nil, errors.New("bad session id - " + err.Error())
+		}
+		return sessID, a.user, nil
+	}
+	if !a.haveKey {
+		return nil, nil, errors.New("decoding tokens requires -keys")
+	}
+	if sessID, userID, err = a.st.DecodeToken(args[0]); err != nil {
+		return nil, nil, err
+	}
+	if userID == nil {
+		userID = a.user
+	}
+	return sessID, userID, nil
+}
+
+func (a *admin) show(ctx context.Context, args []string, byID bool) error {
+	sessID, uID, err := a.sessionRef(args, byID)
+	if err != nil {
+		return err
+	}
+	data, userID, ttl, maxAge, minRefresh, err := a.be.GetCtx(ctx, sessID, uID)
+	if err != nil {
+		return err
+	}
+	s, err := a.describe(qsess.SessEntry{
+		SessID:         sessID,
+		UserID:         userID,
+		Data:           data,
+		TimeToLiveSecs: ttl,
+		MaxAgeSecs:     maxAge,
+		MinRefreshSecs: minRefresh,
+	}, true)
+	if err != nil {
+		return err
+	}
+	return a.print(s, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, f := range [][2]string{
+			{"id", s.ID},
+			{"user id", s.UserID},
+			{"ttl", (time.Duration(s.TTLSecs) * time.Second).String()},
+			{"max age", (time.Duration(s.MaxAgeSecs) * time.Second).String()},
+			{"created", s.Created},
+			{"last saved", s.LastSaved},
+			{"client ip", s.ClientIP},
+			{"user agent", s.UserAgent},
+		} {
+			if f[1] != "" {
+				fmt.Fprintf(tw, "%s:\t%s\n", f[0], f[1])
+			}
+		}
+		if s.DataError != "" {
+			fmt.Fprintf(tw, "data:\tcan't decode - %s\n", s.DataError)
+		} else if b, err := json.MarshalIndent(s.Data, "", "  "); err == nil {
+			fmt.Fprintf(tw, "data:\t%s\n", b)
+		} else {
+			fmt.Fprintf(tw, "data:\t%v\n", s.Data)
+		}
+		tw.Flush()
+	})
+}
+
+func (a *admin) revoke(ctx context.Context, args []string, byID bool) error {
+	sessID, userID, err := a.sessionRef(args, byID)
+	if err != nil {
+		return err
+	}
+	if err := a.be.DeleteCtx(ctx, sessID, userID); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(sessID)
+	return a.print(map[string]string{"revoked": id}, func(w io.Writer) {
+		fmt.Fprintf(w, "revoked session %s\n", id)
+	})
+}
+
+func (a *admin) revokeUser(ctx context.Context, args []string) error {
+	if err := a.be.DeleteByUserIDCtx(ctx, []byte(args[0])); err != nil {
+		return err
+	}
+	return a.print(map[string]string{"revoked_user": args[0]}, func(w io.Writer) {
+		fmt.Fprintf(w, "revoked all sessions of user %s\n", args[0])
+	})
+}
+
+// pruneObserver passes on reports of pruner passes.
+type pruneObserver chan qsess.Event
+
+func (o pruneObserver) Observe(e qsess.Event) {
+	if e.Op == qsess.OpPrune {
+		select {
+		case o <- e:
+		default:
+		}
+	}
+}
+
+// prune wakes the back-end's pruner goroutine (which prunes whenever it is
+// given a new interval), and waits for it to report its pass.
+func (a *admin) prune(ctx context.Context, args []string) error {
+	if a.st.PruneInterval == nil {
+		return errors.New("this back-end has no pruner (it expires sessions by itself)")
+	}
+	done := make(pruneObserver, 1)
+	a.st.Observer = done
+	// the interval doesn't matter, since the pruner is stopped when we exit.
+	select {
+	case a.st.PruneInterval <- 60:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case e := <-done:
+		if e.Err != nil {
+			return e.Err
+		}
+		return a.print(map[string]int{"pruned": e.Count}, func(w io.Writer) {
+			fmt.Fprintf(w, "pruned %d expired sessions\n", e.Count)
+		})
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
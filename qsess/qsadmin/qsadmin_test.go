@@ -0,0 +1,188 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsadmin
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/internal/backends"
+)
+
+var testKey = []byte("key-for-encryption--------------")
+
+// setup makes a goleveldb database with two sessions for "admin-user" and
+// one for "admin-other", and returns the flags to use it, and the token
+// of the first session.
+func setup(t *testing.T) ([]string, string) {
+	dir := t.TempDir()
+	db := "goleveldb:" + filepath.Join(dir, "db") + "?prefix=ff"
+	keys := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keys, []byte("# test key\n"+hex.EncodeToString(testKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	st, closeSt, err := backends.Open(db, testKey)
+	if err != nil {
+		t.Fatal("Open failed - " + err.Error())
+	}
+	defer closeSt()
+	st.AuthType = qsess.TokenAuth
+	var token string
+	for i, uid := range []string{"admin-user", "admin-user", "admin-other"} {
+		sess := st.NewSession([]byte(uid))
+		sess.Data.(*qsess.VarMap).Vars["n"] = i
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		if i == 0 {
+			if token, _, err = sess.Token(); err != nil {
+				t.Fatal("Token failed - " + err.Error())
+			}
+		}
+	}
+	return []string{"-db", db, "-keys", keys}, token
+}
+
+// run runs qsess-admin with -json, and decodes its output into v.
+func run(t *testing.T, flags []string, v interface{}, args ...string) {
+	var stdout, stderr bytes.Buffer
+	args = append(append(append([]string(nil), flags...), "-json"), args...)
+	if status := Run(context.Background(), args, &stdout, &stderr); status != 0 {
+		t.Fatalf("%s failed - %s", strings.Join(args, " "), stderr.String())
+	}
+	if err := json.Unmarshal(stdout.Bytes(), v); err != nil {
+		t.Fatalf("%s - bad output - %s", strings.Join(args, " "), err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	flags, token := setup(t)
+
+	var count map[string]int
+	if run(t, flags, &count, "count"); count["count"] != 3 {
+		t.Fatalf("expected 3 sessions, got %d", count["count"])
+	}
+
+	var list []session
+	if run(t, flags, &list, "list", "admin-user"); len(list) != 2 {
+		t.Fatalf("expected 2 sessions for admin-user, got %d", len(list))
+	}
+	for _, s := range list {
+		if s.UserID != "admin-user" || s.TTLSecs <= 0 || s.Created == "" {
+			t.Fatalf("bad list entry %+v", s)
+		}
+	}
+
+	var shown session
+	run(t, flags, &shown, "show", token)
+	if shown.UserID != "admin-user" || shown.Data.(map[string]interface{})["n"] != 0.0 {
+		t.Fatalf("bad show output %+v", shown)
+	}
+	var byID session
+	if run(t, flags, &byID, "show-id", shown.ID); byID.ID != shown.ID {
+		t.Fatal("show-id showed the wrong session")
+	}
+
+	var revoked map[string]string
+	if run(t, flags, &revoked, "revoke", token); revoked["revoked"] != shown.ID {
+		t.Fatal("revoke revoked the wrong session")
+	}
+	run(t, flags, &revoked, "revoke-user", "admin-other")
+	if run(t, flags, &count, "count"); count["count"] != 1 {
+		t.Fatalf("expected 1 session after revoking, got %d", count["count"])
+	}
+
+	var stderr bytes.Buffer
+	if Run(context.Background(), append(flags, "show", token), new(bytes.Buffer), &stderr) != 1 {
+		t.Fatal("show of a revoked session should fail")
+	}
+	for _, cmd := range []string{"show-id", "revoke-id"} {
+		if Run(context.Background(), append(flags, cmd, "ab"), new(bytes.Buffer), &stderr) != 1 {
+			t.Fatalf("%s of a malformed session id should fail", cmd)
+		}
+	}
+	if Run(context.Background(), append(flags, "bogus"), new(bytes.Buffer), &stderr) != 2 {
+		t.Fatal("unknown command should fail with usage")
+	}
+}
+
+// iterOnly is a back-end which can iterate over sessions, but not list them
+// by user id.
+type iterOnly struct {
+	qsess.SessBackEndCtx
+	qsess.Iterable
+}
+
+// TestAdminWrapped checks that count and list see what a wrapped back-end
+// (here, encrypted at rest) can really do, not just what the wrapper can.
+func TestAdminWrapped(t *testing.T) {
+	st, err := qsess.NewMapStore(testKey)
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	base := st.BackEndCtx()
+	st.SetBackEnd(iterOnly{base, base.(qsess.Iterable)})
+	if err := st.EncryptAtRest(false); err != nil {
+		t.Fatal("EncryptAtRest failed - " + err.Error())
+	}
+	for _, uid := range []string{"admin-user", "admin-user", "admin-other"} {
+		if err := st.NewSession([]byte(uid)).Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+	}
+
+	var out bytes.Buffer
+	a := &admin{st: st, be: st.BackEndCtx(), json: true, out: &out}
+	if err := a.list(context.Background(), []string{"admin-user"}); err != nil {
+		t.Fatal("list failed - " + err.Error())
+	}
+	var list []session
+	if err := json.Unmarshal(out.Bytes(), &list); err != nil || len(list) != 2 {
+		t.Fatalf("expected 2 sessions for admin-user, got %s", out.String())
+	}
+
+	// without Iterable, neither count nor list can work.
+	st.SetBackEnd(struct{ qsess.SessBackEndCtx }{base})
+	if err := st.EncryptAtRest(false); err != nil {
+		t.Fatal("EncryptAtRest failed - " + err.Error())
+	}
+	a.be = st.BackEndCtx()
+	if err := a.count(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "can't count") {
+		t.Fatalf("count - expected \"can't count\" error, got %v", err)
+	}
+	if err := a.list(context.Background(), []string{"admin-user"}); err == nil || !strings.Contains(err.Error(), "can't list") {
+		t.Fatalf("list - expected \"can't list\" error, got %v", err)
+	}
+}
+
+func TestAdminPrune(t *testing.T) {
+	dir := t.TempDir()
+	db := "goleveldb:" + filepath.Join(dir, "db")
+	st, closeSt, err := backends.Open(db)
+	if err != nil {
+		t.Fatal("Open failed - " + err.Error())
+	}
+	sess := st.NewSession([]byte("admin-prune"))
+	sess.MaxAgeSecs = 1
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	closeSt()
+	time.Sleep(2100 * time.Millisecond)
+
+	var pruned map[string]int
+	if run(t, []string{"-db", db}, &pruned, "prune"); pruned["pruned"] != 1 {
+		t.Fatalf("expected to prune 1 session, got %d", pruned["pruned"])
+	}
+}
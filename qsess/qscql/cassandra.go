@@ -14,25 +14,39 @@ package qscql
 // used as an index - bad when indexed items can disappear via TTL expiration.
 //
 // This package implements #2 for Cassandra and #1 for Scylla.
+//
+// Session versions, for optimistic concurrency control, are checked with
+// lightweight transactions. CQL cannot increment an ordinary column, so a
+// new version is the current time in nanoseconds; versions are only
+// compared for equality, so they need not be consecutive.
+//
+// cqlStore does not implement qsess.SessToucher: a TTL can only be extended
+// by rewriting every cell of a row, which is no cheaper than a Save.
 
 import (
-	"errors"
+	"context"
 	"time"
 
 	"github.com/gkong/go-qweb/qsess"
 	"github.com/gocql/gocql"
 )
 
-// type cqlStore holds per-store information and implements SessBackEnd.
+// type cqlStore holds per-store information and implements SessBackEndCtx.
 type cqlStore struct {
-	db          *gocql.Session
-	uidIndex    bool
-	uidToClient bool
-	qGet        string
-	qInsert     string
-	qDelete     string
-	qDelByUID   string // delete all sessions for a user id
-	qGetByUID   string // find all sessions for a user id, for manual deletion
+	db            *gocql.Session
+	uidIndex      bool
+	uidToClient   bool
+	qGet          string
+	qInsert       string
+	qCASUpdate    string // update, if the version matches
+	qCASLegacy    string // update, if the record has no version (written by an older qscql)
+	qDelete       string
+	qCASDelete    string // delete, if the version matches
+	qCASDelLegacy string // delete, if the record has no version
+	qDelByUID     string // delete all sessions for a user id
+	qGetByUID     string // find all sessions for a user id, for manual deletion
+	qListByUID    string // find all sessions for a user id, with their data
+	qIterate      string // all sessions, with their data
 }
 
 // NewCqlStore creates a new session store, using a cassandra database.
@@ -41,8 +55,8 @@ type cqlStore struct {
 // (it will be created if it doesn't exist).
 //
 // cipherkeys are one or more 32-byte encryption keys, to be used with
-// AES-GCM. For encryption, only the first key is used;
-// for decryption all keys are tried (allowing key rotation).
+// AES-GCM. For encryption, only the first key is used; for decryption,
+// the key is identified by the cookie or token (allowing key rotation).
 //
 // uidIndex and uidToClient control the implementation of DeleteByUserID.
 // If you are not using DeleteByUserID, set them both to false.
@@ -62,109 +76,329 @@ func NewCqlStore(gs *gocql.Session, table string, uidIndex bool, uidToClient boo
 		db:          gs,
 		uidIndex:    uidIndex,
 		uidToClient: uidToClient,
-		qInsert:     `INSERT INTO "` + table + `" (sessid, userid, data, maxage, minrefresh) VALUES(?, ?, ?, ?, ?) USING TTL ?`,
+		qInsert:     `INSERT INTO "` + table + `" (sessid, userid, data, maxage, minrefresh, version) VALUES(?, ?, ?, ?, ?, ?) USING TTL ?`,
+		qIterate:    `SELECT sessid, userid, data, TTL(data), maxage, minrefresh FROM "` + table + `"`,
 	}
 
+	// in qCASLegacy, "maxage != null" keeps a deleted session from being
+	// re-created.
 	if uidToClient {
 		key = "(userid, sessid)"
-		cs.qGet = `SELECT data, userid, TTL(data), maxage, minrefresh FROM "` + table + `" WHERE userid = ? AND sessid = ?`
+		cs.qCASUpdate = `UPDATE "` + table + `" USING TTL ? SET data = ?, maxage = ?, minrefresh = ?, version = ? WHERE userid = ? AND sessid = ? IF version = ?`
+		cs.qCASLegacy = `UPDATE "` + table + `" USING TTL ? SET data = ?, maxage = ?, minrefresh = ?, version = ? WHERE userid = ? AND sessid = ? IF maxage != null AND version = null`
+		cs.qGet = `SELECT data, userid, TTL(data), maxage, minrefresh, version FROM "` + table + `" WHERE userid = ? AND sessid = ?`
 		cs.qDelete = `DELETE FROM "` + table + `" WHERE userid = ? AND sessid = ?`
+		cs.qCASDelete = cs.qDelete + ` IF version = ?`
+		cs.qCASDelLegacy = cs.qDelete + ` IF maxage != null AND version = null`
 		cs.qDelByUID = `DELETE FROM "` + table + `" WHERE userid = ?`
+		cs.qListByUID = `SELECT sessid, data, TTL(data), maxage, minrefresh FROM "` + table + `" WHERE userid = ?`
 
 	} else {
 		key = "(sessid)"
-		cs.qGet = `SELECT data, userid, TTL(data), maxage, minrefresh FROM "` + table + `" WHERE sessid = ?`
+		cs.qCASUpdate = `UPDATE "` + table + `" USING TTL ? SET userid = ?, data = ?, maxage = ?, minrefresh = ?, version = ? WHERE sessid = ? IF version = ?`
+		cs.qCASLegacy = `UPDATE "` + table + `" USING TTL ? SET userid = ?, data = ?, maxage = ?, minrefresh = ?, version = ? WHERE sessid = ? IF maxage != null AND version = null`
+		cs.qGet = `SELECT data, userid, TTL(data), maxage, minrefresh, version FROM "` + table + `" WHERE sessid = ?`
 		cs.qDelete = `DELETE FROM "` + table + `" WHERE sessid = ?`
+		cs.qCASDelete = cs.qDelete + ` IF version = ?`
+		cs.qCASDelLegacy = cs.qDelete + ` IF maxage != null AND version = null`
 		cs.qGetByUID = `SELECT sessid FROM "` + table + `" WHERE userid = ?`
+		cs.qListByUID = `SELECT sessid, data, TTL(data), maxage, minrefresh FROM "` + table + `" WHERE userid = ?`
 	}
 
 	err := gs.Query(`CREATE TABLE IF NOT EXISTS "` + table +
-		`" ( sessid uuid, userid blob, data blob, maxage int, minrefresh int, PRIMARY KEY ` + key +
+		`" ( sessid uuid, userid blob, data blob, maxage int, minrefresh int, version bigint, PRIMARY KEY ` + key +
 		` ) WITH gc_grace_seconds = 86400 AND compaction = { 'class':'LeveledCompactionStrategy'}`).Exec()
 	if err != nil {
-		return &qsess.Store{}, errors.New("NewCqlStore - CREATE TABLE failed - " + err.Error())
+		return &qsess.Store{}, cqlErr{"NewCqlStore - CREATE TABLE failed", err}
+	}
+
+	// tables created by older versions of qscql have no version column.
+	// CQL has no ADD IF NOT EXISTS, so check the table metadata first.
+	meta, err := gs.KeyspaceMetadata(gs.Query("").Keyspace())
+	if err != nil {
+		return &qsess.Store{}, cqlErr{"NewCqlStore - KeyspaceMetadata failed", err}
+	}
+	if tm, ok := meta.Tables[table]; ok {
+		if _, ok := tm.Columns["version"]; !ok {
+			err = gs.Query(`ALTER TABLE "` + table + `" ADD version bigint`).Exec()
+			if err != nil {
+				return &qsess.Store{}, cqlErr{"NewCqlStore - ALTER TABLE failed", err}
+			}
+		}
 	}
 
 	if uidIndex {
 		err = gs.Query(`CREATE INDEX IF NOT EXISTS "` + table + `_uid_ndx" ON ` + table + ` (userid)`).Exec()
 		if err != nil {
-			return &qsess.Store{}, errors.New("NewCqlStore - CREATE INDEX failed - " + err.Error())
+			return &qsess.Store{}, cqlErr{"NewCqlStore - CREATE INDEX failed", err}
 		}
 	}
 
-	st, err := qsess.NewStore(cs, uidToClient, cipherkeys...)
+	st, err := qsess.NewStoreCtx(cs, uidToClient, cipherkeys...)
 	if err != nil {
-		return nil, errors.New("NewCqlStore - NewStore - " + err.Error())
+		return nil, cqlErr{"NewCqlStore - NewStore", err}
 	}
 
 	return st, nil
 }
 
-func (c *cqlStore) Get(sessID []byte, userID []byte) ([]byte, []byte, int, int, int, error) {
+func (c *cqlStore) GetCtx(ctx context.Context, sessID []byte, userID []byte) ([]byte, []byte, int, int, int, error) {
+	data, userID, ttl, maxage, minrefresh, _, err := c.GetVersionCtx(ctx, sessID, userID)
+	return data, userID, ttl, maxage, minrefresh, err
+}
+
+// GetVersionCtx returns version zero for records written before versions
+// existed (a null version column).
+func (c *cqlStore) GetVersionCtx(ctx context.Context, sessID []byte, userID []byte) ([]byte, []byte, int, int, int, int64, error) {
 	var data []byte
 	var ttl, maxage, minrefresh int
+	var version int64
 	var err error
 	if c.uidToClient {
-		err = c.db.Query(c.qGet).Bind(userID, bytesToID(sessID)).Scan(&data, &userID, &ttl, &maxage, &minrefresh)
+		err = c.db.Query(c.qGet).WithContext(ctx).Bind(userID, bytesToID(sessID)).Scan(&data, &userID, &ttl, &maxage, &minrefresh, &version)
 	} else {
-		err = c.db.Query(c.qGet).Bind(bytesToID(sessID)).Scan(&data, &userID, &ttl, &maxage, &minrefresh)
+		err = c.db.Query(c.qGet).WithContext(ctx).Bind(bytesToID(sessID)).Scan(&data, &userID, &ttl, &maxage, &minrefresh, &version)
 	}
-	return data, userID, ttl, maxage, minrefresh, err
+	if err == gocql.ErrNotFound {
+		// expired rows vanish, so there's no telling expired from not found.
+		err = cqlErr{"cqlStore.Get", qsess.ErrNotFound}
+	} else if err != nil {
+		err = cqlErr{"cqlStore.Get - SELECT failed", err}
+	}
+	return data, userID, ttl, maxage, minrefresh, version, err
+}
+
+func (c *cqlStore) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxage int, minrefresh int) error {
+	version := int64(-1)
+	return c.SaveVersionCtx(ctx, sessID, data, userID, maxage, minrefresh, &version)
 }
 
-func (c *cqlStore) Save(sessID *[]byte, data []byte, userID []byte, maxage int, minrefresh int) error {
-	if *sessID == nil {
-		// this is the first Save of a new session; generate a new key.
-		*sessID = gocql.UUIDFromTime(time.Now()).Bytes()
+func (c *cqlStore) SaveVersionCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxage int, minrefresh int, version *int64) error {
+	newVersion := time.Now().UnixNano()
+
+	if *sessID == nil || *version < 0 {
+		if *sessID == nil {
+			// this is the first Save of a new session; generate a new key.
+			*sessID = gocql.UUIDFromTime(time.Now()).Bytes()
+		}
+		err := c.db.Query(c.qInsert).WithContext(ctx).Bind(*sessID, userID, data, maxage, minrefresh, newVersion, maxage).Exec()
+		if err != nil {
+			return cqlErr{"cqlStore.Save - INSERT failed", err}
+		}
+		*version = newVersion
+		return nil
 	}
-	return c.db.Query(c.qInsert).Bind(*sessID, userID, data, maxage, minrefresh, maxage).Exec()
+
+	var q *gocql.Query
+	switch {
+	case c.uidToClient && *version == 0:
+		q = c.db.Query(c.qCASLegacy).Bind(maxage, data, maxage, minrefresh, newVersion, userID, bytesToID(*sessID))
+	case c.uidToClient:
+		q = c.db.Query(c.qCASUpdate).Bind(maxage, data, maxage, minrefresh, newVersion, userID, bytesToID(*sessID), *version)
+	case *version == 0:
+		q = c.db.Query(c.qCASLegacy).Bind(maxage, userID, data, maxage, minrefresh, newVersion, bytesToID(*sessID))
+	default:
+		q = c.db.Query(c.qCASUpdate).Bind(maxage, userID, data, maxage, minrefresh, newVersion, bytesToID(*sessID), *version)
+	}
+
+	current := map[string]interface{}{}
+	applied, err := q.WithContext(ctx).MapScanCAS(current)
+	if err != nil {
+		return cqlErr{"cqlStore.Save - CAS update failed", err}
+	}
+	if !applied {
+		if len(current) == 0 {
+			// no such record (deleted or expired)
+			return cqlErr{"cqlStore.Save", qsess.ErrNotFound}
+		}
+		return qsess.ErrConflict
+	}
+	*version = newVersion
+	return nil
 }
 
-func (c *cqlStore) Delete(sessID []byte, userID []byte) error {
+func (c *cqlStore) DeleteCtx(ctx context.Context, sessID []byte, userID []byte) error {
+	var err error
 	if c.uidToClient {
-		return c.db.Query(c.qDelete).Bind(userID, bytesToID(sessID)).Exec()
+		err = c.db.Query(c.qDelete).WithContext(ctx).Bind(userID, bytesToID(sessID)).Exec()
+	} else {
+		err = c.db.Query(c.qDelete).WithContext(ctx).Bind(bytesToID(sessID)).Exec()
 	}
-	return c.db.Query(c.qDelete).Bind(bytesToID(sessID)).Exec()
+	if err != nil {
+		return cqlErr{"cqlStore.Delete - DELETE failed", err}
+	}
+	return nil
 }
 
-func (c *cqlStore) DeleteByUserID(userID []byte) error {
+// ConsumeCtx gets a session, then deletes it, if its version is unchanged,
+// with a conditional delete (a lightweight transaction), so only one of
+// several concurrent consumers succeeds. The others fail with ErrNotFound
+// (or ErrConflict, if the session was saved in the meantime). Expired rows
+// vanish, so ConsumeCtx never returns ErrExpired.
+func (c *cqlStore) ConsumeCtx(ctx context.Context, sessID []byte, userID []byte) ([]byte, []byte, int, int, int, error) {
+	data, userID, ttl, maxage, minrefresh, version, err := c.GetVersionCtx(ctx, sessID, userID)
+	if err != nil {
+		return nil, nil, 0, 0, 0, err
+	}
+
+	var q *gocql.Query
+	switch {
+	case c.uidToClient && version == 0:
+		q = c.db.Query(c.qCASDelLegacy).Bind(userID, bytesToID(sessID))
+	case c.uidToClient:
+		q = c.db.Query(c.qCASDelete).Bind(userID, bytesToID(sessID), version)
+	case version == 0:
+		q = c.db.Query(c.qCASDelLegacy).Bind(bytesToID(sessID))
+	default:
+		q = c.db.Query(c.qCASDelete).Bind(bytesToID(sessID), version)
+	}
+
+	current := map[string]interface{}{}
+	applied, err := q.WithContext(ctx).MapScanCAS(current)
+	if err != nil {
+		return nil, nil, 0, 0, 0, cqlErr{"cqlStore.Consume - CAS delete failed", err}
+	}
+	if !applied {
+		if len(current) == 0 {
+			// consumed (or deleted) by someone else
+			return nil, nil, 0, 0, 0, cqlErr{"cqlStore.Consume", qsess.ErrNotFound}
+		}
+		return nil, nil, 0, 0, 0, qsess.ErrConflict
+	}
+	return data, userID, ttl, maxage, minrefresh, nil
+}
+
+func (c *cqlStore) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
 	var sessID []byte
 	var err error
 
 	if (!c.uidIndex) && (!c.uidToClient) {
-		return errors.New("cqlStore.DeleteByUserID - require uidIndex or uidToClient")
+		return cqlErr{"cqlStore.DeleteByUserID - require uidIndex or uidToClient", nil}
 	}
 
 	if c.uidToClient {
-		return c.db.Query(c.qDelByUID, userID).Exec()
+		if err := c.db.Query(c.qDelByUID, userID).WithContext(ctx).Exec(); err != nil {
+			return cqlErr{"cqlStore.DeleteByUserID - DELETE failed", err}
+		}
+		return nil
 	} else {
 		// even if we have an index, we can't delete using a WHERE clause that
 		// doesn't include the partition key, so do a SELECT and delete each
 		// session explicitly. this is OK, because (we assume) DeleteByUserID
 		// happens rarely, and the number of sessions per userid is very small.
-		iter := c.db.Query(c.qGetByUID, userID).Iter()
+		iter := c.db.Query(c.qGetByUID, userID).WithContext(ctx).Iter()
 
 		// try to delete all, in spite of errors (if any).
 		// if errors, return the first one.
 		err = nil
 		for iter.Scan(&sessID) {
-			curErr := c.db.Query(c.qDelete).Bind(bytesToID(sessID)).Exec()
+			curErr := c.db.Query(c.qDelete).WithContext(ctx).Bind(bytesToID(sessID)).Exec()
 			if curErr != nil && err == nil {
 				err = curErr
 			}
 		}
 		closeErr := iter.Close()
 		if err != nil {
-			return err
+			return cqlErr{"cqlStore.DeleteByUserID - DELETE failed", err}
+		}
+		if closeErr != nil {
+			return cqlErr{"cqlStore.DeleteByUserID - SELECT failed", closeErr}
+		}
+		return nil
+	}
+}
+
+func (c *cqlStore) ListByUserIDCtx(ctx context.Context, userID []byte) ([]qsess.SessEntry, error) {
+	if (!c.uidIndex) && (!c.uidToClient) {
+		return nil, cqlErr{"cqlStore.ListByUserID - require uidIndex or uidToClient", nil}
+	}
+
+	var entries []qsess.SessEntry
+	var sessID gocql.UUID
+	var data []byte
+	var ttl, maxage, minrefresh int
+
+	iter := c.db.Query(c.qListByUID, userID).WithContext(ctx).Iter()
+	for iter.Scan(&sessID, &data, &ttl, &maxage, &minrefresh) {
+		entries = append(entries, qsess.SessEntry{
+			SessID:         sessID.Bytes(),
+			UserID:         userID,
+			Data:           data,
+			TimeToLiveSecs: ttl,
+			MaxAgeSecs:     maxage,
+			MinRefreshSecs: minrefresh,
+		})
+		data = nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, cqlErr{"cqlStore.ListByUserID", err}
+	}
+	return entries, nil
+}
+
+// IterateCtx scans the whole table, a page at a time.
+func (c *cqlStore) IterateCtx(ctx context.Context, fn func(e qsess.SessEntry) error) error {
+	var sessID gocql.UUID
+	var userID, data []byte
+	var ttl, maxage, minrefresh int
+
+	iter := c.db.Query(c.qIterate).WithContext(ctx).Iter()
+	for iter.Scan(&sessID, &userID, &data, &ttl, &maxage, &minrefresh) {
+		if ttl > 0 {
+			err := fn(qsess.SessEntry{
+				SessID:         sessID.Bytes(),
+				UserID:         userID,
+				Data:           data,
+				TimeToLiveSecs: ttl,
+				MaxAgeSecs:     maxage,
+				MinRefreshSecs: minrefresh,
+			})
+			if err != nil {
+				iter.Close()
+				return err
+			}
 		}
-		return closeErr
+		userID, data = nil, nil
+	}
+	if err := iter.Close(); err != nil {
+		return cqlErr{"cqlStore.Iterate", err}
+	}
+	return nil
+}
+
+// ImportCtx writes with an INSERT, which replaces any existing session.
+func (c *cqlStore) ImportCtx(ctx context.Context, e qsess.SessEntry) error {
+	if len(e.SessID) != 16 {
+		return cqlErr{"cqlStore.Import - session id has the wrong size", nil}
 	}
+	err := c.db.Query(c.qInsert).WithContext(ctx).Bind(e.SessID, e.UserID, e.Data, e.MaxAgeSecs, e.MinRefreshSecs, time.Now().UnixNano(), e.TimeToLiveSecs).Exec()
+	if err != nil {
+		return cqlErr{"cqlStore.Import - INSERT failed", err}
+	}
+	return nil
+}
+
+type cqlErr struct {
+	msg string
+	err error
+}
+
+func (e cqlErr) Error() string {
+	if e.err != nil {
+		return "qscql." + e.msg + " - " + e.err.Error()
+	}
+	return "qscql." + e.msg
+}
+
+func (e cqlErr) Unwrap() error {
+	return e.err
 }
 
 // serialize gocql.UUIDs, which we use as session ids (database keys).
 
 func bytesToID(src []byte) gocql.UUID {
-	// could check error return, but depend on qsess promise not to touch
+	// malformed ids (qsadmin passes ids typed by operators) become the
+	// zero UUID, which is never a session id, so they are not found.
 	u, _ := gocql.UUIDFromBytes(src)
 	return u
 }
@@ -113,7 +113,100 @@ func TestCassUCDeleteByUserId(t *testing.T) {
 	qstest.DeleteByUserIDTest(t, st, false)
 }
 
+func TestCassUCListByUserId(t *testing.T) {
+	st := makeTestStore(t, "UClistbyuid", false, true)
+	qstest.ListByUserIDTest(t, st)
+}
+
+func TestCassRegenerate(t *testing.T) {
+	st := makeTestStore(t, "regen", false, false)
+	qstest.RegenerateTest(t, st)
+}
+
+func TestCassConflict(t *testing.T) {
+	st := makeTestStore(t, "conflict", false, false)
+	qstest.ConflictTest(t, st)
+}
+
+func TestCassUCConflict(t *testing.T) {
+	st := makeTestStore(t, "UCconflict", false, true)
+	qstest.ConflictTest(t, st)
+}
+
+func TestCassAbsoluteExpiration(t *testing.T) {
+	st := makeTestStore(t, "absexp", false, false)
+	qstest.AbsoluteExpirationTest(t, st)
+}
+
+func TestCassRefresh(t *testing.T) {
+	st := makeTestStore(t, "refresh", false, false)
+	qstest.RefreshTest(t, st)
+}
+
+func TestCassSentinelErrors(t *testing.T) {
+	st := makeTestStore(t, "sentinel", false, false)
+	qstest.SentinelErrorsTest(t, st)
+}
+
+func TestCassFlash(t *testing.T) {
+	st := makeTestStore(t, "flash", false, false)
+	qstest.FlashTest(t, st)
+}
+
+func TestCassCSRF(t *testing.T) {
+	st := makeTestStore(t, "csrf", false, false)
+	qstest.CSRFTest(t, st)
+}
+
+func TestCassJWT(t *testing.T) {
+	st := makeTestStore(t, "jwt", false, false)
+	qstest.JWTTest(t, st)
+}
+
+func TestCassFingerprint(t *testing.T) {
+	st := makeTestStore(t, "fingerprint", false, false)
+	qstest.FingerprintTest(t, st)
+}
+
 func TestCassExpiration(t *testing.T) {
 	st := makeTestStore(t, "exp", false, false)
 	qstest.ExpirationTest(t, st)
 }
+
+func TestCassIterate(t *testing.T) {
+	st := makeTestStore(t, "iterate", false, false)
+	qstest.IterateTest(t, st)
+}
+
+func TestCassUCIterate(t *testing.T) {
+	st := makeTestStore(t, "UCiterate", false, true)
+	qstest.IterateTest(t, st)
+}
+
+func TestCassEncryptAtRest(t *testing.T) {
+	st := makeTestStore(t, "atrest", false, false)
+	qstest.EncryptAtRestTest(t, st)
+}
+
+func TestCassLifecycle(t *testing.T) {
+	// expired sessions vanish by TTL, so Cassandra reports no expiry.
+	st := makeTestStore(t, "lifecycle", false, false)
+	qstest.LifecycleTest(t, st, false, false)
+}
+
+func TestCassRemember(t *testing.T) {
+	// theft detection uses DeleteByUserID, which needs user ids in tokens
+	// or an index on userid.
+	st := makeTestStore(t, "remember", false, true)
+	qstest.RememberTest(t, st)
+}
+
+func TestCassConsume(t *testing.T) {
+	st := makeTestStore(t, "consume", false, false)
+	qstest.ConsumeTest(t, st)
+}
+
+func TestCassUCConsume(t *testing.T) {
+	st := makeTestStore(t, "UCconsume", false, true)
+	qstest.ConsumeTest(t, st)
+}
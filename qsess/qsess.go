@@ -15,9 +15,13 @@
 package qsess
 
 import (
+	"bytes"
+	"context"
 	"crypto/cipher"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -55,7 +59,8 @@ func ParseAuthType(s string) (AuthTypeEnum, error) {
 	return at, nil
 }
 
-// A back-end consists of an implementation of SessBackEnd and a Store constructor.
+// A back-end consists of an implementation of SessBackEnd (or SessBackEndCtx)
+// and a Store constructor.
 // Session ids are back-end-defined and generated by SessBackEnd.Save,
 // are not interpreted or modified by code outside of the back-end,
 // and are not visible to users.
@@ -65,11 +70,219 @@ type SessBackEnd interface {
 	Save(sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error
 	// Get and Delete take a userID argument, but it is ignored except in
 	// the rare case of a back-end that requires uidToClient = true.
+	// Get's error must match ErrNotFound (or ErrExpired) if there is no such
+	// session; any other error is reported as ErrBackend.
 	Get(sessID []byte, uID []byte) (data []byte, userID []byte, timeToLiveSecs int, maxAgeSecs int, minRefreshSecs int, err error)
 	Delete(sessID []byte, uID []byte) error
 	DeleteByUserID(userID []byte) error
 }
 
+// SessBackEndCtx is the context-aware version of SessBackEnd.
+// Store calls back-ends exclusively through this interface, so that
+// request cancellation and deadlines propagate into database calls.
+// Back-ends which only implement SessBackEnd are adapted by NewStore.
+type SessBackEndCtx interface {
+	SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error
+	GetCtx(ctx context.Context, sessID []byte, uID []byte) (data []byte, userID []byte, timeToLiveSecs int, maxAgeSecs int, minRefreshSecs int, err error)
+	DeleteCtx(ctx context.Context, sessID []byte, uID []byte) error
+	DeleteByUserIDCtx(ctx context.Context, userID []byte) error
+}
+
+// legacyBackEnd adapts a SessBackEnd to the SessBackEndCtx interface.
+// The underlying back-end cannot be interrupted, but a context which is
+// already done prevents the call from being made.
+type legacyBackEnd struct {
+	be SessBackEnd
+}
+
+func (l legacyBackEnd) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.be.Save(sessID, data, userID, maxAgeSecs, minRefreshSecs)
+}
+
+// GetCtx's errors are classified like those of any other back-end: only
+// errors matching ErrNotFound (or ErrExpired) mean "no session"; anything
+// else is reported as ErrBackend.
+func (l legacyBackEnd) GetCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	if err := ctx.Err(); err != nil {
+		return []byte{}, []byte{}, 0, 0, 0, err
+	}
+	return l.be.Get(sessID, uID)
+}
+
+func (l legacyBackEnd) DeleteCtx(ctx context.Context, sessID []byte, uID []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.be.Delete(sessID, uID)
+}
+
+func (l legacyBackEnd) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.be.DeleteByUserID(userID)
+}
+
+// ctxlessBackEnd adapts a SessBackEndCtx to the SessBackEnd interface, for
+// Store.BackEnd.
+type ctxlessBackEnd struct {
+	be SessBackEndCtx
+}
+
+func (c ctxlessBackEnd) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	return c.be.SaveCtx(context.Background(), sessID, data, userID, maxAgeSecs, minRefreshSecs)
+}
+
+func (c ctxlessBackEnd) Get(sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	return c.be.GetCtx(context.Background(), sessID, uID)
+}
+
+func (c ctxlessBackEnd) Delete(sessID []byte, uID []byte) error {
+	return c.be.DeleteCtx(context.Background(), sessID, uID)
+}
+
+func (c ctxlessBackEnd) DeleteByUserID(userID []byte) error {
+	return c.be.DeleteByUserIDCtx(context.Background(), userID)
+}
+
+// SessEntry describes a stored session, as returned by back-end functions
+// which enumerate sessions.
+type SessEntry struct {
+	SessID         []byte
+	UserID         []byte
+	Data           []byte
+	TimeToLiveSecs int
+	MaxAgeSecs     int
+	MinRefreshSecs int
+}
+
+// SessLister is an optional interface for back-ends which can enumerate
+// the active sessions for a given user id (typically via the same index
+// they maintain for DeleteByUserID). It is required by Store.ListByUserID.
+type SessLister interface {
+	ListByUserIDCtx(ctx context.Context, userID []byte) ([]SessEntry, error)
+}
+
+// Iterable is an optional interface for back-ends which can enumerate all
+// their active sessions, for copying and administration (see
+// cmd/qsess-copy).
+type Iterable interface {
+	// IterateCtx calls fn for each unexpired session, in no particular order,
+	// stopping if fn returns an error, which IterateCtx then returns.
+	// Sessions saved or deleted during the iteration may or may not be seen.
+	IterateCtx(ctx context.Context, fn func(e SessEntry) error) error
+}
+
+// SessImporter is an optional interface for back-ends which can store a
+// session under a given id, such as a session read from another back-end
+// via Iterable, so that cookies and tokens referring to it remain valid.
+type SessImporter interface {
+	// ImportCtx stores the session e (replacing any session with the same
+	// id), to expire in e.TimeToLiveSecs. It fails if e.SessID could not
+	// have been made by this back-end.
+	ImportCtx(ctx context.Context, e SessEntry) error
+}
+
+// SessVersioner is an optional interface for back-ends which keep a version
+// number for each session, incremented by every save, enabling optimistic
+// concurrency control (see Store.VersionCheck and Store.Update).
+type SessVersioner interface {
+	// GetVersionCtx is like GetCtx, but also returns the session's version.
+	GetVersionCtx(ctx context.Context, sessID []byte, uID []byte) (data []byte, userID []byte, timeToLiveSecs int, maxAgeSecs int, minRefreshSecs int, version int64, err error)
+	// SaveVersionCtx is like SaveCtx, but, if *version is non-negative and
+	// the session already exists, it only writes if the stored version is
+	// equal to *version, otherwise it returns ErrConflict.
+	// On success, *version is set to the new version.
+	SaveVersionCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int, version *int64) error
+}
+
+// SessToucher is an optional interface for back-ends which can extend a
+// session's expiration time without rewriting its data. If a back-end does
+// not implement it, Save and Refresh fall back to a full write.
+type SessToucher interface {
+	// TouchCtx sets a session's expiration time to maxAgeSecs from now,
+	// leaving its data, user id, max age, min refresh and version unchanged.
+	// It fails if the session does not exist.
+	TouchCtx(ctx context.Context, sessID []byte, uID []byte, maxAgeSecs int) error
+}
+
+// SessConsumer is an optional interface for back-ends which can read and
+// delete a session in one atomic operation, so that, of several concurrent
+// callers, only one gets the session. It is required by
+// Store.ConsumeTokenSession.
+type SessConsumer interface {
+	// ConsumeCtx is like GetCtx, but also deletes the session. An expired
+	// session is deleted too, and ConsumeCtx fails with ErrExpired.
+	ConsumeCtx(ctx context.Context, sessID []byte, uID []byte) (data []byte, userID []byte, timeToLiveSecs int, maxAgeSecs int, minRefreshSecs int, err error)
+}
+
+// SessBackEndWrapper is implemented by back-ends which wrap other back-ends
+// (CachingBackEnd, for example). A wrapper implements the optional
+// interfaces, but Store only uses them if every back-end it wraps does too.
+type SessBackEndWrapper interface {
+	Unwrap() SessBackEndCtx
+}
+
+// capable reports whether be, and every back-end it wraps, satisfies is.
+func capable(be SessBackEndCtx, is func(SessBackEndCtx) bool) bool {
+	for {
+		if !is(be) {
+			return false
+		}
+		w, ok := be.(SessBackEndWrapper)
+		if !ok {
+			return true
+		}
+		be = w.Unwrap()
+	}
+}
+
+// Supports reports whether be, and every back-end it wraps, implements the
+// optional interface T (SessVersioner, for example), which a bare type
+// assertion can't tell for wrappers such as CachingBackEnd:
+//
+//	if !qsess.Supports[qsess.SessVersioner](st.BackEndCtx()) { ... }
+func Supports[T any](be SessBackEndCtx) bool {
+	return be != nil && capable(be, func(b SessBackEndCtx) bool { _, ok := b.(T); return ok })
+}
+
+func versioner(be SessBackEndCtx) (SessVersioner, bool) {
+	vb, ok := be.(SessVersioner)
+	return vb, ok && capable(be, func(b SessBackEndCtx) bool { _, ok := b.(SessVersioner); return ok })
+}
+
+func toucher(be SessBackEndCtx) (SessToucher, bool) {
+	tb, ok := be.(SessToucher)
+	return tb, ok && capable(be, func(b SessBackEndCtx) bool { _, ok := b.(SessToucher); return ok })
+}
+
+func lister(be SessBackEndCtx) (SessLister, bool) {
+	lb, ok := be.(SessLister)
+	return lb, ok && capable(be, func(b SessBackEndCtx) bool { _, ok := b.(SessLister); return ok })
+}
+
+func mover(be SessBackEndCtx) (SessMover, bool) {
+	mb, ok := be.(SessMover)
+	return mb, ok && capable(be, func(b SessBackEndCtx) bool { _, ok := b.(SessMover); return ok })
+}
+
+func consumer(be SessBackEndCtx) (SessConsumer, bool) {
+	cb, ok := be.(SessConsumer)
+	return cb, ok && capable(be, func(b SessBackEndCtx) bool { _, ok := b.(SessConsumer); return ok })
+}
+
+// SessMover is an optional interface for back-ends which move sessions to
+// new ids as they are read (MigratingBackEnd, for example). After every
+// successful Get, Store calls MoveCtx with the session's record, and, if it
+// returns a new id, re-issues the session's cookie or token (see StaleKey).
+type SessMover interface {
+	// MoveCtx returns nil if the session doesn't need to move.
+	MoveCtx(ctx context.Context, sessID []byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) (newID []byte, err error)
+}
+
 // SessData is an interface for per-session data storage.
 // The default session data type is VarMap.
 // It can be replaced with a custom data type by setting Store.NewSessData.
@@ -90,6 +303,13 @@ type Store struct {
 	// It can be overridden in individual sessions by setting Session.MaxAgeSecs.
 	MaxAgeSecs int
 
+	// AbsoluteMaxAgeSecs, if positive, caps the lifetime of a session,
+	// measured from its creation, regardless of how often it is refreshed.
+	// A session expires at the earlier of its idle deadline (MaxAgeSecs after
+	// the last Save) and its absolute deadline. It can be overridden in
+	// individual sessions by setting Session.AbsoluteMaxAgeSecs.
+	AbsoluteMaxAgeSecs int
+
 	// SessMinRefreshSecs enables applications to reduce refresh overhead,
 	// by not automatically refreshing the session expiration time at
 	// every request. Package qsess does not perform session refresh itself;
@@ -116,28 +336,94 @@ type Store struct {
 	GetToken    func(w http.ResponseWriter, r *http.Request) (token string, err error)
 
 	// Bring-your-own-crypto by registering Encrypt and Decrypt functions.
+	// Encrypt's output is base64-encoded to make a cookie or token, and
+	// Decrypt is given the cookie or token as it is, still base64-encoded.
+	// They are only used for cookies and tokens, so they can't be combined
+	// with EncryptAtRest.
 	Encrypt func(data []byte) ([]byte, error)
 	Decrypt func(data []byte) ([]byte, error)
 
+	// Purpose, if set, is bound to cookies, tokens and handles as encryption
+	// additional data, so those made by a Store with a different Purpose are
+	// rejected, even if the Stores share keys. Changing it invalidates
+	// existing cookies and tokens. See also DeriveKeys.
+	Purpose string
+
+	// LegacyTokens, which Store constructors set to true, makes the Store
+	// accept cookies and tokens made before key ids were introduced, by
+	// trying every key on any which no key's id opens. GetSession re-issues
+	// them under the primary key (see Session.StaleKey), so upgrading logs
+	// no one out. Once they have been re-issued or expired, clear it: while
+	// it is true, an invalid token costs a decryption attempt with every
+	// key, rather than none.
+	LegacyTokens bool
+
+	// JWT, if set, makes tokens JSON Web Tokens (see JWTConfig).
+	JWT *JWTConfig
+
+	// Fingerprint, if set, binds sessions to clients. GetSession compares
+	// the fingerprint of the client making each request with the one
+	// recorded in the session (see NewClientSession and
+	// Session.BindFingerprint), and, if they differ, or the session has none,
+	// calls FingerprintMismatch, which decides what to do (and may log the
+	// mismatch). If FingerprintMismatch is nil, GetSession fails with
+	// ErrFingerprintMismatch. Fingerprints are only checked by GetSession,
+	// not GetTokenSession.
+	Fingerprint         FingerprintFunc
+	FingerprintMismatch func(s *Session, r *http.Request) FingerprintAction
+
+	// Observer, if set, is told about every operation (see Observer).
+	// Set it before using the Store, since back-end pruners read it from
+	// their own goroutines.
+	Observer Observer
+
+	// RecordClientInfo, if true, causes GetSession to record the client's
+	// IP address and User-Agent (see Session.SetClient), to be persisted
+	// at the next Save and reported by ListByUserID.
+	RecordClientInfo bool
+
+	// VersionCheck, if true, makes Save fail with ErrConflict if the session
+	// has been saved by someone else since it was read by GetSession.
+	// It requires a back-end which implements SessVersioner (all the
+	// back-ends in this module do), otherwise it has no effect.
+	// See also Update, which retries on conflict.
+	VersionCheck bool
+
+	// UpdateRetries is the number of times Update retries after a conflict.
+	UpdateRetries int
+
 	// SessionSaved is an optional callback, which enables you to keep track
 	// of users' last-visited time. This has no effect on session expiration;
 	// it is purely for use by application code. You must supply a userID
 	// with NewSession, for this to be useful.
 	SessionSaved func(UserID []byte, timestamp time.Time) error
 
+	// Lifecycle, if set, is called when sessions are created, saved,
+	// deleted, revoked or found to have expired (see LifecycleEvent), for
+	// example, to audit logins and logouts. Like Observer, it is called
+	// synchronously, and from back-ends' pruner goroutines, so it must be
+	// fast and safe for concurrent use, and should be set before the Store
+	// is used.
+	Lifecycle func(e LifecycleEvent)
+
 	// for back-ends that create a goroutine to prune expired sessions
 	PruneInterval chan int // value is interval in seconds
 	PruneKill     chan int // kill pruner goroutine, value doesn't matter
 
-	backEnd SessBackEnd
+	backEnd SessBackEndCtx
 
 	// true if back-end requires user id (in addition to session id) to locate
 	// sessions, so cookies/tokens must store both user id and session id.
 	// NOTE: this exposes (encrypted) user ids to clients.
 	uidToClient bool
 
-	// when encrypting: always use ciphers[0]. when decrypting - try all ciphers
+	// key ring. when encrypting: always use ciphers[0]. when decrypting -
+	// use the cipher(s) whose keyIDs entry matches the id in the data.
 	ciphers []cipher.AEAD
+	keyIDs  []byte
+
+	// keys for deriving per-session CSRF secrets, one per cipher key
+	csrfKeys [][]byte
 }
 
 const (
@@ -150,12 +436,29 @@ const (
 	DefaultCookieSecure   = false
 	DefaultCookieHTTPOnly = true
 	DefaultCookieSameSite = http.SameSiteDefaultMode
+	DefaultUpdateRetries  = 3
 )
 
 // NewStore is exported only for use by back-ends.
 // Users should never call NewStore; instead, they should call
 // back-end-specific Store constructors.
+//
+// If backend also implements SessBackEndCtx, its context-aware methods are
+// used, otherwise it is wrapped in an adapter which ignores contexts.
 func NewStore(backend SessBackEnd, uidToClient bool, cipherkeys ...[]byte) (*Store, error) {
+	if bc, ok := backend.(SessBackEndCtx); ok {
+		return NewStoreCtx(bc, uidToClient, cipherkeys...)
+	}
+	var bc SessBackEndCtx
+	if backend != nil {
+		bc = legacyBackEnd{backend}
+	}
+	return NewStoreCtx(bc, uidToClient, cipherkeys...)
+}
+
+// NewStoreCtx is like NewStore, but takes a context-aware back-end.
+// It is exported only for use by back-ends.
+func NewStoreCtx(backend SessBackEndCtx, uidToClient bool, cipherkeys ...[]byte) (*Store, error) {
 	if len(cipherkeys) == 0 {
 		return nil, qsErr{"NewStore - must have at least one cipherkey", nil}
 	}
@@ -170,11 +473,15 @@ func NewStore(backend SessBackEnd, uidToClient bool, cipherkeys ...[]byte) (*Sto
 		CookieSecure:   DefaultCookieSecure,
 		CookieHTTPOnly: DefaultCookieHTTPOnly,
 		CookieSameSite: DefaultCookieSameSite,
+		UpdateRetries:  DefaultUpdateRetries,
 		NewSessData:    newVarMap,
+		LegacyTokens:   true,
 
 		backEnd:     backend,
 		uidToClient: uidToClient,
 		ciphers:     make([]cipher.AEAD, len(cipherkeys)),
+		keyIDs:      make([]byte, len(cipherkeys)),
+		csrfKeys:    make([][]byte, len(cipherkeys)),
 	}
 
 	return st, st.makeCiphers(cipherkeys...)
@@ -188,14 +495,55 @@ type Session struct {
 	// See Store for more information on how these values are used.
 	MaxAgeSecs     int
 	MinRefreshSecs int
+	// AbsoluteMaxAgeSecs is initialized from the Store, but, once a session
+	// has been saved with a positive value, it is persisted with the session.
+	AbsoluteMaxAgeSecs int
 	// sessId is a back-end-defined database key.
 	// In newly-created sessions, it is empty, until BackEnd.Save() fills it in.
 	sessID []byte
 	// userId is application-defined and maintained for DeleteByUserId.
 	userID []byte
+	// meta is persisted along with session data (see meta.go).
+	meta sessMeta
+	// version is the back-end version number, as of the last Get or Save,
+	// or -1 if unknown (see SessVersioner).
+	version int64
+	// clean describes the back-end record, as of the last Get or Save,
+	// so Save can tell whether to write or just touch.
+	clean sessRecord
+	// staleKey is true if the session's cookie or token was made with a
+	// key other than the Store's primary key, or refers to an id which the
+	// session has moved from (see SessMover), and has not been re-issued.
+	staleKey bool
+	// cookieChunks is the number of cookies the session's cookie data
+	// was split across, when last read from or sent to the client.
+	cookieChunks int
+	// reauth is true if GetSession found a fingerprint mismatch, and was
+	// told to require re-authentication.
+	reauth bool
 	store  *Store
 }
 
+// sessRecord is what a back-end holds for a session, besides expiration.
+type sessRecord struct {
+	valid          bool
+	data           []byte // marshaled session data, without metadata
+	meta           sessMeta
+	maxAgeSecs     int
+	minRefreshSecs int
+}
+
+// unchanged reports whether the session's metadata and settings match the
+// back-end record. The caller must compare data, if necessary.
+func (s *Session) unchanged() bool {
+	return s.clean.valid && s.sessID != nil && s.meta == s.clean.meta &&
+		s.MaxAgeSecs == s.clean.maxAgeSecs && s.MinRefreshSecs == s.clean.minRefreshSecs
+}
+
+func (s *Session) markClean(data []byte) {
+	s.clean = sessRecord{true, data, s.meta, s.MaxAgeSecs, s.MinRefreshSecs}
+}
+
 // NewSession creates a new session object.
 // It is not persisted to until Session.Save() is called.
 //
@@ -211,6 +559,21 @@ func (st *Store) NewSession(userID []byte) *Session {
 	}
 	s := st.newSess()
 	s.userID = userID
+	s.meta.created = time.Now().Unix()
+	return s
+}
+
+// NewClientSession is NewSession, for a session created for the client
+// making r (typically, at login). If Store.Fingerprint is set, the session
+// is bound to the client (see Session.BindFingerprint), and, if
+// Store.RecordClientInfo is true, the client's IP address and User-Agent
+// are recorded (see Session.SetClient).
+func (st *Store) NewClientSession(userID []byte, r *http.Request) *Session {
+	s := st.NewSession(userID)
+	s.BindFingerprint(r)
+	if st.RecordClientInfo {
+		s.SetClient(r)
+	}
 	return s
 }
 
@@ -223,81 +586,226 @@ func (st *Store) newSess() *Session {
 	}
 
 	return &Session{
-		Data:           d,
-		MaxAgeSecs:     st.MaxAgeSecs,
-		MinRefreshSecs: st.MinRefreshSecs,
-		store:          st,
+		Data:               d,
+		MaxAgeSecs:         st.MaxAgeSecs,
+		MinRefreshSecs:     st.MinRefreshSecs,
+		AbsoluteMaxAgeSecs: st.AbsoluteMaxAgeSecs,
+		version:            -1,
+		store:              st,
 	}
 }
 
 // GetSession determines if the current HTTP request headers contain a cookie
 // or token for an active session and, if so, returns a valid *Session,
 // otherwise it returns a non-nil error.
+// The request's context is passed along to the back-end.
 func (st *Store) GetSession(w http.ResponseWriter, r *http.Request) (s *Session, timeToLiveSecs int, e error) {
+	return st.GetSessionCtx(r.Context(), w, r)
+}
+
+// GetSessionCtx is like GetSession, but uses ctx, rather than the request's
+// context, for back-end calls.
+func (st *Store) GetSessionCtx(ctx context.Context, w http.ResponseWriter, r *http.Request) (s *Session, timeToLiveSecs int, e error) {
 	var idEncrypted string
+	var chunks int
 
 	switch st.AuthType {
 	case CookieAuth:
-		cookie, err := r.Cookie(st.CookieName)
+		var err error
+		idEncrypted, chunks, err = st.readCookies(r)
 		if err != nil {
-			return nil, 0, qsErr{"GetSession - no cookie", err}
+			return nil, 0, qsErr{"GetSession - no cookie", withSentinel(ErrNoCredentials, err)}
 		}
-		idEncrypted = cookie.Value
 	case TokenAuth:
 		if st.GetToken != nil {
 			tok, err := st.GetToken(w, r)
 			if err != nil {
-				return nil, 0, qsErr{"GetSession - GetToken failed", err}
+				return nil, 0, qsErr{"GetSession - GetToken failed", withSentinel(ErrNoCredentials, err)}
 			}
 			idEncrypted = tok
 		} else {
 			tok := r.Header.Get("Authorization")
 			if len(tok) < 8 || strings.ToLower(tok[0:7]) != "bearer " {
-				return nil, 0, qsErr{"GetSession - token not present or malformed", nil}
+				return nil, 0, qsErr{"GetSession - token not present or malformed", ErrNoCredentials}
 			}
 			idEncrypted = tok[7:]
 		}
 	}
 
-	return st.GetTokenSession(idEncrypted)
+	s, timeToLiveSecs, e = st.GetTokenSessionCtx(ctx, idEncrypted)
+	if e == nil {
+		s.cookieChunks = chunks
+	}
+	if e == nil && st.Fingerprint != nil {
+		if e = s.checkFingerprint(r); e != nil {
+			return nil, 0, e
+		}
+	}
+	if e == nil && st.RecordClientInfo {
+		s.SetClient(r)
+	}
+	if e == nil && s.staleKey {
+		// re-issue the cookie or token under the primary key. if this fails,
+		// the old one still works, so don't fail the request.
+		s.sendToClient(w)
+	}
+	return s, timeToLiveSecs, e
 }
 
 // GetTokenSession determines if the given token refers to an active session
 // and, if so, returns a valid *Session, otherwise it returns a non-nil error.
 func (st *Store) GetTokenSession(token string) (s *Session, timeToLiveSecs int, e error) {
+	return st.GetTokenSessionCtx(context.Background(), token)
+}
+
+// GetTokenSessionCtx is like GetTokenSession, with a context for back-end calls.
+func (st *Store) GetTokenSessionCtx(ctx context.Context, token string) (s *Session, timeToLiveSecs int, e error) {
 	s = st.newSess()
 
-	if err := s.decode(token); err != nil {
-		return nil, 0, qsErr{"GetTokenSession - decode - ", err}
+	start := time.Now()
+	err := s.decode(token)
+	st.observe(OpDecode, start, len(token), err)
+	if err != nil {
+		return nil, 0, qsErr{"GetTokenSession - decode - ", withSentinel(ErrInvalidToken, err)}
 	}
 
-	dbData, userid, ttl, maxage, minrefresh, err := st.backEnd.Get(s.sessID, s.userID)
+	var dbData, userid []byte
+	var ttl, maxage, minrefresh int
+	start = time.Now()
+	if vb, ok := versioner(st.backEnd); ok {
+		dbData, userid, ttl, maxage, minrefresh, s.version, err = vb.GetVersionCtx(ctx, s.sessID, s.userID)
+	} else {
+		dbData, userid, ttl, maxage, minrefresh, err = st.backEnd.GetCtx(ctx, s.sessID, s.userID)
+	}
 	if err != nil {
+		err = backEndErr(err)
+		st.observe(OpGet, start, 0, err)
+		if errors.Is(err, ErrExpired) {
+			st.observeEvent(OpExpire)
+			// back-ends may return the expired session's record with ErrExpired
+			st.ReportExpired(s.sessID, userid, dbData)
+		}
 		return nil, 0, qsErr{"GetTokenSession - no record in db", err}
 	}
-	if err := s.Data.Unmarshal(dbData); err != nil {
-		return nil, 0, qsErr{"GetTokenSession - unmarshal failed", err}
+	st.observe(OpGet, start, len(dbData), nil)
+	if mb, ok := mover(st.backEnd); ok {
+		// if the move fails, the session can still be read at its old id.
+		if newID, err := mb.MoveCtx(ctx, s.sessID, dbData, userid, maxage, minrefresh); err == nil && newID != nil {
+			s.sessID = newID
+			s.staleKey = true
+		}
+	}
+	if ttl, err = s.load(ctx, dbData, userid, ttl, maxage, minrefresh, true); err != nil {
+		return nil, 0, qsErr{"GetTokenSession - ", err}
+	}
+	return s, ttl, nil
+}
+
+// load fills in a session from a record read from the back-end, and returns
+// its time-to-live, which is reduced to meet its absolute deadline, if any.
+// If the deadline has passed, it fails with ErrExpired, and, if
+// deleteExpired is true, deletes the record.
+func (s *Session) load(ctx context.Context, dbData []byte, userid []byte, ttl int, maxage int, minrefresh int, deleteExpired bool) (int, error) {
+	st := s.store
+	var err error
+	s.meta, dbData, err = unwrapMeta(dbData)
+	if err != nil {
+		return 0, qsErr{"load - bad metadata", withSentinel(ErrBackend, err)}
 	}
+	storedMeta := s.meta
+	// a record to be resealed differs from the clean one, so it can't just
+	// be touched.
+	s.meta.reseal = false
 
 	s.MaxAgeSecs = maxage
 	s.MinRefreshSecs = minrefresh
 	s.userID = userid
-	return s, ttl, nil
+
+	if s.meta.absMaxAge > 0 {
+		// the back-end's max age may have been reduced to meet the absolute deadline
+		s.AbsoluteMaxAgeSecs = int(s.meta.absMaxAge)
+		s.MaxAgeSecs = int(s.meta.maxAge)
+	}
+	if s.AbsoluteMaxAgeSecs > 0 {
+		if s.meta.created == 0 {
+			// saved by an older version of qsess; start the clock now.
+			s.meta.created = time.Now().Unix()
+		}
+		remaining := s.absoluteRemaining()
+		if remaining <= 0 {
+			st.observeEvent(OpExpire)
+			if deleteExpired {
+				st.deleteBackEnd(ctx, s.sessID, s.userID)
+			}
+			st.lifecycle(LifecycleExpired, s.userID, s.meta)
+			return 0, qsErr{"load - session has reached its absolute lifetime", ErrExpired}
+		}
+		if remaining < ttl {
+			ttl = remaining
+		}
+	}
+
+	if err := s.Data.Unmarshal(dbData); err != nil {
+		return 0, qsErr{"load - unmarshal failed", err}
+	}
+	s.markClean(dbData)
+	s.clean.meta = storedMeta
+
+	return ttl, nil
+}
+
+// absoluteRemaining returns the number of seconds until the session reaches
+// its absolute deadline. Only meaningful if AbsoluteMaxAgeSecs is positive.
+func (s *Session) absoluteRemaining() int {
+	return int(s.meta.created + int64(s.AbsoluteMaxAgeSecs) - time.Now().Unix())
+}
+
+// effectiveMaxAge returns the max age to be given to the back-end and the
+// client: MaxAgeSecs, reduced, if necessary, to meet the absolute deadline.
+func (s *Session) effectiveMaxAge() int {
+	if s.AbsoluteMaxAgeSecs > 0 {
+		if remaining := s.absoluteRemaining(); remaining < s.MaxAgeSecs {
+			return remaining
+		}
+	}
+	return s.MaxAgeSecs
 }
 
 // Token returns a token referring to the current session, ready to be given to the client.
 func (s *Session) Token() (token string, timeToLiveSecs int, err error) {
-	_, _, ttl, _, _, err := s.store.backEnd.Get(s.sessID, s.userID)
+	return s.TokenCtx(context.Background())
+}
+
+// TokenCtx is like Token, with a context for back-end calls.
+func (s *Session) TokenCtx(ctx context.Context) (token string, timeToLiveSecs int, err error) {
+	start := time.Now()
+	data, _, ttl, _, _, err := s.store.backEnd.GetCtx(ctx, s.sessID, s.userID)
+	if err != nil {
+		err = backEndErr(err)
+	}
+	s.store.observe(OpGet, start, len(data), err)
 	if err != nil {
 		return "", 0, qsErr{"Token - Get failed", err}
 	}
-	token, err = s.encode()
+	token, err = s.encode(ttl)
 	if err != nil {
 		return "", 0, qsErr{"Token - token creation failed", err}
 	}
 	return token, ttl, nil
 }
 
+// StaleKey reports whether the cookie or token which referred to the session
+// was made with a key other than the Store's primary key (the first one given
+// to the Store's constructor), or refers to an id which the back-end has
+// moved the session from (see SessMover), and has not yet been re-issued.
+//
+// GetSession re-issues such cookies and tokens automatically (tokens only if
+// SendToken is set). Users of GetTokenSession should check StaleKey and, if
+// it is true, give the client a new token, from Token.
+func (s *Session) StaleKey() bool {
+	return s.staleKey
+}
+
 // UserID returns the user id that was specified when the session was created.
 // Callers should NOT modify the contents of the returned byte slice.
 func (s *Session) UserID() []byte {
@@ -316,46 +824,246 @@ func (s *Session) UserID() []byte {
 // If AuthType is TokenAuth, you must either supply an implementation of
 // SendToken or make other arrangements for sending the token to the client.
 func (s *Session) Save(w http.ResponseWriter) error {
+	return s.SaveCtx(context.Background(), w)
+}
+
+// SaveCtx is like Save, with a context for back-end calls.
+// Pass r.Context() to have the back-end write abandoned, if the client goes away.
+func (s *Session) SaveCtx(ctx context.Context, w http.ResponseWriter) error {
+	return s.save(ctx, w, s.store.VersionCheck)
+}
+
+func (s *Session) save(ctx context.Context, w http.ResponseWriter, checkVersion bool) error {
 	st := s.store
 
 	if s.MaxAgeSecs < 1 {
 		return qsErr{"Save - MaxAgeSecs must be positive", nil}
 	}
 
+	if err := s.write(ctx, checkVersion); err != nil {
+		return qsErr{"Save - ", err}
+	}
+
+	if err := s.sendToClient(w); err != nil {
+		return qsErr{"Save - ", err}
+	}
+
+	if st.SessionSaved != nil {
+		if err := st.SessionSaved(s.userID, time.Now()); err != nil {
+			return qsErr{"Save - SessionSaved failed", err}
+		}
+	}
+
+	return nil
+}
+
+// write marshals session data and writes it to the back-end.
+// If the session has never been saved, the back-end assigns it a new id.
+// If nothing has changed since the session was read, and the back-end
+// supports it, it just touches the session, extending its expiration time.
+// If checkVersion is true and the back-end supports it, the write fails with
+// ErrConflict if the session has been saved since we read it.
+func (s *Session) write(ctx context.Context, checkVersion bool) error {
+	maxAge := s.effectiveMaxAge()
+	if maxAge < 1 {
+		return qsErr{"write - session has reached its absolute lifetime", ErrExpired}
+	}
+	if s.AbsoluteMaxAgeSecs > 0 {
+		s.meta.absMaxAge, s.meta.maxAge = int64(s.AbsoluteMaxAgeSecs), int64(s.MaxAgeSecs)
+	} else {
+		s.meta.absMaxAge, s.meta.maxAge = 0, 0
+	}
+
 	dbData, err := s.Data.Marshal()
 	if err != nil {
-		return qsErr{"Save - marshal failed", err}
+		return qsErr{"write - marshal failed", err}
+	}
+
+	if s.unchanged() && bytes.Equal(dbData, s.clean.data) {
+		if err := s.touch(ctx, maxAge); !errors.Is(err, ErrNotSupported) {
+			return err
+		}
+	}
+
+	s.meta.saved = time.Now().Unix()
+	isNew := s.sessID == nil
+	wrapped := s.meta.wrap(dbData)
+	start := time.Now()
+	if vb, ok := versioner(s.store.backEnd); ok {
+		version := s.version
+		if !checkVersion || isNew {
+			version = -1
+		}
+		err = vb.SaveVersionCtx(ctx, &s.sessID, wrapped, s.userID, maxAge, s.MinRefreshSecs, &version)
+		if err == nil {
+			s.version = version
+		}
+	} else {
+		err = s.store.backEnd.SaveCtx(ctx, &s.sessID, wrapped, s.userID, maxAge, s.MinRefreshSecs)
 	}
-	err = st.backEnd.Save(&s.sessID, dbData, s.userID, s.MaxAgeSecs, s.MinRefreshSecs)
 	if err != nil {
-		return qsErr{"Save - db write failed", err}
+		err = backEndErr(err)
+	}
+	s.store.observe(OpSave, start, len(wrapped), err)
+	if err != nil {
+		return qsErr{"write - db write failed", err}
+	}
+	if isNew {
+		s.store.observeEvent(OpCreate)
+		s.store.lifecycle(LifecycleCreated, s.userID, s.meta)
+	} else {
+		s.store.lifecycle(LifecycleSaved, s.userID, s.meta)
 	}
+	s.markClean(dbData)
+	return nil
+}
+
+// touch extends the session's expiration time, without writing its data.
+// It returns ErrNotSupported if the back-end can't do that.
+func (s *Session) touch(ctx context.Context, maxAge int) error {
+	tb, ok := toucher(s.store.backEnd)
+	if !ok {
+		return ErrNotSupported
+	}
+	start := time.Now()
+	err := tb.TouchCtx(ctx, s.sessID, s.userID, maxAge)
+	if errors.Is(err, ErrNotSupported) {
+		return err
+	}
+	if err != nil {
+		err = backEndErr(err)
+	}
+	s.store.observe(OpTouch, start, 0, err)
+	if err != nil {
+		return qsErr{"touch - db touch failed", err}
+	}
+	s.store.lifecycle(LifecycleSaved, s.userID, s.meta)
+	return nil
+}
+
+// Refresh extends the session's expiration time, like Save, but without
+// marshaling Data, so it must only be used if Data has not been modified
+// since GetSession. If the session's settings or metadata have changed
+// (for example, its MaxAgeSecs), or the back-end does not implement
+// SessToucher, Refresh performs a full Save.
+// Like Save, Refresh must precede any writes to the response body.
+func (s *Session) Refresh(w http.ResponseWriter) error {
+	return s.RefreshCtx(context.Background(), w)
+}
+
+// RefreshCtx is like Refresh, with a context for back-end calls.
+func (s *Session) RefreshCtx(ctx context.Context, w http.ResponseWriter) error {
+	if !s.unchanged() || s.AbsoluteMaxAgeSecs != int(s.meta.absMaxAge) {
+		return s.SaveCtx(ctx, w)
+	}
+	maxAge := s.effectiveMaxAge()
+	if maxAge < 1 {
+		return qsErr{"Refresh - session has reached its absolute lifetime", ErrExpired}
+	}
+	err := s.touch(ctx, maxAge)
+	if errors.Is(err, ErrNotSupported) {
+		return s.SaveCtx(ctx, w)
+	}
+	if err != nil {
+		return qsErr{"Refresh - ", err}
+	}
+	if err := s.sendToClient(w); err != nil {
+		return qsErr{"Refresh - ", err}
+	}
+	return nil
+}
+
+// sendToClient sends a cookie or token referring to the session to the client.
+func (s *Session) sendToClient(w http.ResponseWriter) error {
+	st := s.store
+	s.staleKey = false
 
 	switch st.AuthType {
 	case CookieAuth:
-		ckData, err := s.encode()
+		ckData, err := s.encode(s.effectiveMaxAge())
 		if err != nil {
-			return qsErr{"Save - cookie encode failed", err}
+			return qsErr{"sendToClient - cookie encode failed", err}
 		}
-		http.SetCookie(w, s.newCookie(ckData))
+		s.setCookies(w, ckData)
 	case TokenAuth:
 		if st.SendToken != nil {
-			tokData, err := s.encode()
+			tokData, err := s.encode(s.effectiveMaxAge())
 			if err != nil {
-				return qsErr{"Save - token creation failed", err}
+				return qsErr{"sendToClient - token creation failed", err}
 			}
-			if err := st.SendToken(tokData, s.MaxAgeSecs, w); err != nil {
-				return qsErr{"Save - SendToken failed", err}
+			if err := st.SendToken(tokData, s.effectiveMaxAge(), w); err != nil {
+				return qsErr{"sendToClient - SendToken failed", err}
 			}
 		}
 	}
+	return nil
+}
+
+// Regenerate gives a session a new id, while keeping its data, user id and
+// expiration settings, to prevent session fixation attacks. Call it
+// whenever a user logs in or changes privilege level.
+//
+// A new back-end record is written, a new cookie is written (or, with
+// TokenAuth, SendToken is called, if set; otherwise, call Token to get the
+// new token), and the old record is deleted. If writing the record or
+// sending it to the client fails, the new record is deleted, and the session
+// keeps its old id. If the old record can't be deleted, the session keeps
+// its new id, which the client already has, and an error is returned, because
+// the old id remains usable until it expires.
+// Like Save, Regenerate must precede any writes to the response body.
+func (s *Session) Regenerate(w http.ResponseWriter) error {
+	return s.RegenerateAsCtx(context.Background(), w, nil)
+}
+
+// RegenerateCtx is like Regenerate, with a context for back-end calls.
+func (s *Session) RegenerateCtx(ctx context.Context, w http.ResponseWriter) error {
+	return s.RegenerateAsCtx(ctx, w, nil)
+}
+
+// RegenerateAs is like Regenerate, but also gives the session a new user id,
+// for example, to turn an anonymous pre-login session into an authenticated
+// one. The session's creation time is reset, if the user id changes.
+func (s *Session) RegenerateAs(w http.ResponseWriter, userID []byte) error {
+	return s.RegenerateAsCtx(context.Background(), w, userID)
+}
+
+// RegenerateAsCtx is like RegenerateAs, with a context for back-end calls.
+// A nil userID leaves the user id unchanged.
+func (s *Session) RegenerateAsCtx(ctx context.Context, w http.ResponseWriter, userID []byte) error {
+	if s.MaxAgeSecs < 1 {
+		return qsErr{"Regenerate - MaxAgeSecs must be positive", nil}
+	}
 
-	if st.SessionSaved != nil {
-		if err := st.SessionSaved(s.userID, time.Now()); err != nil {
-			return qsErr{"Save - SessionSaved failed", err}
-		}
+	oldSessID, oldUserID, oldMeta, oldVersion, oldClean := s.sessID, s.userID, s.meta, s.version, s.clean
+	restore := func() {
+		s.sessID, s.userID, s.meta, s.version, s.clean = oldSessID, oldUserID, oldMeta, oldVersion, oldClean
+	}
+
+	s.sessID = nil
+	if userID != nil && !bytes.Equal(userID, s.userID) {
+		s.userID = userID
+		s.meta.created = time.Now().Unix()
 	}
 
+	if err := s.write(ctx, false); err != nil {
+		restore()
+		return qsErr{"Regenerate - ", err}
+	}
+
+	// send the new id before deleting the old record, so that, if sending
+	// fails, the client's old id still works.
+	if err := s.sendToClient(w); err != nil {
+		// don't leave two live sessions around
+		s.store.deleteBackEnd(ctx, s.sessID, s.userID)
+		restore()
+		return qsErr{"Regenerate - ", err}
+	}
+
+	if oldSessID != nil {
+		if err := s.store.deleteBackEnd(ctx, oldSessID, oldUserID); err != nil {
+			return qsErr{"Regenerate - delete old session failed", backEndErr(err)}
+		}
+	}
 	return nil
 }
 
@@ -364,16 +1072,24 @@ func (s *Session) Save(w http.ResponseWriter) error {
 // If you're using tokens, and you've registered an implementation of
 // DeleteToken, Delete will call it to delete the token from the cient.
 func (s *Session) Delete(w http.ResponseWriter) error {
+	return s.DeleteCtx(context.Background(), w)
+}
+
+// DeleteCtx is like Delete, with a context for back-end calls.
+func (s *Session) DeleteCtx(ctx context.Context, w http.ResponseWriter) error {
 	// attempt to delete from database and from client.
 	// if either one succeeds, the session is effectively deleted.
 	// if a zombie database entry is left, back-end will eventually prune it.
-	errDb := s.store.backEnd.Delete(s.sessID, s.userID)
+	errDb := s.store.deleteBackEnd(ctx, s.sessID, s.userID)
 	errClient := s.deleteFromClient(w)
 
 	// if BOTH failed, return an error.
 	if errDb != nil && errClient != nil {
 		return qsErr{"Delete - database - " + errDb.Error() + " --AND-- client - ", errClient}
 	}
+	if s.sessID != nil {
+		s.store.lifecycle(LifecycleDeleted, s.userID, s.meta)
+	}
 
 	return nil
 }
@@ -402,10 +1118,17 @@ func (s *Session) deleteFromClient(w http.ResponseWriter) error {
 // It's OK to invoke DeleteByUserID on a newly-created session object,
 // on which Save has never been called.
 func (s *Session) DeleteByUserID(w http.ResponseWriter) error {
+	return s.DeleteByUserIDCtx(context.Background(), w)
+}
+
+// DeleteByUserIDCtx is like DeleteByUserID, with a context for back-end calls.
+func (s *Session) DeleteByUserIDCtx(ctx context.Context, w http.ResponseWriter) error {
 	st := s.store
 
 	// delete all with matching userID (including the current session)
-	errDb := st.backEnd.DeleteByUserID(s.userID)
+	start := time.Now()
+	errDb := st.backEnd.DeleteByUserIDCtx(ctx, s.userID)
+	st.observe(OpDeleteByUserID, start, 0, errDb)
 
 	// delete current session from client (but not if has never been Saved)
 	if s.sessID != nil {
@@ -413,32 +1136,73 @@ func (s *Session) DeleteByUserID(w http.ResponseWriter) error {
 	}
 
 	if errDb != nil {
-		return qsErr{"DeleteByUserID - back-end - ", errDb}
+		return qsErr{"DeleteByUserID - back-end - ", backEndErr(errDb)}
 	}
+	st.lifecycle(LifecycleRevoked, s.userID, s.meta)
 	return nil
 }
 
+// deleteBackEnd deletes a session's back-end record, and reports it.
+func (st *Store) deleteBackEnd(ctx context.Context, sessID []byte, userID []byte) error {
+	start := time.Now()
+	err := st.backEnd.DeleteCtx(ctx, sessID, userID)
+	st.observe(OpDelete, start, 0, err)
+	return err
+}
+
 // given a Session, return data ready to send to client in a cookie or token.
+// ttlSecs is only used for JWTs, which carry their own expiration times.
+func (s *Session) encode(ttlSecs int) (string, error) {
+	if s.store.JWT != nil {
+		return s.store.encodeJWT(s.sessID, s.userID, ttlSecs)
+	}
+	return s.store.encodeRef(s.sessID, s.userID, nil)
+}
+
+// decode cookie/token data into a Session's session id (and possibly user id)
+func (s *Session) decode(token string) error {
+	var sessID, userID []byte
+	var primary bool
+	var err error
+	if s.store.JWT != nil {
+		sessID, userID, primary, err = s.store.decodeJWT(token)
+	} else {
+		sessID, userID, primary, err = s.store.decodeRef(token, nil)
+	}
+	if err != nil {
+		return err
+	}
+	s.staleKey = !primary
+	s.sessID = sessID
+	if s.store.uidToClient {
+		s.userID = userID
+	}
+	return nil
+}
+
+// encodeRef encrypts a reference to a session, for use outside the server.
 // if Store.uidToClient is false, just encrypt the session id.
 // if it is true, marshall session id + user id, then encrypt.
-func (s *Session) encode() (string, error) {
+// ad distinguishes different kinds of references (see encrypt).
+func (st *Store) encodeRef(sessID []byte, userID []byte, ad []byte) (string, error) {
 	var data []byte
 	var err error
-	if s.store.uidToClient {
+	ad = st.purposeAD(ad)
+	if st.uidToClient {
 		// marshall session id and user id into a buffer, then encrypt
-		sidlen := len(s.sessID)
-		uidlen := len(s.userID)
+		sidlen := len(sessID)
+		uidlen := len(userID)
 		if sidlen > 255 {
 			return "", qsErr{"encode - session id too big", nil}
 		}
 		buf := make([]byte, sidlen+uidlen+1)
 		buf[0] = byte(sidlen)
-		copy(buf[1:1+sidlen], s.sessID)
-		copy(buf[1+sidlen:], s.userID)
-		data, err = s.store.encrypt(buf)
+		copy(buf[1:1+sidlen], sessID)
+		copy(buf[1+sidlen:], userID)
+		data, err = st.encrypt(buf, ad)
 	} else {
 		// just encrypt the session id
-		data, err = s.store.encrypt(s.sessID)
+		data, err = st.encrypt(sessID, ad)
 	}
 	if err != nil {
 		return "", qsErr{"encode - encrypt failed", err}
@@ -446,25 +1210,27 @@ func (s *Session) encode() (string, error) {
 	return string(data), nil
 }
 
-// decode cookie/token data into a Session's session id (and possibly user id)
-func (s *Session) decode(token string) error {
-	data, err := s.store.decrypt([]byte(token))
+// decodeRef is the inverse of encodeRef. userID is only returned if
+// Store.uidToClient is true. primary is false if ref was not made with the
+// Store's primary key.
+func (st *Store) decodeRef(ref string, ad []byte) (sessID []byte, userID []byte, primary bool, err error) {
+	data, primary, err := st.decrypt([]byte(ref), st.purposeAD(ad))
 	if err != nil {
-		return qsErr{"decode - decrypt - ", err}
+		return nil, nil, false, qsErr{"decode - decrypt - ", withSentinel(ErrInvalidToken, err)}
 	}
-	if s.store.uidToClient {
+	if st.uidToClient {
 		// unmarshall session id and user id from decrypted data
+		if len(data) == 0 {
+			return nil, nil, false, qsErr{"decode - bad data from client", ErrInvalidToken}
+		}
 		sidlen := int(data[0])
 		if sidlen+1 > len(data) {
-			return qsErr{"decode - bad data from client", nil}
+			return nil, nil, false, qsErr{"decode - bad data from client", ErrInvalidToken}
 		}
-		s.sessID = data[1 : 1+sidlen]
-		s.userID = data[1+sidlen:]
-	} else {
-		// decrypted data is just the session id
-		s.sessID = data
+		return data[1 : 1+sidlen], data[1+sidlen:], primary, nil
 	}
-	return nil
+	// decrypted data is just the session id
+	return data, nil, primary, nil
 }
 
 func (s *Session) newCookie(value string) *http.Cookie {
@@ -476,7 +1242,7 @@ func (s *Session) newCookie(value string) *http.Cookie {
 		Value:    value,
 		Path:     st.CookiePath,
 		Domain:   st.CookieDomain,
-		MaxAge:   s.MaxAgeSecs,
+		MaxAge:   s.effectiveMaxAge(),
 		Secure:   st.CookieSecure,
 		HttpOnly: st.CookieHTTPOnly,
 		SameSite: st.CookieSameSite,
@@ -487,17 +1253,122 @@ func (s *Session) newCookie(value string) *http.Cookie {
 
 func (s *Session) deleteCookie(w http.ResponseWriter) {
 	// to delete a cookie from the client, send one with a negative MaxAge
-	cookie := s.newCookie("")
-	cookie.MaxAge = -1
-	cookie.Expires = time.Unix(1, 0)
-	http.SetCookie(w, cookie)
+	for i := 0; i < s.cookieChunks || i == 0; i++ {
+		cookie := s.newCookie("")
+		if i > 0 {
+			cookie.Name = s.store.chunkName(i)
+		}
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(1, 0)
+		http.SetCookie(w, cookie)
+	}
+	s.cookieChunks = 0
+}
+
+// maxCookieValueSize is the largest value sent in a single cookie. Browsers
+// limit cookies to about 4096 bytes, including name and attributes, so
+// larger values are split across several cookies. maxCookieChunks limits
+// how many are accepted from clients.
+const (
+	maxCookieValueSize = 3800
+	maxCookieChunks    = 20
+)
+
+func (st *Store) chunkName(i int) string {
+	return st.CookieName + "-" + strconv.Itoa(i)
+}
+
+// setCookies sends a cookie value to the client. If it is too large for one
+// cookie, it is split across several, named CookieName, CookieName-1, etc.,
+// and the first one's value is prefixed with the number of chunks and "~"
+// (which appears in neither plain nor JWT encodings). Chunks left over from
+// a previous, larger value are deleted.
+func (s *Session) setCookies(w http.ResponseWriter, value string) {
+	n := (len(value) + maxCookieValueSize - 1) / maxCookieValueSize
+	if n <= 1 {
+		n = 1
+		http.SetCookie(w, s.newCookie(value))
+	} else {
+		for i := 0; i < n; i++ {
+			end := (i + 1) * maxCookieValueSize
+			if end > len(value) {
+				end = len(value)
+			}
+			cookie := s.newCookie(value[i*maxCookieValueSize : end])
+			if i == 0 {
+				cookie.Value = strconv.Itoa(n) + "~" + cookie.Value
+			} else {
+				cookie.Name = s.store.chunkName(i)
+			}
+			http.SetCookie(w, cookie)
+		}
+	}
+	for i := n; i < s.cookieChunks; i++ {
+		cookie := s.newCookie("")
+		cookie.Name = s.store.chunkName(i)
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(1, 0)
+		http.SetCookie(w, cookie)
+	}
+	s.cookieChunks = n
 }
 
-// BackEnd is exported only for use by tests.
+// readCookies is the inverse of setCookies.
+func (st *Store) readCookies(r *http.Request) (value string, chunks int, err error) {
+	cookie, err := r.Cookie(st.CookieName)
+	if err != nil {
+		return "", 0, err
+	}
+	i := strings.IndexByte(cookie.Value, '~')
+	if i < 0 {
+		return cookie.Value, 1, nil
+	}
+	n, err := strconv.Atoi(cookie.Value[:i])
+	if err != nil || n < 2 || n > maxCookieChunks {
+		return "", 0, qsErr{"readCookies - bad chunk count", nil}
+	}
+	var b strings.Builder
+	b.WriteString(cookie.Value[i+1:])
+	for j := 1; j < n; j++ {
+		chunk, err := r.Cookie(st.chunkName(j))
+		if err != nil {
+			return "", 0, qsErr{"readCookies - missing chunk", err}
+		}
+		b.WriteString(chunk.Value)
+	}
+	return b.String(), n, nil
+}
+
+// BackEnd returns the Store's back-end as a SessBackEnd, for callers written
+// before SessBackEndCtx. A back-end given to NewStore which only implements
+// SessBackEnd is returned as is; any other is wrapped in an adapter which
+// passes context.Background to its methods. New code should use BackEndCtx.
 func (st *Store) BackEnd() SessBackEnd {
+	switch be := st.backEnd.(type) {
+	case nil:
+		return nil
+	case legacyBackEnd:
+		return be.be
+	case SessBackEnd:
+		return be
+	default:
+		return ctxlessBackEnd{be}
+	}
+}
+
+// BackEndCtx returns the Store's back-end, for tests, for testing which
+// optional interfaces it implements, and for wrapping (see SetBackEnd).
+func (st *Store) BackEndCtx() SessBackEndCtx {
 	return st.backEnd
 }
 
+// SetBackEnd replaces the Store's back-end, typically with a wrapper of the
+// original one, such as a CachingBackEnd. It must be called before the
+// Store is used.
+func (st *Store) SetBackEnd(be SessBackEndCtx) {
+	st.backEnd = be
+}
+
 // error message wrapping with context and lazy evaluation
 
 type qsErr struct {
@@ -511,3 +1382,7 @@ func (e qsErr) Error() string {
 	}
 	return "qsess." + e.msg
 }
+
+func (e qsErr) Unwrap() error {
+	return e.err
+}
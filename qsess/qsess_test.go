@@ -7,7 +7,11 @@ package qsess
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -70,3 +74,498 @@ func TestUidToClient(t *testing.T) {
 
 	sess.Delete(w)
 }
+
+// legacyMapStore hides mapStore's context-aware methods, to exercise
+// NewStore's adapter for back-ends which only implement SessBackEnd.
+type legacyMapStore struct {
+	m *mapStore
+}
+
+func (l legacyMapStore) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	return l.m.SaveCtx(context.Background(), sessID, data, userID, maxAgeSecs, minRefreshSecs)
+}
+
+func (l legacyMapStore) Get(sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	return l.m.GetCtx(context.Background(), sessID, uID)
+}
+
+func (l legacyMapStore) Delete(sessID []byte, uID []byte) error {
+	return l.m.DeleteCtx(context.Background(), sessID, uID)
+}
+
+func (l legacyMapStore) DeleteByUserID(userID []byte) error {
+	return l.m.DeleteByUserIDCtx(context.Background(), userID)
+}
+
+// TestLegacyBackEnd tests that a back-end which only implements SessBackEnd
+// works, and that a cancelled context keeps it from being called.
+func TestLegacyBackEnd(t *testing.T) {
+	ms := makeTestStore(t, false).backEnd.(*mapStore)
+	store, err := NewStore(legacyMapStore{ms}, false, []byte("key-for-encryption--------------"))
+	if err != nil {
+		t.Fatal("NewStore failed - " + err.Error())
+	}
+	if _, ok := store.backEnd.(legacyBackEnd); !ok {
+		t.Fatal("legacy back-end was not wrapped in an adapter")
+	}
+	if _, ok := store.BackEnd().(legacyMapStore); !ok {
+		t.Fatal("BackEnd did not return the legacy back-end")
+	}
+
+	sess := store.NewSession([]byte("userid-legacy"))
+	w := httptest.NewRecorder()
+	if err := sess.Save(w); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+
+	if _, _, err := store.GetTokenSession(tok); err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := store.GetTokenSessionCtx(ctx, tok); err == nil {
+		t.Fatal("GetTokenSessionCtx succeeded with a cancelled context")
+	}
+	if err := sess.SaveCtx(ctx, w); err == nil {
+		t.Fatal("SaveCtx succeeded with a cancelled context")
+	}
+}
+
+// sliceErr is an error whose dynamic type is not comparable.
+type sliceErr []string
+
+func (e sliceErr) Error() string { return strings.Join(e, ", ") }
+
+// failingLegacyStore is a SessBackEnd whose Get always fails with err.
+type failingLegacyStore struct {
+	legacyMapStore
+	err error
+}
+
+func (f failingLegacyStore) Get(sessID []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	return nil, nil, 0, 0, 0, f.err
+}
+
+// TestLegacyBackEndErrors tests the classification of errors from a
+// back-end which only implements SessBackEnd.
+func TestLegacyBackEndErrors(t *testing.T) {
+	ms := makeTestStore(t, false).backEnd.(*mapStore)
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{sliceErr{"connection", "refused"}, ErrBackend},
+		{errors.New("database is down"), ErrBackend},
+		{fmt.Errorf("no such row - %w", ErrNotFound), ErrNotFound},
+	}
+	for _, tt := range tests {
+		store, err := NewStore(failingLegacyStore{legacyMapStore{ms}, tt.err}, false, []byte("key-for-encryption--------------"))
+		if err != nil {
+			t.Fatal("NewStore failed - " + err.Error())
+		}
+		store.AuthType = TokenAuth
+		sess := store.NewSession([]byte("userid-legacy"))
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		tok, err := sess.encode(0)
+		if err != nil {
+			t.Fatal("encode failed - " + err.Error())
+		}
+		_, _, err = store.GetTokenSession(tok)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Get failing with %q - expected %v, got %v", tt.err, tt.want, err)
+		}
+		if tt.want == ErrBackend && errors.Is(err, ErrNotFound) {
+			t.Errorf("Get failing with %q - reported as ErrNotFound", tt.err)
+		}
+	}
+}
+
+// TestBackEndAdapter tests that BackEnd adapts a context-aware back-end to
+// SessBackEnd, for callers written before SessBackEndCtx.
+func TestBackEndAdapter(t *testing.T) {
+	store := makeTestStore(t, false)
+	var be SessBackEnd = store.BackEnd()
+
+	var sessID []byte
+	if err := be.Save(&sessID, []byte("data"), []byte("userid-adapter"), 60, 30); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	data, userID, _, _, _, err := be.Get(sessID, nil)
+	if err != nil {
+		t.Fatal("Get failed - " + err.Error())
+	}
+	if string(data) != "data" || string(userID) != "userid-adapter" {
+		t.Fatal("Get returned the wrong session")
+	}
+	if err := be.Delete(sessID, nil); err != nil {
+		t.Fatal("Delete failed - " + err.Error())
+	}
+	if _, _, _, _, _, err := be.Get(sessID, nil); err == nil {
+		t.Fatal("Get succeeded after Delete")
+	}
+	if store.BackEndCtx() != store.backEnd {
+		t.Fatal("BackEndCtx did not return the back-end")
+	}
+}
+
+// countingMapStore counts full writes and touches.
+type countingMapStore struct {
+	*mapStore
+	saves, touches int
+}
+
+func (c *countingMapStore) SaveVersionCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int, version *int64) error {
+	c.saves++
+	return c.mapStore.SaveVersionCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs, version)
+}
+
+func (c *countingMapStore) TouchCtx(ctx context.Context, sessID []byte, uID []byte, maxAgeSecs int) error {
+	c.touches++
+	return c.mapStore.TouchCtx(ctx, sessID, uID, maxAgeSecs)
+}
+
+// TestTouch checks that Save only touches sessions whose data and settings
+// have not changed, and that Refresh touches without marshaling.
+func TestTouch(t *testing.T) {
+	store := makeTestStore(t, false)
+	cms := &countingMapStore{mapStore: store.backEnd.(*mapStore)}
+	store.backEnd = cms
+	store.AuthType = TokenAuth
+
+	sess := store.NewSession([]byte("touch-user"))
+	sess.Data.(*VarMap).Vars["a"] = "b"
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	tok, _, _ := sess.Token()
+
+	check := func(what string, saves, touches int) {
+		t.Helper()
+		if cms.saves != saves || cms.touches != touches {
+			t.Fatalf("%s - expected %d saves, %d touches; got %d, %d", what, saves, touches, cms.saves, cms.touches)
+		}
+	}
+	check("first Save", 1, 0)
+
+	sess, _, err := store.GetTokenSession(tok)
+	if err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	check("unchanged Save", 1, 1)
+
+	if err := sess.Refresh(httptest.NewRecorder()); err != nil {
+		t.Fatal("Refresh failed - " + err.Error())
+	}
+	check("Refresh", 1, 2)
+
+	sess.Data.(*VarMap).Vars["a"] = "c"
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	check("Save of changed data", 2, 2)
+
+	sess.MaxAgeSecs++
+	if err := sess.Refresh(httptest.NewRecorder()); err != nil {
+		t.Fatal("Refresh failed - " + err.Error())
+	}
+	check("Refresh with changed MaxAgeSecs", 3, 2)
+
+	sess, _, err = store.GetTokenSession(tok)
+	if err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	if sess.Data.(*VarMap).Vars["a"].(string) != "c" {
+		t.Fatal("changed data was not saved")
+	}
+}
+
+// failingMapStore fails every Get, as if the database were down.
+type failingMapStore struct {
+	*mapStore
+}
+
+func (f failingMapStore) GetVersionCtx(ctx context.Context, sessID []byte, uID []byte) ([]byte, []byte, int, int, int, int64, error) {
+	return nil, nil, 0, 0, 0, 0, errors.New("connection refused")
+}
+
+// TestBackendError checks that unclassified back-end failures are reported
+// as ErrBackend, and that legacy back-ends' failures are not.
+func TestBackendError(t *testing.T) {
+	store := makeTestStore(t, false)
+	sess := store.NewSession([]byte("userid"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	tok, _, _ := sess.Token()
+
+	store.backEnd = failingMapStore{store.backEnd.(*mapStore)}
+	_, _, err := store.GetTokenSession(tok)
+	if !errors.Is(err, ErrBackend) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrBackend, got %v", err)
+	}
+
+	legacy, err := NewStore(legacyMapStore{&mapStore{sess: map[uint32]mapSess{}, uindex: map[string]map[uint32]struct{}{}}}, false, []byte("key-for-encryption--------------"))
+	if err != nil {
+		t.Fatal("NewStore failed - " + err.Error())
+	}
+	_, _, err = legacy.GetTokenSession(tok)
+	if err == nil || errors.Is(err, ErrBackend) {
+		t.Fatalf("legacy back-end - expected a non-ErrBackend error, got %v", err)
+	}
+}
+
+// TestKeyRotation checks that cookies made with a non-primary key, or before
+// key ids were introduced, are accepted and re-issued under the primary key,
+// and that cookies made with a retired key are rejected.
+func TestKeyRotation(t *testing.T) {
+	oldKey := []byte("old-key-for-encryption----------")
+	newKey := []byte("new-key-for-encryption----------")
+
+	oldStore, err := NewMapStore(oldKey)
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	sess := oldStore.NewSession([]byte("userid-rotate"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	oldCookie, err := sess.encode(sess.MaxAgeSecs)
+	if err != nil {
+		t.Fatal("encode failed - " + err.Error())
+	}
+
+	// a cookie in the format used before key ids: nonce, then ciphertext.
+	c := oldStore.ciphers[0]
+	nonce := make([]byte, c.NonceSize())
+	sealed := c.Seal(nonce, nonce, sess.sessID, nil)
+	legacyCookie := base64.URLEncoding.EncodeToString(sealed)
+
+	// same back-end, with a new primary key.
+	rotated, err := NewStoreCtx(oldStore.backEnd, false, newKey, oldKey)
+	if err != nil {
+		t.Fatal("NewStoreCtx failed - " + err.Error())
+	}
+	if !rotated.LegacyTokens {
+		t.Fatal("LegacyTokens is not set by default")
+	}
+
+	getWithCookie := func(st *Store, cookie string) (*Session, *httptest.ResponseRecorder, error) {
+		r, _ := http.NewRequest("GET", "http://foo.com", nil)
+		r.AddCookie(&http.Cookie{Name: st.CookieName, Value: cookie})
+		w := httptest.NewRecorder()
+		s, _, err := st.GetSession(w, r)
+		return s, w, err
+	}
+
+	for _, cookie := range []string{oldCookie, legacyCookie} {
+		s, w, err := getWithCookie(rotated, cookie)
+		if err != nil {
+			t.Fatal("GetSession with old cookie failed - " + err.Error())
+		}
+		if s.StaleKey() {
+			t.Error("StaleKey still true after GetSession re-issued the cookie")
+		}
+		resp := w.Result()
+		if len(resp.Cookies()) != 1 {
+			t.Fatal("GetSession did not re-issue the cookie")
+		}
+		s2, w2, err := getWithCookie(rotated, resp.Cookies()[0].Value)
+		if err != nil {
+			t.Fatal("GetSession with re-issued cookie failed - " + err.Error())
+		}
+		if !bytes.Equal(s2.sessID, sess.sessID) || s2.StaleKey() {
+			t.Error("re-issued cookie refers to the wrong session, or is stale")
+		}
+		if len(w2.Result().Cookies()) != 0 {
+			t.Error("GetSession re-issued a cookie made with the primary key")
+		}
+	}
+
+	// without LegacyTokens, cookies without key ids are rejected.
+	rotated.LegacyTokens = false
+	if _, _, err := getWithCookie(rotated, legacyCookie); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for cookie without key id, got %v", err)
+	}
+
+	// retire the old key.
+	retired, err := NewStoreCtx(oldStore.backEnd, false, newKey)
+	if err != nil {
+		t.Fatal("NewStoreCtx failed - " + err.Error())
+	}
+	if _, _, err := getWithCookie(retired, oldCookie); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for cookie made with retired key, got %v", err)
+	}
+}
+
+// countingAEAD counts calls to Open.
+type countingAEAD struct {
+	cipher.AEAD
+	opens *int
+}
+
+func (c countingAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	*c.opens++
+	return c.AEAD.Open(dst, nonce, ciphertext, additionalData)
+}
+
+// TestUnknownKeyID checks that, with LegacyTokens cleared, a token whose
+// key id matches no key is rejected without any decryption attempts.
+func TestUnknownKeyID(t *testing.T) {
+	store, err := NewMapStore(
+		[]byte("key-to-detect-tampering---------"),
+		[]byte("key-for-encryption--------------"),
+	)
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	opens := 0
+	for i, c := range store.ciphers {
+		store.ciphers[i] = countingAEAD{c, &opens}
+	}
+	store.LegacyTokens = false
+
+	var id byte
+	for bytes.IndexByte(store.keyIDs, id) >= 0 {
+		id++
+	}
+	forged := make([]byte, 1+store.ciphers[0].NonceSize()+32)
+	forged[0] = id
+	tok := base64.URLEncoding.EncodeToString(forged)
+
+	if _, _, err := store.GetTokenSession(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+	if opens != 0 {
+		t.Errorf("expected no decryption attempts, got %d", opens)
+	}
+
+	store.LegacyTokens = true
+	if _, _, err := store.GetTokenSession(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("LegacyTokens - expected ErrInvalidToken, got %v", err)
+	}
+	if opens != len(store.ciphers) {
+		t.Errorf("LegacyTokens - expected %d decryption attempts, got %d", len(store.ciphers), opens)
+	}
+}
+
+// TestPurpose checks that Stores with different purposes reject each other's
+// tokens, whether they share keys or derive them from a shared secret.
+func TestPurpose(t *testing.T) {
+	master := []byte("master-secret")
+
+	login, email := DeriveKeys("login", master), DeriveKeys("email", master)
+	if len(login[0]) != 32 || bytes.Equal(login[0], email[0]) {
+		t.Fatal("DeriveKeys should make distinct 32-byte keys for each purpose")
+	}
+	if !bytes.Equal(login[0], DeriveKeys("login", master)[0]) {
+		t.Fatal("DeriveKeys is not deterministic")
+	}
+
+	makeStore := func(be SessBackEndCtx, purpose string, keys ...[]byte) *Store {
+		st, err := NewStoreCtx(be, false, keys...)
+		if err != nil {
+			t.Fatal("NewStoreCtx failed - " + err.Error())
+		}
+		st.Purpose = purpose
+		return st
+	}
+	first := makeTestStore(t, false)
+	first.Purpose = "login"
+	sess := first.NewSession([]byte("userid-purpose"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+
+	sameKeys := []byte("key-to-detect-tampering---------")
+	otherPurpose := makeStore(first.backEnd, "email", sameKeys)
+	if _, _, err := otherPurpose.GetTokenSession(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Store with other purpose, same keys - expected ErrInvalidToken, got %v", err)
+	}
+	samePurpose := makeStore(first.backEnd, "login", sameKeys)
+	if _, _, err := samePurpose.GetTokenSession(tok); err != nil {
+		t.Errorf("Store with same purpose and keys rejected token - %v", err)
+	}
+
+	loginStore := makeStore(first.backEnd, "login", login...)
+	sess = loginStore.NewSession([]byte("userid-purpose"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	if tok, _, err = sess.Token(); err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+	emailStore := makeStore(first.backEnd, "", email...)
+	if _, _, err := emailStore.GetTokenSession(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Store with keys derived for other purpose - expected ErrInvalidToken, got %v", err)
+	}
+	if _, _, err := makeStore(first.backEnd, "login", DeriveKeys("login", master)...).GetTokenSession(tok); err != nil {
+		t.Errorf("Store with keys derived for same purpose rejected token - %v", err)
+	}
+}
+
+func TestFingerprintIPPrefix(t *testing.T) {
+	fp := FingerprintIPPrefix(24, 64)
+	tests := []struct {
+		addr1, addr2 string
+		same         bool
+	}{
+		{"192.0.2.1:1234", "192.0.2.200:5678", true},
+		{"192.0.2.1:1234", "192.0.3.1:1234", false},
+		{"[2001:db8::1]:1234", "[2001:db8::ffff]:1234", true},
+		{"[2001:db8::1]:1234", "[2001:db8:0:1::1]:1234", false},
+	}
+	for _, tt := range tests {
+		r1 := &http.Request{RemoteAddr: tt.addr1}
+		r2 := &http.Request{RemoteAddr: tt.addr2}
+		if bytes.Equal(fp(r1), fp(r2)) != tt.same {
+			t.Errorf("%s vs %s - expected same = %v", tt.addr1, tt.addr2, tt.same)
+		}
+	}
+}
+
+// TestRegenerateSendFails tests that, if Regenerate can't send the new id to
+// the client, the session keeps its old id, which still works.
+func TestRegenerateSendFails(t *testing.T) {
+	store := makeTestStore(t, false)
+	store.AuthType = TokenAuth
+
+	sess := store.NewSession([]byte("userid-regen"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+	oldID := sess.sessID
+
+	store.SendToken = func(token string, maxAgeSecs int, w http.ResponseWriter) error {
+		return errors.New("client went away")
+	}
+	if err := sess.Regenerate(httptest.NewRecorder()); err == nil {
+		t.Fatal("Regenerate succeeded although SendToken failed")
+	}
+	if !bytes.Equal(sess.sessID, oldID) {
+		t.Fatal("Regenerate changed the session's id although SendToken failed")
+	}
+	if _, _, err := store.GetTokenSession(tok); err != nil {
+		t.Fatal("old token no longer works after failed Regenerate - " + err.Error())
+	}
+	if n := len(store.backEnd.(*mapStore).sess); n != 1 {
+		t.Fatalf("expected 1 session in back-end after failed Regenerate, found %d", n)
+	}
+}
@@ -29,7 +29,10 @@ package qsldb
 //   but it doesn't seem worth the trouble, for such an unlikely scenario.
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/gkong/go-qweb/qsess"
@@ -39,7 +42,9 @@ import (
 
 const DefaultPruneIntervalSecs = 2 * 60 // prune every 2 minutes
 
-// type gldbStore holds per-store information and implements SessBackEnd
+// type gldbStore holds per-store information and implements SessBackEndCtx.
+// goleveldb calls cannot be interrupted, so contexts are only checked
+// before starting work.
 
 type gldbStore struct {
 	db *leveldb.DB
@@ -49,6 +54,13 @@ type gldbStore struct {
 	sessPrefix []byte // key prefix for session table records
 	expPrefix  []byte // key prefix for expiration index records
 	uidPrefix  []byte // key prefix for user id index records
+	verPrefix  []byte // key prefix for session version records
+
+	// saveMu serializes saves, deletes and consumes, so version checks and
+	// updates, and get-and-delete, are atomic, and a save can't bring back a
+	// session deleted after it checked the version.
+	// (a goleveldb database can only be opened by one process.)
+	saveMu sync.Mutex
 
 	sessKeySize int
 	expKeySize  int
@@ -62,8 +74,8 @@ type gldbStore struct {
 // a single goleveldb session store, prefix can be empty.
 //
 // cipherkeys are one or more 32-byte encryption keys, to be used with
-// AES-GCM. For encryption, only the first key is used;
-// for decryption all keys are tried (allowing key rotation).
+// AES-GCM. For encryption, only the first key is used; for decryption,
+// the key is identified by the cookie or token (allowing key rotation).
 //
 // Additional configuration options can be set by manipulating fields in the
 // returned qsess.Store.
@@ -83,29 +95,51 @@ func NewGldbStore(db *leveldb.DB, prefix []byte, errLog io.Writer, cipherkeys ..
 		sessPrefix: bscat(prefix, []byte{1}),
 		expPrefix:  bscat(prefix, []byte{2}),
 		uidPrefix:  bscat(prefix, []byte{3}),
+		verPrefix:  bscat(prefix, []byte{4}),
 	}
 
 	gst.sessKeySize = sessKeySize(gst.prefixSize)
 	gst.expKeySize = expKeySize(gst.prefixSize)
 
-	st, err := qsess.NewStore(gst, false, cipherkeys...)
+	st, err := qsess.NewStoreCtx(gst, false, cipherkeys...)
 	if err != nil {
 		return nil, gldbErr{"NewGldbStore - NewStore - ", err}
 	}
 	st.PruneInterval = make(chan int)
 	st.PruneKill = make(chan int)
 
-	go gst.prune(DefaultPruneIntervalSecs, st.PruneInterval, st.PruneKill, errLog)
+	go gst.prune(st, DefaultPruneIntervalSecs, st.PruneInterval, st.PruneKill, errLog)
 
 	return st, nil
 }
 
-func (gst *gldbStore) Get(sessID []byte, uidNOTUSED []byte) (data []byte, userID []byte, timeToLiveSecs int, maxAgeSecs int, minRefreshSecs int, err error) {
-	data, err = gst.db.Get(sessID, nil)
-	if err != nil {
+func (gst *gldbStore) GetCtx(ctx context.Context, sessID []byte, uID []byte) (data []byte, userID []byte, timeToLiveSecs int, maxAgeSecs int, minRefreshSecs int, err error) {
+	data, userID, timeToLiveSecs, maxAgeSecs, minRefreshSecs, _, err = gst.GetVersionCtx(ctx, sessID, uID)
+	return
+}
+
+func (gst *gldbStore) GetVersionCtx(ctx context.Context, sessID []byte, uidNOTUSED []byte) (data []byte, userID []byte, timeToLiveSecs int, maxAgeSecs int, minRefreshSecs int, version int64, err error) {
+	if err = ctx.Err(); err != nil {
 		err = gldbErr{"gldbStore.Get", err}
 		return
 	}
+	if !gst.isSessKey(sessID) {
+		err = errBadSessID
+		return
+	}
+	// read the session record and its version from one snapshot, so a
+	// concurrent save can't pair old data with a new version.
+	snap, err := gst.db.GetSnapshot()
+	if err != nil {
+		err = gldbErr{"gldbStore.Get - snapshot", err}
+		return
+	}
+	defer snap.Release()
+	data, err = snap.Get(sessID, nil)
+	if err != nil {
+		err = gldbErr{"gldbStore.Get", notFound(err)}
+		return
+	}
 
 	if len(data) < sessValueFixedPartSize {
 		err = gldbErr{"gldbStore.Get - malformed session record", nil}
@@ -114,18 +148,38 @@ func (gst *gldbStore) Get(sessID []byte, uidNOTUSED []byte) (data []byte, userID
 	sessVal := gldbSessValue(data)
 	ttl := sessVal.expiration() - time.Now().Unix()
 	if ttl <= 0 {
-		gst.Delete(sessID, nil)
-		err = gldbErr{"gldbStore.Get - expired", nil}
+		gst.DeleteCtx(ctx, sessID, nil)
+		// return the record with the error, for qsess lifecycle events
+		data, userID = sessVal.data(), sessVal.userID()
+		err = gldbErr{"gldbStore.Get - expired", qsess.ErrExpired}
 		return
 	}
 
-	return sessVal.data(), sessVal.userID(), int(ttl), int(sessVal.maxage()), int(sessVal.minrefresh()), nil
+	if version, err = gst.version(snap, sessID); err != nil {
+		err = gldbErr{"gldbStore.Get - version", err}
+		return
+	}
+
+	return sessVal.data(), sessVal.userID(), int(ttl), int(sessVal.maxage()), int(sessVal.minrefresh()), version, nil
 }
 
-func (gst *gldbStore) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+func (gst *gldbStore) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	version := int64(-1)
+	return gst.SaveVersionCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs, &version)
+}
+
+func (gst *gldbStore) SaveVersionCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int, version *int64) error {
 	var sessKey gldbSessKey
 	var firstSave bool
 	var oldExpKey gldbExpKey
+	var oldVersion int64
+
+	if err := ctx.Err(); err != nil {
+		return gldbErr{"gldbStore.Save", err}
+	}
+
+	gst.saveMu.Lock()
+	defer gst.saveMu.Unlock()
 
 	if *sessID == nil {
 		// this is the first Save of a new session; generate a unique key.
@@ -133,17 +187,27 @@ func (gst *gldbStore) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSec
 		*sessID = sessKey
 		firstSave = true
 	} else {
+		if !gst.isSessKey(*sessID) {
+			return errBadSessID
+		}
 		sessKey = *sessID
 		// see if session exists; could be gone via expiration or DeleteByUserId
 		oldData, err := gst.db.Get(sessKey, nil)
 		if err != nil {
-			return gldbErr{"gldbStore.Save - session not found", nil}
+			return gldbErr{"gldbStore.Save - session not found", notFound(err)}
 		}
 		if len(oldData) < sessValueFixedPartSize {
 			return gldbErr{"gldbStore.Save - malformed session record", nil}
 		}
 		oldSessVal := gldbSessValue(oldData)
 		oldExpKey = gst.expKey(oldSessVal.expirationBytes(), sessKey)
+
+		if oldVersion, err = gst.version(gst.db, sessKey); err != nil {
+			return gldbErr{"gldbStore.Save - version", err}
+		}
+		if *version >= 0 && *version != oldVersion {
+			return qsess.ErrConflict
+		}
 	}
 
 	sessVal, err := newSessValue(len(userID), len(data))
@@ -159,19 +223,29 @@ func (gst *gldbStore) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSec
 	// sequence: expiration index entry, session record, user id index entry
 	// so we can't leak anything if we get interrupted.
 
-	if err := gst.db.Put(gst.expKey(sessVal.expirationBytes(), sessKey), []byte{}, nil); err != nil {
+	newExpKey := gst.expKey(sessVal.expirationBytes(), sessKey)
+	if err := gst.db.Put(newExpKey, []byte{}, nil); err != nil {
 		return gldbErr{"gldbStore.Save - expiration index Put", err}
 	}
 
-	if err := gst.db.Put(sessKey, sessVal, nil); err != nil {
+	// the session record and its version are written in one batch, so
+	// readers never see one without the other.
+	verVal := make([]byte, bytesPerInt64)
+	itob(verVal, oldVersion+1)
+	batch := new(leveldb.Batch)
+	batch.Put(sessKey, sessVal)
+	batch.Put(gst.verKey(sessKey), verVal)
+	if err := gst.db.Write(batch, nil); err != nil {
 		return gldbErr{"gldbStore.Save - session Put", err}
 	}
+	*version = oldVersion + 1
 
 	if firstSave {
 		if err := gst.db.Put(gst.uidKey(userID, sessKey), []byte{}, nil); err != nil {
 			return gldbErr{"gldbStore.Save - userid index Put", err}
 		}
-	} else {
+	} else if !bytes.Equal(oldExpKey, newExpKey) {
+		// (saved again within the same second, the keys are the same.)
 		if err := gst.db.Delete(oldExpKey, nil); err != nil {
 			return gldbErr{"gldbStore.Save - old expiration index Delete", err}
 		}
@@ -180,20 +254,76 @@ func (gst *gldbStore) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSec
 	return nil
 }
 
-func (gst *gldbStore) Delete(sessID []byte, uidNOTUSED []byte) error {
+func (gst *gldbStore) TouchCtx(ctx context.Context, sessID []byte, uidNOTUSED []byte, maxAgeSecs int) error {
+	if err := ctx.Err(); err != nil {
+		return gldbErr{"gldbStore.Touch", err}
+	}
+	if !gst.isSessKey(sessID) {
+		return errBadSessID
+	}
+
+	// serialize with saves, so we can't overwrite newer data with the old.
+	gst.saveMu.Lock()
+	defer gst.saveMu.Unlock()
+
 	data, err := gst.db.Get(sessID, nil)
 	if err != nil {
-		return gldbErr{"gldbStore.Delete - Get", err}
+		return gldbErr{"gldbStore.Touch - session not found", notFound(err)}
 	}
 	if len(data) < sessValueFixedPartSize {
-		return gldbErr{"gldbStore.Delete - malformed session record", nil}
+		return gldbErr{"gldbStore.Touch - malformed session record", nil}
 	}
 	sessVal := gldbSessValue(data)
+	oldExpKey := gst.expKey(append([]byte{}, sessVal.expirationBytes()...), sessID)
+	itob(sessVal.expirationBytes(), time.Now().Add(time.Duration(maxAgeSecs)*time.Second).Unix())
 
-	// sequence: user id index entry, session record, expiration index entry
-	// so we can't leak anything if we get interrupted.
+	// same sequence as Save: new expiration index entry, session record,
+	// old expiration index entry.
+
+	newExpKey := gst.expKey(sessVal.expirationBytes(), sessID)
+	if err := gst.db.Put(newExpKey, []byte{}, nil); err != nil {
+		return gldbErr{"gldbStore.Touch - expiration index Put", err}
+	}
+	if err := gst.db.Put(sessID, sessVal, nil); err != nil {
+		return gldbErr{"gldbStore.Touch - session Put", err}
+	}
+	if !bytes.Equal(oldExpKey, newExpKey) {
+		if err := gst.db.Delete(oldExpKey, nil); err != nil {
+			return gldbErr{"gldbStore.Touch - old expiration index Delete", err}
+		}
+	}
+	return nil
+}
+
+func (gst *gldbStore) DeleteCtx(ctx context.Context, sessID []byte, uidNOTUSED []byte) error {
+	if err := ctx.Err(); err != nil {
+		return gldbErr{"gldbStore.Delete", err}
+	}
+	if !gst.isSessKey(sessID) {
+		return errBadSessID
+	}
+
+	gst.saveMu.Lock()
+	defer gst.saveMu.Unlock()
+
+	data, err := gst.db.Get(sessID, nil)
+	if err != nil {
+		return gldbErr{"gldbStore.Delete - Get", notFound(err)}
+	}
+	if len(data) < sessValueFixedPartSize {
+		return gldbErr{"gldbStore.Delete - malformed session record", nil}
+	}
+	return gst.deleteSess(sessID, gldbSessValue(data))
+}
+
+// deleteSess deletes a session record, which has been read as sessVal, and
+// its index entries.
+func (gst *gldbStore) deleteSess(sessID []byte, sessVal gldbSessValue) error {
+	// sequence: user id index entry, version record, session record,
+	// expiration index entry, so we can't leak anything if we get interrupted.
 
 	gst.db.Delete(gst.uidKey(sessVal.userID(), sessID), nil)
+	gst.db.Delete(gst.verKey(sessID), nil)
 
 	if err := gst.db.Delete(sessID, nil); err != nil {
 		return gldbErr{"gldbStore.Delete - session Delete", err}
@@ -206,17 +336,62 @@ func (gst *gldbStore) Delete(sessID []byte, uidNOTUSED []byte) error {
 	return nil
 }
 
-func (gst *gldbStore) DeleteByUserID(userID []byte) error {
+// ConsumeCtx gets and deletes a session, holding saveMu, so concurrent
+// consumers (and saves) of the same session are serialized.
+func (gst *gldbStore) ConsumeCtx(ctx context.Context, sessID []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, 0, 0, 0, gldbErr{"gldbStore.Consume", err}
+	}
+	if !gst.isSessKey(sessID) {
+		return nil, nil, 0, 0, 0, errBadSessID
+	}
+
+	gst.saveMu.Lock()
+	defer gst.saveMu.Unlock()
+
+	data, err := gst.db.Get(sessID, nil)
+	if err != nil {
+		return nil, nil, 0, 0, 0, gldbErr{"gldbStore.Consume", notFound(err)}
+	}
+	if len(data) < sessValueFixedPartSize {
+		return nil, nil, 0, 0, 0, gldbErr{"gldbStore.Consume - malformed session record", nil}
+	}
+	sessVal := gldbSessValue(data)
+	if err := gst.deleteSess(sessID, sessVal); err != nil {
+		return nil, nil, 0, 0, 0, err
+	}
+
+	ttl := sessVal.expiration() - time.Now().Unix()
+	if ttl <= 0 {
+		return sessVal.data(), sessVal.userID(), 0, 0, 0, gldbErr{"gldbStore.Consume - expired", qsess.ErrExpired}
+	}
+	return sessVal.data(), sessVal.userID(), int(ttl), int(sessVal.maxage()), int(sessVal.minrefresh()), nil
+}
+
+func (gst *gldbStore) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
 	// since sessions can disappear via expiration, it's not necessarily
 	// an error for any (or all) of these deletes to fail,
 	// so just plow ahead, attempting everything, then blithely return nil
 
+	if err := ctx.Err(); err != nil {
+		return gldbErr{"gldbStore.DeleteByUserID", err}
+	}
+
+	gst.saveMu.Lock()
+	defer gst.saveMu.Unlock()
+
 	// find sessions using index of sessions by userid
+	uidKeyLen := len(gst.uidKeyPrefix(userID)) + gst.sessKeySize
 	iter := gst.db.NewIterator(util.BytesPrefix(gst.uidKeyPrefix(userID)), nil)
 	for iter.Next() {
 		uxkey := gldbUIDKey(iter.Key())
+		if len(uxkey) != uidKeyLen {
+			// belongs to a longer user id, which has userID as a prefix
+			continue
+		}
 		skey := uxkey.sessKey(gst.prefixSize)
 		expir, expErr := gst.findExpiration(skey)
+		gst.db.Delete(gst.verKey(skey), nil)
 		gst.db.Delete(skey, nil)
 		gst.db.Delete(uxkey, nil)
 		if expErr == nil {
@@ -227,6 +402,156 @@ func (gst *gldbStore) DeleteByUserID(userID []byte) error {
 	return nil
 }
 
+func (gst *gldbStore) ListByUserIDCtx(ctx context.Context, userID []byte) ([]qsess.SessEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, gldbErr{"gldbStore.ListByUserID", err}
+	}
+
+	var entries []qsess.SessEntry
+	now := time.Now().Unix()
+	uidKeyLen := len(gst.uidKeyPrefix(userID)) + gst.sessKeySize
+
+	iter := gst.db.NewIterator(util.BytesPrefix(gst.uidKeyPrefix(userID)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		uxkey := gldbUIDKey(iter.Key())
+		if len(uxkey) != uidKeyLen {
+			continue
+		}
+		skey := append([]byte{}, uxkey.sessKey(gst.prefixSize)...)
+		data, err := gst.db.Get(skey, nil)
+		if err != nil || len(data) < sessValueFixedPartSize {
+			// gone via expiration or concurrent deletion
+			continue
+		}
+		sessVal := gldbSessValue(data)
+		ttl := sessVal.expiration() - now
+		if ttl <= 0 {
+			continue
+		}
+		entries = append(entries, qsess.SessEntry{
+			SessID:         skey,
+			UserID:         sessVal.userID(),
+			Data:           sessVal.data(),
+			TimeToLiveSecs: int(ttl),
+			MaxAgeSecs:     int(sessVal.maxage()),
+			MinRefreshSecs: int(sessVal.minrefresh()),
+		})
+	}
+	if err := iter.Error(); err != nil {
+		return nil, gldbErr{"gldbStore.ListByUserID - iterator", err}
+	}
+	return entries, nil
+}
+
+func (gst *gldbStore) IterateCtx(ctx context.Context, fn func(e qsess.SessEntry) error) error {
+	now := time.Now().Unix()
+	iter := gst.db.NewIterator(util.BytesPrefix(gst.sessPrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return gldbErr{"gldbStore.Iterate", err}
+		}
+		if len(iter.Key()) != gst.sessKeySize || len(iter.Value()) < sessValueFixedPartSize {
+			continue
+		}
+		// the iterator reuses its buffers
+		skey := append([]byte{}, iter.Key()...)
+		sessVal := gldbSessValue(append([]byte{}, iter.Value()...))
+		ttl := sessVal.expiration() - now
+		if ttl <= 0 {
+			continue
+		}
+		err := fn(qsess.SessEntry{
+			SessID:         skey,
+			UserID:         sessVal.userID(),
+			Data:           sessVal.data(),
+			TimeToLiveSecs: int(ttl),
+			MaxAgeSecs:     int(sessVal.maxage()),
+			MinRefreshSecs: int(sessVal.minrefresh()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return gldbErr{"gldbStore.Iterate - iterator", err}
+	}
+	return nil
+}
+
+// ImportCtx only accepts session ids made by a store with the same prefix.
+func (gst *gldbStore) ImportCtx(ctx context.Context, e qsess.SessEntry) error {
+	if err := ctx.Err(); err != nil {
+		return gldbErr{"gldbStore.Import", err}
+	}
+	if len(e.SessID) != gst.sessKeySize || !bytes.HasPrefix(e.SessID, gst.sessPrefix) {
+		return gldbErr{"gldbStore.Import - session id is not from a store with this prefix", nil}
+	}
+	sessKey := gldbSessKey(e.SessID)
+
+	gst.saveMu.Lock()
+	defer gst.saveMu.Unlock()
+
+	if old, err := gst.db.Get(sessKey, nil); err == nil && len(old) >= sessValueFixedPartSize {
+		gst.deleteSess(sessKey, gldbSessValue(old))
+	}
+
+	sessVal, err := newSessValue(len(e.UserID), len(e.Data))
+	if err != nil {
+		return gldbErr{"gldbStore.Import - newSessValue", err}
+	}
+	itob(sessVal.expirationBytes(), time.Now().Add(time.Duration(e.TimeToLiveSecs)*time.Second).Unix())
+	itob(sessVal.maxageBytes(), int64(e.MaxAgeSecs))
+	itob(sessVal.minrefreshBytes(), int64(e.MinRefreshSecs))
+	copy(sessVal.userID(), e.UserID)
+	copy(sessVal.data(), e.Data)
+
+	// same sequence as Save
+	if err := gst.db.Put(gst.expKey(sessVal.expirationBytes(), sessKey), []byte{}, nil); err != nil {
+		return gldbErr{"gldbStore.Import - expiration index Put", err}
+	}
+	verVal := make([]byte, bytesPerInt64)
+	itob(verVal, 1)
+	batch := new(leveldb.Batch)
+	batch.Put(sessKey, sessVal)
+	batch.Put(gst.verKey(sessKey), verVal)
+	if err := gst.db.Write(batch, nil); err != nil {
+		return gldbErr{"gldbStore.Import - session Put", err}
+	}
+	if err := gst.db.Put(gst.uidKey(e.UserID, sessKey), []byte{}, nil); err != nil {
+		return gldbErr{"gldbStore.Import - userid index Put", err}
+	}
+	return nil
+}
+
+// isSessKey reports whether sessID could be one of this store's session
+// keys, rather than another record's key, or something else entirely.
+func (gst *gldbStore) isSessKey(sessID []byte) bool {
+	return len(sessID) == gst.sessKeySize && bytes.HasPrefix(sessID, gst.sessPrefix)
+}
+
+// errBadSessID is returned for session ids which aren't session keys.
+// qsess passes only ids it was given, but qsadmin passes ids typed by
+// operators.
+var errBadSessID = gldbErr{"gldbStore - malformed session id", qsess.ErrNotFound}
+
+// given a session key, return its version (zero if it has never been saved
+// with a version record), as read by r (the database or a snapshot of it).
+func (gst *gldbStore) version(r leveldb.Reader, sessKey gldbSessKey) (int64, error) {
+	val, err := r.Get(gst.verKey(sessKey), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != bytesPerInt64 {
+		return 0, gldbErr{"gldbStore.version - malformed version record", nil}
+	}
+	return btoi(val), nil
+}
+
 // given a session key, read its session record and return its expiration time
 func (gst *gldbStore) findExpiration(sessKey gldbSessKey) ([]byte, error) {
 	data, err := gst.db.Get(sessKey, nil)
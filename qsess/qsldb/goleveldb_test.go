@@ -5,9 +5,13 @@ package qsldb
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"math"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -68,7 +72,7 @@ func gldbTestStore(t *testing.T) *qsess.Store {
 func TestAccessors(t *testing.T) {
 	testStore := gldbTestStore(t)
 	defer func() { testStore.PruneKill <- 0 }()
-	gst, ok := testStore.BackEnd().(*gldbStore)
+	gst, ok := testStore.BackEndCtx().(*gldbStore)
 	if !ok {
 		t.Fatal("testStore is not a gldbStore")
 	}
@@ -135,6 +139,66 @@ func TestGldbDeleteByUserId(t *testing.T) {
 	qstest.DeleteByUserIDTest(t, testStore, true)
 }
 
+func TestGldbListByUserId(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.ListByUserIDTest(t, testStore)
+}
+
+func TestGldbRegenerate(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.RegenerateTest(t, testStore)
+}
+
+func TestGldbConflict(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.ConflictTest(t, testStore)
+}
+
+func TestGldbAbsoluteExpiration(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.AbsoluteExpirationTest(t, testStore)
+}
+
+func TestGldbRefresh(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.RefreshTest(t, testStore)
+}
+
+func TestGldbSentinelErrors(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.SentinelErrorsTest(t, testStore)
+}
+
+func TestGldbFlash(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.FlashTest(t, testStore)
+}
+
+func TestGldbCSRF(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.CSRFTest(t, testStore)
+}
+
+func TestGldbJWT(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.JWTTest(t, testStore)
+}
+
+func TestGldbFingerprint(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.FingerprintTest(t, testStore)
+}
+
 func TestGldbExpiration(t *testing.T) {
 	testStore := gldbTestStore(t)
 	defer func() { testStore.PruneKill <- 0 }()
@@ -144,7 +208,7 @@ func TestGldbExpiration(t *testing.T) {
 func TestGldbExpireIndex(t *testing.T) {
 	testStore := gldbTestStore(t)
 	defer func() { testStore.PruneKill <- 0 }()
-	gst, ok := testStore.BackEnd().(*gldbStore)
+	gst, ok := testStore.BackEndCtx().(*gldbStore)
 	if !ok {
 		t.Fatal("testStore is not a gldbStore")
 	}
@@ -175,11 +239,11 @@ func expireTest(t *testing.T, testStore *qsess.Store, gst *gldbStore, usePruner
 	}
 
 	// make a record with time-to-live = 2 sec
-	if err := gst.Save((*[]byte)(&key), []byte{1, 2, 3}, []byte{4, 5, 6}, 2, 3); err != nil {
+	if err := gst.SaveCtx(context.Background(), (*[]byte)(&key), []byte{1, 2, 3}, []byte{4, 5, 6}, 2, 3); err != nil {
 		t.Fatal("Save failed - " + err.Error())
 	}
 	// immediate Get should succeed, since expiration not yet reached
-	_, userID, ttl, _, _, err := gst.Get(key, []byte{})
+	_, userID, ttl, _, _, err := gst.GetCtx(context.Background(), key, []byte{})
 	if err != nil || ttl < 0 || ttl > 2 {
 		t.Fatal("problem with first Get")
 	}
@@ -204,7 +268,7 @@ func expireTest(t *testing.T, testStore *qsess.Store, gst *gldbStore, usePruner
 
 	if !usePruner {
 		// Get should notice the session is expired, delete it, and return an error
-		if _, _, ttl, _, _, err = gst.Get(key, []byte{}); err == nil {
+		if _, _, ttl, _, _, err = gst.GetCtx(context.Background(), key, []byte{}); err == nil {
 			t.Fatal("Get succeeded; should have failed due to expiration")
 		}
 	}
@@ -223,3 +287,169 @@ func expireTest(t *testing.T, testStore *qsess.Store, gst *gldbStore, usePruner
 		t.Fatal("record found in userid index; should have been deleted")
 	}
 }
+
+func TestGldbIterate(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.IterateTest(t, testStore)
+}
+
+func TestGldbEncryptAtRest(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.EncryptAtRestTest(t, testStore)
+}
+
+func TestGldbLifecycle(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.LifecycleTest(t, testStore, true, true)
+}
+
+func TestGldbEncryptedLifecycle(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	if err := testStore.EncryptAtRest(false); err != nil {
+		t.Fatal("EncryptAtRest failed - " + err.Error())
+	}
+	qstest.LifecycleTest(t, testStore, true, true)
+}
+
+func TestGldbResaveExpireIndex(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	gst := testStore.BackEndCtx().(*gldbStore)
+
+	// saving and touching again within the same second must not lose the
+	// session's expiration index entry.
+	var key []byte
+	for i := 0; i < 2; i++ {
+		if err := gst.SaveCtx(context.Background(), &key, []byte{1, 2, 3}, []byte{4, 5, 6}, 60, 3); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+	}
+	if err := gst.TouchCtx(context.Background(), key, nil, 60); err != nil {
+		t.Fatal("Touch failed - " + err.Error())
+	}
+	exp, err := gst.findExpiration(key)
+	if err != nil {
+		t.Fatal("problem with findExpiration")
+	}
+	if _, err := testGldb.Get(gst.expKey(exp, key), nil); err != nil {
+		t.Fatal("record not found in expiration index")
+	}
+}
+
+func TestGldbSaveDeleteRace(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	gst := testStore.BackEndCtx().(*gldbStore)
+	ctx := context.Background()
+
+	// a versioned save racing with a delete must never bring back the
+	// deleted session.
+	for i := 0; i < 200; i++ {
+		var key []byte
+		if err := gst.SaveCtx(ctx, &key, []byte{1, 2, 3}, []byte{4, 5, 6}, 60, 3); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		_, _, _, _, _, version, err := gst.GetVersionCtx(ctx, key, nil)
+		if err != nil {
+			t.Fatal("GetVersion failed - " + err.Error())
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v := version
+			gst.SaveVersionCtx(ctx, &key, []byte{7, 8, 9}, []byte{4, 5, 6}, 60, 3, &v)
+		}()
+		delErr := gst.DeleteCtx(ctx, key, nil)
+		wg.Wait()
+
+		if delErr == nil {
+			if _, _, _, _, _, err := gst.GetCtx(ctx, key, nil); err == nil {
+				t.Fatal("deleted session was brought back by a concurrent Save")
+			}
+		}
+	}
+}
+
+// TestGldbBadSessID checks that ids which aren't session keys (such as those
+// typed into qsess-admin) are not found, and don't touch other records.
+func TestGldbBadSessID(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	gst := testStore.BackEndCtx().(*gldbStore)
+	ctx := context.Background()
+
+	other := []byte("another-application's-record")
+	if err := testGldb.Put(other, bytes.Repeat([]byte{1}, 64), nil); err != nil {
+		t.Fatal("Put failed - " + err.Error())
+	}
+	for _, id := range [][]byte{{0xab}, other} {
+		if _, _, _, _, _, err := gst.GetCtx(ctx, id, nil); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Get %x - expected ErrNotFound, got %v", id, err)
+		}
+		if err := gst.DeleteCtx(ctx, id, nil); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Delete %x - expected ErrNotFound, got %v", id, err)
+		}
+	}
+	if _, err := testGldb.Get(other, nil); err != nil {
+		t.Error("Delete of a malformed session id deleted another record")
+	}
+}
+
+func TestGldbGetVersionRace(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	gst := testStore.BackEndCtx().(*gldbStore)
+	ctx := context.Background()
+
+	// each save stores its own version number as the session data, so a
+	// read pairing data and version from different saves is detectable.
+	var key []byte
+	if err := gst.SaveCtx(ctx, &key, []byte("1"), []byte{4, 5, 6}, 60, 3); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			_, _, _, _, _, v, err := gst.GetVersionCtx(ctx, key, nil)
+			if err != nil {
+				return
+			}
+			gst.SaveVersionCtx(ctx, &key, []byte(strconv.FormatInt(v+1, 10)), []byte{4, 5, 6}, 60, 3, &v)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		data, _, _, _, _, version, err := gst.GetVersionCtx(ctx, key, nil)
+		if err != nil {
+			t.Fatal("GetVersion failed - " + err.Error())
+		}
+		if string(data) != strconv.FormatInt(version, 10) {
+			t.Fatalf("GetVersion returned data %q with version %d", data, version)
+		}
+	}
+}
+
+func TestGldbRemember(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.RememberTest(t, testStore)
+}
+
+func TestGldbConsume(t *testing.T) {
+	testStore := gldbTestStore(t)
+	defer func() { testStore.PruneKill <- 0 }()
+	qstest.ConsumeTest(t, testStore)
+}
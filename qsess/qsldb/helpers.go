@@ -7,6 +7,9 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"io"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 // concatenate byte slices, returning a new one containing the contents of all
@@ -55,3 +58,15 @@ func (e gldbErr) Error() string {
 	}
 	return "qsldb." + e.msg
 }
+
+func (e gldbErr) Unwrap() error {
+	return e.err
+}
+
+// notFound translates goleveldb's "not found" into qsess.ErrNotFound.
+func notFound(err error) error {
+	if err == leveldb.ErrNotFound {
+		return qsess.ErrNotFound
+	}
+	return err
+}
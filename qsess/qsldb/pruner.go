@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io"
 	"time"
+
+	"github.com/gkong/go-qweb/qsess"
 )
 
 // prune periodically deletes expired sessions from the session store.
@@ -17,7 +19,9 @@ import (
 // It runs until it receives something on its pruneKill channel.
 // You can change its wait interval by sending a number of seconds
 // to its pruneInterval channel.
-func (gst *gldbStore) prune(waitSecs int, pruneInterval <-chan int, pruneKill <-chan int, log io.Writer) {
+// Each pass is reported to st's Observer, if any, and each session pruned
+// to its Lifecycle callback.
+func (gst *gldbStore) prune(st *qsess.Store, waitSecs int, pruneInterval <-chan int, pruneKill <-chan int, log io.Writer) {
 	for {
 		select {
 		case waitSecs = <-pruneInterval:
@@ -26,7 +30,9 @@ func (gst *gldbStore) prune(waitSecs int, pruneInterval <-chan int, pruneKill <-
 		case <-time.After(time.Duration(waitSecs) * time.Second):
 		}
 
-		now := time.Now().Unix()
+		start := time.Now()
+		now := start.Unix()
+		pruned := 0
 		iter := gst.db.NewIterator(nil, nil)
 		// Giving Seek the key prefix brings us to the first record of the
 		// expiration index, which is ordered by expiration time (ascending).
@@ -50,19 +56,35 @@ func (gst *gldbStore) prune(waitSecs int, pruneInterval <-chan int, pruneKill <-
 			// Current eKey's expiration time is in the past.
 			// Read the session record and verify it's really expired,
 			// then delete the session record and index record.
+			// Hold saveMu, so a concurrent Save or Touch can't extend the
+			// session between the check and the deletion.
 			// Ignore deletion failures, since other concurrent code can
 			// delete these records.
 			sessKey := eKey.sessKey(gst.prefixSize)
+			gst.saveMu.Lock()
+			var expired gldbSessValue
 			data, err := gst.db.Get(sessKey, nil)
 			if err == nil {
 				sessData := gldbSessValue(data)
 				if sessData.expiration() < now {
 					gst.db.Delete(gst.uidKey(sessData.userID(), sessKey), nil)
+					gst.db.Delete(gst.verKey(sessKey), nil)
 					gst.db.Delete(sessKey, nil)
+					expired = sessData
 				}
 			}
 			gst.db.Delete(eKey, nil)
+			gst.saveMu.Unlock()
+			if expired != nil {
+				pruned++
+				// reported without saveMu held, in case the Lifecycle
+				// callback uses the Store. sessKey points into the
+				// iterator's buffer, which the next key overwrites.
+				st.ReportExpired(append([]byte(nil), sessKey...), append([]byte(nil), expired.userID()...), expired.data())
+			}
 		}
+		err := iter.Error()
 		iter.Release()
+		st.ObservePrune(pruned, time.Since(start), err)
 	}
 }
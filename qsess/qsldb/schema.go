@@ -138,3 +138,16 @@ func (gst *gldbStore) uidKeyPrefix(userID []byte) gldbUIDKey {
 func (k *gldbUIDKey) sessKey(prefixSize int) []byte {
 	return (*k)[len(*k)-sessKeySize(prefixSize):]
 }
+
+// session versions, for optimistic concurrency control
+//
+//   key: prefix | session key
+//
+//   value: version (int64)
+//
+// Kept apart from the session table, so session records written before
+// versions existed remain readable (a missing version record means zero).
+
+func (gst *gldbStore) verKey(sessKey []byte) []byte {
+	return bscat(gst.verPrefix, sessKey)
+}
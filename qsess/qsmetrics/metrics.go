@@ -0,0 +1,145 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// Package qsmetrics implements qsess.Observer, by counting session store
+// operations, by kind and outcome, along with their durations and sizes.
+// Counters can be published with expvar, and served in the Prometheus text
+// exposition format. It has no dependencies outside the standard library.
+//
+//	m := qsmetrics.New()
+//	qsStore.Observer = m
+//	m.Publish("qsess")              // appears in /debug/vars
+//	http.Handle("/metrics", m)      // for Prometheus
+package qsmetrics
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gkong/go-qweb/qsess"
+)
+
+// Metrics holds counters. It is safe for concurrent use.
+type Metrics struct {
+	mu     sync.Mutex
+	ops    map[opKey]*opStats
+	pruned int64
+}
+
+type opKey struct {
+	op      qsess.Op
+	outcome string
+}
+
+type opStats struct {
+	Count   int64   `json:"count"`
+	Seconds float64 `json:"seconds"`
+	Bytes   int64   `json:"bytes"`
+}
+
+// New returns a new, empty Metrics.
+func New() *Metrics {
+	return &Metrics{ops: make(map[opKey]*opStats)}
+}
+
+// outcome classifies an error, by the sentinel errors it wraps.
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, qsess.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, qsess.ErrExpired):
+		return "expired"
+	case errors.Is(err, qsess.ErrInvalidToken):
+		return "invalid"
+	case errors.Is(err, qsess.ErrConflict):
+		return "conflict"
+	case errors.Is(err, qsess.ErrNotSupported):
+		return "not_supported"
+	}
+	return "error"
+}
+
+// Observe implements qsess.Observer.
+func (m *Metrics) Observe(e qsess.Event) {
+	k := opKey{e.Op, outcome(e.Err)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.ops[k]
+	if s == nil {
+		s = &opStats{}
+		m.ops[k] = s
+	}
+	s.Count++
+	s.Seconds += e.Duration.Seconds()
+	s.Bytes += int64(e.Bytes)
+	m.pruned += int64(e.Count)
+}
+
+// snapshot returns a copy of the counters, sorted by op and outcome.
+func (m *Metrics) snapshot() ([]opKey, map[opKey]opStats, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]opKey, 0, len(m.ops))
+	stats := make(map[opKey]opStats, len(m.ops))
+	for k, s := range m.ops {
+		keys = append(keys, k)
+		stats[k] = *s
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	return keys, stats, m.pruned
+}
+
+// Publish publishes the counters with expvar, under name, as a JSON object
+// of the form {"ops": {"get": {"ok": {"count": 1, ...}}}, "pruned_sessions": 0}.
+// Like expvar.Publish, it panics if name is already in use.
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		keys, stats, pruned := m.snapshot()
+		ops := make(map[string]map[string]opStats)
+		for _, k := range keys {
+			if ops[string(k.op)] == nil {
+				ops[string(k.op)] = make(map[string]opStats)
+			}
+			ops[string(k.op)][k.outcome] = stats[k]
+		}
+		return map[string]interface{}{"ops": ops, "pruned_sessions": pruned}
+	}))
+}
+
+// ServeHTTP serves the counters in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keys, stats, pruned := m.snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metric := func(name string, help string, value func(opStats) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{op=%q,outcome=%q} %s\n", name, k.op, k.outcome, value(stats[k]))
+		}
+	}
+	metric("qsess_operations_total", "Session store operations, by kind and outcome.",
+		func(s opStats) string { return fmt.Sprint(s.Count) })
+	metric("qsess_operation_seconds_total", "Time spent in session store operations.",
+		func(s opStats) string { return fmt.Sprint(s.Seconds) })
+	metric("qsess_operation_bytes_total", "Bytes read or written by session store operations.",
+		func(s opStats) string { return fmt.Sprint(s.Bytes) })
+
+	fmt.Fprintf(w, "# HELP qsess_pruned_sessions_total Expired sessions deleted by back-end pruners.\n")
+	fmt.Fprintf(w, "# TYPE qsess_pruned_sessions_total counter\n")
+	fmt.Fprintf(w, "qsess_pruned_sessions_total %d\n", pruned)
+}
@@ -0,0 +1,95 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsmetrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gkong/go-qweb/qsess"
+)
+
+func TestMetrics(t *testing.T) {
+	st, err := qsess.NewMapStore([]byte("key-for-encryption--------------"))
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	m := New()
+	st.Observer = m
+
+	sess := st.NewSession([]byte("userid-metrics"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+	if _, _, err := st.GetTokenSession(tok); err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	st.GetTokenSession("garbage")
+	sess.Delete(httptest.NewRecorder())
+	st.GetTokenSession(tok)
+	st.ObservePrune(3, time.Millisecond, nil)
+
+	_, stats, pruned := m.snapshot()
+	expected := map[opKey]int64{
+		{qsess.OpSave, "ok"}:        1,
+		{qsess.OpCreate, "ok"}:      1,
+		{qsess.OpGet, "ok"}:         2, // Token and GetTokenSession
+		{qsess.OpGet, "not_found"}:  1,
+		{qsess.OpDecode, "ok"}:      2,
+		{qsess.OpDecode, "invalid"}: 1,
+		{qsess.OpDelete, "ok"}:      1,
+		{qsess.OpPrune, "ok"}:       1,
+	}
+	for k, n := range expected {
+		if stats[k].Count != n {
+			t.Errorf("%s/%s - expected count %d, got %d", k.op, k.outcome, n, stats[k].Count)
+		}
+	}
+	if stats[opKey{qsess.OpSave, "ok"}].Bytes == 0 {
+		t.Error("save reported no bytes")
+	}
+	if pruned != 3 {
+		t.Errorf("expected 3 pruned sessions, got %d", pruned)
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE qsess_operations_total counter",
+		`qsess_operations_total{op="save",outcome="ok"} 1`,
+		`qsess_operations_total{op="get",outcome="not_found"} 1`,
+		"qsess_pruned_sessions_total 3",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Prometheus output lacks %q", line)
+		}
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("bad Content-Type %q", ct)
+	}
+
+	m.Publish("qsmetrics-test")
+	var published struct {
+		Ops            map[string]map[string]opStats `json:"ops"`
+		PrunedSessions int64                         `json:"pruned_sessions"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("qsmetrics-test").String()), &published); err != nil {
+		t.Fatal("cannot decode expvar JSON - " + err.Error())
+	}
+	if published.Ops["save"]["ok"].Count != 1 || published.PrunedSessions != 3 {
+		t.Errorf("unexpected expvar contents - %+v", published)
+	}
+}
+
+var _ http.Handler = (*Metrics)(nil)
@@ -5,6 +5,7 @@
 package qsmy
 
 import (
+	"context"
 	"database/sql"
 	"encoding/binary"
 	"errors"
@@ -12,10 +13,10 @@ import (
 	"math"
 
 	"github.com/gkong/go-qweb/qsess"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
-// type sqlStore holds per-store information and conforms to the SessBackEnd interface.
+// type sqlStore holds per-store information and conforms to the SessBackEndCtx interface.
 
 type sqlStore struct {
 	db         *sql.DB
@@ -24,6 +25,12 @@ type sqlStore struct {
 	sUpdate    *sql.Stmt
 	sDelete    *sql.Stmt
 	sDelUserID *sql.Stmt
+	sListUID   *sql.Stmt
+	sExists    *sql.Stmt
+	sTouch     *sql.Stmt
+	sIterate   *sql.Stmt
+	sImport    *sql.Stmt
+	sConsume   *sql.Stmt
 }
 
 // NewMysqlStore creates a new session store, using a MySQL database.
@@ -32,21 +39,22 @@ type sqlStore struct {
 // created if it doesn't exist).
 //
 // dataField is an SQL column definition for serialized session data,
-// for example, "VARBINARY(500) NOT NULL".
+// for example, "VARBINARY(500) NOT NULL". Store.EncryptAtRest adds 33 bytes
+// to each record.
 //
 // uidField is an SQL column definition for user ids.
 // It must be indexable and accept []byte values.
 //
 // cipherkeys are one or more 32-byte encryption keys, to be used with
-// AES-GCM. For encryption, only the first key is used;
-// for decryption all keys are tried (allowing key rotation).
+// AES-GCM. For encryption, only the first key is used; for decryption,
+// the key is identified by the cookie or token (allowing key rotation).
 //
 // Additional configuration options can be set by manipulating fields in the
 // returned qsess.Store.
 func NewMysqlStore(sdb *sql.DB, table string, dataField string, uidField string, cipherkeys ...[]byte) (*qsess.Store, error) {
 	ss := &sqlStore{db: sdb}
 
-	st, err := qsess.NewStore(ss, false, cipherkeys...)
+	st, err := qsess.NewStoreCtx(ss, false, cipherkeys...)
 	if err != nil {
 		return nil, myErr{"NewMysqlStore - NewStore - ", err}
 	}
@@ -59,6 +67,7 @@ func NewMysqlStore(sdb *sql.DB, table string, dataField string, uidField string,
 			`, expires DATETIME NOT NULL,
 			maxage INT,
 			minrefresh INT,
+			version BIGINT NOT NULL DEFAULT 0,
 			INDEX(userid),
 			INDEX(expires)
 		 ) DEFAULT CHARSET=utf8, AUTO_INCREMENT=1;`)
@@ -66,6 +75,14 @@ func NewMysqlStore(sdb *sql.DB, table string, dataField string, uidField string,
 		return st, myErr{"NewMysqlStore - CREATE TABLE failed - ", err}
 	}
 
+	// tables created by older versions of qsmy have no version column.
+	// MySQL has no ADD COLUMN IF NOT EXISTS, so ignore "duplicate column".
+	_, err = sdb.Exec(`ALTER TABLE ` + table + ` ADD COLUMN version BIGINT NOT NULL DEFAULT 0`)
+	var myerr *mysql.MySQLError
+	if err != nil && !(errors.As(err, &myerr) && myerr.Number == errDupFieldName) {
+		return st, myErr{"NewMysqlStore - ADD COLUMN version failed - ", err}
+	}
+
 	_, err = sdb.Exec("SET GLOBAL event_scheduler = ON;")
 	if err != nil {
 		return st, myErr{"NewMysqlStore - cannot turn on event_scheduler - ", err}
@@ -80,7 +97,7 @@ func NewMysqlStore(sdb *sql.DB, table string, dataField string, uidField string,
 	// so no need for our time to be synchronized with the MySQL server's time.
 
 	ss.sSelect, err = sdb.Prepare(
-		`SELECT data, userid, (TIME_TO_SEC(TIMEDIFF(expires,NOW()))), maxage, minrefresh FROM ` +
+		`SELECT data, userid, (TIME_TO_SEC(TIMEDIFF(expires,NOW()))), maxage, minrefresh, version FROM ` +
 			table + ` WHERE id = ?`)
 	if err != nil {
 		return st, myErr{"NewMysqlStore - prepare SELECT failed - ", err}
@@ -88,14 +105,17 @@ func NewMysqlStore(sdb *sql.DB, table string, dataField string, uidField string,
 
 	ss.sInsert, err = sdb.Prepare(
 		`INSERT INTO ` + table +
-			` (data, userid, expires, maxage, minrefresh) VALUES(?, ?, ADDTIME(NOW(), SEC_TO_TIME(?)), ?, ?)`)
+			` (data, userid, expires, maxage, minrefresh, version) VALUES(?, ?, ADDTIME(NOW(), SEC_TO_TIME(?)), ?, ?, 1)`)
 	if err != nil {
 		return st, myErr{"NewMysqlStore - prepare INSERT failed - ", err}
 	}
 
+	// LAST_INSERT_ID(expr) makes the new version available via
+	// Result.LastInsertId, without a separate query.
 	ss.sUpdate, err = sdb.Prepare(
 		`UPDATE ` + table +
-			` SET data = ?, userid = ?, expires = ADDTIME(NOW(), SEC_TO_TIME(?)), maxage = ?, minrefresh = ? WHERE id = ?`)
+			` SET data = ?, userid = ?, expires = ADDTIME(NOW(), SEC_TO_TIME(?)), maxage = ?, minrefresh = ?, version = LAST_INSERT_ID(version + 1)` +
+			` WHERE id = ? AND (? < 0 OR version = ?)`)
 	if err != nil {
 		return st, myErr{"NewMysqlStore - prepare UPDATE failed - ", err}
 	}
@@ -110,27 +130,86 @@ func NewMysqlStore(sdb *sql.DB, table string, dataField string, uidField string,
 		return st, myErr{"NewMysqlStore - prepare DelUserID failed - ", err}
 	}
 
+	ss.sListUID, err = sdb.Prepare(
+		`SELECT id, data, (TIME_TO_SEC(TIMEDIFF(expires,NOW()))), maxage, minrefresh FROM ` +
+			table + ` WHERE userid = ? AND expires > NOW()`)
+	if err != nil {
+		return st, myErr{"NewMysqlStore - prepare ListUserID failed - ", err}
+	}
+
+	ss.sExists, err = sdb.Prepare(`SELECT 1 FROM ` + table + ` WHERE id = ?`)
+	if err != nil {
+		return st, myErr{"NewMysqlStore - prepare Exists failed - ", err}
+	}
+
+	ss.sTouch, err = sdb.Prepare(`UPDATE ` + table + ` SET expires = ADDTIME(NOW(), SEC_TO_TIME(?)) WHERE id = ?`)
+	if err != nil {
+		return st, myErr{"NewMysqlStore - prepare Touch failed - ", err}
+	}
+
+	ss.sIterate, err = sdb.Prepare(
+		`SELECT id, userid, data, (TIME_TO_SEC(TIMEDIFF(expires,NOW()))), maxage, minrefresh FROM ` +
+			table + ` WHERE expires > NOW()`)
+	if err != nil {
+		return st, myErr{"NewMysqlStore - prepare Iterate failed - ", err}
+	}
+
+	// an explicit id moves AUTO_INCREMENT past it, if necessary.
+	ss.sImport, err = sdb.Prepare(
+		`REPLACE INTO ` + table +
+			` (id, data, userid, expires, maxage, minrefresh, version) VALUES(?, ?, ?, ADDTIME(NOW(), SEC_TO_TIME(?)), ?, ?, 1)`)
+	if err != nil {
+		return st, myErr{"NewMysqlStore - prepare Import failed - ", err}
+	}
+
+	// Consume reads with FOR UPDATE, then deletes, in a transaction, so a
+	// concurrent consumer waits, then finds nothing.
+	ss.sConsume, err = sdb.Prepare(
+		`SELECT data, userid, (TIME_TO_SEC(TIMEDIFF(expires,NOW()))), maxage, minrefresh FROM ` +
+			table + ` WHERE id = ? FOR UPDATE`)
+	if err != nil {
+		return st, myErr{"NewMysqlStore - prepare Consume failed - ", err}
+	}
+
 	return st, nil
 }
 
-func (ss *sqlStore) Get(sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, error) {
+func (ss *sqlStore) GetCtx(ctx context.Context, sessIDbytes []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	data, userID, ttl, maxage, minrefresh, _, err := ss.GetVersionCtx(ctx, sessIDbytes, uID)
+	return data, userID, ttl, maxage, minrefresh, err
+}
+
+func (ss *sqlStore) GetVersionCtx(ctx context.Context, sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, int64, error) {
+	if len(sessIDbytes) != 4 {
+		return []byte{}, []byte{}, 0, 0, 0, 0, errBadSessID
+	}
 	sessID := bytesToSessID(sessIDbytes)
 	var data, userID []byte
 	var ttl, maxage, minrefresh int
-	if err := ss.sSelect.QueryRow(sessID).Scan(&data, &userID, &ttl, &maxage, &minrefresh); err != nil {
-		return []byte{}, []byte{}, 0, 0, 0, err
+	var version int64
+	if err := ss.sSelect.QueryRowContext(ctx, sessID).Scan(&data, &userID, &ttl, &maxage, &minrefresh, &version); err != nil {
+		if err == sql.ErrNoRows {
+			err = qsess.ErrNotFound
+		}
+		return []byte{}, []byte{}, 0, 0, 0, 0, myErr{"sqlStore.Get - SELECT failed", err}
 	}
 	if ttl <= 0 {
-		ss.Delete(sessIDbytes, []byte{})
-		return []byte{}, []byte{}, 0, 0, 0, myErr{"sqlStore.Get - record has expired", nil}
+		ss.DeleteCtx(ctx, sessIDbytes, []byte{})
+		// return the record with the error, for qsess lifecycle events
+		return data, userID, 0, 0, 0, 0, myErr{"sqlStore.Get - record has expired", qsess.ErrExpired}
 	}
-	return data, userID, ttl, maxage, minrefresh, nil
+	return data, userID, ttl, maxage, minrefresh, version, nil
+}
+
+func (ss *sqlStore) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	version := int64(-1)
+	return ss.SaveVersionCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs, &version)
 }
 
-func (ss *sqlStore) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+func (ss *sqlStore) SaveVersionCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int, version *int64) error {
 	if *sessID == nil {
 		// id is nil: insert a new record and save its id
-		result, err := ss.sInsert.Exec(data, userID, maxAgeSecs, maxAgeSecs, minRefreshSecs)
+		result, err := ss.sInsert.ExecContext(ctx, data, userID, maxAgeSecs, maxAgeSecs, minRefreshSecs)
 		if err != nil {
 			return err
 		}
@@ -142,35 +221,167 @@ func (ss *sqlStore) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSecs
 			return errors.New("sqlStore.Save - returned id is too big")
 		}
 		*sessID = sessIDToBytes(uint32(newID))
+		*version = 1
 	} else {
-		// id is NOT nil: it refers to an existing record; update it.
-		result, err := ss.sUpdate.Exec(data, userID, maxAgeSecs, maxAgeSecs, minRefreshSecs, bytesToSessID(*sessID))
+		// id is NOT nil: it refers to an existing record; update it,
+		// if its version matches (or a negative version says not to check).
+		if len(*sessID) != 4 {
+			return errBadSessID
+		}
+		result, err := ss.sUpdate.ExecContext(ctx, data, userID, maxAgeSecs, maxAgeSecs, minRefreshSecs, bytesToSessID(*sessID), *version, *version)
 		if err != nil {
 			return err
 		}
 		if rows, _ := result.RowsAffected(); rows != 1 {
-			return myErr{fmt.Sprintf("sqlStore.Save - expect 1 row affected, got %d", rows), nil}
+			// either the record does not exist, or its version has changed.
+			var one int
+			if rows == 0 && ss.sExists.QueryRowContext(ctx, bytesToSessID(*sessID)).Scan(&one) == nil {
+				return qsess.ErrConflict
+			}
+			return myErr{fmt.Sprintf("sqlStore.Save - expect 1 row affected, got %d", rows), qsess.ErrNotFound}
+		}
+		newVersion, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		*version = newVersion
+	}
+	return nil
+}
+
+func (ss *sqlStore) TouchCtx(ctx context.Context, sessID []byte, uidNOTUSED []byte, maxAgeSecs int) error {
+	if len(sessID) != 4 {
+		return errBadSessID
+	}
+	result, err := ss.sTouch.ExecContext(ctx, maxAgeSecs, bytesToSessID(sessID))
+	if err != nil {
+		return err
+	}
+	// MySQL doesn't count a row as affected if its value doesn't change
+	// (touched twice in the same second), so check for existence.
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var one int
+		if err := ss.sExists.QueryRowContext(ctx, bytesToSessID(sessID)).Scan(&one); err != nil {
+			if err == sql.ErrNoRows {
+				err = qsess.ErrNotFound
+			}
+			return myErr{"sqlStore.Touch - session not found", err}
 		}
 	}
 	return nil
 }
 
-func (ss *sqlStore) Delete(sessID []byte, uidNOTUSED []byte) error {
-	_, err := ss.sDelete.Exec(bytesToSessID(sessID))
+// ConsumeCtx gets and deletes a session, in a transaction.
+func (ss *sqlStore) ConsumeCtx(ctx context.Context, sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, error) {
+	if len(sessIDbytes) != 4 {
+		return []byte{}, []byte{}, 0, 0, 0, errBadSessID
+	}
+	sessID := bytesToSessID(sessIDbytes)
+	var data, userID []byte
+	var ttl, maxage, minrefresh int
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return []byte{}, []byte{}, 0, 0, 0, myErr{"sqlStore.Consume - BeginTx failed", err}
+	}
+	defer tx.Rollback() // no effect after Commit
+
+	if err := tx.StmtContext(ctx, ss.sConsume).QueryRowContext(ctx, sessID).Scan(&data, &userID, &ttl, &maxage, &minrefresh); err != nil {
+		if err == sql.ErrNoRows {
+			err = qsess.ErrNotFound
+		}
+		return []byte{}, []byte{}, 0, 0, 0, myErr{"sqlStore.Consume - SELECT failed", err}
+	}
+	if _, err := tx.StmtContext(ctx, ss.sDelete).ExecContext(ctx, sessID); err != nil {
+		return []byte{}, []byte{}, 0, 0, 0, myErr{"sqlStore.Consume - DELETE failed", err}
+	}
+	if err := tx.Commit(); err != nil {
+		return []byte{}, []byte{}, 0, 0, 0, myErr{"sqlStore.Consume - Commit failed", err}
+	}
+
+	if ttl <= 0 {
+		return data, userID, 0, 0, 0, myErr{"sqlStore.Consume - record has expired", qsess.ErrExpired}
+	}
+	return data, userID, ttl, maxage, minrefresh, nil
+}
+
+func (ss *sqlStore) DeleteCtx(ctx context.Context, sessID []byte, uidNOTUSED []byte) error {
+	if len(sessID) != 4 {
+		return errBadSessID
+	}
+	_, err := ss.sDelete.ExecContext(ctx, bytesToSessID(sessID))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (ss *sqlStore) DeleteByUserID(userID []byte) error {
-	_, err := ss.sDelUserID.Exec(userID)
+func (ss *sqlStore) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
+	_, err := ss.sDelUserID.ExecContext(ctx, userID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func (ss *sqlStore) ListByUserIDCtx(ctx context.Context, userID []byte) ([]qsess.SessEntry, error) {
+	rows, err := ss.sListUID.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, myErr{"sqlStore.ListByUserID - SELECT failed", err}
+	}
+	defer rows.Close()
+
+	var entries []qsess.SessEntry
+	for rows.Next() {
+		var id uint32
+		e := qsess.SessEntry{UserID: userID}
+		if err := rows.Scan(&id, &e.Data, &e.TimeToLiveSecs, &e.MaxAgeSecs, &e.MinRefreshSecs); err != nil {
+			return nil, myErr{"sqlStore.ListByUserID - Scan failed", err}
+		}
+		e.SessID = sessIDToBytes(id)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, myErr{"sqlStore.ListByUserID - rows.Err", err}
+	}
+	return entries, nil
+}
+
+func (ss *sqlStore) IterateCtx(ctx context.Context, fn func(e qsess.SessEntry) error) error {
+	rows, err := ss.sIterate.QueryContext(ctx)
+	if err != nil {
+		return myErr{"sqlStore.Iterate - SELECT failed", err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint32
+		var e qsess.SessEntry
+		if err := rows.Scan(&id, &e.UserID, &e.Data, &e.TimeToLiveSecs, &e.MaxAgeSecs, &e.MinRefreshSecs); err != nil {
+			return myErr{"sqlStore.Iterate - Scan failed", err}
+		}
+		e.SessID = sessIDToBytes(id)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return myErr{"sqlStore.Iterate - rows.Err", err}
+	}
+	return nil
+}
+
+func (ss *sqlStore) ImportCtx(ctx context.Context, e qsess.SessEntry) error {
+	if len(e.SessID) != 4 {
+		return myErr{"sqlStore.Import - session id has the wrong size", nil}
+	}
+	_, err := ss.sImport.ExecContext(ctx, bytesToSessID(e.SessID), e.Data, e.UserID, e.TimeToLiveSecs, e.MaxAgeSecs, e.MinRefreshSecs)
+	if err != nil {
+		return myErr{"sqlStore.Import - REPLACE failed", err}
+	}
+	return nil
+}
+
 // serialize uint32, which we use to store a session id (database key).
 
 func sessIDToBytes(id uint32) []byte {
@@ -179,11 +390,19 @@ func sessIDToBytes(id uint32) []byte {
 	return b
 }
 
+// callers check len(b) first (see errBadSessID).
 func bytesToSessID(b []byte) uint32 {
-	// could check len(b), but depend on qsess promise not to touch
 	return binary.LittleEndian.Uint32(b)
 }
 
+// errBadSessID is returned for session ids of the wrong size, which this
+// back-end can't have made. qsess passes only ids it was given, but qsadmin
+// passes ids typed by operators.
+var errBadSessID = myErr{"sqlStore - malformed session id", qsess.ErrNotFound}
+
+// MySQL error number for "duplicate column name"
+const errDupFieldName = 1060
+
 type myErr struct {
 	msg string
 	err error
@@ -195,3 +414,7 @@ func (e myErr) Error() string {
 	}
 	return "qsmy." + e.msg
 }
+
+func (e myErr) Unwrap() error {
+	return e.err
+}
@@ -4,7 +4,9 @@
 package qsmy
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"math"
 	"testing"
@@ -69,6 +71,66 @@ func TestMysqlDeleteByUserId(t *testing.T) {
 	dropTestTable(t, "delbyuid")
 }
 
+func TestMysqlListByUserId(t *testing.T) {
+	st := makeTestStore(t, "listbyuid")
+	qstest.ListByUserIDTest(t, st)
+	dropTestTable(t, "listbyuid")
+}
+
+func TestMysqlRegenerate(t *testing.T) {
+	st := makeTestStore(t, "regen")
+	qstest.RegenerateTest(t, st)
+	dropTestTable(t, "regen")
+}
+
+func TestMysqlConflict(t *testing.T) {
+	st := makeTestStore(t, "conflict")
+	qstest.ConflictTest(t, st)
+	dropTestTable(t, "conflict")
+}
+
+func TestMysqlAbsoluteExpiration(t *testing.T) {
+	st := makeTestStore(t, "absexp")
+	qstest.AbsoluteExpirationTest(t, st)
+	dropTestTable(t, "absexp")
+}
+
+func TestMysqlRefresh(t *testing.T) {
+	st := makeTestStore(t, "refresh")
+	qstest.RefreshTest(t, st)
+	dropTestTable(t, "refresh")
+}
+
+func TestMysqlSentinelErrors(t *testing.T) {
+	st := makeTestStore(t, "sentinel")
+	qstest.SentinelErrorsTest(t, st)
+	dropTestTable(t, "sentinel")
+}
+
+func TestMysqlFlash(t *testing.T) {
+	st := makeTestStore(t, "flash")
+	qstest.FlashTest(t, st)
+	dropTestTable(t, "flash")
+}
+
+func TestMysqlCSRF(t *testing.T) {
+	st := makeTestStore(t, "csrf")
+	qstest.CSRFTest(t, st)
+	dropTestTable(t, "csrf")
+}
+
+func TestMysqlJWT(t *testing.T) {
+	st := makeTestStore(t, "jwt")
+	qstest.JWTTest(t, st)
+	dropTestTable(t, "jwt")
+}
+
+func TestMysqlFingerprint(t *testing.T) {
+	st := makeTestStore(t, "fingerprint")
+	qstest.FingerprintTest(t, st)
+	dropTestTable(t, "fingerprint")
+}
+
 func TestMysqlExpiration(t *testing.T) {
 	st := makeTestStore(t, "exp")
 	qstest.ExpirationTest(t, st)
@@ -87,3 +149,58 @@ func TestMysqlSerializer(t *testing.T) {
 		// t.Logf("%x %d => %d\n", b, b, intf)
 	}
 }
+
+// TestMysqlBadSessID checks that malformed session ids (such as those typed into
+// qsess-admin) are not found, without reaching the database.
+func TestMysqlBadSessID(t *testing.T) {
+	be := &sqlStore{}
+	ctx := context.Background()
+	for _, id := range [][]byte{{}, {0xab}, {1, 2, 3, 4, 5}} {
+		if _, _, _, _, _, err := be.GetCtx(ctx, id, nil); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Get %x - expected ErrNotFound, got %v", id, err)
+		}
+		if err := be.DeleteCtx(ctx, id, nil); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Delete %x - expected ErrNotFound, got %v", id, err)
+		}
+		if err := be.TouchCtx(ctx, id, nil, 60); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Touch %x - expected ErrNotFound, got %v", id, err)
+		}
+		if _, _, _, _, _, err := be.ConsumeCtx(ctx, id, nil); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Consume %x - expected ErrNotFound, got %v", id, err)
+		}
+		sessID := id
+		if err := be.SaveCtx(ctx, &sessID, []byte{}, []byte{}, 60, 10); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Save %x - expected ErrNotFound, got %v", id, err)
+		}
+	}
+}
+
+func TestMysqlIterate(t *testing.T) {
+	st := makeTestStore(t, "iterate")
+	qstest.IterateTest(t, st)
+	dropTestTable(t, "iterate")
+}
+
+func TestMysqlEncryptAtRest(t *testing.T) {
+	st := makeTestStore(t, "atrest")
+	qstest.EncryptAtRestTest(t, st)
+	dropTestTable(t, "atrest")
+}
+
+func TestMysqlLifecycle(t *testing.T) {
+	st := makeTestStore(t, "lifecycle")
+	qstest.LifecycleTest(t, st, true, false)
+	dropTestTable(t, "lifecycle")
+}
+
+func TestMysqlRemember(t *testing.T) {
+	st := makeTestStore(t, "remember")
+	qstest.RememberTest(t, st)
+	dropTestTable(t, "remember")
+}
+
+func TestMysqlConsume(t *testing.T) {
+	st := makeTestStore(t, "consume")
+	qstest.ConsumeTest(t, st)
+	dropTestTable(t, "consume")
+}
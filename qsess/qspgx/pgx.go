@@ -16,14 +16,17 @@ import (
 	"time"
 
 	"github.com/gkong/go-qweb/qsess"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const DefaultPruneIntervalSecs = 2 * 60 // prune every 2 minutes
 
+// noctx is used for work that is not done on behalf of a request,
+// such as table creation and pruning.
 var noctx = context.Background()
 
-// type pgxStore holds per-store information and conforms to the SessBackEnd interface.
+// type pgxStore holds per-store information and conforms to the SessBackEndCtx interface.
 type pgxStore struct {
 	db    *pgxpool.Pool
 	table string
@@ -31,8 +34,14 @@ type pgxStore struct {
 	// SQL strings which can be precomputed, saving string concatenation
 	pGetQuerySQL       string
 	pGetDeleteSQL      string
+	pConsumeSQL        string
 	pDeleteSQL         string
 	pDeleteByUserIDSQL string
+	pListByUserIDSQL   string
+	pExistsSQL         string
+	pIterateSQL        string
+	pImportSQL         string
+	pImportSeqSQL      string
 }
 
 // NewPgxStore creates a new session store, using a PostgreSQL database accessed via pgxpool.
@@ -40,20 +49,32 @@ type pgxStore struct {
 // table is the name of a database table to hold session data (it will be created if it doesn't exist).
 //
 // cipherkeys are one or more 32-byte encryption keys, to be used with AES-GCM.
-// For encryption, only the first key is used; for decryption all keys are tried (allowing key rotation).
+// For encryption, only the first key is used; for decryption, the key is identified by the cookie or token (allowing key rotation).
 //
 // Additional configuration options can be set by manipulating fields in the returned qsess.Store.
 func NewPgxStore(pdb *pgxpool.Pool, tableName string, errLog io.Writer, cipherkeys ...[]byte) (*qsess.Store, error) {
 	ps := &pgxStore{
 		db:                 pdb,
 		table:              tableName,
-		pGetQuerySQL:       `SELECT data, userid, FLOOR(EXTRACT(EPOCH FROM (expires-NOW()))), maxage, minrefresh FROM ` + tableName + ` WHERE id = $1`,
+		pGetQuerySQL:       `SELECT data, userid, FLOOR(EXTRACT(EPOCH FROM (expires-NOW()))), maxage, minrefresh, version FROM ` + tableName + ` WHERE id = $1`,
 		pGetDeleteSQL:      `DELETE FROM ` + tableName + ` WHERE id = $1`,
+		pConsumeSQL:        `DELETE FROM ` + tableName + ` WHERE id = $1 RETURNING data, userid, FLOOR(EXTRACT(EPOCH FROM (expires-NOW()))), maxage, minrefresh`,
 		pDeleteSQL:         `DELETE FROM ` + tableName + ` WHERE id = $1`,
 		pDeleteByUserIDSQL: `DELETE FROM ` + tableName + ` WHERE userid = $1`,
+		pListByUserIDSQL:   `SELECT id, data, FLOOR(EXTRACT(EPOCH FROM (expires-NOW()))), maxage, minrefresh FROM ` + tableName + ` WHERE userid = $1 AND expires > NOW()`,
+		pExistsSQL:         `SELECT 1 FROM ` + tableName + ` WHERE id = $1`,
+		pIterateSQL:        `SELECT id, userid, data, FLOOR(EXTRACT(EPOCH FROM (expires-NOW()))), maxage, minrefresh FROM ` + tableName + ` WHERE expires > NOW()`,
+		pImportSQL: `INSERT INTO ` + tableName + ` (id, data, userid, expires, maxage, minrefresh, version)` +
+			` VALUES($1, $2, $3, NOW() + $4 * INTERVAL '1 second', $5, $6, 1)` +
+			` ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, userid = EXCLUDED.userid, expires = EXCLUDED.expires,` +
+			` maxage = EXCLUDED.maxage, minrefresh = EXCLUDED.minrefresh, version = EXCLUDED.version`,
+		// an explicit id doesn't advance the SERIAL sequence, so do it here,
+		// (never moving it backwards, which would reuse deleted sessions' ids).
+		pImportSeqSQL: `SELECT setval(seq, GREATEST($1::bigint, COALESCE(pg_sequence_last_value(seq), 1)))` +
+			` FROM (SELECT pg_get_serial_sequence('` + tableName + `', 'id')::regclass AS seq) AS s`,
 	}
 
-	st, err := qsess.NewStore(ps, false, cipherkeys...)
+	st, err := qsess.NewStoreCtx(ps, false, cipherkeys...)
 	if err != nil {
 		return nil, pgxErr{"NewPgxStore - NewStore - ", err}
 	}
@@ -61,7 +82,7 @@ func NewPgxStore(pdb *pgxpool.Pool, tableName string, errLog io.Writer, cipherke
 	st.PruneInterval = make(chan int)
 	st.PruneKill = make(chan int)
 
-	go ps.prune(DefaultPruneIntervalSecs, st.PruneInterval, st.PruneKill, errLog)
+	go ps.prune(st, DefaultPruneIntervalSecs, st.PruneInterval, st.PruneKill, errLog)
 
 	_, err = pdb.Exec(noctx,
 		`CREATE TABLE IF NOT EXISTS `+tableName+` (
@@ -70,12 +91,19 @@ func NewPgxStore(pdb *pgxpool.Pool, tableName string, errLog io.Writer, cipherke
 			userid BYTEA,
 			expires TIMESTAMP NOT NULL,
 			maxage INTEGER,
-			minrefresh INTEGER
+			minrefresh INTEGER,
+			version BIGINT NOT NULL DEFAULT 0
 		 )`)
 	if err != nil {
 		return st, pgxErr{"NewPgxStore - CREATE TABLE failed - ", err}
 	}
 
+	// tables created by older versions of qspgx have no version column.
+	_, err = pdb.Exec(noctx, `ALTER TABLE `+tableName+` ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0`)
+	if err != nil {
+		return st, pgxErr{"NewPgxStore - ADD COLUMN version failed - ", err}
+	}
+
 	_, err = pdb.Exec(noctx, `CREATE INDEX IF NOT EXISTS `+tableName+`_userid ON `+tableName+` (userid)`)
 	if err != nil {
 		return st, pgxErr{"NewPgxStore - CREATE userid index failed - ", err}
@@ -89,78 +117,213 @@ func NewPgxStore(pdb *pgxpool.Pool, tableName string, errLog io.Writer, cipherke
 	return st, nil
 }
 
-func (ps *pgxStore) Get(sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, error) {
+func (ps *pgxStore) GetCtx(ctx context.Context, sessIDbytes []byte, uID []byte) ([]byte, []byte, int, int, int, error) {
+	data, userID, ttl, maxage, minrefresh, _, err := ps.GetVersionCtx(ctx, sessIDbytes, uID)
+	return data, userID, ttl, maxage, minrefresh, err
+}
+
+func (ps *pgxStore) GetVersionCtx(ctx context.Context, sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, int64, error) {
+	if len(sessIDbytes) != 4 {
+		return []byte{}, []byte{}, 0, 0, 0, 0, errBadSessID
+	}
 	sessID := bytesToSessID(sessIDbytes)
 	var data, userID []byte
 	var ttl, maxage, minrefresh int
+	var version int64
 
-	row := ps.db.QueryRow(noctx, ps.pGetQuerySQL, sessID)
-	if err := row.Scan(&data, &userID, &ttl, &maxage, &minrefresh); err != nil {
-		return []byte{}, []byte{}, 0, 0, 0, pgxErr{"pgxStore.Get - row.Scan failed - ", err}
+	row := ps.db.QueryRow(ctx, ps.pGetQuerySQL, sessID)
+	if err := row.Scan(&data, &userID, &ttl, &maxage, &minrefresh, &version); err != nil {
+		if err == pgx.ErrNoRows {
+			err = qsess.ErrNotFound
+		}
+		return []byte{}, []byte{}, 0, 0, 0, 0, pgxErr{"pgxStore.Get - row.Scan failed - ", err}
 	}
 
 	if ttl <= 0 {
-		if _, err := ps.db.Exec(noctx, ps.pGetDeleteSQL, sessID); err != nil {
-			return []byte{}, []byte{}, 0, 0, 0, pgxErr{"pgxStore.Get - DELETE failed - ", err}
+		if _, err := ps.db.Exec(ctx, ps.pGetDeleteSQL, sessID); err != nil {
+			return []byte{}, []byte{}, 0, 0, 0, 0, pgxErr{"pgxStore.Get - DELETE failed - ", err}
 		}
-		return []byte{}, []byte{}, 0, 0, 0, pgxErr{"pgxStore.Get - record has expired", nil}
+		// return the record with the error, for qsess lifecycle events
+		return data, userID, 0, 0, 0, 0, pgxErr{"pgxStore.Get - record has expired", qsess.ErrExpired}
 	}
-	return data, userID, ttl, maxage, minrefresh, nil
+	return data, userID, ttl, maxage, minrefresh, version, nil
 }
 
-func (ps *pgxStore) Save(sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+func (ps *pgxStore) SaveCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int) error {
+	version := int64(-1)
+	return ps.SaveVersionCtx(ctx, sessID, data, userID, maxAgeSecs, minRefreshSecs, &version)
+}
+
+func (ps *pgxStore) SaveVersionCtx(ctx context.Context, sessID *[]byte, data []byte, userID []byte, maxAgeSecs int, minRefreshSecs int, version *int64) error {
 	if *sessID == nil {
 		// id is nil: insert a new record and save its id
 
 		var newID uint32
 
 		// XXX - find a way to make maxAgeSecs a parameter, so we can move the SQL strings into pgxStore and not have to recompute every time
-		row := ps.db.QueryRow(noctx, `INSERT INTO `+ps.table+
-			` (data, userid, expires, maxage, minrefresh) VALUES($1, $2, NOW() + INTERVAL '`+strconv.Itoa(maxAgeSecs)+` seconds', $3, $4) RETURNING id`,
+		row := ps.db.QueryRow(ctx, `INSERT INTO `+ps.table+
+			` (data, userid, expires, maxage, minrefresh, version) VALUES($1, $2, NOW() + INTERVAL '`+strconv.Itoa(maxAgeSecs)+` seconds', $3, $4, 1) RETURNING id`,
 			data, userID, maxAgeSecs, minRefreshSecs)
 		if err := row.Scan(&newID); err != nil {
 			return pgxErr{"pgxStore.Save - row.Scan failed - ", err}
 		}
 
 		*sessID = sessIDToBytes(newID)
+		*version = 1
 	} else {
-		// id is NOT nil: it refers to an existing record; update it.
+		// id is NOT nil: it refers to an existing record; update it,
+		// if its version matches (or a negative version says not to check).
+		if len(*sessID) != 4 {
+			return errBadSessID
+		}
 
-		cmdtag, err := ps.db.Exec(noctx, `UPDATE `+ps.table+
-			` SET data = $1, userid = $2, expires = NOW() + INTERVAL '`+strconv.Itoa(maxAgeSecs)+` seconds', maxage = $3, minrefresh = $4 WHERE id = $5`,
-			data, userID, maxAgeSecs, minRefreshSecs, bytesToSessID(*sessID))
+		var newVersion int64
+		row := ps.db.QueryRow(ctx, `UPDATE `+ps.table+
+			` SET data = $1, userid = $2, expires = NOW() + INTERVAL '`+strconv.Itoa(maxAgeSecs)+` seconds', maxage = $3, minrefresh = $4, version = version + 1`+
+			` WHERE id = $5 AND ($6 < 0 OR version = $6) RETURNING version`,
+			data, userID, maxAgeSecs, minRefreshSecs, bytesToSessID(*sessID), *version)
+		err := row.Scan(&newVersion)
+		if err == pgx.ErrNoRows {
+			// either the record does not exist, or its version has changed.
+			var one int
+			if ps.db.QueryRow(ctx, ps.pExistsSQL, bytesToSessID(*sessID)).Scan(&one) == nil {
+				return qsess.ErrConflict
+			}
+			return pgxErr{"pgxStore.Save - UPDATE affected no rows", qsess.ErrNotFound}
+		}
 		if err != nil {
 			return pgxErr{"pgxStore.Save - UPDATE failed - ", err}
 		}
-		// if record does not exist, UPDATE doesn't return an error! you have to check for no RowsAffected.
-		if cmdtag.RowsAffected() < 1 {
-			return pgxErr{"pgxStore.Save - UPDATE affected no rows - ", err}
-		}
+		*version = newVersion
+	}
+	return nil
+}
+
+func (ps *pgxStore) TouchCtx(ctx context.Context, sessID []byte, uidNOTUSED []byte, maxAgeSecs int) error {
+	if len(sessID) != 4 {
+		return errBadSessID
+	}
+	cmdtag, err := ps.db.Exec(ctx, `UPDATE `+ps.table+
+		` SET expires = NOW() + INTERVAL '`+strconv.Itoa(maxAgeSecs)+` seconds' WHERE id = $1`,
+		bytesToSessID(sessID))
+	if err != nil {
+		return pgxErr{"pgxStore.Touch - UPDATE failed - ", err}
+	}
+	if cmdtag.RowsAffected() < 1 {
+		return pgxErr{"pgxStore.Touch - UPDATE affected no rows", qsess.ErrNotFound}
 	}
 	return nil
 }
 
-func (ps *pgxStore) Delete(sessID []byte, uidNOTUSED []byte) error {
-	if _, err := ps.db.Exec(noctx, ps.pDeleteSQL, bytesToSessID(sessID)); err != nil {
+// ConsumeCtx gets and deletes a session with DELETE ... RETURNING, which is
+// atomic, so only one of several concurrent consumers gets the session.
+func (ps *pgxStore) ConsumeCtx(ctx context.Context, sessIDbytes []byte, uidNOTUSED []byte) ([]byte, []byte, int, int, int, error) {
+	if len(sessIDbytes) != 4 {
+		return []byte{}, []byte{}, 0, 0, 0, errBadSessID
+	}
+	var data, userID []byte
+	var ttl, maxage, minrefresh int
+
+	row := ps.db.QueryRow(ctx, ps.pConsumeSQL, bytesToSessID(sessIDbytes))
+	if err := row.Scan(&data, &userID, &ttl, &maxage, &minrefresh); err != nil {
+		if err == pgx.ErrNoRows {
+			err = qsess.ErrNotFound
+		}
+		return []byte{}, []byte{}, 0, 0, 0, pgxErr{"pgxStore.Consume - DELETE failed - ", err}
+	}
+	if ttl <= 0 {
+		return data, userID, 0, 0, 0, pgxErr{"pgxStore.Consume - record has expired", qsess.ErrExpired}
+	}
+	return data, userID, ttl, maxage, minrefresh, nil
+}
+
+func (ps *pgxStore) DeleteCtx(ctx context.Context, sessID []byte, uidNOTUSED []byte) error {
+	if len(sessID) != 4 {
+		return errBadSessID
+	}
+	if _, err := ps.db.Exec(ctx, ps.pDeleteSQL, bytesToSessID(sessID)); err != nil {
 		return pgxErr{"pgxStore.Delete - DELETE failed - ", err}
 	}
 	return nil
 }
 
-func (ps *pgxStore) DeleteByUserID(userID []byte) error {
-	if _, err := ps.db.Exec(noctx, ps.pDeleteByUserIDSQL, userID); err != nil {
+func (ps *pgxStore) DeleteByUserIDCtx(ctx context.Context, userID []byte) error {
+	if _, err := ps.db.Exec(ctx, ps.pDeleteByUserIDSQL, userID); err != nil {
 		return pgxErr{"pgxStore.DeleteByUserID - DELETE failed - ", err}
 	}
 	return nil
 }
 
+func (ps *pgxStore) ListByUserIDCtx(ctx context.Context, userID []byte) ([]qsess.SessEntry, error) {
+	rows, err := ps.db.Query(ctx, ps.pListByUserIDSQL, userID)
+	if err != nil {
+		return nil, pgxErr{"pgxStore.ListByUserID - SELECT failed - ", err}
+	}
+	defer rows.Close()
+
+	var entries []qsess.SessEntry
+	for rows.Next() {
+		var id uint32
+		e := qsess.SessEntry{UserID: userID}
+		if err := rows.Scan(&id, &e.Data, &e.TimeToLiveSecs, &e.MaxAgeSecs, &e.MinRefreshSecs); err != nil {
+			return nil, pgxErr{"pgxStore.ListByUserID - rows.Scan failed - ", err}
+		}
+		e.SessID = sessIDToBytes(id)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, pgxErr{"pgxStore.ListByUserID - rows.Err - ", err}
+	}
+	return entries, nil
+}
+
+func (ps *pgxStore) IterateCtx(ctx context.Context, fn func(e qsess.SessEntry) error) error {
+	rows, err := ps.db.Query(ctx, ps.pIterateSQL)
+	if err != nil {
+		return pgxErr{"pgxStore.Iterate - SELECT failed - ", err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint32
+		var e qsess.SessEntry
+		if err := rows.Scan(&id, &e.UserID, &e.Data, &e.TimeToLiveSecs, &e.MaxAgeSecs, &e.MinRefreshSecs); err != nil {
+			return pgxErr{"pgxStore.Iterate - rows.Scan failed - ", err}
+		}
+		e.SessID = sessIDToBytes(id)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return pgxErr{"pgxStore.Iterate - rows.Err - ", err}
+	}
+	return nil
+}
+
+func (ps *pgxStore) ImportCtx(ctx context.Context, e qsess.SessEntry) error {
+	if len(e.SessID) != 4 {
+		return pgxErr{"pgxStore.Import - session id has the wrong size", nil}
+	}
+	id := bytesToSessID(e.SessID)
+	if _, err := ps.db.Exec(ctx, ps.pImportSQL, id, e.Data, e.UserID, e.TimeToLiveSecs, e.MaxAgeSecs, e.MinRefreshSecs); err != nil {
+		return pgxErr{"pgxStore.Import - INSERT failed - ", err}
+	}
+	if _, err := ps.db.Exec(ctx, ps.pImportSeqSQL, int64(id)); err != nil {
+		return pgxErr{"pgxStore.Import - setval failed - ", err}
+	}
+	return nil
+}
+
 // prune() periodically deletes expired sessions from the session store.
 // the "expires" field must be indexed for this to run efficiently.
 //
 // prune runs in a goroutine, started by NewPgxStore.
 // It runs until it receives something on its pruneKill channel.
 // You can change its wait interval by sending a number of seconds to its pruneInterval channel.
-func (ps *pgxStore) prune(waitSecs int, pruneInterval <-chan int, pruneKill <-chan int, log io.Writer) {
+// Each pass is reported to st's Observer, if any. If st has a Lifecycle
+// callback, the deleted sessions are returned, so they can be reported to it.
+func (ps *pgxStore) prune(st *qsess.Store, waitSecs int, pruneInterval <-chan int, pruneKill <-chan int, log io.Writer) {
 	for {
 		select {
 		case waitSecs = <-pruneInterval:
@@ -169,8 +332,37 @@ func (ps *pgxStore) prune(waitSecs int, pruneInterval <-chan int, pruneKill <-ch
 		case <-time.After(time.Duration(waitSecs) * time.Second):
 		}
 
-		ps.db.Exec(noctx, `DELETE FROM `+ps.table+` WHERE expires < NOW()`)
+		start := time.Now()
+		if st.Lifecycle != nil {
+			count, err := ps.pruneReporting(st)
+			st.ObservePrune(count, time.Since(start), err)
+			continue
+		}
+		tag, err := ps.db.Exec(noctx, `DELETE FROM `+ps.table+` WHERE expires < NOW()`)
+		st.ObservePrune(int(tag.RowsAffected()), time.Since(start), err)
+	}
+}
+
+// pruneReporting deletes expired sessions, reporting each one to st's
+// Lifecycle callback, and returns the number deleted.
+func (ps *pgxStore) pruneReporting(st *qsess.Store) (int, error) {
+	rows, err := ps.db.Query(noctx, `DELETE FROM `+ps.table+` WHERE expires < NOW() RETURNING id, userid, data`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var id uint32
+		var userID, data []byte
+		if err := rows.Scan(&id, &userID, &data); err != nil {
+			return count, err
+		}
+		st.ReportExpired(sessIDToBytes(id), userID, data)
+		count++
 	}
+	return count, rows.Err()
 }
 
 // serialize uint32, which we use to store a session id (database key).
@@ -181,11 +373,16 @@ func sessIDToBytes(id uint32) []byte {
 	return b
 }
 
+// callers check len(b) first (see errBadSessID).
 func bytesToSessID(b []byte) uint32 {
-	// could check len(b), but depend on qsess promise not to touch
 	return binary.LittleEndian.Uint32(b)
 }
 
+// errBadSessID is returned for session ids of the wrong size, which this
+// back-end can't have made. qsess passes only ids it was given, but qsadmin
+// passes ids typed by operators.
+var errBadSessID = pgxErr{"pgxStore - malformed session id", qsess.ErrNotFound}
+
 type pgxErr struct {
 	msg string
 	err error
@@ -197,3 +394,7 @@ func (e pgxErr) Error() string {
 	}
 	return "qspgx." + e.msg
 }
+
+func (e pgxErr) Unwrap() error {
+	return e.err
+}
@@ -4,6 +4,8 @@
 package qspgx
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"os"
@@ -76,6 +78,66 @@ func TestPgsqlDeleteByUserId(t *testing.T) {
 	dropTestTable(t, "delbyuid")
 }
 
+func TestPgsqlListByUserId(t *testing.T) {
+	st := makeTestStore(t, "listbyuid")
+	qstest.ListByUserIDTest(t, st)
+	dropTestTable(t, "listbyuid")
+}
+
+func TestPgsqlRegenerate(t *testing.T) {
+	st := makeTestStore(t, "regen")
+	qstest.RegenerateTest(t, st)
+	dropTestTable(t, "regen")
+}
+
+func TestPgsqlConflict(t *testing.T) {
+	st := makeTestStore(t, "conflict")
+	qstest.ConflictTest(t, st)
+	dropTestTable(t, "conflict")
+}
+
+func TestPgsqlAbsoluteExpiration(t *testing.T) {
+	st := makeTestStore(t, "absexp")
+	qstest.AbsoluteExpirationTest(t, st)
+	dropTestTable(t, "absexp")
+}
+
+func TestPgsqlRefresh(t *testing.T) {
+	st := makeTestStore(t, "refresh")
+	qstest.RefreshTest(t, st)
+	dropTestTable(t, "refresh")
+}
+
+func TestPgsqlSentinelErrors(t *testing.T) {
+	st := makeTestStore(t, "sentinel")
+	qstest.SentinelErrorsTest(t, st)
+	dropTestTable(t, "sentinel")
+}
+
+func TestPgsqlFlash(t *testing.T) {
+	st := makeTestStore(t, "flash")
+	qstest.FlashTest(t, st)
+	dropTestTable(t, "flash")
+}
+
+func TestPgsqlCSRF(t *testing.T) {
+	st := makeTestStore(t, "csrf")
+	qstest.CSRFTest(t, st)
+	dropTestTable(t, "csrf")
+}
+
+func TestPgsqlJWT(t *testing.T) {
+	st := makeTestStore(t, "jwt")
+	qstest.JWTTest(t, st)
+	dropTestTable(t, "jwt")
+}
+
+func TestPgsqlFingerprint(t *testing.T) {
+	st := makeTestStore(t, "fingerprint")
+	qstest.FingerprintTest(t, st)
+	dropTestTable(t, "fingerprint")
+}
+
 func TestPgsqlExpiration(t *testing.T) {
 	st := makeTestStore(t, "exp")
 	qstest.ExpirationTest(t, st)
@@ -94,3 +156,58 @@ func TestPgsqlSerializer(t *testing.T) {
 		// t.Logf("%x %d => %d\n", b, b, intf)
 	}
 }
+
+// TestPgsqlBadSessID checks that malformed session ids (such as those typed into
+// qsess-admin) are not found, without reaching the database.
+func TestPgsqlBadSessID(t *testing.T) {
+	be := &pgxStore{}
+	ctx := context.Background()
+	for _, id := range [][]byte{{}, {0xab}, {1, 2, 3, 4, 5}} {
+		if _, _, _, _, _, err := be.GetCtx(ctx, id, nil); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Get %x - expected ErrNotFound, got %v", id, err)
+		}
+		if err := be.DeleteCtx(ctx, id, nil); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Delete %x - expected ErrNotFound, got %v", id, err)
+		}
+		if err := be.TouchCtx(ctx, id, nil, 60); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Touch %x - expected ErrNotFound, got %v", id, err)
+		}
+		if _, _, _, _, _, err := be.ConsumeCtx(ctx, id, nil); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Consume %x - expected ErrNotFound, got %v", id, err)
+		}
+		sessID := id
+		if err := be.SaveCtx(ctx, &sessID, []byte{}, []byte{}, 60, 10); !errors.Is(err, qsess.ErrNotFound) {
+			t.Errorf("Save %x - expected ErrNotFound, got %v", id, err)
+		}
+	}
+}
+
+func TestPgsqlIterate(t *testing.T) {
+	st := makeTestStore(t, "iterate")
+	qstest.IterateTest(t, st)
+	dropTestTable(t, "iterate")
+}
+
+func TestPgsqlEncryptAtRest(t *testing.T) {
+	st := makeTestStore(t, "atrest")
+	qstest.EncryptAtRestTest(t, st)
+	dropTestTable(t, "atrest")
+}
+
+func TestPgsqlLifecycle(t *testing.T) {
+	st := makeTestStore(t, "lifecycle")
+	qstest.LifecycleTest(t, st, true, true)
+	dropTestTable(t, "lifecycle")
+}
+
+func TestPgsqlRemember(t *testing.T) {
+	st := makeTestStore(t, "remember")
+	qstest.RememberTest(t, st)
+	dropTestTable(t, "remember")
+}
+
+func TestPgsqlConsume(t *testing.T) {
+	st := makeTestStore(t, "consume")
+	qstest.ConsumeTest(t, st)
+	dropTestTable(t, "consume")
+}
@@ -0,0 +1,336 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// Package qsremember implements "remember me" persistent logins for qsess,
+// without keeping sessions alive for weeks. A remember-me cookie holds a
+// selector, which identifies a record in a back-end, and a random validator,
+// of which the record holds only a hash. Each time the cookie is used to log
+// in, the validator is replaced, and a fresh, short-lived session is made.
+// If an old validator is presented, the cookie must have been copied, so
+// all the user's remember-me cookies are revoked.
+//
+// Records are kept in a qsess.Store of their own (for example, a qspgx
+// Store with its own table, or a qsldb Store with its own prefix), so any
+// back-end which implements qsess.SessVersioner can be used: all the
+// database back-ends in this module do; NewCookieStore's doesn't.
+//
+//	m, err := qsremember.NewManager(rememberStore, sessStore)
+//	...
+//	// after a password login, with "remember me" checked:
+//	err = m.Issue(ctx, w, userID)
+//	...
+//	// when a request has no session:
+//	sess, err := m.Login(ctx, w, r)
+//	...
+//	// on logout:
+//	err = m.Forget(ctx, w, r)
+package qsremember
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gkong/go-qweb/qsess"
+)
+
+const (
+	DefaultMaxAgeSecs = 30 * 24 * 60 * 60 // remember-me cookies last 30 days from last use
+	DefaultGraceSecs  = 10
+	DefaultCookieName = "qsremember"
+)
+
+// ErrTheft is returned by Login when a remember-me cookie is presented with
+// an old validator, meaning the cookie has been copied. By then, all the
+// user's remember-me cookies have been revoked.
+var ErrTheft = errors.New("qsremember - remember-me cookie has been used by someone else")
+
+const validatorSize = 32
+
+// Manager issues and checks remember-me cookies. Its fields may be changed
+// after NewManager, before it is used.
+type Manager struct {
+	tokens   *qsess.Store
+	sessions *qsess.Store
+
+	// MaxAgeSecs is how long a remember-me cookie lasts, from its last use.
+	MaxAgeSecs int
+
+	// SessionMaxAgeSecs, if positive, is the MaxAgeSecs of sessions made by
+	// Login, which otherwise get the session Store's default.
+	SessionMaxAgeSecs int
+
+	// GraceSecs is how long a replaced validator is tolerated, without
+	// being treated as theft, so concurrent requests carrying the same
+	// cookie don't revoke it. Login fails, with qsess.ErrConflict, for
+	// such requests.
+	GraceSecs int
+
+	// OnTheft, if set, is called by Login when it detects theft, after
+	// revoking the user's remember-me cookies.
+	OnTheft func(userID []byte)
+
+	// RevokeSessionsOnTheft, if true, makes Login also delete all the
+	// user's sessions when it detects theft.
+	RevokeSessionsOnTheft bool
+
+	// remember-me cookie settings. NewManager copies the domain, path,
+	// secure and same-site settings from the session Store.
+	CookieName     string
+	CookieDomain   string
+	CookiePath     string
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+}
+
+// NewManager returns a Manager which keeps remember-me records in tokens,
+// and makes sessions in sessions. It configures tokens for its own use (it
+// sets its AuthType, NewSessData and VersionCheck), so tokens must not be
+// used for anything else. It fails with qsess.ErrNotSupported if tokens'
+// back-end does not implement qsess.SessVersioner, which is needed to
+// replace validators atomically.
+func NewManager(tokens *qsess.Store, sessions *qsess.Store) (*Manager, error) {
+	if !qsess.Supports[qsess.SessVersioner](tokens.BackEndCtx()) {
+		return nil, remErr{"NewManager - back-end does not keep versions", qsess.ErrNotSupported}
+	}
+	tokens.AuthType = qsess.TokenAuth
+	tokens.SendToken = nil
+	tokens.NewSessData = func() qsess.SessData { return &record{} }
+	tokens.VersionCheck = true
+
+	return &Manager{
+		tokens:         tokens,
+		sessions:       sessions,
+		MaxAgeSecs:     DefaultMaxAgeSecs,
+		GraceSecs:      DefaultGraceSecs,
+		CookieName:     DefaultCookieName,
+		CookieDomain:   sessions.CookieDomain,
+		CookiePath:     sessions.CookiePath,
+		CookieSecure:   sessions.CookieSecure,
+		CookieSameSite: sessions.CookieSameSite,
+	}, nil
+}
+
+// record is the data of a remember-me record: hashes of the current and
+// previous validators, and when the current one was issued.
+type record struct {
+	hash     [sha256.Size]byte
+	prevHash [sha256.Size]byte
+	issued   int64 // unix seconds
+}
+
+const recordSize = 2*sha256.Size + 8
+
+func (rec *record) Marshal() ([]byte, error) {
+	b := make([]byte, recordSize)
+	copy(b, rec.hash[:])
+	copy(b[sha256.Size:], rec.prevHash[:])
+	binary.BigEndian.PutUint64(b[2*sha256.Size:], uint64(rec.issued))
+	return b, nil
+}
+
+func (rec *record) Unmarshal(b []byte) error {
+	if len(b) != recordSize {
+		return remErr{"record.Unmarshal - malformed record", qsess.ErrBackend}
+	}
+	copy(rec.hash[:], b)
+	copy(rec.prevHash[:], b[sha256.Size:])
+	rec.issued = int64(binary.BigEndian.Uint64(b[2*sha256.Size:]))
+	return nil
+}
+
+// rotate gives rec a new validator, which it returns.
+func (rec *record) rotate() ([]byte, error) {
+	v := make([]byte, validatorSize)
+	if _, err := rand.Read(v); err != nil {
+		return nil, err
+	}
+	rec.prevHash = rec.hash
+	rec.hash = sha256.Sum256(v)
+	rec.issued = time.Now().Unix()
+	return v, nil
+}
+
+// Issue makes a remember-me record for userID, and sends its cookie to the
+// client. Call it after a user logs in with a password and asks to be
+// remembered. userID must not be empty.
+func (m *Manager) Issue(ctx context.Context, w http.ResponseWriter, userID []byte) error {
+	if len(userID) == 0 {
+		return remErr{"Issue - empty user id", nil}
+	}
+	rs := m.tokens.NewSession(userID)
+	rs.MaxAgeSecs = m.MaxAgeSecs
+	rs.MinRefreshSecs = m.MaxAgeSecs
+	v, err := rs.Data.(*record).rotate()
+	if err != nil {
+		return remErr{"Issue - rand.Read failed", err}
+	}
+	if err := rs.SaveCtx(ctx, w); err != nil {
+		return remErr{"Issue - Save", err}
+	}
+	return m.setCookie(ctx, w, rs, v)
+}
+
+// Login logs a user in with a remember-me cookie. It replaces the cookie's
+// validator, sends the new cookie, makes a new session (which it also
+// sends), and returns it. Sessions made this way have not seen a password,
+// so applications may want to ask for one before sensitive operations.
+//
+// It fails with qsess.ErrNoCredentials if there is no remember-me cookie,
+// with qsess.ErrInvalidToken, qsess.ErrExpired or qsess.ErrNotFound (and
+// deletes the cookie) if it is no good, with qsess.ErrConflict if another
+// request has just replaced its validator, and with ErrTheft if it has been
+// copied.
+func (m *Manager) Login(ctx context.Context, w http.ResponseWriter, r *http.Request) (*qsess.Session, error) {
+	rs, v, err := m.read(ctx, w, r)
+	if err != nil {
+		return nil, remErr{"Login", err}
+	}
+	rec := rs.Data.(*record)
+	h := sha256.Sum256(v)
+
+	if subtle.ConstantTimeCompare(h[:], rec.hash[:]) != 1 {
+		if subtle.ConstantTimeCompare(h[:], rec.prevHash[:]) == 1 && time.Now().Unix()-rec.issued <= int64(m.GraceSecs) {
+			return nil, remErr{"Login - validator was just replaced", qsess.ErrConflict}
+		}
+		m.theft(ctx, w, rs.UserID())
+		return nil, remErr{"Login", ErrTheft}
+	}
+
+	if v, err = rec.rotate(); err != nil {
+		return nil, remErr{"Login - rand.Read failed", err}
+	}
+	rs.MaxAgeSecs = m.MaxAgeSecs
+	rs.MinRefreshSecs = m.MaxAgeSecs
+	if err := rs.SaveCtx(ctx, w); err != nil {
+		// ErrConflict if a concurrent request got there first.
+		return nil, remErr{"Login - Save", err}
+	}
+	if err := m.setCookie(ctx, w, rs, v); err != nil {
+		return nil, remErr{"Login", err}
+	}
+
+	sess := m.sessions.NewClientSession(rs.UserID(), r)
+	if m.SessionMaxAgeSecs > 0 {
+		sess.MaxAgeSecs = m.SessionMaxAgeSecs
+	}
+	if err := sess.SaveCtx(ctx, w); err != nil {
+		return nil, remErr{"Login - session Save", err}
+	}
+	return sess, nil
+}
+
+// Forget deletes the request's remember-me cookie, and its record, if any.
+// Call it when a user logs out.
+func (m *Manager) Forget(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	rs, _, err := m.read(ctx, w, r)
+	if err != nil {
+		if errors.Is(err, qsess.ErrBackend) {
+			return remErr{"Forget", err}
+		}
+		return nil
+	}
+	m.deleteCookie(w)
+	if err := rs.DeleteCtx(ctx, w); err != nil {
+		return remErr{"Forget - Delete", err}
+	}
+	return nil
+}
+
+// ForgetUser deletes all of a user's remember-me records, for example, when
+// the user's password is changed.
+func (m *Manager) ForgetUser(ctx context.Context, userID []byte) error {
+	if err := m.tokens.NewSession(userID).DeleteByUserIDCtx(ctx, nil); err != nil {
+		return remErr{"ForgetUser", err}
+	}
+	return nil
+}
+
+// read returns the record and validator of the request's remember-me
+// cookie. If the cookie is no good, it deletes it.
+func (m *Manager) read(ctx context.Context, w http.ResponseWriter, r *http.Request) (*qsess.Session, []byte, error) {
+	c, err := r.Cookie(m.CookieName)
+	if err != nil || c.Value == "" {
+		return nil, nil, qsess.ErrNoCredentials
+	}
+	i := strings.LastIndexByte(c.Value, '.')
+	var v []byte
+	if i >= 0 {
+		v, err = base64.RawURLEncoding.DecodeString(c.Value[i+1:])
+	}
+	if i < 0 || err != nil || len(v) != validatorSize {
+		m.deleteCookie(w)
+		return nil, nil, remErr{"malformed cookie", qsess.ErrInvalidToken}
+	}
+	rs, _, err := m.tokens.GetTokenSessionCtx(ctx, c.Value[:i])
+	if err != nil {
+		if !errors.Is(err, qsess.ErrBackend) {
+			m.deleteCookie(w)
+		}
+		return nil, nil, err
+	}
+	return rs, v, nil
+}
+
+// theft revokes the user's remember-me cookies (and, if configured, their
+// sessions), and reports it.
+func (m *Manager) theft(ctx context.Context, w http.ResponseWriter, userID []byte) {
+	m.deleteCookie(w)
+	m.ForgetUser(ctx, userID)
+	if m.RevokeSessionsOnTheft {
+		m.sessions.NewSession(userID).DeleteByUserIDCtx(ctx, nil)
+	}
+	if m.OnTheft != nil {
+		m.OnTheft(userID)
+	}
+}
+
+func (m *Manager) setCookie(ctx context.Context, w http.ResponseWriter, rs *qsess.Session, v []byte) error {
+	selector, _, err := rs.TokenCtx(ctx)
+	if err != nil {
+		return remErr{"setCookie - Token", err}
+	}
+	value := selector + "." + base64.RawURLEncoding.EncodeToString(v)
+	http.SetCookie(w, m.newCookie(value, m.MaxAgeSecs))
+	return nil
+}
+
+func (m *Manager) deleteCookie(w http.ResponseWriter) {
+	http.SetCookie(w, m.newCookie("", -1))
+}
+
+func (m *Manager) newCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     m.CookieName,
+		Value:    value,
+		Domain:   m.CookieDomain,
+		Path:     m.CookiePath,
+		MaxAge:   maxAge,
+		Secure:   m.CookieSecure,
+		HttpOnly: true,
+		SameSite: m.CookieSameSite,
+	}
+}
+
+type remErr struct {
+	msg string
+	err error
+}
+
+func (e remErr) Error() string {
+	if e.err != nil {
+		return "qsremember." + e.msg + " - " + e.err.Error()
+	}
+	return "qsremember." + e.msg
+}
+
+func (e remErr) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,180 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsremember_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/qsremember"
+)
+
+var testKey = []byte("key-for-encryption--------------")
+
+func TestNewManagerCookieStore(t *testing.T) {
+	tokens, err := qsess.NewCookieStore(nil, false, testKey)
+	if err != nil {
+		t.Fatal("NewCookieStore failed - " + err.Error())
+	}
+	sessions, err := qsess.NewMapStore(testKey)
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	// records kept in clients can't be revoked or rotated.
+	if _, err := qsremember.NewManager(tokens, sessions); !errors.Is(err, qsess.ErrNotSupported) {
+		t.Fatalf("NewManager with cookie store - expected ErrNotSupported, got %v", err)
+	}
+}
+
+// unversioned hides a back-end's optional interfaces.
+type unversioned struct {
+	qsess.SessBackEndCtx
+}
+
+func TestNewManagerWrapped(t *testing.T) {
+	// a CachingBackEnd implements SessVersioner, but the back-end it wraps
+	// must too.
+	tokens, err := qsess.NewMapStore(testKey)
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	tokens.SetBackEnd(qsess.NewCachingBackEnd(unversioned{tokens.BackEndCtx()}, 10, time.Minute, nil))
+	if _, err := qsremember.NewManager(tokens, tokens); !errors.Is(err, qsess.ErrNotSupported) {
+		t.Fatalf("NewManager with cache over unversioned back-end - expected ErrNotSupported, got %v", err)
+	}
+
+	tokens, err = qsess.NewMapStore(testKey)
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	tokens.SetBackEnd(qsess.NewCachingBackEnd(tokens.BackEndCtx(), 10, time.Minute, nil))
+	if _, err := qsremember.NewManager(tokens, tokens); err != nil {
+		t.Fatal("NewManager with cache over map back-end failed - " + err.Error())
+	}
+}
+
+type mapManager struct {
+	*qsremember.Manager
+	sessions *qsess.Store
+	thefts   [][]byte
+}
+
+func newMapManager(t *testing.T) *mapManager {
+	tokens, err := qsess.NewMapStore(testKey)
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	sessions, err := qsess.NewMapStore(testKey)
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	m, err := qsremember.NewManager(tokens, sessions)
+	if err != nil {
+		t.Fatal("NewManager failed - " + err.Error())
+	}
+	mm := &mapManager{Manager: m, sessions: sessions}
+	m.OnTheft = func(userID []byte) { mm.thefts = append(mm.thefts, userID) }
+	return mm
+}
+
+// cookie returns the remember-me cookie set in w.
+func (mm *mapManager) cookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == mm.CookieName && c.MaxAge > 0 {
+			return c
+		}
+	}
+	t.Fatal("no remember-me cookie was set")
+	return nil
+}
+
+func (mm *mapManager) login(c *http.Cookie) (*qsess.Session, *httptest.ResponseRecorder, error) {
+	r := httptest.NewRequest("GET", "http://foo.com", nil)
+	r.AddCookie(c)
+	w := httptest.NewRecorder()
+	sess, err := mm.Login(context.Background(), w, r)
+	return sess, w, err
+}
+
+func (mm *mapManager) issue(t *testing.T, userID []byte) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := mm.Issue(context.Background(), w, userID); err != nil {
+		t.Fatal("Issue failed - " + err.Error())
+	}
+	return mm.cookie(t, w)
+}
+
+// TestReplayWithinGrace checks that a replaced validator, presented again
+// within the grace window, as by a concurrent request, fails with
+// ErrConflict, without revoking anything.
+func TestReplayWithinGrace(t *testing.T) {
+	mm := newMapManager(t)
+	userID := []byte("userid-grace")
+	c1 := mm.issue(t, userID)
+
+	_, w, err := mm.login(c1)
+	if err != nil {
+		t.Fatal("Login failed - " + err.Error())
+	}
+	c2 := mm.cookie(t, w)
+
+	if _, _, err := mm.login(c1); !errors.Is(err, qsess.ErrConflict) || errors.Is(err, qsremember.ErrTheft) {
+		t.Fatalf("replay within grace window - expected ErrConflict, got %v", err)
+	}
+	if len(mm.thefts) != 0 {
+		t.Fatal("replay within grace window was reported as theft")
+	}
+	if _, _, err := mm.login(c2); err != nil {
+		t.Fatal("Login with current cookie failed after replay within grace window - " + err.Error())
+	}
+}
+
+// TestReplayTheft checks that a replaced validator, presented again after
+// the grace window, is treated as theft, revoking the user's remember-me
+// cookies and sessions.
+func TestReplayTheft(t *testing.T) {
+	mm := newMapManager(t)
+	mm.GraceSecs = 0
+	mm.RevokeSessionsOnTheft = true
+	userID := []byte("userid-theft")
+	c1 := mm.issue(t, userID)
+	other := mm.issue(t, userID)
+
+	sess, w, err := mm.login(c1)
+	if err != nil {
+		t.Fatal("Login failed - " + err.Error())
+	}
+	c2 := mm.cookie(t, w)
+	mm.sessions.AuthType = qsess.TokenAuth
+	sessToken, _, err := sess.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+
+	// validators are issued with one-second resolution.
+	time.Sleep(1100 * time.Millisecond)
+
+	if _, _, err := mm.login(c1); !errors.Is(err, qsremember.ErrTheft) {
+		t.Fatalf("replay after grace window - expected ErrTheft, got %v", err)
+	}
+	if len(mm.thefts) != 1 || !bytes.Equal(mm.thefts[0], userID) {
+		t.Fatalf("expected one theft of %q to be reported, got %q", userID, mm.thefts)
+	}
+	for _, c := range []*http.Cookie{c2, other} {
+		if _, _, err := mm.login(c); err == nil {
+			t.Fatal("Login succeeded with a remember-me cookie which should have been revoked")
+		}
+	}
+	if _, _, err := mm.sessions.GetTokenSession(sessToken); err == nil {
+		t.Fatal("session made by Login was not revoked")
+	}
+}
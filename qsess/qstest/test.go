@@ -6,14 +6,20 @@ package qstest
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gkong/go-qweb/qsess"
+	"github.com/gkong/go-qweb/qsess/qsremember"
 )
 
 func TestNothing(t *testing.T) {
@@ -121,6 +127,442 @@ func ExpirationTest(t *testing.T, store *qsess.Store) {
 	}
 }
 
+// AbsoluteExpirationTest verifies that a session expires at its absolute
+// deadline, even if it is refreshed (saved) before its idle deadline.
+func AbsoluteExpirationTest(t *testing.T, store *qsess.Store) {
+	st := *store // make a copy, to mess with
+	st.AuthType = qsess.TokenAuth
+	st.MaxAgeSecs = 100
+	st.AbsoluteMaxAgeSecs = 4
+
+	sess := st.NewSession([]byte("userid-abs"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatalf("Token failed - %s", err.Error())
+	}
+	r, _ := http.NewRequest("GET", "http://nowhere.com", nil)
+	r.Header.Add("Authorization", "Bearer "+tok)
+
+	st.AbsoluteMaxAgeSecs = 0 // the session must remember its own setting
+
+	for i := 0; i < 2; i++ {
+		time.Sleep(time.Second)
+		sess, ttl, err := st.GetSession(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("Get failed, but session should not have expired yet - %s", err.Error())
+		}
+		if ttl > 4 {
+			t.Fatalf("Get reported ttl %d, beyond the absolute deadline", ttl)
+		}
+		if sess.MaxAgeSecs != 100 || sess.AbsoluteMaxAgeSecs != 4 {
+			t.Fatalf("Get returned MaxAgeSecs %d, AbsoluteMaxAgeSecs %d; expected 100, 4", sess.MaxAgeSecs, sess.AbsoluteMaxAgeSecs)
+		}
+		// refresh, which must not extend the session past its absolute deadline
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatalf("Save failed - %s", err.Error())
+		}
+	}
+
+	time.Sleep(3 * time.Second)
+
+	if _, _, err := st.GetSession(httptest.NewRecorder(), r); err == nil {
+		t.Fatal("Get succeeded, but session should have reached its absolute lifetime")
+	}
+}
+
+// RefreshTest verifies that Refresh, and Save of an unchanged session,
+// extend expiration time without disturbing session data.
+func RefreshTest(t *testing.T, store *qsess.Store) {
+	st := *store // make a copy, to mess with
+	st.AuthType = qsess.TokenAuth
+
+	sess := st.NewSession([]byte("userid-refresh"))
+	sess.MaxAgeSecs = 3
+	sess.Data.(*qsess.VarMap).Vars["note"] = "still here"
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatalf("Token failed - %s", err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		time.Sleep(2 * time.Second)
+		sess, _, err = st.GetTokenSession(tok)
+		if err != nil {
+			t.Fatalf("Get failed, but session should have been refreshed - %s", err.Error())
+		}
+		if i == 0 {
+			err = sess.Refresh(httptest.NewRecorder())
+		} else {
+			err = sess.Save(httptest.NewRecorder())
+		}
+		if err != nil {
+			t.Fatalf("refresh failed - %s", err.Error())
+		}
+	}
+
+	time.Sleep(2 * time.Second)
+	sess, ttl, err := st.GetTokenSession(tok)
+	if err != nil {
+		t.Fatalf("Get failed, but session should have been refreshed - %s", err.Error())
+	}
+	if ttl > 3 {
+		t.Fatalf("expected ttl <= 3, got %d", ttl)
+	}
+	if sess.MaxAgeSecs != 3 || sess.Data.(*qsess.VarMap).Vars["note"] != "still here" {
+		t.Fatal("refresh did not preserve session data")
+	}
+
+	sess.Delete(httptest.NewRecorder())
+}
+
+// SentinelErrorsTest checks that failures are reported with the right
+// sentinel errors.
+func SentinelErrorsTest(t *testing.T, store *qsess.Store) {
+	st := *store // make a copy, to mess with
+	st.AuthType = qsess.TokenAuth
+
+	r, _ := http.NewRequest("GET", "http://nowhere.com", nil)
+	if _, _, err := st.GetSession(httptest.NewRecorder(), r); !errors.Is(err, qsess.ErrNoCredentials) {
+		t.Fatalf("GetSession without token - expected ErrNoCredentials, got %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer not-a-real-token")
+	if _, _, err := st.GetSession(httptest.NewRecorder(), r); !errors.Is(err, qsess.ErrInvalidToken) {
+		t.Fatalf("GetSession with garbage token - expected ErrInvalidToken, got %v", err)
+	}
+
+	sess := st.NewSession([]byte("userid-sentinel"))
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatalf("Token failed - %s", err.Error())
+	}
+	if err := sess.Delete(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Delete failed - %s", err.Error())
+	}
+	_, _, err = st.GetTokenSession(tok)
+	if !errors.Is(err, qsess.ErrNotFound) {
+		t.Fatalf("GetTokenSession of deleted session - expected ErrNotFound, got %v", err)
+	}
+	if errors.Is(err, qsess.ErrBackend) {
+		t.Fatal("GetTokenSession of deleted session - reported as ErrBackend")
+	}
+}
+
+// FlashTest checks that flash messages survive a round trip through the
+// back-end, in order, and are cleared once read, regardless of session data
+// type.
+func FlashTest(t *testing.T, store *qsess.Store) {
+	st := *store // make a copy, to mess with
+	st.AuthType = qsess.TokenAuth
+	st.NewSessData = nil // flashes must not depend on session data
+
+	sess := st.NewSession([]byte("userid-flash"))
+	sess.AddFlash("info", "saved")
+	sess.AddFlash("error", "")
+	sess.AddFlash("", "caf\u00e9")
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatalf("Token failed - %s", err.Error())
+	}
+
+	sess, _, err = st.GetTokenSession(tok)
+	if err != nil {
+		t.Fatalf("GetTokenSession failed - %s", err.Error())
+	}
+	flashes := sess.Flashes()
+	expected := []qsess.Flash{
+		{Kind: "info", Msg: "saved"},
+		{Kind: "error", Msg: ""},
+		{Kind: "", Msg: "caf\u00e9"},
+	}
+	if len(flashes) != len(expected) {
+		t.Fatalf("expected %d flashes, got %d", len(expected), len(flashes))
+	}
+	for i := range expected {
+		if flashes[i] != expected[i] {
+			t.Fatalf("flash %d - expected %v, got %v", i, expected[i], flashes[i])
+		}
+	}
+	if len(sess.Flashes()) != 0 {
+		t.Fatal("Flashes did not clear flash messages")
+	}
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+
+	sess, _, err = st.GetTokenSession(tok)
+	if err != nil {
+		t.Fatalf("GetTokenSession failed - %s", err.Error())
+	}
+	if len(sess.Flashes()) != 0 {
+		t.Fatal("flash messages were returned again after being read and saved")
+	}
+
+	sess.Delete(httptest.NewRecorder())
+}
+
+// CSRFTest checks that a session's CSRF tokens survive a round trip through
+// the back-end, are masked differently each time, and are rejected by other
+// sessions and after Regenerate.
+func CSRFTest(t *testing.T, store *qsess.Store) {
+	st := *store // make a copy, to mess with
+	st.AuthType = qsess.TokenAuth
+
+	sess := st.NewSession([]byte("userid-csrf"))
+	if sess.CSRFToken() != "" {
+		t.Fatal("unsaved session returned a CSRF token")
+	}
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+	csrf1, csrf2 := sess.CSRFToken(), sess.CSRFToken()
+	if csrf1 == "" || csrf1 == csrf2 {
+		t.Fatal("CSRF tokens should be non-empty and differently masked")
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatalf("Token failed - %s", err.Error())
+	}
+
+	sess, _, err = st.GetTokenSession(tok)
+	if err != nil {
+		t.Fatalf("GetTokenSession failed - %s", err.Error())
+	}
+	if !sess.CheckCSRFToken(csrf1) || !sess.CheckCSRFToken(csrf2) {
+		t.Fatal("CheckCSRFToken rejected a valid token")
+	}
+	tampered := "A" + csrf1[1:]
+	if csrf1[0] == 'A' {
+		tampered = "B" + csrf1[1:]
+	}
+	for _, bad := range []string{"", "garbage", tampered} {
+		if sess.CheckCSRFToken(bad) {
+			t.Fatalf("CheckCSRFToken accepted %q", bad)
+		}
+	}
+
+	other := st.NewSession([]byte("userid-csrf"))
+	if err := other.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+	if other.CheckCSRFToken(csrf1) {
+		t.Fatal("CheckCSRFToken accepted another session's token")
+	}
+	other.Delete(httptest.NewRecorder())
+
+	if err := sess.Regenerate(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Regenerate failed - %s", err.Error())
+	}
+	if sess.CheckCSRFToken(csrf1) {
+		t.Fatal("CheckCSRFToken accepted a token issued before Regenerate")
+	}
+	if !sess.CheckCSRFToken(sess.CSRFToken()) {
+		t.Fatal("CheckCSRFToken rejected a token issued after Regenerate")
+	}
+
+	sess.Delete(httptest.NewRecorder())
+}
+
+// JWTTest checks that JWT tokens, signed with HS256 and EdDSA, carry the
+// standard claims, refer to their sessions, and are rejected if tampered with,
+// expired or signed with the wrong algorithm.
+func JWTTest(t *testing.T, store *qsess.Store) {
+	_, edKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed - %s", err.Error())
+	}
+	configs := []*qsess.JWTConfig{
+		{HMACKey: []byte("jwt-hmac-key"), Issuer: "qstest"},
+		{EdDSAKey: edKey, Audience: "qstest-api"},
+	}
+
+	for _, jc := range configs {
+		st := *store // make a copy, to mess with
+		st.AuthType = qsess.TokenAuth
+		st.JWT = jc
+
+		sess := st.NewSession([]byte("userid-jwt"))
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatalf("Save failed - %s", err.Error())
+		}
+		tok, _, err := sess.Token()
+		if err != nil {
+			t.Fatalf("Token failed - %s", err.Error())
+		}
+
+		parts := strings.Split(tok, ".")
+		if len(parts) != 3 {
+			t.Fatalf("token is not a JWT - %s", tok)
+		}
+		var claims map[string]interface{}
+		claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || json.Unmarshal(claimsJSON, &claims) != nil {
+			t.Fatal("cannot decode JWT claims")
+		}
+		for _, c := range []string{"exp", "iat", "sid"} {
+			if _, ok := claims[c]; !ok {
+				t.Errorf("JWT has no %s claim", c)
+			}
+		}
+		if claims["sub"] != "userid-jwt" {
+			t.Errorf("JWT sub claim - expected userid-jwt, got %v", claims["sub"])
+		}
+		if exp, iat := claims["exp"].(float64), claims["iat"].(float64); exp <= iat {
+			t.Errorf("JWT exp (%v) is not after iat (%v)", exp, iat)
+		}
+
+		if _, _, err := st.GetTokenSession(tok); err != nil {
+			t.Fatalf("GetTokenSession failed - %s", err.Error())
+		}
+
+		// flip a bit in the payload, keeping the signature.
+		payload := []byte(parts[1])
+		payload[0] ^= 1
+		tampered := parts[0] + "." + string(payload) + "." + parts[2]
+		noneHdr := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+		for _, bad := range []string{tampered, noneHdr + "." + parts[1] + ".", "garbage"} {
+			if _, _, err := st.GetTokenSession(bad); !errors.Is(err, qsess.ErrInvalidToken) {
+				t.Errorf("expected ErrInvalidToken for %q, got %v", bad, err)
+			}
+		}
+
+		// tokens from a Store with a different JWTConfig are rejected
+		other := st
+		other.JWT = &qsess.JWTConfig{HMACKey: []byte("other-hmac-key"), Issuer: jc.Issuer, Audience: jc.Audience}
+		if _, _, err := other.GetTokenSession(tok); !errors.Is(err, qsess.ErrInvalidToken) {
+			t.Errorf("expected ErrInvalidToken from Store with other key, got %v", err)
+		}
+
+		sess.Delete(httptest.NewRecorder())
+	}
+
+	// an expired JWT
+	st := *store
+	st.AuthType = qsess.TokenAuth
+	st.JWT = configs[0]
+	sess := st.NewSession([]byte("userid-jwt"))
+	sess.MaxAgeSecs = 1
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+	tok, _, err := sess.Token()
+	if err != nil {
+		t.Fatalf("Token failed - %s", err.Error())
+	}
+	time.Sleep(2 * time.Second)
+	if _, _, err := st.GetTokenSession(tok); !errors.Is(err, qsess.ErrExpired) {
+		t.Errorf("expected ErrExpired for expired JWT, got %v", err)
+	}
+}
+
+// FingerprintTest checks that a session's fingerprint is persisted by the
+// back-end, and that mismatches are handled according to the Store's policy.
+func FingerprintTest(t *testing.T, store *qsess.Store) {
+	st := *store // make a copy, to mess with
+	st.AuthType = qsess.TokenAuth
+	st.Fingerprint = qsess.FingerprintUserAgent
+
+	login, _ := http.NewRequest("POST", "http://nowhere.com", nil)
+	login.Header.Set("User-Agent", "qstest-browser")
+	save := func(sess *qsess.Session) string {
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatalf("Save failed - %s", err.Error())
+		}
+		tok, _, err := sess.Token()
+		if err != nil {
+			t.Fatalf("Token failed - %s", err.Error())
+		}
+		return tok
+	}
+	requestTok := func(tok string, userAgent string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://nowhere.com", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		r.Header.Set("User-Agent", userAgent)
+		return r
+	}
+
+	// a session with no fingerprint isn't bound to the first client to
+	// present it.
+	unbound := st.NewSession([]byte("userid-fingerprint"))
+	unboundTok := save(unbound)
+	for i := 0; i < 2; i++ {
+		if _, _, err := st.GetSession(httptest.NewRecorder(), requestTok(unboundTok, "thief")); !errors.Is(err, qsess.ErrFingerprintMismatch) {
+			t.Fatalf("GetSession of unbound session - expected ErrFingerprintMismatch, got %v", err)
+		}
+	}
+	unbound.Delete(httptest.NewRecorder())
+
+	sess := st.NewClientSession([]byte("userid-fingerprint"), login)
+	tok := save(sess)
+	request := func(userAgent string) *http.Request {
+		return requestTok(tok, userAgent)
+	}
+
+	if _, _, err := st.GetSession(httptest.NewRecorder(), request("qstest-browser")); err != nil {
+		t.Fatalf("GetSession from the same client failed - %s", err.Error())
+	}
+	if _, _, err := st.GetSession(httptest.NewRecorder(), request("elsewhere")); !errors.Is(err, qsess.ErrFingerprintMismatch) {
+		t.Fatalf("GetSession from another client - expected ErrFingerprintMismatch, got %v", err)
+	}
+
+	calls := 0
+	for _, action := range []qsess.FingerprintAction{qsess.FingerprintReauth, qsess.FingerprintLogOnly} {
+		st.FingerprintMismatch = func(s *qsess.Session, r *http.Request) qsess.FingerprintAction {
+			calls++
+			return action
+		}
+		s, _, err := st.GetSession(httptest.NewRecorder(), request("elsewhere"))
+		if err != nil {
+			t.Fatalf("GetSession with action %d failed - %s", action, err.Error())
+		}
+		if s.ReauthRequired() != (action == qsess.FingerprintReauth) {
+			t.Errorf("action %d - ReauthRequired is %v", action, s.ReauthRequired())
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected FingerprintMismatch to be called twice, got %d", calls)
+	}
+
+	// re-authenticate from the new client, and the session moves there.
+	st.FingerprintMismatch = func(s *qsess.Session, r *http.Request) qsess.FingerprintAction {
+		return qsess.FingerprintReauth
+	}
+	r := request("elsewhere")
+	sess, _, err := st.GetSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("GetSession failed - %s", err.Error())
+	}
+	sess.BindFingerprint(r)
+	if sess.ReauthRequired() {
+		t.Error("ReauthRequired still true after BindFingerprint")
+	}
+	if err := sess.Save(httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed - %s", err.Error())
+	}
+	st.FingerprintMismatch = nil
+	if _, _, err := st.GetSession(httptest.NewRecorder(), request("elsewhere")); err != nil {
+		t.Fatalf("GetSession from re-bound client failed - %s", err.Error())
+	}
+	if _, _, err := st.GetSession(httptest.NewRecorder(), request("qstest-browser")); !errors.Is(err, qsess.ErrFingerprintMismatch) {
+		t.Fatalf("GetSession from original client - expected ErrFingerprintMismatch, got %v", err)
+	}
+
+	sess.Delete(httptest.NewRecorder())
+}
+
 // DeleteByUserIdTest is a backend-independent test of DeleteByUserID.
 //
 // noZombies - report an error if Saving a deleted session succeeds
@@ -231,3 +673,729 @@ func NoSessDataTest(t *testing.T, store *qsess.Store) {
 
 	s2.Delete(w)
 }
+
+// ListByUserIDTest is a backend-independent test of ListByUserID and
+// DeleteSession.
+func ListByUserIDTest(t *testing.T, store *qsess.Store) {
+	var sessions []*qsess.Session
+	var tokens []string
+
+	for i, uid := range []string{"lister1", "lister2", "lister1", "lister1"} {
+		s := store.NewSession([]byte(uid))
+		if i == 0 {
+			r, _ := http.NewRequest("GET", "http://foo.com", nil)
+			r.RemoteAddr = "192.0.2.7:4321"
+			r.Header.Set("User-Agent", "qstest-agent")
+			s.SetClient(r)
+		}
+		if err := s.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		tok, _, err := s.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+		sessions = append(sessions, s)
+		tokens = append(tokens, tok)
+	}
+
+	infos, err := store.ListByUserID([]byte("lister1"))
+	if err != nil {
+		t.Fatal("ListByUserID failed - " + err.Error())
+	}
+	if len(infos) != 3 {
+		t.Fatalf("ListByUserID - expected 3 sessions, got %d", len(infos))
+	}
+
+	var handle string
+	for _, info := range infos {
+		if info.Created.IsZero() || info.LastSaved.IsZero() || info.TimeToLiveSecs <= 0 {
+			t.Errorf("ListByUserID - missing metadata - %+v", info)
+		}
+		if sessions[0].MatchesHandle(info.Handle) {
+			handle = info.Handle
+			if info.ClientIP != "192.0.2.7" || info.UserAgent != "qstest-agent" {
+				t.Errorf("ListByUserID - wrong client info - %q %q", info.ClientIP, info.UserAgent)
+			}
+		}
+	}
+	if handle == "" {
+		t.Fatal("ListByUserID - handle of first session not found")
+	}
+
+	// a handle must not work as a token
+	if _, _, err := store.GetTokenSession(handle); err == nil {
+		t.Fatal("GetTokenSession accepted a session handle")
+	}
+
+	if err := store.DeleteSession(handle); err != nil {
+		t.Fatal("DeleteSession failed - " + err.Error())
+	}
+	if _, _, err := store.GetTokenSession(tokens[0]); err == nil {
+		t.Fatal("session still exists after DeleteSession")
+	}
+	for _, i := range []int{1, 2, 3} {
+		if _, _, err := store.GetTokenSession(tokens[i]); err != nil {
+			t.Fatalf("session %d unexpectedly deleted - %s", i, err.Error())
+		}
+	}
+
+	infos, err = store.ListByUserID([]byte("lister1"))
+	if err != nil {
+		t.Fatal("second ListByUserID failed - " + err.Error())
+	}
+	if len(infos) != 2 {
+		t.Fatalf("ListByUserID - expected 2 sessions after DeleteSession, got %d", len(infos))
+	}
+
+	for _, s := range sessions[1:] {
+		s.Delete(httptest.NewRecorder())
+	}
+}
+
+// RegenerateTest is a backend-independent test of Regenerate and RegenerateAs.
+func RegenerateTest(t *testing.T, store *qsess.Store) {
+	msg := "regenerate me"
+
+	s1 := store.NewSession([]byte("regen-anon"))
+	s1.MaxAgeSecs = 100
+	s1.MinRefreshSecs = 50
+	s1.Data.(*qsess.VarMap).Vars["note"] = msg
+	if err := s1.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	oldTok, _, err := s1.Token()
+	if err != nil {
+		t.Fatal("Token failed - " + err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	if err := s1.RegenerateAs(w, []byte("regen-user")); err != nil {
+		t.Fatal("RegenerateAs failed - " + err.Error())
+	}
+	if _, ok := w.Header()["Set-Cookie"]; !ok && store.AuthType == qsess.CookieAuth {
+		t.Fatal("RegenerateAs did not write a cookie")
+	}
+
+	if _, _, err := store.GetTokenSession(oldTok); err == nil {
+		t.Fatal("old session still exists after RegenerateAs")
+	}
+
+	newTok, _, err := s1.Token()
+	if err != nil {
+		t.Fatal("Token failed after RegenerateAs - " + err.Error())
+	}
+	if newTok == oldTok {
+		t.Fatal("RegenerateAs did not change the token")
+	}
+	s2, _, err := store.GetTokenSession(newTok)
+	if err != nil {
+		t.Fatal("GetTokenSession failed after RegenerateAs - " + err.Error())
+	}
+	if string(s2.UserID()) != "regen-user" {
+		t.Fatalf("RegenerateAs - expected user id regen-user, got %s", s2.UserID())
+	}
+	if s2.MaxAgeSecs != 100 || s2.MinRefreshSecs != 50 {
+		t.Fatal("RegenerateAs - failed to keep MaxAgeSecs/MinRefreshSecs")
+	}
+	if s2.Data.(*qsess.VarMap).Vars["note"].(string) != msg {
+		t.Fatal("RegenerateAs - failed to keep session data")
+	}
+
+	// plain Regenerate keeps the user id
+	if err := s2.Regenerate(httptest.NewRecorder()); err != nil {
+		t.Fatal("Regenerate failed - " + err.Error())
+	}
+	if _, _, err := store.GetTokenSession(newTok); err == nil {
+		t.Fatal("old session still exists after Regenerate")
+	}
+	tok3, _, err := s2.Token()
+	if err != nil {
+		t.Fatal("Token failed after Regenerate - " + err.Error())
+	}
+	s3, _, err := store.GetTokenSession(tok3)
+	if err != nil {
+		t.Fatal("GetTokenSession failed after Regenerate - " + err.Error())
+	}
+	if string(s3.UserID()) != "regen-user" {
+		t.Fatal("Regenerate changed the user id")
+	}
+
+	s3.Delete(httptest.NewRecorder())
+}
+
+// ConflictTest checks optimistic concurrency control: with VersionCheck,
+// a Save of a stale copy of a session must fail with ErrConflict, and
+// concurrent Updates must not lose each other's changes.
+func ConflictTest(t *testing.T, store *qsess.Store) {
+	oldCheck, oldRetries := store.VersionCheck, store.UpdateRetries
+	defer func() { store.VersionCheck, store.UpdateRetries = oldCheck, oldRetries }()
+	store.VersionCheck = true
+
+	s := store.NewSession([]byte("conflict-user"))
+	s.MaxAgeSecs = 100
+	s.MinRefreshSecs = 50
+	s.Data.(*qsess.VarMap).Vars["count"] = 0
+	s, _, r := roundtrip(t, s, store)
+
+	sa, _, err := store.GetSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal("GetSession failed - " + err.Error())
+	}
+	sb, _, err := store.GetSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal("GetSession failed - " + err.Error())
+	}
+	sa.Data.(*qsess.VarMap).Vars["count"] = 1
+	if err := sa.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("first Save failed - " + err.Error())
+	}
+	sb.Data.(*qsess.VarMap).Vars["count"] = 2
+	if err := sb.Save(httptest.NewRecorder()); !errors.Is(err, qsess.ErrConflict) {
+		t.Fatalf("Save of stale session - expected ErrConflict, got %v", err)
+	}
+	// a session which has saved successfully can save again
+	if err := sa.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("second Save failed - " + err.Error())
+	}
+
+	const workers, updates = 4, 10
+	store.UpdateRetries = workers * updates
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < updates; j++ {
+				_, err := store.Update(httptest.NewRecorder(), r, func(s *qsess.Session) error {
+					s.Data.(*qsess.VarMap).Vars["count"] = s.Data.(*qsess.VarMap).Vars["count"].(int) + 1
+					return nil
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal("Update failed - " + err.Error())
+		}
+	}
+
+	final, _, err := store.GetSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal("GetSession failed - " + err.Error())
+	}
+	if count := final.Data.(*qsess.VarMap).Vars["count"].(int); count != 1+workers*updates {
+		t.Fatalf("Update lost changes - expected count %d, got %d", 1+workers*updates, count)
+	}
+
+	// errors from fn abort the update, without saving
+	fnErr := errors.New("fn failed")
+	if _, err := store.Update(httptest.NewRecorder(), r, func(s *qsess.Session) error {
+		s.Data.(*qsess.VarMap).Vars["count"] = -1
+		return fnErr
+	}); err != fnErr {
+		t.Fatalf("Update - expected fn error, got %v", err)
+	}
+
+	final.Delete(httptest.NewRecorder())
+}
+
+// IterateTest requires a back-end which implements qsess.Iterable and
+// qsess.SessImporter.
+func IterateTest(t *testing.T, store *qsess.Store) {
+	iterable, ok := store.BackEndCtx().(qsess.Iterable)
+	if !ok {
+		t.Fatal("back-end does not implement Iterable")
+	}
+	importer, ok := store.BackEndCtx().(qsess.SessImporter)
+	if !ok {
+		t.Fatal("back-end does not implement SessImporter")
+	}
+
+	users := []string{"iterate1", "iterate2", "iterate3"}
+	tokens := make(map[string]string)
+	for _, uid := range users {
+		s := store.NewSession([]byte(uid))
+		s.Data.(*qsess.VarMap).Vars["note"] = "note for " + uid
+		if err := s.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		tok, _, err := s.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+		tokens[uid] = tok
+	}
+
+	// the back-end may hold other tests' sessions, so only look for ours.
+	entries := make(map[string]qsess.SessEntry)
+	err := iterable.IterateCtx(context.Background(), func(e qsess.SessEntry) error {
+		if _, ok := tokens[string(e.UserID)]; ok {
+			entries[string(e.UserID)] = e
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Iterate failed - " + err.Error())
+	}
+	if len(entries) != len(users) {
+		t.Fatalf("Iterate - expected %d sessions, got %d", len(users), len(entries))
+	}
+	for uid, e := range entries {
+		if e.TimeToLiveSecs <= 0 || e.TimeToLiveSecs > store.MaxAgeSecs || e.MaxAgeSecs != store.MaxAgeSecs {
+			t.Errorf("Iterate - bad expiration for %s - ttl %d, max age %d", uid, e.TimeToLiveSecs, e.MaxAgeSecs)
+		}
+	}
+
+	// stopping early
+	stop := errors.New("stop")
+	n := 0
+	err = iterable.IterateCtx(context.Background(), func(e qsess.SessEntry) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Fatalf("Iterate - expected to stop after 1 session with fn's error, got %d and %v", n, err)
+	}
+
+	// delete a session, then import it: its token should work again.
+	s, _, err := store.GetTokenSession(tokens[users[0]])
+	if err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	if err := s.Delete(httptest.NewRecorder()); err != nil {
+		t.Fatal("Delete failed - " + err.Error())
+	}
+	e := entries[users[0]]
+	e.TimeToLiveSecs = 100
+	if err := importer.ImportCtx(context.Background(), e); err != nil {
+		t.Fatal("Import failed - " + err.Error())
+	}
+	s, ttl, err := store.GetTokenSession(tokens[users[0]])
+	if err != nil {
+		t.Fatal("GetTokenSession of imported session failed - " + err.Error())
+	}
+	if s.Data.(*qsess.VarMap).Vars["note"] != "note for "+users[0] || string(s.UserID()) != users[0] {
+		t.Fatal("imported session data does not match saved session data")
+	}
+	if ttl < 98 || ttl > 100 || s.MaxAgeSecs != e.MaxAgeSecs {
+		t.Fatalf("imported session has ttl %d and max age %d, expected 100 and %d", ttl, s.MaxAgeSecs, e.MaxAgeSecs)
+	}
+
+	// importing over an existing session replaces it.
+	e.Data = entries[users[1]].Data
+	if err := importer.ImportCtx(context.Background(), e); err != nil {
+		t.Fatal("second Import failed - " + err.Error())
+	}
+	s, _, err = store.GetTokenSession(tokens[users[0]])
+	if err != nil {
+		t.Fatal("GetTokenSession of re-imported session failed - " + err.Error())
+	}
+	if s.Data.(*qsess.VarMap).Vars["note"] != "note for "+users[1] {
+		t.Fatal("Import did not replace the existing session")
+	}
+
+	if err := importer.ImportCtx(context.Background(), qsess.SessEntry{SessID: []byte{1, 2, 3}, TimeToLiveSecs: 100}); err == nil {
+		t.Fatal("Import accepted an id of the wrong size")
+	}
+
+	for _, tok := range tokens {
+		if s, _, err := store.GetTokenSession(tok); err == nil {
+			s.Delete(httptest.NewRecorder())
+		}
+	}
+}
+
+// EncryptAtRestTest enables Store.EncryptAtRest, and checks that session
+// data is encrypted in the back-end, and bound to session ids. It requires
+// a back-end which implements Iterable.
+func EncryptAtRestTest(t *testing.T, store *qsess.Store) {
+	ctx := context.Background()
+	raw := store.BackEndCtx()
+	iterable, ok := raw.(qsess.Iterable)
+	if !ok {
+		t.Fatal("back-end does not implement Iterable")
+	}
+
+	save := func(uid string) string {
+		s := store.NewSession([]byte(uid))
+		s.Data.(*qsess.VarMap).Vars["secret"] = "secret of " + uid
+		if err := s.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		tok, _, err := s.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+		return tok
+	}
+	check := func(tok string, uid string) error {
+		s, _, err := store.GetTokenSession(tok)
+		if err != nil {
+			return err
+		}
+		if s.Data.(*qsess.VarMap).Vars["secret"] != "secret of "+uid {
+			t.Fatalf("wrong session data for %s", uid)
+		}
+		return nil
+	}
+	rawEntries := func() map[string]qsess.SessEntry {
+		entries := make(map[string]qsess.SessEntry)
+		err := iterable.IterateCtx(ctx, func(e qsess.SessEntry) error {
+			if strings.HasPrefix(string(e.UserID), "atrest-") {
+				entries[string(e.UserID)] = e
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal("Iterate failed - " + err.Error())
+		}
+		return entries
+	}
+
+	plainTok := save("atrest-plain")
+	if err := store.EncryptAtRest(false); err != nil {
+		t.Fatal("EncryptAtRest failed - " + err.Error())
+	}
+	tokA, tokB := save("atrest-a"), save("atrest-b")
+	if err := check(tokA, "atrest-a"); err != nil {
+		t.Fatal("GetTokenSession of encrypted session failed - " + err.Error())
+	}
+
+	entries := rawEntries()
+	for _, uid := range []string{"atrest-a", "atrest-b"} {
+		if bytes.Contains(entries[uid].Data, []byte("secret of")) {
+			t.Fatalf("session data for %s is stored in plaintext", uid)
+		}
+	}
+	if !bytes.Contains(entries["atrest-plain"].Data, []byte("secret of")) {
+		t.Fatal("session saved before EncryptAtRest should be in plaintext")
+	}
+	if err := check(plainTok, "atrest-plain"); !errors.Is(err, qsess.ErrNotFound) || errors.Is(err, qsess.ErrBackend) {
+		t.Fatalf("plaintext session - expected ErrNotFound, got %v", err)
+	}
+
+	// a record copied from one session to another can't be read.
+	a, b := entries["atrest-a"], entries["atrest-b"]
+	id := append([]byte(nil), a.SessID...)
+	if err := raw.SaveCtx(ctx, &id, b.Data, a.UserID, a.MaxAgeSecs, a.MinRefreshSecs); err != nil {
+		t.Fatal("raw Save failed - " + err.Error())
+	}
+	if err := check(tokA, "atrest-a"); !errors.Is(err, qsess.ErrNotFound) || errors.Is(err, qsess.ErrBackend) {
+		t.Fatalf("session data swapped from another session - expected ErrNotFound, got %v", err)
+	}
+	if err := check(tokB, "atrest-b"); err != nil {
+		t.Fatal("GetTokenSession of encrypted session failed - " + err.Error())
+	}
+
+	// with acceptPlaintext, plaintext sessions are read, and encrypted when saved.
+	store.SetBackEnd(raw)
+	if err := store.EncryptAtRest(true); err != nil {
+		t.Fatal("EncryptAtRest failed - " + err.Error())
+	}
+	s, _, err := store.GetTokenSession(plainTok)
+	if err != nil {
+		t.Fatal("plaintext session should be accepted - " + err.Error())
+	}
+	s.Data.(*qsess.VarMap).Vars["more"] = "changed"
+	if err := s.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	if bytes.Contains(rawEntries()["atrest-plain"].Data, []byte("secret of")) {
+		t.Fatal("plaintext session should be encrypted when saved")
+	}
+	if err := check(plainTok, "atrest-plain"); err != nil {
+		t.Fatal("GetTokenSession of re-saved session failed - " + err.Error())
+	}
+
+	for _, e := range rawEntries() {
+		raw.DeleteCtx(ctx, e.SessID, e.UserID)
+	}
+}
+
+// LifecycleTest sets Store.Lifecycle, and checks that creating, saving,
+// deleting and revoking sessions are reported to it, along with expiry
+// noticed by Get (if lazy is true) and by the back-end's pruner (if pruned
+// is true, in which case the Store must have a PruneInterval channel).
+func LifecycleTest(t *testing.T, store *qsess.Store, lazy bool, pruned bool) {
+	var mu sync.Mutex
+	var events []qsess.LifecycleEvent
+	store.Lifecycle = func(e qsess.LifecycleEvent) {
+		if strings.HasPrefix(string(e.UserID), "lifecycle-") {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		}
+	}
+	defer func() { store.Lifecycle = nil }()
+
+	// wait returns the first event of type typ for uid, removing it.
+	wait := func(typ qsess.LifecycleType, uid string) qsess.LifecycleEvent {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			for i, e := range events {
+				if e.Type == typ && string(e.UserID) == uid {
+					events = append(events[:i], events[i+1:]...)
+					mu.Unlock()
+					return e
+				}
+			}
+			mu.Unlock()
+		}
+		t.Fatalf("no %s event for %s", typ, uid)
+		return qsess.LifecycleEvent{}
+	}
+	save := func(uid string, maxAge int) (*qsess.Session, string) {
+		s := store.NewSession([]byte(uid))
+		s.MaxAgeSecs = maxAge
+		s.Data.(*qsess.VarMap).Vars["n"] = 1
+		if err := s.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		tok, _, err := s.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+		return s, tok
+	}
+
+	s, tok := save("lifecycle-1", 60)
+	if e := wait(qsess.LifecycleCreated, "lifecycle-1"); e.Created.IsZero() || e.LastSaved.IsZero() {
+		t.Fatal("created event has no metadata")
+	}
+	s, _, err := store.GetTokenSession(tok)
+	if err != nil {
+		t.Fatal("GetTokenSession failed - " + err.Error())
+	}
+	s.Data.(*qsess.VarMap).Vars["n"] = 2
+	if err := s.Save(httptest.NewRecorder()); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	wait(qsess.LifecycleSaved, "lifecycle-1")
+	if err := s.Delete(httptest.NewRecorder()); err != nil {
+		t.Fatal("Delete failed - " + err.Error())
+	}
+	if e := wait(qsess.LifecycleDeleted, "lifecycle-1"); e.Created.IsZero() {
+		t.Fatal("deleted event has no metadata")
+	}
+
+	save("lifecycle-2", 60)
+	s, _ = save("lifecycle-2", 60)
+	if err := s.DeleteByUserID(httptest.NewRecorder()); err != nil {
+		t.Fatal("DeleteByUserID failed - " + err.Error())
+	}
+	wait(qsess.LifecycleRevoked, "lifecycle-2")
+
+	if !lazy && !pruned {
+		return
+	}
+	_, lazyTok := save("lifecycle-3", 1)
+	if pruned {
+		save("lifecycle-4", 1)
+	}
+	time.Sleep(3 * time.Second)
+
+	if lazy {
+		if _, _, err := store.GetTokenSession(lazyTok); !errors.Is(err, qsess.ErrExpired) {
+			t.Fatalf("GetTokenSession of expired session - expected ErrExpired, got %v", err)
+		}
+		if e := wait(qsess.LifecycleExpired, "lifecycle-3"); e.Created.IsZero() {
+			t.Fatal("expired event has no metadata")
+		}
+	}
+	if pruned {
+		store.PruneInterval <- 120 // also starts a pass now
+		if e := wait(qsess.LifecycleExpired, "lifecycle-4"); e.Created.IsZero() {
+			t.Fatal("pruned event has no metadata")
+		}
+	}
+}
+
+// RememberTest checks qsremember with remember-me records kept in tokens,
+// which it configures for that purpose, and sessions in a map store.
+func RememberTest(t *testing.T, tokens *qsess.Store) {
+	ctx := context.Background()
+	sessions, err := qsess.NewMapStore([]byte("key-for-remember-test-sessions--"))
+	if err != nil {
+		t.Fatal("NewMapStore failed - " + err.Error())
+	}
+	m, err := qsremember.NewManager(tokens, sessions)
+	if err != nil {
+		t.Fatal("NewManager failed - " + err.Error())
+	}
+	var stolen []byte
+	m.OnTheft = func(userID []byte) { stolen = userID }
+	m.RevokeSessionsOnTheft = true
+
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+	login := func(c *http.Cookie) (*qsess.Session, *httptest.ResponseRecorder, error) {
+		r, _ := http.NewRequest("GET", "http://foo.com", nil)
+		if c != nil {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		sess, err := m.Login(ctx, w, r)
+		return sess, w, err
+	}
+
+	w := httptest.NewRecorder()
+	if err := m.Issue(ctx, w, []byte("remember-1")); err != nil {
+		t.Fatal("Issue failed - " + err.Error())
+	}
+	c1 := cookie(w, m.CookieName)
+	if c1 == nil || c1.MaxAge != m.MaxAgeSecs || !c1.HttpOnly {
+		t.Fatal("Issue sent no remember-me cookie, or the wrong one")
+	}
+
+	// only a hash of the validator is stored.
+	i := strings.LastIndexByte(c1.Value, '.')
+	validator, _ := base64.RawURLEncoding.DecodeString(c1.Value[i+1:])
+	sessID, _, err := tokens.DecodeToken(c1.Value[:i])
+	if err != nil {
+		t.Fatal("DecodeToken failed - " + err.Error())
+	}
+	data, _, _, _, _, err := tokens.BackEndCtx().GetCtx(ctx, sessID, nil)
+	if err != nil {
+		t.Fatal("back-end Get failed - " + err.Error())
+	}
+	if len(validator) == 0 || bytes.Contains(data, validator) {
+		t.Fatal("validator is stored in the back-end")
+	}
+
+	sess, w, err := login(c1)
+	if err != nil {
+		t.Fatal("Login failed - " + err.Error())
+	}
+	if string(sess.UserID()) != "remember-1" {
+		t.Fatal("Login made a session for the wrong user")
+	}
+	c2 := cookie(w, m.CookieName)
+	sessCookie := cookie(w, sessions.CookieName)
+	if c2 == nil || c2.Value == c1.Value || sessCookie == nil {
+		t.Fatal("Login did not send a new remember-me cookie and a session cookie")
+	}
+
+	// a validator replaced moments ago is a race, not theft.
+	if _, _, err := login(c1); !errors.Is(err, qsess.ErrConflict) {
+		t.Fatalf("Login with just-replaced validator - expected ErrConflict, got %v", err)
+	}
+
+	_, w, err = login(c2)
+	if err != nil {
+		t.Fatal("second Login failed - " + err.Error())
+	}
+	c3 := cookie(w, m.CookieName)
+
+	// after the grace period, an old validator means theft.
+	m.GraceSecs = -1
+	if _, w, err = login(c2); !errors.Is(err, qsremember.ErrTheft) {
+		t.Fatalf("Login with replaced validator - expected ErrTheft, got %v", err)
+	}
+	if string(stolen) != "remember-1" {
+		t.Fatal("OnTheft was not called")
+	}
+	if c := cookie(w, m.CookieName); c == nil || c.MaxAge >= 0 {
+		t.Fatal("remember-me cookie not deleted after theft")
+	}
+	if _, _, err := login(c3); err == nil {
+		t.Fatal("remember-me cookie still works after theft")
+	}
+	r, _ := http.NewRequest("GET", "http://foo.com", nil)
+	r.AddCookie(sessCookie)
+	if _, _, err := sessions.GetSession(httptest.NewRecorder(), r); err == nil {
+		t.Fatal("session still exists after theft")
+	}
+
+	// Forget deletes the record.
+	w = httptest.NewRecorder()
+	if err := m.Issue(ctx, w, []byte("remember-2")); err != nil {
+		t.Fatal("Issue failed - " + err.Error())
+	}
+	c4 := cookie(w, m.CookieName)
+	r, _ = http.NewRequest("GET", "http://foo.com", nil)
+	r.AddCookie(c4)
+	if err := m.Forget(ctx, httptest.NewRecorder(), r); err != nil {
+		t.Fatal("Forget failed - " + err.Error())
+	}
+	if _, _, err := login(c4); err == nil {
+		t.Fatal("remember-me cookie still works after Forget")
+	}
+
+	if _, _, err := login(nil); !errors.Is(err, qsess.ErrNoCredentials) {
+		t.Fatalf("Login without cookie - expected ErrNoCredentials, got %v", err)
+	}
+	bad := *c3
+	bad.Value = "garbage"
+	if _, _, err := login(&bad); !errors.Is(err, qsess.ErrInvalidToken) {
+		t.Fatalf("Login with malformed cookie - expected ErrInvalidToken, got %v", err)
+	}
+}
+
+// ConsumeTest checks Store.ConsumeTokenSession: a token's session can be
+// consumed once, and only once, even by concurrent callers.
+func ConsumeTest(t *testing.T, store *qsess.Store) {
+	save := func(msg string) string {
+		s := store.NewSession([]byte("consume-user"))
+		s.Data.(*qsess.VarMap).Vars["note"] = msg
+		if err := s.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		tok, _, err := s.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+		return tok
+	}
+
+	tok := save("verify me")
+	s, ttl, err := store.ConsumeTokenSession(tok)
+	if err != nil {
+		t.Fatal("ConsumeTokenSession failed - " + err.Error())
+	}
+	if string(s.UserID()) != "consume-user" || s.Data.(*qsess.VarMap).Vars["note"] != "verify me" {
+		t.Fatal("consumed session does not match saved session")
+	}
+	if ttl <= 0 {
+		t.Fatalf("ConsumeTokenSession returned ttl %d, expected > 0", ttl)
+	}
+	if _, _, err := store.ConsumeTokenSession(tok); !errors.Is(err, qsess.ErrNotFound) {
+		t.Fatalf("second ConsumeTokenSession - expected ErrNotFound, got %v", err)
+	}
+	if _, _, err := store.GetTokenSession(tok); err == nil {
+		t.Fatal("GetTokenSession of consumed session succeeded")
+	}
+	if _, _, err := store.ConsumeTokenSession("garbage"); !errors.Is(err, qsess.ErrInvalidToken) {
+		t.Fatalf("ConsumeTokenSession of bad token - expected ErrInvalidToken, got %v", err)
+	}
+
+	// of many concurrent consumers, exactly one succeeds.
+	tok = save("race me")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	consumed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := store.ConsumeTokenSession(tok); err == nil {
+				mu.Lock()
+				consumed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if consumed != 1 {
+		t.Fatalf("session consumed %d times by concurrent callers, expected once", consumed)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"net/http"
+)
+
+// Codec marshals and unmarshals session data of type T, for Typed.
+type Codec[T any] interface {
+	Marshal(v *T) ([]byte, error)
+	Unmarshal(data []byte, v *T) error
+}
+
+// GobCodec is a Codec which uses encoding/gob, like VarMap.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(v *T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Unmarshal(data []byte, v *T) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Typed is a type-safe view of a Store, whose sessions hold data of type T,
+// so handlers needn't make (possibly panicking) type assertions on
+// Session.Data.
+//
+//	type SessData struct { Cart []string }
+//
+//	typed := qsess.NewTyped[SessData](st, nil)
+//	sess, _, err := typed.GetSession(w, r)
+//	...
+//	sess.Data.Cart = append(sess.Data.Cart, item)
+//	err = sess.Save(w)
+//
+// Sessions obtained from the Store itself (for example, qctx.Ctx.Sess) can
+// be converted with Wrap.
+type Typed[T any] struct {
+	st *Store
+}
+
+// NewTyped returns a Typed for st, which marshals session data with codec,
+// or, if codec is nil, with GobCodec. It sets st.NewSessData, so st's
+// sessions hold data of type T; don't change it afterwards.
+func NewTyped[T any](st *Store, codec Codec[T]) *Typed[T] {
+	if codec == nil {
+		codec = GobCodec[T]{}
+	}
+	st.NewSessData = func() SessData {
+		return &typedData[T]{codec: codec, v: new(T)}
+	}
+	return &Typed[T]{st}
+}
+
+// TypedSession is a Session whose data is of type T.
+type TypedSession[T any] struct {
+	*Session
+
+	// Data is the session's data, which is saved by Save (it shadows
+	// Session.Data, which holds the SessData adapter for it). Data may be
+	// modified or replaced, but should not be nil.
+	Data *T
+}
+
+// typedData adapts a *T to SessData. Once its session has been wrapped, it
+// marshals the TypedSession's Data field, so that field can be replaced.
+type typedData[T any] struct {
+	codec Codec[T]
+	v     *T
+	p     **T
+}
+
+func (d *typedData[T]) Marshal() ([]byte, error) {
+	v := d.v
+	if d.p != nil {
+		v = *d.p
+	}
+	if v == nil {
+		v = new(T)
+	}
+	return d.codec.Marshal(v)
+}
+
+func (d *typedData[T]) Unmarshal(data []byte) error {
+	v := new(T)
+	if err := d.codec.Unmarshal(data, v); err != nil {
+		return err
+	}
+	d.v = v
+	if d.p != nil {
+		*d.p = v
+	}
+	return nil
+}
+
+// Store returns the underlying Store.
+func (t *Typed[T]) Store() *Store {
+	return t.st
+}
+
+// Wrap returns a TypedSession for a session of t's Store. It fails if the
+// session's data is not of type T (which can only happen if the Store's
+// NewSessData was changed after NewTyped).
+func (t *Typed[T]) Wrap(s *Session) (*TypedSession[T], error) {
+	d, ok := s.Data.(*typedData[T])
+	if !ok {
+		return nil, qsErr{"Typed.Wrap - session data has the wrong type", nil}
+	}
+	ts := &TypedSession[T]{Session: s}
+	if d.p != nil {
+		// already wrapped; share its Data field
+		ts.Data = *d.p
+	} else {
+		ts.Data = d.v
+	}
+	d.p = &ts.Data
+	return ts, nil
+}
+
+func (t *Typed[T]) wrap(s *Session, ttl int, err error) (*TypedSession[T], int, error) {
+	if err != nil {
+		return nil, 0, err
+	}
+	ts, err := t.Wrap(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ts, ttl, nil
+}
+
+// NewSession is like Store.NewSession. It panics if the Store's NewSessData
+// has been changed since NewTyped.
+func (t *Typed[T]) NewSession(userID []byte) *TypedSession[T] {
+	ts, err := t.Wrap(t.st.NewSession(userID))
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
+
+// NewClientSession is like Store.NewClientSession. It panics if the Store's
+// NewSessData has been changed since NewTyped.
+func (t *Typed[T]) NewClientSession(userID []byte, r *http.Request) *TypedSession[T] {
+	ts, err := t.Wrap(t.st.NewClientSession(userID, r))
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
+
+// GetSession is like Store.GetSession.
+func (t *Typed[T]) GetSession(w http.ResponseWriter, r *http.Request) (*TypedSession[T], int, error) {
+	return t.wrap(t.st.GetSession(w, r))
+}
+
+// GetSessionCtx is like Store.GetSessionCtx.
+func (t *Typed[T]) GetSessionCtx(ctx context.Context, w http.ResponseWriter, r *http.Request) (*TypedSession[T], int, error) {
+	return t.wrap(t.st.GetSessionCtx(ctx, w, r))
+}
+
+// GetTokenSession is like Store.GetTokenSession.
+func (t *Typed[T]) GetTokenSession(token string) (*TypedSession[T], int, error) {
+	return t.wrap(t.st.GetTokenSession(token))
+}
+
+// GetTokenSessionCtx is like Store.GetTokenSessionCtx.
+func (t *Typed[T]) GetTokenSessionCtx(ctx context.Context, token string) (*TypedSession[T], int, error) {
+	return t.wrap(t.st.GetTokenSessionCtx(ctx, token))
+}
+
+// ConsumeTokenSession is like Store.ConsumeTokenSession.
+func (t *Typed[T]) ConsumeTokenSession(token string) (*TypedSession[T], int, error) {
+	return t.wrap(t.st.ConsumeTokenSession(token))
+}
+
+// ConsumeTokenSessionCtx is like Store.ConsumeTokenSessionCtx.
+func (t *Typed[T]) ConsumeTokenSessionCtx(ctx context.Context, token string) (*TypedSession[T], int, error) {
+	return t.wrap(t.st.ConsumeTokenSessionCtx(ctx, token))
+}
+
+// Update is like Store.Update.
+func (t *Typed[T]) Update(w http.ResponseWriter, r *http.Request, fn func(*TypedSession[T]) error) (*TypedSession[T], error) {
+	return t.UpdateCtx(context.Background(), w, r, fn)
+}
+
+// UpdateCtx is like Store.UpdateCtx.
+func (t *Typed[T]) UpdateCtx(ctx context.Context, w http.ResponseWriter, r *http.Request, fn func(*TypedSession[T]) error) (*TypedSession[T], error) {
+	s, err := t.st.UpdateCtx(ctx, w, r, func(s *Session) error {
+		ts, err := t.Wrap(s)
+		if err != nil {
+			return err
+		}
+		return fn(ts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ts, _, err := t.wrap(s, 0, nil)
+	return ts, err
+}
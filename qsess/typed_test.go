@@ -0,0 +1,119 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+// tests that do NOT see package internals
+
+package qsess_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkong/go-qweb/qsess"
+)
+
+type cart struct {
+	Items []string
+	Total int
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v *cart) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v *cart) error { return json.Unmarshal(data, v) }
+
+func TestTyped(t *testing.T) {
+	for _, codec := range []qsess.Codec[cart]{nil, jsonCodec{}} {
+		st := makeTestStore(t, false)
+		st.AuthType = qsess.TokenAuth
+		typed := qsess.NewTyped[cart](st, codec)
+
+		sess := typed.NewSession([]byte("typed-user"))
+		sess.Data.Items = append(sess.Data.Items, "apple")
+		sess.Data.Total = 1
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		token, _, err := sess.Token()
+		if err != nil {
+			t.Fatal("Token failed - " + err.Error())
+		}
+
+		sess, _, err = typed.GetTokenSession(token)
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+		if len(sess.Data.Items) != 1 || sess.Data.Items[0] != "apple" || sess.Data.Total != 1 {
+			t.Fatalf("got wrong data %+v", *sess.Data)
+		}
+
+		// replacing Data must be saved, too
+		sess.Data = &cart{Items: []string{"pear"}, Total: 2}
+		if err := sess.Save(httptest.NewRecorder()); err != nil {
+			t.Fatal("Save failed - " + err.Error())
+		}
+		plain, _, err := st.GetTokenSession(token)
+		if err != nil {
+			t.Fatal("GetTokenSession failed - " + err.Error())
+		}
+		wrapped, err := typed.Wrap(plain)
+		if err != nil {
+			t.Fatal("Wrap failed - " + err.Error())
+		}
+		if wrapped.Data.Total != 2 || wrapped.Data.Items[0] != "pear" {
+			t.Fatalf("replaced data was not saved, got %+v", *wrapped.Data)
+		}
+
+		consumed, ttl, err := typed.ConsumeTokenSession(token)
+		if err != nil {
+			t.Fatal("ConsumeTokenSession failed - " + err.Error())
+		}
+		if ttl <= 0 || consumed.Data.Total != 2 {
+			t.Fatalf("ConsumeTokenSession returned ttl %d, data %+v", ttl, *consumed.Data)
+		}
+		if _, _, err := typed.GetTokenSession(token); err == nil {
+			t.Fatal("GetTokenSession of consumed session succeeded")
+		}
+	}
+}
+
+func TestTypedUpdate(t *testing.T) {
+	st := makeTestStore(t, false)
+	typed := qsess.NewTyped[cart](st, nil)
+
+	w := httptest.NewRecorder()
+	if err := typed.NewSession([]byte("typed-update")).Save(w); err != nil {
+		t.Fatal("Save failed - " + err.Error())
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := typed.Update(httptest.NewRecorder(), r, func(s *qsess.TypedSession[cart]) error {
+			s.Data.Total++
+			return nil
+		})
+		if err != nil {
+			t.Fatal("Update failed - " + err.Error())
+		}
+	}
+	sess, _, err := typed.GetSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal("GetSession failed - " + err.Error())
+	}
+	if sess.Data.Total != 2 {
+		t.Fatalf("expected Total 2, got %d", sess.Data.Total)
+	}
+}
+
+func TestTypedWrongType(t *testing.T) {
+	st := makeTestStore(t, false)
+	typed := qsess.NewTyped[cart](st, nil)
+	st.NewSessData = nil
+	if _, err := typed.Wrap(st.NewSession(nil)); err == nil {
+		t.Fatal("Wrap of a session with the wrong data type should fail")
+	}
+}
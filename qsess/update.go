@@ -0,0 +1,49 @@
+// Copyright 2026 George S. Kong. All rights reserved.
+// Use of this source code is governed by a license that can be found in the LICENSE.txt file.
+
+package qsess
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Update performs a read-modify-write cycle on the session referred to by
+// the request, with optimistic concurrency control: it calls GetSession,
+// passes the session to fn, which modifies it, then saves it, failing if
+// another request has saved the session in the meantime. On conflict, the
+// whole cycle is retried, up to Store.UpdateRetries times, after which
+// Update returns an error matching ErrConflict. If fn returns an error, the
+// session is not saved and the error is returned.
+//
+// fn may be called more than once, so it should not have side effects
+// other than modifying the session.
+//
+// Update requires a back-end which implements SessVersioner, otherwise it
+// returns ErrNotSupported. Like Save, it must precede any writes to the
+// response body.
+func (st *Store) Update(w http.ResponseWriter, r *http.Request, fn func(*Session) error) (*Session, error) {
+	return st.UpdateCtx(r.Context(), w, r, fn)
+}
+
+// UpdateCtx is like Update, with a context for back-end calls.
+func (st *Store) UpdateCtx(ctx context.Context, w http.ResponseWriter, r *http.Request, fn func(*Session) error) (*Session, error) {
+	if _, ok := versioner(st.backEnd); !ok {
+		return nil, ErrNotSupported
+	}
+
+	for attempt := 0; ; attempt++ {
+		s, _, err := st.GetSessionCtx(ctx, w, r)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(s); err != nil {
+			return s, err
+		}
+		err = s.save(ctx, w, true)
+		if !errors.Is(err, ErrConflict) || attempt >= st.UpdateRetries {
+			return s, err
+		}
+	}
+}